@@ -30,14 +30,47 @@ type EnvironmentConfiguration struct {
 	ApiServerBaseURL string
 
 	// MetaData config
+	// "local", a public base url, "s3://<bucket>/<prefix>" to read and write through the S3 API (see MetadataS3Config),
+	// "mongo://<shared|app>/<collection>" to store metadata in mongo,
+	// or "git://<absolute repo path>#<branch>" to read from (and commit admin changes to) a git repo
 	SharedMetadataSourceURL string
 	AppMetadataSourceURL string
 	MetadataAutoUpdaterPollSeconds int
+	MetadataSchedulerPollSeconds int // 0 disables running scheduled metadata actions on this server
+
+	// Optional. Local directory in which metadata fetched from remote sources is cached,
+	// so that servers can still boot (from the last metadata they saw) when the source is unreachable
+	MetadataCacheDirectory string
+
+	// Used by "s3://" metadata sources
+	MetadataS3Config MetadataS3Configuration
+
+	// Optional. Signs metadata manifests when they are saved, and verifies them when they are loaded
+	MetadataSigningConfig MetadataSigningConfiguration
 
 	// Admin tool config
 	AdminToolConfig AdminToolConfiguration
 }
 
+type MetadataS3Configuration struct {
+	Region string
+	Endpoint string		// Optional. For S3-compatible stand-ins, eg: "http://localhost:9000"
+	ForcePathStyle bool
+
+	// Optional. The default aws credentials chain is used if not set
+	AccessKeyId string
+	SecretAccessKeyConfig PasswordConfig
+
+	PresignedURLExpirySeconds int		// 0 disables handing out presigned download urls to clients
+}
+
+type MetadataSigningConfiguration struct {
+	Algorithm string				// "" (disabled), "hmac-sha256" or "ed25519"
+	KeyConfig PasswordConfig		// hmac secret, or base64 ed25519 private key. Optional for ed25519 on servers that only verify
+	PublicKey string				// base64 ed25519 public key, for servers that only verify
+	RequireSignatures bool			// Refuse to load unsigned manifests. Turn on once every version's manifest has been signed
+}
+
 type AdminToolConfiguration struct {
 	SharedMetadataS3BucketName string
 	AppMetadataS3BucketName string
@@ -0,0 +1,264 @@
+package admin
+
+import (
+    "encoding/json"
+    "errors"
+    "github.com/spacetimi/timi_shared_server/code/core"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
+    "github.com/spacetimi/timi_shared_server/utils/logger"
+    "io/ioutil"
+    "net/http"
+    "regexp"
+    "strings"
+)
+
+/**
+ * Json api mirroring the admin pages, for internal dashboards and automation.
+ * Authenticated with api keys (see admin_api_auth.go) instead of the login cookie.
+ * Every response is an AdminApiResponse, except for csv / xliff downloads which are sent as files
+ */
+
+const kApiPathPrefix = "/admin/api/v1/"
+
+const kApiRoute_MetadataSpace = "API_METADATA_SPACE"
+const kApiRoute_MetadataCurrentVersions = "API_METADATA_CURRENT_VERSIONS"
+const kApiRoute_MetadataVersionMappings = "API_METADATA_VERSION_MAPPINGS"
+const kApiRoute_MetadataRefresh = "API_METADATA_REFRESH"
+const kApiRoute_MetadataVersions = "API_METADATA_VERSIONS"
+const kApiRoute_MetadataVersion = "API_METADATA_VERSION"
+const kApiRoute_MetadataItems = "API_METADATA_ITEMS"
+const kApiRoute_MetadataItem = "API_METADATA_ITEM"
+const kApiRoute_MetadataItemCSV = "API_METADATA_ITEM_CSV"
+const kApiRoute_MetadataItemOverride = "API_METADATA_ITEM_OVERRIDE"
+const kApiRoute_MetadataUpgradeIntegrity = "API_METADATA_UPGRADE_INTEGRITY"
+const kApiRoute_MetadataSyncFromGit = "API_METADATA_SYNC_FROM_GIT"
+const kApiRoute_MetadataSchedules = "API_METADATA_SCHEDULES"
+const kApiRoute_MetadataSchedule = "API_METADATA_SCHEDULE"
+const kApiRoute_Localization = "API_LOCALIZATION"
+const kApiRoute_LocalizationCSV = "API_LOCALIZATION_CSV"
+const kApiRoute_LocalizationXLIFF = "API_LOCALIZATION_XLIFF"
+const kApiRoute_StorageCacheStats = "API_STORAGE_CACHE_STATS"
+
+const kApiMetadataSpacePattern = "^/admin/api/v1/metadata/(?:app|shared)"
+const kApiMetadataVersionPattern = kApiMetadataSpacePattern + "/versions/" + core.AppVersionRegexPattern
+
+var kAdminApiRoutes = map[string]string{
+    kApiMetadataSpacePattern + "$": kApiRoute_MetadataSpace,
+    kApiMetadataSpacePattern + "/currentVersions$": kApiRoute_MetadataCurrentVersions,
+    kApiMetadataSpacePattern + "/versionMappings$": kApiRoute_MetadataVersionMappings,
+    kApiMetadataSpacePattern + "/refresh$": kApiRoute_MetadataRefresh,
+    kApiMetadataSpacePattern + "/versions$": kApiRoute_MetadataVersions,
+    kApiMetadataVersionPattern + "$": kApiRoute_MetadataVersion,
+    kApiMetadataVersionPattern + "/items$": kApiRoute_MetadataItems,
+    kApiMetadataVersionPattern + "/items/[^/]+$": kApiRoute_MetadataItem,
+    kApiMetadataVersionPattern + "/items/[^/]+/csv$": kApiRoute_MetadataItemCSV,
+    kApiMetadataVersionPattern + "/items/[^/]+/overrides/[a-z]+$": kApiRoute_MetadataItemOverride,
+    kApiMetadataVersionPattern + "/upgradeIntegrity$": kApiRoute_MetadataUpgradeIntegrity,
+    kApiMetadataSpacePattern + "/syncFromGit$": kApiRoute_MetadataSyncFromGit,
+    kApiMetadataSpacePattern + "/schedules$": kApiRoute_MetadataSchedules,
+    kApiMetadataSpacePattern + "/schedules/[0-9]+$": kApiRoute_MetadataSchedule,
+    "^/admin/api/v1/localization$": kApiRoute_Localization,
+    "^/admin/api/v1/localization/" + core.AppVersionRegexPattern + "$": kApiRoute_Localization,
+    "^/admin/api/v1/localization/" + core.AppVersionRegexPattern + "/csv$": kApiRoute_LocalizationCSV,
+    "^/admin/api/v1/localization/" + core.AppVersionRegexPattern + "/xliff/[^/]+$": kApiRoute_LocalizationXLIFF,
+    "^/admin/api/v1/storage/cacheStats$": kApiRoute_StorageCacheStats,
+}
+
+var kAdminApiRouteRegexToRouteName map[*regexp.Regexp]string
+
+/** Package init **/
+func init() {
+    kAdminApiRouteRegexToRouteName = make(map[*regexp.Regexp]string, len(kAdminApiRoutes))
+    for route, routeName := range kAdminApiRoutes {
+        reg, err := regexp.Compile(route)
+        if err != nil {
+            logger.LogError("bad route regex in admin api controller" +
+                            "|regex=" + route +
+                            "|error=" + err.Error())
+            continue
+        }
+        kAdminApiRouteRegexToRouteName[reg] = routeName
+    }
+}
+
+/**
+ * Handles: /admin/api/v1/...
+ */
+func handleAdminApiRequest(httpResponseWriter http.ResponseWriter, request *http.Request) {
+    clientName, err := authenticateApiRequest(request)
+    if err != nil {
+        logger.LogWarning("unauthorized admin api request" +
+                          "|request url=" + request.URL.Path +
+                          "|error=" + err.Error())
+        writeApiError(httpResponseWriter, http.StatusUnauthorized, err.Error())
+        return
+    }
+
+    // Writes are attributed to the client (eg: in git backed metadata and scheduled actions)
+    apiUser := "api:" + clientName
+
+    tokens := getApiPathTokens(request)
+
+    switch getRouteNameForRequest(kAdminApiRouteRegexToRouteName, request.URL.Path) {
+
+    case kApiRoute_MetadataSpace:
+        handleApiMetadataSpace(httpResponseWriter, request, tokens)
+    case kApiRoute_MetadataCurrentVersions:
+        handleApiMetadataCurrentVersions(httpResponseWriter, request, tokens, apiUser)
+    case kApiRoute_MetadataVersionMappings:
+        handleApiMetadataVersionMappings(httpResponseWriter, request, tokens, apiUser)
+    case kApiRoute_MetadataRefresh:
+        handleApiMetadataRefresh(httpResponseWriter, request)
+    case kApiRoute_MetadataVersions:
+        handleApiMetadataVersions(httpResponseWriter, request, tokens, apiUser)
+    case kApiRoute_MetadataVersion:
+        handleApiMetadataVersion(httpResponseWriter, request, tokens)
+    case kApiRoute_MetadataItems:
+        handleApiMetadataItems(httpResponseWriter, request, tokens, apiUser)
+    case kApiRoute_MetadataItem:
+        handleApiMetadataItem(httpResponseWriter, request, tokens, apiUser)
+    case kApiRoute_MetadataItemCSV:
+        handleApiMetadataItemCSV(httpResponseWriter, request, tokens, apiUser)
+    case kApiRoute_MetadataItemOverride:
+        handleApiMetadataItemOverride(httpResponseWriter, request, tokens, apiUser)
+    case kApiRoute_MetadataUpgradeIntegrity:
+        handleApiMetadataUpgradeIntegrity(httpResponseWriter, request, tokens, apiUser)
+    case kApiRoute_MetadataSyncFromGit:
+        handleApiMetadataSyncFromGit(httpResponseWriter, request, tokens, apiUser)
+    case kApiRoute_MetadataSchedules:
+        handleApiMetadataSchedules(httpResponseWriter, request, tokens, apiUser)
+    case kApiRoute_MetadataSchedule:
+        handleApiMetadataSchedule(httpResponseWriter, request, tokens, apiUser)
+    case kApiRoute_Localization:
+        handleApiLocalization(httpResponseWriter, request, tokens)
+    case kApiRoute_LocalizationCSV:
+        handleApiLocalizationCSV(httpResponseWriter, request, tokens, apiUser)
+    case kApiRoute_LocalizationXLIFF:
+        handleApiLocalizationXLIFF(httpResponseWriter, request, tokens, apiUser)
+    case kApiRoute_StorageCacheStats:
+        handleApiStorageCacheStats(httpResponseWriter, request)
+
+    default:
+        writeApiError(httpResponseWriter, http.StatusNotFound, "unknown api route: " + request.URL.Path)
+    }
+}
+
+/**
+ * The path after /admin/api/v1/, split on '/'
+ */
+func getApiPathTokens(request *http.Request) []string {
+    return strings.Split(strings.TrimPrefix(request.URL.Path, kApiPathPrefix), "/")
+}
+
+func writeApiResponse(httpResponseWriter http.ResponseWriter, statusCode int, response *AdminApiResponse) {
+    responseBytes, err := json.Marshal(response)
+    if err != nil {
+        logger.LogError("error serializing admin api response|error=" + err.Error())
+        statusCode = http.StatusInternalServerError
+        responseBytes = []byte("{\"Success\":false,\"ErrorMessage\":\"error serializing response\"}")
+    }
+
+    httpResponseWriter.Header().Set("Content-Type", "application/json")
+    httpResponseWriter.WriteHeader(statusCode)
+    _, err = httpResponseWriter.Write(responseBytes)
+    if err != nil {
+        logger.LogError("error writing admin api response|error=" + err.Error())
+    }
+}
+
+func writeApiResult(httpResponseWriter http.ResponseWriter, result interface{}) {
+    writeApiResponse(httpResponseWriter, http.StatusOK, &AdminApiResponse{Success: true, Result: result})
+}
+
+func writeApiError(httpResponseWriter http.ResponseWriter, statusCode int, errorMessage string) {
+    writeApiResponse(httpResponseWriter, statusCode, &AdminApiResponse{Success: false, ErrorMessage: errorMessage})
+}
+
+func writeApiMethodNotAllowed(httpResponseWriter http.ResponseWriter, request *http.Request) {
+    writeApiError(httpResponseWriter, http.StatusMethodNotAllowed, "method not allowed: " + request.Method)
+}
+
+/**
+ * Writes a 400 and returns false if the body is not the expected json
+ */
+func readApiJsonBody(httpResponseWriter http.ResponseWriter, request *http.Request, body interface{}) bool {
+    bodyBytes, err := ioutil.ReadAll(request.Body)
+    if err == nil {
+        err = json.Unmarshal(bodyBytes, body)
+    }
+    if err != nil {
+        writeApiError(httpResponseWriter, http.StatusBadRequest, "error reading request body: " + err.Error())
+        return false
+    }
+    return true
+}
+
+/**
+ * Writes a 400 and returns false if the body cannot be read
+ */
+func readApiRawBody(httpResponseWriter http.ResponseWriter, request *http.Request) ([]byte, bool) {
+    bodyBytes, err := ioutil.ReadAll(request.Body)
+    if err != nil {
+        writeApiError(httpResponseWriter, http.StatusBadRequest, "error reading request body: " + err.Error())
+        return nil, false
+    }
+    return bodyBytes, true
+}
+
+/**
+ * tokens[1] of metadata routes. The route regexes only match app or shared
+ */
+func getApiMetadataSpace(tokens []string) metadata_typedefs.MetadataSpace {
+    if tokens[1] == "shared" {
+        return metadata_typedefs.METADATA_SPACE_SHARED
+    }
+    return metadata_typedefs.METADATA_SPACE_APP
+}
+
+/**
+ * Writes a 404 and returns false if the version does not exist in the space
+ */
+func getApiMetadataVersion(httpResponseWriter http.ResponseWriter, versionString string, space metadata_typedefs.MetadataSpace) (*core.AppVersion, bool) {
+    version, err := core.GetAppVersionFromString(versionString)
+    if err != nil {
+        writeApiError(httpResponseWriter, http.StatusNotFound, "bad version: " + err.Error())
+        return nil, false
+    }
+
+    validVersion, err := metadata_service.Instance().IsVersionValid(version.String(), space)
+    if !validVersion {
+        errorMessage := "invalid version"
+        if err != nil {
+            errorMessage += ": " + err.Error()
+        }
+        writeApiError(httpResponseWriter, http.StatusNotFound, errorMessage)
+        return nil, false
+    }
+
+    return version, true
+}
+
+/**
+ * Same as the admin pages: writes are refused while this server's copy of the metadata is stale.
+ * Writes a 409 and returns false if so. Clients can POST to .../refresh and retry
+ */
+func checkApiMetadataUpToDate(httpResponseWriter http.ResponseWriter, request *http.Request, space metadata_typedefs.MetadataSpace) bool {
+    if !metadata_service.CheckIfMetadataUpToDate(space, request.Context()) {
+        writeApiError(httpResponseWriter, http.StatusConflict, "metadata not up to date. refresh and try again")
+        return false
+    }
+    return true
+}
+
+/**
+ * To be called after a successful write, while still holding the metadata service's write instance
+ */
+func markApiMetadataAsUpdated(request *http.Request, space metadata_typedefs.MetadataSpace) error {
+    err := metadata_service.MarkMetadataAsUpdated(space, request.Context())
+    if err != nil {
+        return errors.New("error marking metadata as updated: " + err.Error())
+    }
+    metadata_service.RefreshLastUpdatedTimestamps()
+    return nil
+}
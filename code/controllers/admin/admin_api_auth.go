@@ -0,0 +1,88 @@
+package admin
+
+import (
+    "crypto/subtle"
+    "errors"
+    "github.com/spacetimi/timi_shared_server/code/config"
+    "github.com/spacetimi/timi_shared_server/utils/aws_helper"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+)
+
+/**
+ * Api keys are per client (an internal dashboard, a build pipeline, ...), sent as:
+ *   Authorization: Bearer <client name>:<api key>
+ * The keys are read from a json aws secret (client name => api key), so that they can be added or revoked
+ * without a deploy. Changes are picked up within kApiKeyCacheDuration
+ */
+
+const kApiKeysSecretName = "admin_api_keys"
+
+const kApiKeyForLocalhostClientName = "local"
+const kApiKeyForLocalhostKey = "spacetimi-local-api-key"
+
+const kApiKeyCacheDuration = 5 * time.Minute
+
+type cachedApiKey struct {
+    apiKey string
+    cachedAt time.Time
+}
+
+var apiKeyCache = make(map[string]cachedApiKey)
+var apiKeyCacheMutex sync.Mutex
+
+/**
+ * Returns the name of the authenticated client
+ */
+func authenticateApiRequest(request *http.Request) (string, error) {
+    authorization := request.Header.Get("Authorization")
+    if !strings.HasPrefix(authorization, "Bearer ") {
+        return "", errors.New("missing api key")
+    }
+
+    tokens := strings.SplitN(strings.TrimPrefix(authorization, "Bearer "), ":", 2)
+    if len(tokens) != 2 || tokens[0] == "" || tokens[1] == "" {
+        return "", errors.New("malformed api key. expected <client name>:<api key>")
+    }
+    clientName := tokens[0]
+
+    apiKey, err := getApiKeyForClient(clientName)
+    if err != nil {
+        return "", errors.New("unknown api client: " + err.Error())
+    }
+
+    if subtle.ConstantTimeCompare([]byte(apiKey), []byte(tokens[1])) != 1 {
+        return "", errors.New("wrong api key")
+    }
+
+    return clientName, nil
+}
+
+func getApiKeyForClient(clientName string) (string, error) {
+    if config.GetEnvironmentConfiguration().AppEnvironment == config.LOCAL {
+        if clientName != kApiKeyForLocalhostClientName {
+            return "", errors.New("not an api client")
+        }
+        return kApiKeyForLocalhostKey, nil
+    }
+
+    apiKeyCacheMutex.Lock()
+    cached, ok := apiKeyCache[clientName]
+    apiKeyCacheMutex.Unlock()
+    if ok && time.Since(cached.cachedAt) < kApiKeyCacheDuration {
+        return cached.apiKey, nil
+    }
+
+    apiKey, err := aws_helper.ReadJsonSecret(kApiKeysSecretName, clientName)
+    if err != nil {
+        return "", errors.New("error fetching api key from aws secret: " + err.Error())
+    }
+
+    apiKeyCacheMutex.Lock()
+    apiKeyCache[clientName] = cachedApiKey{apiKey: apiKey, cachedAt: time.Now()}
+    apiKeyCacheMutex.Unlock()
+
+    return apiKey, nil
+}
@@ -0,0 +1,236 @@
+package admin
+
+import (
+    "bytes"
+    "github.com/spacetimi/timi_shared_server/code/core"
+    "github.com/spacetimi/timi_shared_server/code/core/services/localization_service"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service"
+    "github.com/spacetimi/timi_shared_server/utils/logger"
+    "net/http"
+    "strconv"
+)
+
+/**
+ * Handles: GET /admin/api/v1/localization and /admin/api/v1/localization/<version>
+ * The locales of the version (the latest version if none is in the url), and the missing translations
+ */
+func handleApiLocalization(httpResponseWriter http.ResponseWriter, request *http.Request, tokens []string) {
+    if request.Method != http.MethodGet {
+        writeApiMethodNotAllowed(httpResponseWriter, request)
+        return
+    }
+    if !checkApiLocalizationInitialized(httpResponseWriter) {
+        return
+    }
+    space := localization_service.GetMetadataSpace()
+
+    var version *core.AppVersion
+    if len(tokens) < 2 {
+        var err error
+        version, err = metadata_service.Instance().GetLatestDefinedVersion(space)
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusNotFound, "no metadata version to show strings for: " + err.Error())
+            return
+        }
+    } else {
+        var ok bool
+        version, ok = getApiMetadataVersion(httpResponseWriter, tokens[1], space)
+        if !ok {
+            return
+        }
+    }
+
+    tables, err := localization_service.GetStringTablesInVersion(version)
+    if err != nil {
+        writeApiError(httpResponseWriter, http.StatusInternalServerError, "error loading string tables for version: " + err.Error())
+        return
+    }
+
+    result := &AdminApiLocalizationInfo{
+        Space: space.String(),
+        Version: version.String(),
+        DefaultLocale: localization_service.GetDefaultLocale(),
+        AllVersions: metadata_service.Instance().GetAllVersions(space),
+        Locales: []AdminLocaleInfo{},
+        MissingTranslations: localization_service.GetMissingTranslations(tables),
+    }
+
+    sortVersionStringsDescending(result.AllVersions)
+
+    missingCounts := make(map[string]int)
+    for _, missingTranslation := range result.MissingTranslations {
+        for _, locale := range missingTranslation.MissingLocales {
+            missingCounts[locale]++
+        }
+    }
+    for _, locale := range localization_service.GetSupportedLocales() {
+        stringCount := 0
+        if table, ok := tables[locale]; ok {
+            stringCount = len(table.Strings)
+        }
+        result.Locales = append(result.Locales, AdminLocaleInfo{
+            Locale: locale,
+            StringCount: stringCount,
+            MissingCount: missingCounts[locale],
+        })
+    }
+
+    writeApiResult(httpResponseWriter, result)
+}
+
+/**
+ * Handles: /admin/api/v1/localization/<version>/csv
+ *   GET: every locale's strings as csv
+ *   PUT: replaces the strings of every locale in the csv in the request body
+ */
+func handleApiLocalizationCSV(httpResponseWriter http.ResponseWriter, request *http.Request, tokens []string, apiUser string) {
+    if !checkApiLocalizationInitialized(httpResponseWriter) {
+        return
+    }
+    space := localization_service.GetMetadataSpace()
+
+    switch request.Method {
+
+    case http.MethodGet:
+        version, ok := getApiMetadataVersion(httpResponseWriter, tokens[1], space)
+        if !ok {
+            return
+        }
+        tables, err := localization_service.GetStringTablesInVersion(version)
+        var buffer bytes.Buffer
+        if err == nil {
+            err = localization_service.ExportStringTablesToCSV(tables, &buffer)
+        }
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusInternalServerError, "error exporting strings: " + err.Error())
+            return
+        }
+        writeApiFile(httpResponseWriter, "text/csv", buffer.Bytes())
+
+    case http.MethodPut:
+        body, ok := readApiRawBody(httpResponseWriter, request)
+        if !ok {
+            return
+        }
+        tables, err := localization_service.ImportStringTablesFromCSV(bytes.NewReader(body))
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusBadRequest, "error reading strings from csv: " + err.Error())
+            return
+        }
+        saveApiStringTables(httpResponseWriter, request, tokens[1], tables, apiUser)
+
+    default:
+        writeApiMethodNotAllowed(httpResponseWriter, request)
+    }
+}
+
+/**
+ * Handles: /admin/api/v1/localization/<version>/xliff/<locale>
+ *   GET: the locale's strings as xliff, for translators
+ *   PUT: replaces the locale's strings with the xliff in the request body
+ */
+func handleApiLocalizationXLIFF(httpResponseWriter http.ResponseWriter, request *http.Request, tokens []string, apiUser string) {
+    if !checkApiLocalizationInitialized(httpResponseWriter) {
+        return
+    }
+    space := localization_service.GetMetadataSpace()
+    locale := localization_service.NormalizeLocale(tokens[3])
+
+    switch request.Method {
+
+    case http.MethodGet:
+        version, ok := getApiMetadataVersion(httpResponseWriter, tokens[1], space)
+        if !ok {
+            return
+        }
+        tables, err := localization_service.GetStringTablesInVersion(version)
+        var buffer bytes.Buffer
+        if err == nil {
+            err = localization_service.ExportStringTableToXLIFF(tables, locale, &buffer)
+        }
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusInternalServerError, "error exporting strings: " + err.Error())
+            return
+        }
+        writeApiFile(httpResponseWriter, "application/x-xliff+xml", buffer.Bytes())
+
+    case http.MethodPut:
+        body, ok := readApiRawBody(httpResponseWriter, request)
+        if !ok {
+            return
+        }
+        table, err := localization_service.ImportStringTableFromXLIFF(bytes.NewReader(body))
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusBadRequest, "error reading strings from xliff: " + err.Error())
+            return
+        }
+        if table.Locale != locale {
+            writeApiError(httpResponseWriter, http.StatusBadRequest, "xliff is for locale " + table.Locale + ", not " + locale)
+            return
+        }
+        saveApiStringTables(httpResponseWriter, request, tokens[1], []*localization_service.StringTable{table}, apiUser)
+
+    default:
+        writeApiMethodNotAllowed(httpResponseWriter, request)
+    }
+}
+
+/********** Helpers **********/
+
+func checkApiLocalizationInitialized(httpResponseWriter http.ResponseWriter) bool {
+    if !localization_service.IsInitialized() {
+        writeApiError(httpResponseWriter, http.StatusNotFound, "localization service is not enabled for this app")
+        return false
+    }
+    return true
+}
+
+func writeApiFile(httpResponseWriter http.ResponseWriter, contentType string, contents []byte) {
+    httpResponseWriter.Header().Set("Content-Type", contentType)
+    _, err := httpResponseWriter.Write(contents)
+    if err != nil {
+        logger.LogError("error writing admin api file response|error=" + err.Error())
+    }
+}
+
+func saveApiStringTables(httpResponseWriter http.ResponseWriter, request *http.Request, versionString string, tables []*localization_service.StringTable, apiUser string) {
+    space := localization_service.GetMetadataSpace()
+
+    version, ok := getApiMetadataVersion(httpResponseWriter, versionString, space)
+    if !ok {
+        return
+    }
+    if !checkApiMetadataUpToDate(httpResponseWriter, request, space) {
+        return
+    }
+
+    defer metadata_service.ReleaseInstanceRW()
+    mds := metadata_service.InstanceRWAsUser(apiUser)
+
+    result := &AdminApiLocalizationImportResult{Version: version.String()}
+    for _, table := range tables {
+        err := mds.SetMetadataItem(table, version)
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusBadRequest, "error saving strings for " + table.Locale + ": " + err.Error())
+            return
+        }
+        result.Locales = append(result.Locales, AdminLocaleInfo{
+            Locale: table.Locale,
+            StringCount: len(table.Strings),
+        })
+    }
+
+    err := markApiMetadataAsUpdated(request, space)
+    if err != nil {
+        writeApiError(httpResponseWriter, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    logger.LogInfo("imported strings" +
+                   "|metadata space=" + space.String() +
+                   "|version=" + version.String() +
+                   "|locale count=" + strconv.Itoa(len(tables)) +
+                   "|api user=" + apiUser)
+
+    writeApiResult(httpResponseWriter, result)
+}
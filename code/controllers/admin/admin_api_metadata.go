@@ -0,0 +1,834 @@
+package admin
+
+import (
+    "encoding/json"
+    "errors"
+    "github.com/spacetimi/timi_shared_server/code/core"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_factory"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
+    "github.com/spacetimi/timi_shared_server/utils/logger"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+/**
+ * Handles: GET /admin/api/v1/metadata/<space>
+ */
+func handleApiMetadataSpace(httpResponseWriter http.ResponseWriter, request *http.Request, tokens []string) {
+    if request.Method != http.MethodGet {
+        writeApiMethodNotAllowed(httpResponseWriter, request)
+        return
+    }
+    space := getApiMetadataSpace(tokens)
+
+    allVersions := metadata_service.Instance().GetAllVersions(space)
+    allVersionsSorted := make([]string, len(allVersions))
+    copy(allVersionsSorted, allVersions)
+    sortVersionStringsDescending(allVersionsSorted)
+
+    writeApiResult(httpResponseWriter, &AdminApiMetadataSpaceInfo{
+        Space: space.String(),
+        AllVersions: allVersionsSorted,
+        CurrentVersions: metadata_service.Instance().GetCurrentVersions(space),
+        VersionMappings: metadata_service.Instance().GetVersionMappings(space),
+        IsUpToDate: metadata_service.CheckIfMetadataUpToDate(space, request.Context()),
+        CanSyncFromGit: metadata_service.Instance().CanImportMetadataFromRef(space),
+    })
+}
+
+/**
+ * Handles: PUT /admin/api/v1/metadata/<space>/currentVersions
+ */
+func handleApiMetadataCurrentVersions(httpResponseWriter http.ResponseWriter, request *http.Request, tokens []string, apiUser string) {
+    if request.Method != http.MethodPut {
+        writeApiMethodNotAllowed(httpResponseWriter, request)
+        return
+    }
+    space := getApiMetadataSpace(tokens)
+
+    var body AdminApiSetCurrentVersionsRequest
+    if !readApiJsonBody(httpResponseWriter, request, &body) {
+        return
+    }
+    if !checkApiMetadataUpToDate(httpResponseWriter, request, space) {
+        return
+    }
+
+    defer metadata_service.ReleaseInstanceRW()
+    mds := metadata_service.InstanceRWAsUser(apiUser)
+    err := mds.SetCurrentVersions(body.CurrentVersions, space)
+    if err != nil {
+        writeApiError(httpResponseWriter, http.StatusBadRequest, "error setting current versions: " + err.Error())
+        return
+    }
+    err = markApiMetadataAsUpdated(request, space)
+    if err != nil {
+        writeApiError(httpResponseWriter, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    logger.LogInfo("Updated current versions for metadata space: " + space.String() +
+                   " to: " + strings.Join(body.CurrentVersions, ",") +
+                   "|api user=" + apiUser)
+
+    writeApiResult(httpResponseWriter, &AdminApiSetCurrentVersionsRequest{CurrentVersions: mds.GetCurrentVersions(space)})
+}
+
+/**
+ * Handles: PUT /admin/api/v1/metadata/<space>/versionMappings
+ */
+func handleApiMetadataVersionMappings(httpResponseWriter http.ResponseWriter, request *http.Request, tokens []string, apiUser string) {
+    if request.Method != http.MethodPut {
+        writeApiMethodNotAllowed(httpResponseWriter, request)
+        return
+    }
+    space := getApiMetadataSpace(tokens)
+
+    var body AdminApiSetVersionMappingsRequest
+    if !readApiJsonBody(httpResponseWriter, request, &body) {
+        return
+    }
+    if !checkApiMetadataUpToDate(httpResponseWriter, request, space) {
+        return
+    }
+
+    defer metadata_service.ReleaseInstanceRW()
+    mds := metadata_service.InstanceRWAsUser(apiUser)
+    err := mds.SetVersionMappings(body.VersionMappings, space)
+    if err != nil {
+        writeApiError(httpResponseWriter, http.StatusBadRequest, "error setting version mappings: " + err.Error())
+        return
+    }
+    err = markApiMetadataAsUpdated(request, space)
+    if err != nil {
+        writeApiError(httpResponseWriter, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    logger.LogInfo("Updated version mappings for metadata space: " + space.String() +
+                   "|mapping count=" + strconv.Itoa(len(body.VersionMappings)) +
+                   "|api user=" + apiUser)
+
+    writeApiResult(httpResponseWriter, &AdminApiSetVersionMappingsRequest{VersionMappings: mds.GetVersionMappings(space)})
+}
+
+/**
+ * Handles: POST /admin/api/v1/metadata/<space>/refresh
+ */
+func handleApiMetadataRefresh(httpResponseWriter http.ResponseWriter, request *http.Request) {
+    if request.Method != http.MethodPost {
+        writeApiMethodNotAllowed(httpResponseWriter, request)
+        return
+    }
+
+    metadata_service.RefreshMetadata()
+    writeApiResult(httpResponseWriter, nil)
+}
+
+/**
+ * Handles: POST /admin/api/v1/metadata/<space>/versions
+ * Creates an empty version, or a copy of CloneFrom
+ */
+func handleApiMetadataVersions(httpResponseWriter http.ResponseWriter, request *http.Request, tokens []string, apiUser string) {
+    if request.Method != http.MethodPost {
+        writeApiMethodNotAllowed(httpResponseWriter, request)
+        return
+    }
+    space := getApiMetadataSpace(tokens)
+
+    var body AdminApiCreateVersionRequest
+    if !readApiJsonBody(httpResponseWriter, request, &body) {
+        return
+    }
+    newVersion, err := core.GetAppVersionFromString(body.Version)
+    if err != nil {
+        writeApiError(httpResponseWriter, http.StatusBadRequest, "error parsing new version number: " + err.Error())
+        return
+    }
+    var cloneFromVersion *core.AppVersion
+    if body.CloneFrom != "" {
+        var ok bool
+        cloneFromVersion, ok = getApiMetadataVersion(httpResponseWriter, body.CloneFrom, space)
+        if !ok {
+            return
+        }
+    }
+    if !checkApiMetadataUpToDate(httpResponseWriter, request, space) {
+        return
+    }
+
+    defer metadata_service.ReleaseInstanceRW()
+    mds := metadata_service.InstanceRWAsUser(apiUser)
+    if cloneFromVersion != nil {
+        err = mds.CloneMetadataVersion(cloneFromVersion, newVersion, space, body.MarkAsCurrent)
+    } else {
+        err = mds.CreateNewVersion(newVersion, space, body.MarkAsCurrent)
+    }
+    if err != nil {
+        writeApiError(httpResponseWriter, http.StatusBadRequest, "error creating new version: " + err.Error())
+        return
+    }
+    err = markApiMetadataAsUpdated(request, space)
+    if err != nil {
+        writeApiError(httpResponseWriter, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    items, hasLegacyHashes := getApiMetadataItemsInVersion(mds, newVersion, space)
+    writeApiResult(httpResponseWriter, &AdminApiMetadataVersionInfo{
+        Space: space.String(),
+        Version: newVersion.String(),
+        Items: items,
+        HasLegacyHashes: hasLegacyHashes,
+    })
+}
+
+/**
+ * Handles: GET /admin/api/v1/metadata/<space>/versions/<version>
+ * Lists every registered item, and whether (and how) it is defined in the version
+ */
+func handleApiMetadataVersion(httpResponseWriter http.ResponseWriter, request *http.Request, tokens []string) {
+    if request.Method != http.MethodGet {
+        writeApiMethodNotAllowed(httpResponseWriter, request)
+        return
+    }
+    space := getApiMetadataSpace(tokens)
+    version, ok := getApiMetadataVersion(httpResponseWriter, tokens[3], space)
+    if !ok {
+        return
+    }
+
+    items, hasLegacyHashes := getAdminMetadataItemsInVersion(version, space)
+    writeApiResult(httpResponseWriter, &AdminApiMetadataVersionInfo{
+        Space: space.String(),
+        Version: version.String(),
+        Items: items,
+        HasLegacyHashes: hasLegacyHashes,
+    })
+}
+
+/**
+ * Handles: /admin/api/v1/metadata/<space>/versions/<version>/items
+ *   GET: contents of every item defined in the version (like download_all)
+ *   PUT: saves several items at once (like upload_all). Nothing is saved unless every item is valid
+ */
+func handleApiMetadataItems(httpResponseWriter http.ResponseWriter, request *http.Request, tokens []string, apiUser string) {
+    space := getApiMetadataSpace(tokens)
+
+    switch request.Method {
+
+    case http.MethodGet:
+        version, ok := getApiMetadataVersion(httpResponseWriter, tokens[3], space)
+        if !ok {
+            return
+        }
+        manifestItems, err := metadata_service.Instance().GetMetadataManifestItemsInVersion(version.String(), space)
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusInternalServerError, "error getting metadata items in version: " + err.Error())
+            return
+        }
+
+        result := &AdminApiMetadataItems{Items: make(map[string]json.RawMessage)}
+        for _, manifestItem := range manifestItems {
+            content, err := metadata_service.Instance().GetMetadataItemRawContent(manifestItem.MetadataKey, version, space)
+            if err != nil {
+                writeApiError(httpResponseWriter, http.StatusInternalServerError, "error fetching metadata item for key: " + manifestItem.MetadataKey +
+                                                                                  ". Error: " + err.Error())
+                return
+            }
+            result.Items[manifestItem.MetadataKey] = json.RawMessage(content)
+        }
+        writeApiResult(httpResponseWriter, result)
+
+    case http.MethodPut:
+        var body AdminApiMetadataItems
+        if !readApiJsonBody(httpResponseWriter, request, &body) {
+            return
+        }
+        version, ok := getApiMetadataVersion(httpResponseWriter, tokens[3], space)
+        if !ok {
+            return
+        }
+        if len(body.Items) == 0 {
+            writeApiError(httpResponseWriter, http.StatusBadRequest, "found no metadata to upload in request")
+            return
+        }
+
+        var errorList []string
+        var metadataItems []metadata_typedefs.IMetadataItem
+        for metadataItemKey, content := range body.Items {
+            metadataItem, err := instantiateAndValidateApiMetadataItem(metadataItemKey, content, space)
+            if err != nil {
+                errorList = append(errorList, err.Error())
+                continue
+            }
+            metadataItems = append(metadataItems, metadataItem)
+        }
+        if len(errorList) != 0 {
+            sort.Strings(errorList)
+            writeApiError(httpResponseWriter, http.StatusBadRequest, strings.Join(errorList, "; "))
+            return
+        }
+        if !checkApiMetadataUpToDate(httpResponseWriter, request, space) {
+            return
+        }
+
+        defer metadata_service.ReleaseInstanceRW()
+        mds := metadata_service.InstanceRWAsUser(apiUser)
+        for _, metadataItem := range metadataItems {
+            err := mds.SetMetadataItem(metadataItem, version)
+            if err != nil {
+                errorList = append(errorList, "error uploading metadata item for key: " + metadataItem.GetKey() +
+                                              "(error=" + err.Error() + ")")
+            }
+        }
+        err := markApiMetadataAsUpdated(request, space)
+        if err != nil {
+            errorList = append(errorList, err.Error())
+        }
+        if len(errorList) != 0 {
+            writeApiError(httpResponseWriter, http.StatusInternalServerError, strings.Join(errorList, "; "))
+            return
+        }
+
+        logger.LogInfo("Updated metadata items" +
+                       "|metadata space=" + space.String() +
+                       "|version=" + version.String() +
+                       "|item count=" + strconv.Itoa(len(metadataItems)) +
+                       "|api user=" + apiUser)
+
+        items, hasLegacyHashes := getApiMetadataItemsInVersion(mds, version, space)
+        writeApiResult(httpResponseWriter, &AdminApiMetadataVersionInfo{
+            Space: space.String(),
+            Version: version.String(),
+            Items: items,
+            HasLegacyHashes: hasLegacyHashes,
+        })
+
+    default:
+        writeApiMethodNotAllowed(httpResponseWriter, request)
+    }
+}
+
+/**
+ * Handles: /admin/api/v1/metadata/<space>/versions/<version>/items/<metadata item key>
+ *   GET: the item's content
+ *   PUT: saves the item (the request body is the item's json)
+ */
+func handleApiMetadataItem(httpResponseWriter http.ResponseWriter, request *http.Request, tokens []string, apiUser string) {
+    space := getApiMetadataSpace(tokens)
+    metadataItemKey := tokens[5]
+
+    switch request.Method {
+
+    case http.MethodGet:
+        version, ok := getApiMetadataVersion(httpResponseWriter, tokens[3], space)
+        if !ok {
+            return
+        }
+        content, err := metadata_service.Instance().GetMetadataItemRawContent(metadataItemKey, version, space)
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusNotFound, "failed to fetch metadata item: " + err.Error())
+            return
+        }
+        writeApiResult(httpResponseWriter, json.RawMessage(content))
+
+    case http.MethodPut:
+        content, ok := readApiRawBody(httpResponseWriter, request)
+        if !ok {
+            return
+        }
+        version, ok := getApiMetadataVersion(httpResponseWriter, tokens[3], space)
+        if !ok {
+            return
+        }
+        metadataItem, err := instantiateAndValidateApiMetadataItem(metadataItemKey, content, space)
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusBadRequest, err.Error())
+            return
+        }
+        if !checkApiMetadataUpToDate(httpResponseWriter, request, space) {
+            return
+        }
+
+        defer metadata_service.ReleaseInstanceRW()
+        mds := metadata_service.InstanceRWAsUser(apiUser)
+        err = mds.SetMetadataItem(metadataItem, version)
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusInternalServerError, "error saving " + metadataItemKey + ": " + err.Error())
+            return
+        }
+        err = markApiMetadataAsUpdated(request, space)
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusInternalServerError, err.Error())
+            return
+        }
+
+        logger.LogInfo("Updated metadata item" +
+                       "|metadata space=" + space.String() +
+                       "|version=" + version.String() +
+                       "|metadata item key=" + metadataItemKey +
+                       "|api user=" + apiUser)
+
+        writeApiManifestItemResult(httpResponseWriter, mds, metadataItemKey, version, space)
+
+    default:
+        writeApiMethodNotAllowed(httpResponseWriter, request)
+    }
+}
+
+/**
+ * Handles: /admin/api/v1/metadata/<space>/versions/<version>/items/<metadata item key>/csv
+ *   GET: the tabular item as csv
+ *   PUT: replaces the tabular item's records with the csv in the request body
+ */
+func handleApiMetadataItemCSV(httpResponseWriter http.ResponseWriter, request *http.Request, tokens []string, apiUser string) {
+    space := getApiMetadataSpace(tokens)
+    metadataItemKey := tokens[5]
+
+    switch request.Method {
+
+    case http.MethodGet:
+        version, ok := getApiMetadataVersion(httpResponseWriter, tokens[3], space)
+        if !ok {
+            return
+        }
+        csvContents, err := getMetadataItemAsCSV(metadataItemKey, version, space)
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusBadRequest, "error exporting " + metadataItemKey + " as csv: " + err.Error())
+            return
+        }
+
+        httpResponseWriter.Header().Set("Content-Type", "text/csv")
+        _, err = httpResponseWriter.Write(csvContents)
+        if err != nil {
+            logger.LogError("error writing metadata item csv" +
+                            "|metadata item key=" + metadataItemKey +
+                            "|error=" + err.Error())
+        }
+
+    case http.MethodPut:
+        csvContents, ok := readApiRawBody(httpResponseWriter, request)
+        if !ok {
+            return
+        }
+        version, ok := getApiMetadataVersion(httpResponseWriter, tokens[3], space)
+        if !ok {
+            return
+        }
+        metadataItem, errorList := getMetadataItemFromCSV(metadataItemKey, csvContents, version, space)
+        if len(errorList) != 0 {
+            writeApiError(httpResponseWriter, http.StatusBadRequest, "error importing csv for " + metadataItemKey + ": " + strings.Join(errorList, "; "))
+            return
+        }
+        if !checkApiMetadataUpToDate(httpResponseWriter, request, space) {
+            return
+        }
+
+        defer metadata_service.ReleaseInstanceRW()
+        mds := metadata_service.InstanceRWAsUser(apiUser)
+        err := mds.SetMetadataItem(metadataItem, version)
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusInternalServerError, "error saving " + metadataItemKey + ": " + err.Error())
+            return
+        }
+        err = markApiMetadataAsUpdated(request, space)
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusInternalServerError, err.Error())
+            return
+        }
+
+        logger.LogInfo("Updated metadata item from csv" +
+                       "|metadata space=" + space.String() +
+                       "|version=" + version.String() +
+                       "|metadata item key=" + metadataItemKey +
+                       "|api user=" + apiUser)
+
+        writeApiManifestItemResult(httpResponseWriter, mds, metadataItemKey, version, space)
+
+    default:
+        writeApiMethodNotAllowed(httpResponseWriter, request)
+    }
+}
+
+/**
+ * Handles: /admin/api/v1/metadata/<space>/versions/<version>/items/<metadata item key>/overrides/<platform>
+ *   GET: the platform override (a json merge patch on the item)
+ *   PUT: saves the platform override in the request body
+ *   DELETE: removes the platform override
+ */
+func handleApiMetadataItemOverride(httpResponseWriter http.ResponseWriter, request *http.Request, tokens []string, apiUser string) {
+    space := getApiMetadataSpace(tokens)
+    metadataItemKey := tokens[5]
+
+    platform, err := metadata_typedefs.GetMetadataPlatformFromString(tokens[7])
+    if err != nil || platform == metadata_typedefs.METADATA_PLATFORM_NONE {
+        writeApiError(httpResponseWriter, http.StatusNotFound, "invalid platform: " + tokens[7])
+        return
+    }
+
+    switch request.Method {
+
+    case http.MethodGet:
+        version, ok := getApiMetadataVersion(httpResponseWriter, tokens[3], space)
+        if !ok {
+            return
+        }
+        content, err := metadata_service.Instance().GetMetadataItemRawContent(metadata_typedefs.GetPlatformOverrideKey(metadataItemKey, platform), version, space)
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusNotFound, "failed to fetch platform override: " + err.Error())
+            return
+        }
+        writeApiResult(httpResponseWriter, json.RawMessage(content))
+
+    case http.MethodPut:
+        overrideJson, ok := readApiRawBody(httpResponseWriter, request)
+        if !ok {
+            return
+        }
+        version, ok := getApiMetadataVersion(httpResponseWriter, tokens[3], space)
+        if !ok {
+            return
+        }
+
+        // Make sure the base item with the override applied is still a valid metadata item
+        err = validatePlatformOverride(metadataItemKey, string(overrideJson), version, space)
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusBadRequest, "invalid platform override for " + metadataItemKey + ": " + err.Error())
+            return
+        }
+        if !checkApiMetadataUpToDate(httpResponseWriter, request, space) {
+            return
+        }
+
+        defer metadata_service.ReleaseInstanceRW()
+        mds := metadata_service.InstanceRWAsUser(apiUser)
+        err = mds.SetMetadataItemPlatformOverride(metadataItemKey, string(overrideJson), version, space, platform)
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusInternalServerError, err.Error())
+            return
+        }
+        err = markApiMetadataAsUpdated(request, space)
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusInternalServerError, err.Error())
+            return
+        }
+
+        writeApiManifestItemResult(httpResponseWriter, mds, metadataItemKey, version, space)
+
+    case http.MethodDelete:
+        version, ok := getApiMetadataVersion(httpResponseWriter, tokens[3], space)
+        if !ok {
+            return
+        }
+        if !checkApiMetadataUpToDate(httpResponseWriter, request, space) {
+            return
+        }
+
+        defer metadata_service.ReleaseInstanceRW()
+        mds := metadata_service.InstanceRWAsUser(apiUser)
+        err = mds.RemoveMetadataItemPlatformOverride(metadataItemKey, version, space, platform)
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusBadRequest, err.Error())
+            return
+        }
+        err = markApiMetadataAsUpdated(request, space)
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusInternalServerError, err.Error())
+            return
+        }
+
+        writeApiManifestItemResult(httpResponseWriter, mds, metadataItemKey, version, space)
+
+    default:
+        writeApiMethodNotAllowed(httpResponseWriter, request)
+    }
+}
+
+/**
+ * Handles: POST /admin/api/v1/metadata/<space>/versions/<version>/upgradeIntegrity
+ */
+func handleApiMetadataUpgradeIntegrity(httpResponseWriter http.ResponseWriter, request *http.Request, tokens []string, apiUser string) {
+    if request.Method != http.MethodPost {
+        writeApiMethodNotAllowed(httpResponseWriter, request)
+        return
+    }
+    space := getApiMetadataSpace(tokens)
+    version, ok := getApiMetadataVersion(httpResponseWriter, tokens[3], space)
+    if !ok {
+        return
+    }
+    if !checkApiMetadataUpToDate(httpResponseWriter, request, space) {
+        return
+    }
+
+    defer metadata_service.ReleaseInstanceRW()
+    upgradedCount, err := metadata_service.InstanceRWAsUser(apiUser).UpgradeMetadataManifestIntegrity(version, space)
+    if err != nil {
+        writeApiError(httpResponseWriter, http.StatusInternalServerError, "error upgrading metadata integrity: " + err.Error())
+        return
+    }
+    err = markApiMetadataAsUpdated(request, space)
+    if err != nil {
+        writeApiError(httpResponseWriter, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    writeApiResult(httpResponseWriter, &AdminApiUpgradeIntegrityResult{UpgradedCount: upgradedCount})
+}
+
+/**
+ * Handles: POST /admin/api/v1/metadata/<space>/syncFromGit
+ */
+func handleApiMetadataSyncFromGit(httpResponseWriter http.ResponseWriter, request *http.Request, tokens []string, apiUser string) {
+    if request.Method != http.MethodPost {
+        writeApiMethodNotAllowed(httpResponseWriter, request)
+        return
+    }
+    space := getApiMetadataSpace(tokens)
+
+    var body AdminApiSyncFromGitRequest
+    if !readApiJsonBody(httpResponseWriter, request, &body) {
+        return
+    }
+    if !metadata_service.Instance().CanImportMetadataFromRef(space) {
+        writeApiError(httpResponseWriter, http.StatusBadRequest, "metadata for space " + space.String() + " is not stored in git")
+        return
+    }
+    gitRef := strings.TrimSpace(body.GitRef)
+    if gitRef == "" {
+        writeApiError(httpResponseWriter, http.StatusBadRequest, "no git ref")
+        return
+    }
+    newVersion, err := core.GetAppVersionFromString(body.Version)
+    if err != nil {
+        writeApiError(httpResponseWriter, http.StatusBadRequest, "error parsing new version number: " + err.Error())
+        return
+    }
+    if !checkApiMetadataUpToDate(httpResponseWriter, request, space) {
+        return
+    }
+
+    defer metadata_service.ReleaseInstanceRW()
+    mds := metadata_service.InstanceRWAsUser(apiUser)
+    err = mds.ImportMetadataVersionFromRef(gitRef, newVersion, space, body.MarkAsCurrent)
+    if err != nil {
+        writeApiError(httpResponseWriter, http.StatusBadRequest, "error syncing from git: " + err.Error())
+        return
+    }
+    err = markApiMetadataAsUpdated(request, space)
+    if err != nil {
+        writeApiError(httpResponseWriter, http.StatusInternalServerError, err.Error())
+        return
+    }
+
+    items, hasLegacyHashes := getApiMetadataItemsInVersion(mds, newVersion, space)
+    writeApiResult(httpResponseWriter, &AdminApiMetadataVersionInfo{
+        Space: space.String(),
+        Version: newVersion.String(),
+        Items: items,
+        HasLegacyHashes: hasLegacyHashes,
+    })
+}
+
+/**
+ * Handles: /admin/api/v1/metadata/<space>/schedules
+ *   GET: every scheduled action of the space
+ *   POST: schedules a new action
+ */
+func handleApiMetadataSchedules(httpResponseWriter http.ResponseWriter, request *http.Request, tokens []string, apiUser string) {
+    space := getApiMetadataSpace(tokens)
+
+    switch request.Method {
+
+    case http.MethodGet:
+        actions, err := metadata_service.GetScheduledMetadataActions(space, request.Context())
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusInternalServerError, "error loading scheduled actions: " + err.Error())
+            return
+        }
+        schedules := []AdminScheduledMetadataAction{}
+        for _, action := range actions {
+            schedules = append(schedules, newAdminScheduledMetadataAction(action))
+        }
+        writeApiResult(httpResponseWriter, schedules)
+
+    case http.MethodPost:
+        var body AdminApiScheduleRequest
+        if !readApiJsonBody(httpResponseWriter, request, &body) {
+            return
+        }
+        actionType, err := metadata_typedefs.GetScheduledMetadataActionTypeFromString(body.ActionType)
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusBadRequest, err.Error())
+            return
+        }
+
+        action := &metadata_typedefs.ScheduledMetadataAction{
+            Space: space,
+            ActionType: actionType,
+            CreatedBy: apiUser,
+        }
+        setScheduledMetadataActionFromApiRequest(&body, action)
+        err = metadata_service.ScheduleMetadataAction(action, request.Context())
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusBadRequest, "error scheduling action: " + err.Error())
+            return
+        }
+        writeApiResult(httpResponseWriter, newAdminScheduledMetadataAction(action))
+
+    default:
+        writeApiMethodNotAllowed(httpResponseWriter, request)
+    }
+}
+
+/**
+ * Handles: /admin/api/v1/metadata/<space>/schedules/<schedule id>
+ *   GET: the scheduled action
+ *   PUT: edits the pending action
+ *   DELETE: cancels the pending action
+ */
+func handleApiMetadataSchedule(httpResponseWriter http.ResponseWriter, request *http.Request, tokens []string, apiUser string) {
+    space := getApiMetadataSpace(tokens)
+
+    scheduleId, err := strconv.ParseInt(tokens[3], 10, 64)
+    if err != nil {
+        writeApiError(httpResponseWriter, http.StatusNotFound, "bad schedule id: " + tokens[3])
+        return
+    }
+    action, err := metadata_service.GetScheduledMetadataAction(scheduleId, request.Context())
+    if err == nil && action.Space != space {
+        err = errors.New("scheduled action belongs to metadata space: " + action.Space.String())
+    }
+    if err != nil {
+        writeApiError(httpResponseWriter, http.StatusNotFound, "invalid scheduled action: " + err.Error())
+        return
+    }
+
+    switch request.Method {
+
+    case http.MethodGet:
+        writeApiResult(httpResponseWriter, newAdminScheduledMetadataAction(action))
+
+    case http.MethodPut:
+        var body AdminApiScheduleRequest
+        if !readApiJsonBody(httpResponseWriter, request, &body) {
+            return
+        }
+        setScheduledMetadataActionFromApiRequest(&body, action)
+        err = metadata_service.UpdateScheduledMetadataAction(action, request.Context())
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusBadRequest, "error updating scheduled action: " + err.Error())
+            return
+        }
+
+        logger.LogInfo("scheduled metadata action edited" +
+                       "|schedule id=" + strconv.FormatInt(action.ScheduleId, 10) +
+                       "|edited by=" + apiUser)
+
+        writeApiResult(httpResponseWriter, newAdminScheduledMetadataAction(action))
+
+    case http.MethodDelete:
+        err = metadata_service.CancelScheduledMetadataAction(action.ScheduleId, apiUser, request.Context())
+        if err != nil {
+            writeApiError(httpResponseWriter, http.StatusBadRequest, "error cancelling scheduled action: " + err.Error())
+            return
+        }
+        writeApiResult(httpResponseWriter, nil)
+
+    default:
+        writeApiMethodNotAllowed(httpResponseWriter, request)
+    }
+}
+
+/********** Helpers **********/
+
+/**
+ * Same checks as the upload pages: a factory must be registered for the key, in this space, and the item must validate
+ */
+func instantiateAndValidateApiMetadataItem(metadataItemKey string, content []byte, space metadata_typedefs.MetadataSpace) (metadata_typedefs.IMetadataItem, error) {
+    metadataItem, err := metadata_factory.InstantiateMetadataItem(metadataItemKey)
+    if err != nil {
+        return nil, errors.New("error instantiating metadata item for key: " + metadataItemKey + " (error=" + err.Error() + ")")
+    }
+    if space != metadataItem.GetMetadataSpace() {
+        return nil, errors.New("wrong metadata space for metadata item with key: " + metadataItemKey +
+                               " (expected=" + metadataItem.GetMetadataSpace().String() +
+                               ", got=" + space.String() + ")")
+    }
+
+    err = metadata_typedefs.UnmarshalAndValidateMetadataItem(content, metadataItem)
+    if err != nil {
+        return nil, errors.New("error deserializing metadata item for key: " + metadataItemKey + " (error=" + err.Error() + ")")
+    }
+    return metadataItem, nil
+}
+
+/**
+ * For results of writes. Reads from the write instance, since Instance() blocks until it is released
+ */
+func writeApiManifestItemResult(httpResponseWriter http.ResponseWriter, mds *metadata_service.MetadataService, metadataItemKey string, version *core.AppVersion, space metadata_typedefs.MetadataSpace) {
+    manifestItem, err := mds.GetMetadataManifestItemInVersion(metadataItemKey, version, space)
+    if err != nil {
+        writeApiError(httpResponseWriter, http.StatusInternalServerError, "saved, but failed to read back manifest item: " + err.Error())
+        return
+    }
+    writeApiResult(httpResponseWriter, manifestItem)
+}
+
+/**
+ * Like getAdminMetadataItemsInVersion, but reading from the write instance
+ */
+func getApiMetadataItemsInVersion(mds *metadata_service.MetadataService, version *core.AppVersion, space metadata_typedefs.MetadataSpace) ([]AdminMetadataItem, bool) {
+    manifestItems, err := mds.GetMetadataManifestItemsInVersion(version.String(), space)
+    if err != nil {
+        return nil, false
+    }
+
+    items := []AdminMetadataItem{}
+    hasLegacyHashes := false
+    for _, manifestItem := range manifestItems {
+        if metadata_typedefs.IsLegacyMetadataHash(manifestItem.Hash) {
+            hasLegacyHashes = true
+        }
+
+        var platformOverrides []string
+        for platformString, overrideHash := range manifestItem.PlatformOverrides {
+            platformOverrides = append(platformOverrides, platformString)
+            if metadata_typedefs.IsLegacyMetadataHash(overrideHash) {
+                hasLegacyHashes = true
+            }
+        }
+        sort.Strings(platformOverrides)
+
+        items = append(items, AdminMetadataItem{
+            Key: manifestItem.MetadataKey,
+            Hash: manifestItem.Hash,
+            Defined: true,
+            PlatformOverrides: platformOverrides,
+            IsTabular: metadata_factory.GetTabularMapping(manifestItem.MetadataKey) != nil,
+        })
+    }
+
+    sort.Slice(items, func(i, j int) bool {
+        return items[i].Key < items[j].Key
+    })
+    return items, hasLegacyHashes
+}
+
+func setScheduledMetadataActionFromApiRequest(body *AdminApiScheduleRequest, action *metadata_typedefs.ScheduledMetadataAction) {
+    action.ExecuteAtUnix = body.ExecuteAtUnix
+
+    switch action.ActionType {
+    case metadata_typedefs.SCHEDULED_ACTION_SET_CURRENT_VERSIONS:
+        action.CurrentVersions = body.CurrentVersions
+
+    case metadata_typedefs.SCHEDULED_ACTION_PUBLISH_ITEM:
+        action.Version = strings.TrimSpace(body.Version)
+        action.MetadataKey = strings.TrimSpace(body.MetadataKey)
+        action.Content = body.Content
+    }
+}
@@ -0,0 +1,19 @@
+package admin
+
+import (
+    "github.com/spacetimi/timi_shared_server/code/core/services/storage_service"
+    "net/http"
+)
+
+/**
+ * Handles: GET /admin/api/v1/storage/cacheStats
+ * Blob reads per cache tier, of the server that handled the request
+ */
+func handleApiStorageCacheStats(httpResponseWriter http.ResponseWriter, request *http.Request) {
+    if request.Method != http.MethodGet {
+        writeApiMethodNotAllowed(httpResponseWriter, request)
+        return
+    }
+
+    writeApiResult(httpResponseWriter, storage_service.GetBlobCacheStats())
+}
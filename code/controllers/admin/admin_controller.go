@@ -7,15 +7,21 @@ import (
     "html/template"
     "net/http"
     "regexp"
+    "strings"
     "time"
 )
 
 const kCookieName = "jwtTokenForAdminUser"
 
+// The json api authenticates with api keys instead of the login cookie, and is routed separately.
+// Checked by prefix since the (unanchored) page routes below would also match api paths
+const kAdminApiPathPrefix = "/admin/api/"
+
 const kAdminRouteName_Home = "HOME"
 const kAdminRouteName_Login = "LOGIN"
 const kAdminRouteName_Logout = "LOGOUT"
 const kAdminRouteName_Metadata = "METADATA"
+const kAdminRouteName_Localization = "LOCALIZATION"
 
 var kRoutes = map[string]string {
     "/admin$": kAdminRouteName_Home,
@@ -23,6 +29,7 @@ var kRoutes = map[string]string {
     "/admin/login$": kAdminRouteName_Login,
     "/admin/logout$": kAdminRouteName_Logout,
     "/admin/metadata.*": kAdminRouteName_Metadata,
+    "/admin/localization.*": kAdminRouteName_Localization,
 }
 
 var kRouteRegexToRouteName map[*regexp.Regexp]string
@@ -43,6 +50,11 @@ func init() {
 }
 
 func AdminController(httpResponseWriter http.ResponseWriter, request *http.Request) {
+    if strings.HasPrefix(request.URL.Path, kAdminApiPathPrefix) {
+        handleAdminApiRequest(httpResponseWriter, request)
+        return
+    }
+
     adminPageObject := AdminPageObject {
         AppName: config.GetAppName(),
         AppEnvironment: "Unknown",
@@ -103,6 +115,7 @@ func AdminController(httpResponseWriter http.ResponseWriter, request *http.Reque
 
     case kAdminRouteName_Home: showAdminPage(httpResponseWriter, request, adminPageObject)
     case kAdminRouteName_Metadata: showAdminMetadataPage(httpResponseWriter, request, adminPageObject)
+    case kAdminRouteName_Localization: showAdminLocalizationPage(httpResponseWriter, request, adminPageObject)
 
     default:
         logger.LogWarning("unknown route request for admin controller" +
@@ -0,0 +1,378 @@
+package admin
+
+import (
+    "bytes"
+    "fmt"
+    "github.com/spacetimi/timi_shared_server/code/config"
+    "github.com/spacetimi/timi_shared_server/code/core"
+    "github.com/spacetimi/timi_shared_server/code/core/services/localization_service"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service"
+    "github.com/spacetimi/timi_shared_server/utils/logger"
+    "html/template"
+    "io"
+    "net/http"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const kLocalizationRoute_Overview = "LOCALIZATION_OVERVIEW"
+const kLocalizationRoute_ExportCSV = "LOCALIZATION_EXPORT_CSV"
+const kLocalizationRoute_ExportXLIFF = "LOCALIZATION_EXPORT_XLIFF"
+const kLocalizationRoute_Import = "LOCALIZATION_IMPORT"
+
+var kAdminLocalizationRoutes = map[string]string{
+    "/admin/localization$": kLocalizationRoute_Overview,
+    "/admin/localization/" + core.AppVersionRegexPattern + "$": kLocalizationRoute_Overview,
+    "/admin/localization/exportCSV/" + core.AppVersionRegexPattern + "$": kLocalizationRoute_ExportCSV,
+    "/admin/localization/exportXLIFF/" + core.AppVersionRegexPattern + "/[^/]+$": kLocalizationRoute_ExportXLIFF,
+    "/admin/localization/import/" + core.AppVersionRegexPattern + "$": kLocalizationRoute_Import,
+}
+
+var kAdminLocalizationRouteRegexToRouteName map[*regexp.Regexp]string
+
+/** Package init **/
+func init() {
+    kAdminLocalizationRouteRegexToRouteName = make(map[*regexp.Regexp]string, len(kAdminLocalizationRoutes))
+    for route, routeName := range kAdminLocalizationRoutes {
+        reg, err := regexp.Compile(route)
+        if err != nil {
+            logger.LogError("bad route regex in admin localization controller" +
+                            "|regex=" + route +
+                            "|error=" + err.Error())
+            continue
+        }
+        kAdminLocalizationRouteRegexToRouteName[reg] = routeName
+    }
+}
+
+func showAdminLocalizationPage(httpResponseWriter http.ResponseWriter, request *http.Request, adminPageObject AdminPageObject) {
+    // Add link for back navigation
+    adminPageObject.NavBackLinks = append(adminPageObject.NavBackLinks,
+                                          NavBackLink{
+                                              LinkName: "localization",
+                                              Href: "/admin/localization",
+                                          })
+
+    if !localization_service.IsInitialized() {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Localization service is not enabled for this app",
+            BackLinkHref: "/admin",
+        }
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    matchingRoute := getRouteNameForRequest(kAdminLocalizationRouteRegexToRouteName, request.URL.Path)
+
+    switch matchingRoute {
+
+    case kLocalizationRoute_Overview:
+        showLocalizationOverviewPage(httpResponseWriter, request, adminPageObject)
+    case kLocalizationRoute_ExportCSV:
+        showLocalizationExportPage(httpResponseWriter, request, adminPageObject, false)
+    case kLocalizationRoute_ExportXLIFF:
+        showLocalizationExportPage(httpResponseWriter, request, adminPageObject, true)
+    case kLocalizationRoute_Import:
+        showLocalizationImportPage(httpResponseWriter, request, adminPageObject)
+
+    default:
+        logger.LogWarning("unknown route request for admin localization controller" +
+                          "|request URL=" + request.URL.Path)
+        httpResponseWriter.WriteHeader(http.StatusNotFound)
+    }
+}
+
+/**
+ * Handles: /admin/localization and /admin/localization/<version>
+ * Shows the locales of the version (the latest version if none is in the url), and the report of missing translations
+ */
+func showLocalizationOverviewPage(httpResponseWriter http.ResponseWriter, request *http.Request, adminPageObject AdminPageObject) {
+    space := localization_service.GetMetadataSpace()
+
+    var version *core.AppVersion
+    var err error
+    if request.URL.Path == "/admin/localization" {
+        version, err = metadata_service.Instance().GetLatestDefinedVersion(space)
+    } else {
+        version, err = core.GetAppVersionFromString(filepath.Base(request.URL.Path))
+    }
+    if err != nil {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "No metadata version to show strings for",
+            BackLinkHref: "/admin",
+        }
+        simpleMessagePageObject.HasError = true
+        simpleMessagePageObject.ErrorString = err.Error()
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    tables, err := localization_service.GetStringTablesInVersion(version)
+    if err != nil {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Error loading string tables for version: " + version.String(),
+            BackLinkHref: "/admin/localization",
+        }
+        simpleMessagePageObject.HasError = true
+        simpleMessagePageObject.ErrorString = err.Error()
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    pageObject := AdminLocalizationPageObject{}
+    pageObject.AdminPageObject = adminPageObject
+    pageObject.Space = space.String()
+    pageObject.Version = version.String()
+    pageObject.DefaultLocale = localization_service.GetDefaultLocale()
+    pageObject.AllVersions = metadata_service.Instance().GetAllVersions(space)
+    sortVersionStringsDescending(pageObject.AllVersions)
+
+    missingTranslations := localization_service.GetMissingTranslations(tables)
+    missingCounts := make(map[string]int)
+    for _, missingTranslation := range missingTranslations {
+        for _, locale := range missingTranslation.MissingLocales {
+            missingCounts[locale]++
+        }
+        pageObject.MissingTranslations = append(pageObject.MissingTranslations, AdminMissingTranslation{
+            StringKey: missingTranslation.StringKey,
+            MissingLocales: strings.Join(missingTranslation.MissingLocales, ", "),
+        })
+    }
+
+    for _, locale := range localization_service.GetSupportedLocales() {
+        pageObject.Locales = append(pageObject.Locales, AdminLocaleInfo{
+            Locale: locale,
+            StringCount: len(tables[locale].Strings),
+            MissingCount: missingCounts[locale],
+        })
+    }
+
+    templates, err := template.ParseGlob(config.GetSharedTemplateFilesPath() + "/admin_tool/*")
+    if err != nil {
+        logger.LogError("error parsing templates" +
+                        "|request url=" + request.URL.Path +
+                        "|error=" + err.Error())
+        httpResponseWriter.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+
+    err = templates.ExecuteTemplate(httpResponseWriter, "localization_overview_template.html", pageObject)
+    if err != nil {
+        logger.LogError("Error executing templates" +
+                        "|request url=" + request.URL.String() +
+                        "|error=" + err.Error())
+        httpResponseWriter.WriteHeader(http.StatusInternalServerError)
+    }
+}
+
+/**
+ * Handles: /admin/localization/exportCSV/<version> and /admin/localization/exportXLIFF/<version>/<locale>
+ */
+func showLocalizationExportPage(httpResponseWriter http.ResponseWriter, request *http.Request, adminPageObject AdminPageObject, asXLIFF bool) {
+    tokens := strings.Split(request.URL.Path, "/")
+    versionString := tokens[4]
+
+    version, err := core.GetAppVersionFromString(versionString)
+    if err != nil {
+        httpResponseWriter.WriteHeader(http.StatusNotFound)
+        return
+    }
+
+    tables, err := localization_service.GetStringTablesInVersion(version)
+    if err == nil {
+        var buffer bytes.Buffer
+        var downloadableFileName string
+        var contentType string
+
+        if asXLIFF {
+            locale := tokens[5]
+            err = localization_service.ExportStringTableToXLIFF(tables, locale, &buffer)
+            downloadableFileName = config.GetAppName() + ".strings-" + version.String() + "." + locale + ".xlf"
+            contentType = "application/x-xliff+xml"
+        } else {
+            err = localization_service.ExportStringTablesToCSV(tables, &buffer)
+            downloadableFileName = config.GetAppName() + ".strings-" + version.String() + ".csv"
+            contentType = "text/csv"
+        }
+
+        if err == nil {
+            httpResponseWriter.Header().Set("Content-Type", contentType)
+            httpResponseWriter.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", downloadableFileName))
+
+            http.ServeContent(httpResponseWriter, request, downloadableFileName, time.Now(), bytes.NewReader(buffer.Bytes()))
+            return
+        }
+    }
+
+    simpleMessagePageObject := AdminSimpleMessageObject{
+        AdminPageObject: adminPageObject,
+        SimpleMessage: "Error exporting strings for version: " + version.String(),
+        BackLinkHref: "/admin/localization/" + version.String(),
+    }
+    simpleMessagePageObject.HasError = true
+    simpleMessagePageObject.ErrorString = err.Error()
+
+    showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+}
+
+/**
+ * Handles: /admin/localization/import/<version>
+ * Replaces the string tables of the locales in the uploaded file (.csv with any locales, or .xlf / .xliff with one)
+ */
+func showLocalizationImportPage(httpResponseWriter http.ResponseWriter, request *http.Request, adminPageObject AdminPageObject) {
+    space := localization_service.GetMetadataSpace()
+
+    versionString := filepath.Base(request.URL.Path)
+    backLinkHref := "/admin/localization/" + versionString
+
+    if request.Method != http.MethodPost {
+        httpResponseWriter.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+
+    version, err := core.GetAppVersionFromString(versionString)
+    if err != nil {
+        httpResponseWriter.WriteHeader(http.StatusNotFound)
+        return
+    }
+    validVersion, err := metadata_service.Instance().IsVersionValid(version.String(), space)
+    if !validVersion {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Invalid version",
+            BackLinkHref: "/admin/localization",
+        }
+        simpleMessagePageObject.HasError = true
+        simpleMessagePageObject.ErrorString = err.Error()
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    metadataUpToDate := metadata_service.CheckIfMetadataUpToDate(space, request.Context())
+    if !metadataUpToDate {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Metadata not up to date. Please hit Refresh on the " + space.String() + " metadata page and try again.",
+            BackLinkHref: backLinkHref,
+        }
+        simpleMessagePageObject.HasError = true
+        simpleMessagePageObject.ErrorString = "stale metadata"
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    err = request.ParseMultipartForm(32 << 20)
+    if err != nil {
+        logger.LogError("error parsing request for importing strings" +
+                        "|error=" + err.Error())
+        httpResponseWriter.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+
+    uploadedFile, fileHeader, err := request.FormFile("stringsFile")
+    if err != nil {
+        logger.LogError("error getting file from request for importing strings" +
+                        "|error=" + err.Error())
+        httpResponseWriter.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+    defer func() {
+        err = uploadedFile.Close()
+    }()
+
+    var buffer bytes.Buffer
+    _, err = io.Copy(&buffer, uploadedFile)
+    if err != nil {
+        logger.LogError("error copying file contents from request for importing strings" +
+                        "|error=" + err.Error())
+        httpResponseWriter.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+
+    var tables []*localization_service.StringTable
+    switch strings.ToLower(filepath.Ext(fileHeader.Filename)) {
+    case ".xlf", ".xliff":
+        var table *localization_service.StringTable
+        table, err = localization_service.ImportStringTableFromXLIFF(&buffer)
+        if err == nil {
+            tables = append(tables, table)
+        }
+    default:
+        tables, err = localization_service.ImportStringTablesFromCSV(&buffer)
+    }
+    if err != nil {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Error reading strings from " + fileHeader.Filename,
+            BackLinkHref: backLinkHref,
+        }
+        simpleMessagePageObject.HasError = true
+        simpleMessagePageObject.ErrorString = err.Error()
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    defer metadata_service.ReleaseInstanceRW()
+    mds := metadata_service.InstanceRWAsUser(adminPageObject.LoggedInUser)
+
+    var messageExtras []string
+    for _, table := range tables {
+        err = mds.SetMetadataItem(table, version)
+        if err != nil {
+            simpleMessagePageObject := AdminSimpleMessageObject{
+                AdminPageObject: adminPageObject,
+                SimpleMessage: "Error saving strings for " + table.Locale,
+                MessageExtras: messageExtras,
+                BackLinkHref: backLinkHref,
+            }
+            simpleMessagePageObject.HasError = true
+            simpleMessagePageObject.ErrorString = err.Error()
+
+            showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+            return
+        }
+        messageExtras = append(messageExtras, "Saved " + strconv.Itoa(len(table.Strings)) + " strings for " + table.Locale)
+    }
+
+    err = metadata_service.MarkMetadataAsUpdated(space, request.Context())
+    if err != nil {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Error marking metadata as updated",
+            BackLinkHref: backLinkHref,
+        }
+        simpleMessagePageObject.HasError = true
+        simpleMessagePageObject.ErrorString = err.Error()
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+    metadata_service.RefreshLastUpdatedTimestamps()
+
+    logger.LogInfo("imported strings" +
+                   "|metadata space=" + space.String() +
+                   "|version=" + version.String() +
+                   "|file name=" + fileHeader.Filename +
+                   "|locale count=" + strconv.Itoa(len(tables)))
+
+    simpleMessagePageObject := AdminSimpleMessageObject{
+        AdminPageObject: adminPageObject,
+        SimpleMessage: "Imported strings into version: " + version.String(),
+        MessageExtras: messageExtras,
+        BackLinkHref: backLinkHref,
+    }
+
+    showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+}
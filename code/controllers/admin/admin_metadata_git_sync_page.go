@@ -0,0 +1,132 @@
+package admin
+
+import (
+    "github.com/spacetimi/timi_shared_server/code/core"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
+    "github.com/spacetimi/timi_shared_server/utils/logger"
+    "net/http"
+    "strings"
+)
+
+/**
+ * Handles: /admin/metadata/<space>/syncFromGit
+ * Creates a new version from the metadata files at a git ref (eg: a tag made by designers)
+ */
+func showMetadataSyncFromGitPage(httpResponseWriter http.ResponseWriter, request *http.Request, adminPageObject AdminPageObject, space metadata_typedefs.MetadataSpace) {
+
+    backLinkHref := "/admin/metadata/" + space.String()
+
+    metadataUpToDate := metadata_service.CheckIfMetadataUpToDate(space, request.Context())
+    if !metadataUpToDate {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Metadata not up to date. Please hit Refresh and try again.",
+            BackLinkHref: backLinkHref,
+        }
+        simpleMessagePageObject.HasError = true
+        simpleMessagePageObject.ErrorString = "stale metadata"
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    if !metadata_service.Instance().CanImportMetadataFromRef(space) {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Metadata source for " + space.String() + " is not a git repo",
+            BackLinkHref: backLinkHref,
+        }
+        simpleMessagePageObject.HasError = true
+        simpleMessagePageObject.ErrorString = "unsupported metadata source"
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    // Check post arguments
+    err := request.ParseForm()
+    if err != nil {
+        logger.LogError("error parsing form for metadata request" +
+                        "|request url=" + request.URL.Path +
+                        "|error=" + err.Error())
+        httpResponseWriter.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+
+    gitRef := strings.TrimSpace(request.Form.Get("gitRef"))
+    if gitRef == "" {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Please specify a git tag, branch or commit to sync from",
+            BackLinkHref: backLinkHref,
+        }
+        simpleMessagePageObject.HasError = true
+        simpleMessagePageObject.ErrorString = "missing git ref"
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    newVersionNumberString := request.Form.Get("newVersionNumberString")
+    newVersion, err := core.GetAppVersionFromString(newVersionNumberString)
+    if err != nil {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Error parsing new version number: " + newVersionNumberString,
+            BackLinkHref: backLinkHref,
+        }
+        simpleMessagePageObject.HasError = true
+        simpleMessagePageObject.ErrorString = err.Error()
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    isCurrent := request.Form.Get("newVersionIsCurrent") == "true"
+
+    defer metadata_service.ReleaseInstanceRW()
+    err = metadata_service.InstanceRWAsUser(adminPageObject.LoggedInUser).ImportMetadataVersionFromRef(gitRef, newVersion, space, isCurrent)
+
+    if err != nil {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Error syncing version " + newVersion.String() + " from git ref: " + gitRef,
+            BackLinkHref: backLinkHref,
+        }
+        simpleMessagePageObject.HasError = true
+        simpleMessagePageObject.ErrorString = err.Error()
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    err = metadata_service.MarkMetadataAsUpdated(space, request.Context())
+    if err != nil {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Error marking metadata as updated",
+            BackLinkHref: backLinkHref,
+        }
+        simpleMessagePageObject.HasError = true
+        simpleMessagePageObject.ErrorString = err.Error()
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+    metadata_service.RefreshLastUpdatedTimestamps()
+
+    logger.LogInfo("Synced metadata version from git" +
+                   "|metadata space=" + space.String() +
+                   "|git ref=" + gitRef +
+                   "|version=" + newVersion.String() +
+                   "|synced by=" + adminPageObject.LoggedInUser)
+
+    simpleMessagePageObject := AdminSimpleMessageObject{
+        AdminPageObject: adminPageObject,
+        SimpleMessage: "Successfully synced new version " + newVersion.String() + " from git ref: " + gitRef,
+        BackLinkHref: backLinkHref,
+    }
+
+    showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+}
@@ -0,0 +1,96 @@
+package admin
+
+import (
+    "github.com/spacetimi/timi_shared_server/code/core"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
+    "net/http"
+    "path/filepath"
+    "strconv"
+)
+
+/**
+ * Handles: /admin/metadata/<space>/upgradeIntegrity/<version>
+ * Moves the version's legacy md5 hashes to sha256, and re-signs its manifest
+ */
+func showMetadataUpgradeIntegrityPage(httpResponseWriter http.ResponseWriter, request *http.Request, adminPageObject AdminPageObject, space metadata_typedefs.MetadataSpace) {
+
+    versionString := filepath.Base(request.URL.Path)
+    backLinkHref := "/admin/metadata/" + space.String() + "/editVersion/" + versionString
+
+    if request.Method != http.MethodPost {
+        httpResponseWriter.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+
+    metadataUpToDate := metadata_service.CheckIfMetadataUpToDate(space, request.Context())
+    if !metadataUpToDate {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Metadata not up to date. Please hit Refresh and try again.",
+            BackLinkHref: backLinkHref,
+        }
+        simpleMessagePageObject.HasError = true
+        simpleMessagePageObject.ErrorString = "stale metadata"
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    version, err := core.GetAppVersionFromString(versionString)
+    if err != nil {
+        httpResponseWriter.WriteHeader(http.StatusNotFound)
+        return
+    }
+    validVersion, err := metadata_service.Instance().IsVersionValid(version.String(), space)
+    if !validVersion {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Invalid version",
+            BackLinkHref: "/admin/metadata/" + space.String(),
+        }
+        simpleMessagePageObject.HasError = true
+        simpleMessagePageObject.ErrorString = err.Error()
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    defer metadata_service.ReleaseInstanceRW()
+    upgradedCount, err := metadata_service.InstanceRWAsUser(adminPageObject.LoggedInUser).UpgradeMetadataManifestIntegrity(version, space)
+    if err != nil {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Error upgrading hashes for version: " + version.String(),
+            BackLinkHref: backLinkHref,
+        }
+        simpleMessagePageObject.HasError = true
+        simpleMessagePageObject.ErrorString = err.Error()
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    err = metadata_service.MarkMetadataAsUpdated(space, request.Context())
+    if err != nil {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Error marking metadata as updated",
+            BackLinkHref: backLinkHref,
+        }
+        simpleMessagePageObject.HasError = true
+        simpleMessagePageObject.ErrorString = err.Error()
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+    metadata_service.RefreshLastUpdatedTimestamps()
+
+    simpleMessagePageObject := AdminSimpleMessageObject{
+        AdminPageObject: adminPageObject,
+        SimpleMessage: "Upgraded " + strconv.Itoa(upgradedCount) + " hashes, and re-signed the manifest for version: " + version.String(),
+        BackLinkHref: backLinkHref,
+    }
+
+    showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+}
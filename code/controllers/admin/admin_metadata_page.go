@@ -3,7 +3,6 @@ package admin
 import (
     "archive/zip"
     "bytes"
-    "encoding/json"
     "errors"
     "fmt"
     "github.com/spacetimi/timi_shared_server/code/config"
@@ -43,29 +42,71 @@ const kMetadataRoute_AppRefresh = "METADATA_APP_REFRESH"
 const kMetadataRoute_SharedRefresh = "METADATA_SHARED_REFRESH"
 const kMetadataRoute_AppCreateNewVersion = "METADATA_APP_CREATE_NEW_VERSION"
 const kMetadataRoute_SharedCreateNewVersion = "METADATA_SHARED_CREATE_NEW_VERSION"
+const kMetadataRoute_AppViewOverride = "METADATA_APP_VIEW_OVERRIDE"
+const kMetadataRoute_SharedViewOverride = "METADATA_SHARED_VIEW_OVERRIDE"
+const kMetadataRoute_AppUploadOverride = "METADATA_APP_UPLOAD_OVERRIDE"
+const kMetadataRoute_SharedUploadOverride = "METADATA_SHARED_UPLOAD_OVERRIDE"
+const kMetadataRoute_AppRemoveOverride = "METADATA_APP_REMOVE_OVERRIDE"
+const kMetadataRoute_SharedRemoveOverride = "METADATA_SHARED_REMOVE_OVERRIDE"
+const kMetadataRoute_AppSchedules = "METADATA_APP_SCHEDULES"
+const kMetadataRoute_SharedSchedules = "METADATA_SHARED_SCHEDULES"
+const kMetadataRoute_AppEditSchedule = "METADATA_APP_EDIT_SCHEDULE"
+const kMetadataRoute_SharedEditSchedule = "METADATA_SHARED_EDIT_SCHEDULE"
+const kMetadataRoute_AppCancelSchedule = "METADATA_APP_CANCEL_SCHEDULE"
+const kMetadataRoute_SharedCancelSchedule = "METADATA_SHARED_CANCEL_SCHEDULE"
+const kMetadataRoute_AppSyncFromGit = "METADATA_APP_SYNC_FROM_GIT"
+const kMetadataRoute_SharedSyncFromGit = "METADATA_SHARED_SYNC_FROM_GIT"
+const kMetadataRoute_AppUpgradeIntegrity = "METADATA_APP_UPGRADE_INTEGRITY"
+const kMetadataRoute_SharedUpgradeIntegrity = "METADATA_SHARED_UPGRADE_INTEGRITY"
+const kMetadataRoute_AppDownloadCSV = "METADATA_APP_DOWNLOAD_CSV"
+const kMetadataRoute_SharedDownloadCSV = "METADATA_SHARED_DOWNLOAD_CSV"
+const kMetadataRoute_AppUploadCSV = "METADATA_APP_UPLOAD_CSV"
+const kMetadataRoute_SharedUploadCSV = "METADATA_SHARED_UPLOAD_CSV"
 
 var kAdminMetadataRoutes = map[string]string{
     "/admin/metadata$": kMetadataRoute_SelectSpace,
     "/admin/metadata/app$": kMetadataRoute_AppOverview,
     "/admin/metadata/app/setCurrentVersions$": kMetadataRoute_AppOverview,
-    "/admin/metadata/app/editVersion/[0-9]+\\.[0-9]+$": kMetadataRoute_AppEditVersion,
-    "/admin/metadata/app/view/[0-9]+\\.[0-9]+/.*$": kMetadataRoute_AppViewMetadata,
-    "/admin/metadata/app/download/[0-9]+\\.[0-9]+/.*$": kMetadataRoute_AppDownload,
-    "/admin/metadata/app/download_all/[0-9]+\\.[0-9]+$": kMetadataRoute_AppDownloadAll,
-    "/admin/metadata/app/upload/[0-9]+\\.[0-9]+/.*$": kMetadataRoute_AppUpload,
-    "/admin/metadata/app/upload_all/[0-9]+\\.[0-9]+$": kMetadataRoute_AppUploadAll,
+    "/admin/metadata/app/setVersionMappings$": kMetadataRoute_AppOverview,
+    "/admin/metadata/app/editVersion/" + core.AppVersionRegexPattern + "$": kMetadataRoute_AppEditVersion,
+    "/admin/metadata/app/view/" + core.AppVersionRegexPattern + "/.*$": kMetadataRoute_AppViewMetadata,
+    "/admin/metadata/app/download/" + core.AppVersionRegexPattern + "/.*$": kMetadataRoute_AppDownload,
+    "/admin/metadata/app/download_all/" + core.AppVersionRegexPattern + "$": kMetadataRoute_AppDownloadAll,
+    "/admin/metadata/app/download_csv/" + core.AppVersionRegexPattern + "/[^/]+$": kMetadataRoute_AppDownloadCSV,
+    "/admin/metadata/app/upload/" + core.AppVersionRegexPattern + "/.*$": kMetadataRoute_AppUpload,
+    "/admin/metadata/app/upload_all/" + core.AppVersionRegexPattern + "$": kMetadataRoute_AppUploadAll,
+    "/admin/metadata/app/upload_csv/" + core.AppVersionRegexPattern + "/[^/]+$": kMetadataRoute_AppUploadCSV,
     "/admin/metadata/app/refresh$": kMetadataRoute_AppRefresh,
     "/admin/metadata/app/createNewVersion$": kMetadataRoute_AppCreateNewVersion,
+    "/admin/metadata/app/viewOverride/" + core.AppVersionRegexPattern + "/[^/]+/[a-z]+$": kMetadataRoute_AppViewOverride,
+    "/admin/metadata/app/uploadOverride/" + core.AppVersionRegexPattern + "/[^/]+$": kMetadataRoute_AppUploadOverride,
+    "/admin/metadata/app/removeOverride/" + core.AppVersionRegexPattern + "/[^/]+/[a-z]+$": kMetadataRoute_AppRemoveOverride,
+    "/admin/metadata/app/schedules$": kMetadataRoute_AppSchedules,
+    "/admin/metadata/app/schedules/edit/[0-9]+$": kMetadataRoute_AppEditSchedule,
+    "/admin/metadata/app/schedules/cancel/[0-9]+$": kMetadataRoute_AppCancelSchedule,
+    "/admin/metadata/app/syncFromGit$": kMetadataRoute_AppSyncFromGit,
+    "/admin/metadata/app/upgradeIntegrity/" + core.AppVersionRegexPattern + "$": kMetadataRoute_AppUpgradeIntegrity,
     "/admin/metadata/shared$": kMetadataRoute_SharedOverview,
     "/admin/metadata/shared/setCurrentVersions$": kMetadataRoute_SharedOverview,
-    "/admin/metadata/shared/editVersion/[0-9]+\\.[0-9]+$": kMetadataRoute_SharedEditVersion,
-    "/admin/metadata/shared/view/[0-9]+\\.[0-9]+/.*$": kMetadataRoute_SharedViewMetadata,
-    "/admin/metadata/shared/download/[0-9]+\\.[0-9]+/.*$": kMetadataRoute_SharedDownload,
-    "/admin/metadata/shared/download_all/[0-9]+\\.[0-9]+$": kMetadataRoute_SharedDownloadAll,
-    "/admin/metadata/shared/upload/[0-9]+\\.[0-9]+/.*$": kMetadataRoute_SharedUpload,
-    "/admin/metadata/shared/upload_all/[0-9]+\\.[0-9]+$": kMetadataRoute_SharedUploadAll,
+    "/admin/metadata/shared/setVersionMappings$": kMetadataRoute_SharedOverview,
+    "/admin/metadata/shared/editVersion/" + core.AppVersionRegexPattern + "$": kMetadataRoute_SharedEditVersion,
+    "/admin/metadata/shared/view/" + core.AppVersionRegexPattern + "/.*$": kMetadataRoute_SharedViewMetadata,
+    "/admin/metadata/shared/download/" + core.AppVersionRegexPattern + "/.*$": kMetadataRoute_SharedDownload,
+    "/admin/metadata/shared/download_all/" + core.AppVersionRegexPattern + "$": kMetadataRoute_SharedDownloadAll,
+    "/admin/metadata/shared/download_csv/" + core.AppVersionRegexPattern + "/[^/]+$": kMetadataRoute_SharedDownloadCSV,
+    "/admin/metadata/shared/upload/" + core.AppVersionRegexPattern + "/.*$": kMetadataRoute_SharedUpload,
+    "/admin/metadata/shared/upload_all/" + core.AppVersionRegexPattern + "$": kMetadataRoute_SharedUploadAll,
+    "/admin/metadata/shared/upload_csv/" + core.AppVersionRegexPattern + "/[^/]+$": kMetadataRoute_SharedUploadCSV,
     "/admin/metadata/shared/refresh$": kMetadataRoute_SharedRefresh,
     "/admin/metadata/shared/createNewVersion$": kMetadataRoute_SharedCreateNewVersion,
+    "/admin/metadata/shared/viewOverride/" + core.AppVersionRegexPattern + "/[^/]+/[a-z]+$": kMetadataRoute_SharedViewOverride,
+    "/admin/metadata/shared/uploadOverride/" + core.AppVersionRegexPattern + "/[^/]+$": kMetadataRoute_SharedUploadOverride,
+    "/admin/metadata/shared/removeOverride/" + core.AppVersionRegexPattern + "/[^/]+/[a-z]+$": kMetadataRoute_SharedRemoveOverride,
+    "/admin/metadata/shared/schedules$": kMetadataRoute_SharedSchedules,
+    "/admin/metadata/shared/schedules/edit/[0-9]+$": kMetadataRoute_SharedEditSchedule,
+    "/admin/metadata/shared/schedules/cancel/[0-9]+$": kMetadataRoute_SharedCancelSchedule,
+    "/admin/metadata/shared/syncFromGit$": kMetadataRoute_SharedSyncFromGit,
+    "/admin/metadata/shared/upgradeIntegrity/" + core.AppVersionRegexPattern + "$": kMetadataRoute_SharedUpgradeIntegrity,
 }
 
 var kAdminMetadataRouteRegexToRouteName map[*regexp.Regexp]string
@@ -129,6 +170,14 @@ func showAdminMetadataPage(httpResponseWriter http.ResponseWriter, request *http
         showMetadataUploadAllPage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_APP)
         return
 
+    case kMetadataRoute_AppDownloadCSV:
+        showMetadataDownloadCSVPage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_APP)
+        return
+
+    case kMetadataRoute_AppUploadCSV:
+        showMetadataUploadCSVPage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_APP)
+        return
+
     case kMetadataRoute_AppRefresh:
         refreshMetadata(httpResponseWriter, request, metadata_typedefs.METADATA_SPACE_APP)
         return
@@ -137,6 +186,38 @@ func showAdminMetadataPage(httpResponseWriter http.ResponseWriter, request *http
         showMetadataCreateNewVersionPage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_APP)
         return
 
+    case kMetadataRoute_AppViewOverride:
+        showMetadataViewPlatformOverridePage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_APP)
+        return
+
+    case kMetadataRoute_AppUploadOverride:
+        showMetadataUploadPlatformOverridePage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_APP)
+        return
+
+    case kMetadataRoute_AppRemoveOverride:
+        showMetadataRemovePlatformOverridePage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_APP)
+        return
+
+    case kMetadataRoute_AppSchedules:
+        showMetadataSchedulesPage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_APP)
+        return
+
+    case kMetadataRoute_AppEditSchedule:
+        showMetadataEditSchedulePage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_APP)
+        return
+
+    case kMetadataRoute_AppCancelSchedule:
+        showMetadataCancelSchedulePage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_APP)
+        return
+
+    case kMetadataRoute_AppSyncFromGit:
+        showMetadataSyncFromGitPage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_APP)
+        return
+
+    case kMetadataRoute_AppUpgradeIntegrity:
+        showMetadataUpgradeIntegrityPage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_APP)
+        return
+
     case kMetadataRoute_SharedOverview:
         showMetadataOverviewPage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_SHARED)
         return
@@ -165,6 +246,14 @@ func showAdminMetadataPage(httpResponseWriter http.ResponseWriter, request *http
         showMetadataUploadAllPage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_SHARED)
         return
 
+    case kMetadataRoute_SharedDownloadCSV:
+        showMetadataDownloadCSVPage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_SHARED)
+        return
+
+    case kMetadataRoute_SharedUploadCSV:
+        showMetadataUploadCSVPage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_SHARED)
+        return
+
     case kMetadataRoute_SharedRefresh:
         refreshMetadata(httpResponseWriter, request, metadata_typedefs.METADATA_SPACE_SHARED)
         return
@@ -173,6 +262,38 @@ func showAdminMetadataPage(httpResponseWriter http.ResponseWriter, request *http
         showMetadataCreateNewVersionPage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_SHARED)
         return
 
+    case kMetadataRoute_SharedViewOverride:
+        showMetadataViewPlatformOverridePage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_SHARED)
+        return
+
+    case kMetadataRoute_SharedUploadOverride:
+        showMetadataUploadPlatformOverridePage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_SHARED)
+        return
+
+    case kMetadataRoute_SharedRemoveOverride:
+        showMetadataRemovePlatformOverridePage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_SHARED)
+        return
+
+    case kMetadataRoute_SharedSchedules:
+        showMetadataSchedulesPage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_SHARED)
+        return
+
+    case kMetadataRoute_SharedEditSchedule:
+        showMetadataEditSchedulePage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_SHARED)
+        return
+
+    case kMetadataRoute_SharedCancelSchedule:
+        showMetadataCancelSchedulePage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_SHARED)
+        return
+
+    case kMetadataRoute_SharedSyncFromGit:
+        showMetadataSyncFromGitPage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_SHARED)
+        return
+
+    case kMetadataRoute_SharedUpgradeIntegrity:
+        showMetadataUpgradeIntegrityPage(httpResponseWriter, request, adminPageObject, metadata_typedefs.METADATA_SPACE_SHARED)
+        return
+
     default:
         logger.LogWarning("Unknown metadata route request|request url=" + request.URL.Path)
     }
@@ -210,15 +331,22 @@ func showMetadataOverviewPage(httpResponseWriter http.ResponseWriter, request *h
     allVersions := metadata_service.Instance().GetAllVersions(space)
     allVersionsSorted := make([]string, len(allVersions))
     copy(allVersionsSorted, allVersions)
-    sort.Strings(allVersionsSorted)
-    sort.Sort(sort.Reverse(sort.StringSlice(allVersionsSorted)))
+    sortVersionStringsDescending(allVersionsSorted)
+
+    var versionMappings []string
+    for _, mapping := range metadata_service.Instance().GetVersionMappings(space) {
+        versionMappings = append(versionMappings, mapping.String())
+    }
 
     pageObject.MetadataInfo = MetadataInfo {
         Space: space.String(),
         CurrentVersions: metadata_service.Instance().GetCurrentVersions(space),
         CurrentVersionsCSV: strings.Join(metadata_service.Instance().GetCurrentVersions(space), ","),
         AllVersions: allVersionsSorted,
+        VersionMappings: versionMappings,
+        VersionMappingsText: strings.Join(versionMappings, "\n"),
         IsUpToDate: metadata_service.CheckIfMetadataUpToDate(space, request.Context()),
+        CanSyncFromGit: metadata_service.Instance().CanImportMetadataFromRef(space),
     }
 
     // Check post arguments
@@ -243,7 +371,7 @@ func showMetadataOverviewPage(httpResponseWriter http.ResponseWriter, request *h
             pageObject.ErrorString = "stale metadata for space: " + space.String()
 
         } else {
-            err := updateNewCurrentVersions(space, newCurrentVersionsCSV, request.Context())
+            err := updateNewCurrentVersions(space, newCurrentVersionsCSV, adminPageObject.LoggedInUser, request.Context())
             messageToShow = "Successfully updated current versions."
             if err != nil {
                 messageToShow = "Something went wrong updating current versions."
@@ -262,6 +390,36 @@ func showMetadataOverviewPage(httpResponseWriter http.ResponseWriter, request *h
         return
     }
 
+    // If new version mappings are sent (possibly empty, to clear them), try to update and redirect to show success / failure
+    if request.Form.Get("setVersionMappings") == "true" {
+        var messageToShow string
+
+        metadataUpToDate := metadata_service.CheckIfMetadataUpToDate(space, request.Context())
+        if !metadataUpToDate {
+            messageToShow = "Metadata not up to date. Please hit Refresh and try again."
+            pageObject.HasError = true
+            pageObject.ErrorString = "stale metadata for space: " + space.String()
+
+        } else {
+            err := updateVersionMappings(space, request.Form.Get("versionMappingsText"), adminPageObject.LoggedInUser, request.Context())
+            messageToShow = "Successfully updated version mappings."
+            if err != nil {
+                messageToShow = "Something went wrong updating version mappings."
+                pageObject.HasError = true
+                pageObject.ErrorString = err.Error()
+            }
+        }
+
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: pageObject.AdminPageObject,
+            SimpleMessage: messageToShow,
+            BackLinkHref: "/admin/metadata/" + space.String(),
+        }
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
     templates, err := template.ParseGlob(config.GetSharedTemplateFilesPath() + "/admin_tool/*")
     if err != nil {
         logger.LogError("error parsing templates" +
@@ -281,11 +439,22 @@ func showMetadataOverviewPage(httpResponseWriter http.ResponseWriter, request *h
     }
 }
 
-func updateNewCurrentVersions(space metadata_typedefs.MetadataSpace, newCurrentVersionsCSV string, ctx context.Context) error {
+func sortVersionStringsDescending(versionStrings []string) {
+    sort.SliceStable(versionStrings, func(i, j int) bool {
+        a, errA := core.GetAppVersionFromString(versionStrings[i])
+        b, errB := core.GetAppVersionFromString(versionStrings[j])
+        if errA != nil || errB != nil {
+            return versionStrings[i] > versionStrings[j]
+        }
+        return a.Compare(b) > 0
+    })
+}
+
+func updateNewCurrentVersions(space metadata_typedefs.MetadataSpace, newCurrentVersionsCSV string, username string, ctx context.Context) error {
     newCurrentVersions := strings.Split(strings.Replace(newCurrentVersionsCSV, " ", "", -1), ",")
 
     defer metadata_service.ReleaseInstanceRW()
-    err := metadata_service.InstanceRW().SetCurrentVersions(newCurrentVersions, space)
+    err := metadata_service.InstanceRWAsUser(username).SetCurrentVersions(newCurrentVersions, space)
     if err != nil {
         return err
     }
@@ -302,6 +471,61 @@ func updateNewCurrentVersions(space metadata_typedefs.MetadataSpace, newCurrentV
     return nil
 }
 
+/**
+ * Version mappings are entered one per line (or comma separated) as:
+ *   MIN_APP_VERSION..MAX_APP_VERSION=METADATA_VERSION
+ *   APP_VERSION=METADATA_VERSION
+ */
+func updateVersionMappings(space metadata_typedefs.MetadataSpace, versionMappingsText string, username string, ctx context.Context) error {
+    var mappings []*metadata_typedefs.MetadataVersionMapping
+
+    lines := strings.FieldsFunc(versionMappingsText, func(r rune) bool {
+        return r == '\n' || r == '\r' || r == ','
+    })
+    for _, line := range lines {
+        line = strings.Replace(line, " ", "", -1)
+        if line == "" {
+            continue
+        }
+
+        tokens := strings.Split(line, "=")
+        if len(tokens) != 2 {
+            return errors.New("malformed version mapping: " + line)
+        }
+
+        appVersionRange := strings.Split(tokens[0], "..")
+        mapping := &metadata_typedefs.MetadataVersionMapping{
+            MinAppVersion: appVersionRange[0],
+            MaxAppVersion: appVersionRange[0],
+            MetadataVersion: tokens[1],
+        }
+        if len(appVersionRange) == 2 {
+            mapping.MaxAppVersion = appVersionRange[1]
+        } else if len(appVersionRange) > 2 {
+            return errors.New("malformed app version range in version mapping: " + line)
+        }
+
+        mappings = append(mappings, mapping)
+    }
+
+    defer metadata_service.ReleaseInstanceRW()
+    err := metadata_service.InstanceRWAsUser(username).SetVersionMappings(mappings, space)
+    if err != nil {
+        return err
+    }
+
+    err = metadata_service.MarkMetadataAsUpdated(space, ctx)
+    if err != nil {
+        return errors.New("error marking metadata as updated: " + err.Error())
+    }
+    metadata_service.RefreshLastUpdatedTimestamps()
+
+    logger.LogInfo("Updated version mappings for metadata space: " + space.String() +
+                   " to: " + strings.Join(lines, ","))
+
+    return nil
+}
+
 func showMetadataCreateNewVersionPage(httpResponseWriter http.ResponseWriter, request *http.Request, adminPageObject AdminPageObject, space metadata_typedefs.MetadataSpace) {
 
     metadataUpToDate := metadata_service.CheckIfMetadataUpToDate(space, request.Context())
@@ -346,7 +570,7 @@ func showMetadataCreateNewVersionPage(httpResponseWriter http.ResponseWriter, re
     isCurrent := request.Form.Get("newVersionIsCurrent") == "true"
 
     defer metadata_service.ReleaseInstanceRW()
-    err = metadata_service.InstanceRW().CreateNewVersion(newVersion, space, isCurrent)
+    err = metadata_service.InstanceRWAsUser(adminPageObject.LoggedInUser).CreateNewVersion(newVersion, space, isCurrent)
 
     if err != nil {
         simpleMessagePageObject := AdminSimpleMessageObject{
@@ -431,6 +655,9 @@ func showMetadataEditVersionPage(httpResponseWriter http.ResponseWriter, request
 
 
     pageObject.Version = version.String()
+    for _, platform := range metadata_typedefs.AllMetadataPlatforms {
+        pageObject.Platforms = append(pageObject.Platforms, platform.String())
+    }
 
     metadataUpToDate := metadata_service.CheckIfMetadataUpToDate(space, request.Context())
     if !metadataUpToDate {
@@ -444,28 +671,7 @@ func showMetadataEditVersionPage(httpResponseWriter http.ResponseWriter, request
         return
     }
 
-    metadataFactories := metadata_factory.GetRegisteredFactories()
-    for _, metadataFactory := range metadataFactories {
-        metadataItem := metadataFactory.Instantiate()
-        metadataManifestItem, err := metadata_service.Instance().GetMetadataManifestItemInVersion(metadataItem.GetKey(), version, space)
-        if err != nil || metadataManifestItem == nil {
-            pageObject.Items = append(pageObject.Items, AdminMetadataItem{
-                Key:metadataItem.GetKey(),
-                Hash:"",
-                Defined:false,
-            })
-        } else {
-            pageObject.Items = append(pageObject.Items, AdminMetadataItem{
-                Key:metadataManifestItem.MetadataKey,
-                Hash:metadataManifestItem.Hash,
-                Defined:true,
-            })
-        }
-    }
-
-    sort.Slice(pageObject.Items, func(i, j int) bool {
-        return pageObject.Items[i].Key < pageObject.Items[j].Key
-    })
+    pageObject.Items, pageObject.HasLegacyHashes = getAdminMetadataItemsInVersion(version, space)
 
     templates, err := template.ParseGlob(config.GetSharedTemplateFilesPath() + "/admin_tool/*")
     if err != nil {
@@ -488,6 +694,55 @@ func showMetadataEditVersionPage(httpResponseWriter http.ResponseWriter, request
     return
 }
 
+/**
+ * Every registered metadata item, and whether (and how) it is defined in the version
+ */
+func getAdminMetadataItemsInVersion(version *core.AppVersion, space metadata_typedefs.MetadataSpace) ([]AdminMetadataItem, bool) {
+    var items []AdminMetadataItem
+    hasLegacyHashes := false
+
+    metadataFactories := metadata_factory.GetRegisteredFactories()
+    for _, metadataFactory := range metadataFactories {
+        metadataItem := metadataFactory.Instantiate()
+        metadataManifestItem, err := metadata_service.Instance().GetMetadataManifestItemInVersion(metadataItem.GetKey(), version, space)
+        if err != nil || metadataManifestItem == nil {
+            items = append(items, AdminMetadataItem{
+                Key:metadataItem.GetKey(),
+                Hash:"",
+                Defined:false,
+                IsTabular:metadata_factory.GetTabularMapping(metadataItem.GetKey()) != nil,
+            })
+        } else {
+            if metadata_typedefs.IsLegacyMetadataHash(metadataManifestItem.Hash) {
+                hasLegacyHashes = true
+            }
+
+            var platformOverrides []string
+            for platformString, overrideHash := range metadataManifestItem.PlatformOverrides {
+                platformOverrides = append(platformOverrides, platformString)
+                if metadata_typedefs.IsLegacyMetadataHash(overrideHash) {
+                    hasLegacyHashes = true
+                }
+            }
+            sort.Strings(platformOverrides)
+
+            items = append(items, AdminMetadataItem{
+                Key:metadataManifestItem.MetadataKey,
+                Hash:metadataManifestItem.Hash,
+                Defined:true,
+                PlatformOverrides:platformOverrides,
+                IsTabular:metadata_factory.GetTabularMapping(metadataManifestItem.MetadataKey) != nil,
+            })
+        }
+    }
+
+    sort.Slice(items, func(i, j int) bool {
+        return items[i].Key < items[j].Key
+    })
+
+    return items, hasLegacyHashes
+}
+
 func showMetadataViewOrDownloadPage(httpResponseWriter http.ResponseWriter, request *http.Request, adminPageObject AdminPageObject, space metadata_typedefs.MetadataSpace, viewOnly bool) {
 
     // Parse url for editing version and metadata item key
@@ -629,6 +884,25 @@ func showMetadataDownloadAllPage(httpResponseWriter http.ResponseWriter, request
                                           ". Error: " + err.Error())
             continue
         }
+
+        // Tabular items also get a csv alongside, for editing in spreadsheets
+        mapping := metadata_factory.GetTabularMapping(manifestItem.MetadataKey)
+        if mapping != nil {
+            var csvBuffer bytes.Buffer
+            err = metadata_typedefs.ConvertMetadataJsonToCSV(metadataItemJson, mapping, &csvBuffer)
+            if err == nil {
+                fileWriter, err = zipWriter.Create(manifestItem.MetadataKey + ".csv")
+            }
+            if err == nil {
+                _, err = fileWriter.Write(csvBuffer.Bytes())
+            }
+            if err != nil {
+                hasError = true
+                errorList = append(errorList, "error adding csv to zip archive for metadata item key: " + manifestItem.MetadataKey +
+                                              ". Error: " + err.Error())
+                continue
+            }
+        }
     }
 
     err = zipWriter.Close()
@@ -763,7 +1037,7 @@ func showMetadataUploadPage(httpResponseWriter http.ResponseWriter, request *htt
         return
     }
 
-    err = json.Unmarshal([]byte(fileContents), metadataItem)
+    err = metadata_typedefs.UnmarshalAndValidateMetadataItem([]byte(fileContents), metadataItem)
     if err != nil {
         simpleMessagePageObject := AdminSimpleMessageObject{
             AdminPageObject: adminPageObject,
@@ -777,7 +1051,7 @@ func showMetadataUploadPage(httpResponseWriter http.ResponseWriter, request *htt
     }
 
     defer metadata_service.ReleaseInstanceRW()
-    err = metadata_service.InstanceRW().SetMetadataItem(metadataItem, version)
+    err = metadata_service.InstanceRWAsUser(adminPageObject.LoggedInUser).SetMetadataItem(metadataItem, version)
     if err != nil {
         simpleMessagePageObject := AdminSimpleMessageObject{
             AdminPageObject: adminPageObject,
@@ -907,6 +1181,21 @@ func showMetadataUploadAllPage(httpResponseWriter http.ResponseWriter, request *
         }
         fileContents := buffer.String()
 
+        // Tabular items can be uploaded as csv
+        if strings.ToLower(path.Ext(fileHeader.Filename)) == ".csv" {
+            metadataItem, csvErrors := getMetadataItemFromCSV(metadataItemKey, buffer.Bytes(), version, space)
+            if len(csvErrors) != 0 {
+                hasErrors = true
+                for _, csvError := range csvErrors {
+                    errorList = append(errorList, fileHeader.Filename + ": " + csvError)
+                }
+                continue
+            }
+            metadataItems = append(metadataItems, metadataItem)
+            _ = file.Close()
+            continue
+        }
+
         metadataItem, err := metadata_factory.InstantiateMetadataItem(metadataItemKey)
         if err != nil {
             hasErrors = true
@@ -923,7 +1212,7 @@ func showMetadataUploadAllPage(httpResponseWriter http.ResponseWriter, request *
             continue
         }
 
-        err = json.Unmarshal([]byte(fileContents), metadataItem)
+        err = metadata_typedefs.UnmarshalAndValidateMetadataItem([]byte(fileContents), metadataItem)
         if err != nil {
             hasErrors = true
             errorList = append(errorList, "error deserializing metadata item for key: " + metadataItemKey +
@@ -966,7 +1255,7 @@ func showMetadataUploadAllPage(httpResponseWriter http.ResponseWriter, request *
     var metadataItemKeys []string
 
     defer metadata_service.ReleaseInstanceRW()
-    metadataServiceInstance := metadata_service.InstanceRW()
+    metadataServiceInstance := metadata_service.InstanceRWAsUser(adminPageObject.LoggedInUser)
     for _, metadataItem := range metadataItems {
         err = metadataServiceInstance.SetMetadataItem(metadataItem, version)
         if err != nil {
@@ -0,0 +1,322 @@
+package admin
+
+import (
+    "bytes"
+    "fmt"
+    "github.com/spacetimi/timi_shared_server/code/core"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_factory"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
+    "github.com/spacetimi/timi_shared_server/utils/json_utils"
+    "github.com/spacetimi/timi_shared_server/utils/logger"
+    "io"
+    "net/http"
+    "strings"
+)
+
+/**
+ * Handles: /admin/metadata/<space>/viewOverride/<version>/<metadata item key>/<platform>
+ */
+func showMetadataViewPlatformOverridePage(httpResponseWriter http.ResponseWriter, request *http.Request, adminPageObject AdminPageObject, space metadata_typedefs.MetadataSpace) {
+
+    tokens := strings.Split(request.URL.Path, "/")
+    if len(tokens) < 3 {
+        logger.LogError("malformed request url in metadata view override request" +
+                        "|request url=" + request.URL.Path)
+        httpResponseWriter.WriteHeader(http.StatusNotFound)
+        return
+    }
+    platformString := tokens[len(tokens) - 1]
+    metadataItemKey := tokens[len(tokens) - 2]
+    versionString := tokens[len(tokens) - 3]
+
+    version, platform, ok := parseVersionAndPlatformForOverridePage(httpResponseWriter, request, adminPageObject, space, versionString, platformString)
+    if !ok {
+        return
+    }
+
+    content, err := metadata_service.Instance().GetMetadataItemRawContent(metadata_typedefs.GetPlatformOverrideKey(metadataItemKey, platform), version, space)
+    if err != nil {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Failed to fetch metadata platform override: " + err.Error(),
+            BackLinkHref: "/admin/metadata/" + space.String() + "/editVersion/" + version.String(),
+        }
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    _, err = fmt.Fprintln(httpResponseWriter, content)
+    if err != nil {
+        logger.LogError("error writing metadata platform override json" +
+                        "|metadata item key=" + metadataItemKey +
+                        "|platform=" + platform.String() +
+                        "|error=" + err.Error())
+        httpResponseWriter.WriteHeader(http.StatusInternalServerError)
+    }
+}
+
+/**
+ * Handles: /admin/metadata/<space>/uploadOverride/<version>/<metadata item key>
+ * The platform is sent as a form value
+ */
+func showMetadataUploadPlatformOverridePage(httpResponseWriter http.ResponseWriter, request *http.Request, adminPageObject AdminPageObject, space metadata_typedefs.MetadataSpace) {
+
+    tokens := strings.Split(request.URL.Path, "/")
+    if len(tokens) < 2 {
+        logger.LogError("malformed request url in metadata upload override request" +
+                        "|request url=" + request.URL.Path)
+        httpResponseWriter.WriteHeader(http.StatusNotFound)
+        return
+    }
+    metadataItemKey := tokens[len(tokens) - 1]
+    versionString := tokens[len(tokens) - 2]
+
+    err := request.ParseMultipartForm(32 << 20)
+    if err != nil {
+        logger.LogError("error parsing request for uploading metadata platform override" +
+                        "|metadata item key=" + metadataItemKey +
+                        "|error=" + err.Error())
+        httpResponseWriter.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+
+    version, platform, ok := parseVersionAndPlatformForOverridePage(httpResponseWriter, request, adminPageObject, space, versionString, request.Form.Get("platform"))
+    if !ok {
+        return
+    }
+
+    backLinkHref := "/admin/metadata/" + space.String() + "/editVersion/" + version.String()
+
+    metadataUpToDate := metadata_service.CheckIfMetadataUpToDate(space, request.Context())
+    if !metadataUpToDate {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Metadata not up to date. Please hit Refresh and try again.",
+            BackLinkHref: "/admin/metadata/" + space.String(),
+        }
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    var buffer bytes.Buffer
+    uploadedFile, _, err := request.FormFile(metadataItemKey)
+    if err != nil {
+        logger.LogError("error getting file from request for uploading metadata platform override" +
+                        "|metadata item key=" + metadataItemKey +
+                        "|error=" + err.Error())
+        httpResponseWriter.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+    defer func() {
+        err = uploadedFile.Close()
+    }()
+
+    _, err = io.Copy(&buffer, uploadedFile)
+    if err != nil {
+        logger.LogError("error copying file contents from request for uploading metadata platform override" +
+                        "|metadata item key=" + metadataItemKey +
+                        "|error=" + err.Error())
+        httpResponseWriter.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+    overrideJson := buffer.String()
+
+    // Make sure the base item with the override applied is still a valid metadata item
+    err = validatePlatformOverride(metadataItemKey, overrideJson, version, space)
+    if err != nil {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Invalid platform override for " + metadataItemKey + ". Error=" + err.Error(),
+            BackLinkHref: backLinkHref,
+        }
+        simpleMessagePageObject.HasError = true
+        simpleMessagePageObject.ErrorString = "invalid platform override"
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    defer metadata_service.ReleaseInstanceRW()
+    err = metadata_service.InstanceRWAsUser(adminPageObject.LoggedInUser).SetMetadataItemPlatformOverride(metadataItemKey, overrideJson, version, space, platform)
+    if err != nil {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Error saving platform override for " + metadataItemKey + ". Error=" + err.Error(),
+            BackLinkHref: backLinkHref,
+        }
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    err = metadata_service.MarkMetadataAsUpdated(space, request.Context())
+    if err != nil {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Error marking metadata as updated: " + err.Error(),
+            BackLinkHref: backLinkHref,
+        }
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+    metadata_service.RefreshLastUpdatedTimestamps()
+
+    logger.LogInfo("Updated metadata platform override" +
+                   "|metadata space=" + space.String() +
+                   "|version=" + version.String() +
+                   "|metadata item key=" + metadataItemKey +
+                   "|platform=" + platform.String())
+
+    simpleMessagePageObject := AdminSimpleMessageObject{
+        AdminPageObject: adminPageObject,
+        SimpleMessage: "Successfully saved " + platform.String() + " override for " + metadataItemKey,
+        BackLinkHref: backLinkHref,
+    }
+
+    showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+}
+
+/**
+ * Handles: /admin/metadata/<space>/removeOverride/<version>/<metadata item key>/<platform>
+ */
+func showMetadataRemovePlatformOverridePage(httpResponseWriter http.ResponseWriter, request *http.Request, adminPageObject AdminPageObject, space metadata_typedefs.MetadataSpace) {
+
+    tokens := strings.Split(request.URL.Path, "/")
+    if len(tokens) < 3 {
+        logger.LogError("malformed request url in metadata remove override request" +
+                        "|request url=" + request.URL.Path)
+        httpResponseWriter.WriteHeader(http.StatusNotFound)
+        return
+    }
+    platformString := tokens[len(tokens) - 1]
+    metadataItemKey := tokens[len(tokens) - 2]
+    versionString := tokens[len(tokens) - 3]
+
+    version, platform, ok := parseVersionAndPlatformForOverridePage(httpResponseWriter, request, adminPageObject, space, versionString, platformString)
+    if !ok {
+        return
+    }
+
+    backLinkHref := "/admin/metadata/" + space.String() + "/editVersion/" + version.String()
+
+    metadataUpToDate := metadata_service.CheckIfMetadataUpToDate(space, request.Context())
+    if !metadataUpToDate {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Metadata not up to date. Please hit Refresh and try again.",
+            BackLinkHref: "/admin/metadata/" + space.String(),
+        }
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    defer metadata_service.ReleaseInstanceRW()
+    err := metadata_service.InstanceRWAsUser(adminPageObject.LoggedInUser).RemoveMetadataItemPlatformOverride(metadataItemKey, version, space, platform)
+    if err != nil {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Error removing platform override for " + metadataItemKey + ". Error=" + err.Error(),
+            BackLinkHref: backLinkHref,
+        }
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    err = metadata_service.MarkMetadataAsUpdated(space, request.Context())
+    if err != nil {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Error marking metadata as updated: " + err.Error(),
+            BackLinkHref: backLinkHref,
+        }
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+    metadata_service.RefreshLastUpdatedTimestamps()
+
+    logger.LogInfo("Removed metadata platform override" +
+                   "|metadata space=" + space.String() +
+                   "|version=" + version.String() +
+                   "|metadata item key=" + metadataItemKey +
+                   "|platform=" + platform.String())
+
+    simpleMessagePageObject := AdminSimpleMessageObject{
+        AdminPageObject: adminPageObject,
+        SimpleMessage: "Successfully removed " + platform.String() + " override for " + metadataItemKey,
+        BackLinkHref: backLinkHref,
+    }
+
+    showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+}
+
+/**
+ * Shows an error page and returns false if the version or platform are invalid
+ */
+func parseVersionAndPlatformForOverridePage(httpResponseWriter http.ResponseWriter, request *http.Request, adminPageObject AdminPageObject, space metadata_typedefs.MetadataSpace, versionString string, platformString string) (*core.AppVersion, metadata_typedefs.MetadataPlatform, bool) {
+
+    version, err := core.GetAppVersionFromString(versionString)
+    if err != nil {
+        logger.LogError("error parsing version from url" +
+                        "|request url=" + request.URL.Path +
+                        "|error=" + err.Error())
+        httpResponseWriter.WriteHeader(http.StatusNotFound)
+        return nil, metadata_typedefs.METADATA_PLATFORM_NONE, false
+    }
+
+    validVersion, err := metadata_service.Instance().IsVersionValid(version.String(), space)
+    if !validVersion {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Invalid version: " + err.Error(),
+            BackLinkHref: "/admin/metadata/" + space.String(),
+        }
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return nil, metadata_typedefs.METADATA_PLATFORM_NONE, false
+    }
+
+    platform, err := metadata_typedefs.GetMetadataPlatformFromString(platformString)
+    if err != nil || platform == metadata_typedefs.METADATA_PLATFORM_NONE {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Invalid platform: " + platformString,
+            BackLinkHref: "/admin/metadata/" + space.String() + "/editVersion/" + version.String(),
+        }
+        simpleMessagePageObject.HasError = true
+        simpleMessagePageObject.ErrorString = "invalid platform"
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return nil, metadata_typedefs.METADATA_PLATFORM_NONE, false
+    }
+
+    return version, platform, true
+}
+
+func validatePlatformOverride(metadataItemKey string, overrideJson string, version *core.AppVersion, space metadata_typedefs.MetadataSpace) error {
+    metadataItem, err := metadata_factory.InstantiateMetadataItem(metadataItemKey)
+    if err != nil {
+        return err
+    }
+    if metadataItem.GetMetadataSpace() != space {
+        return fmt.Errorf("wrong metadata space (expected=%s, actual=%s)", space.String(), metadataItem.GetMetadataSpace().String())
+    }
+
+    baseJson, err := metadata_service.Instance().GetMetadataItemRawContent(metadataItemKey, version, space)
+    if err != nil {
+        return err
+    }
+
+    mergedJson, err := json_utils.ApplyMergePatch([]byte(baseJson), []byte(overrideJson))
+    if err != nil {
+        return err
+    }
+
+    return metadata_typedefs.UnmarshalAndValidateMetadataItem(mergedJson, metadataItem)
+}
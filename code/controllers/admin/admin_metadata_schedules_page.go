@@ -0,0 +1,311 @@
+package admin
+
+import (
+    "errors"
+    "github.com/spacetimi/timi_shared_server/code/config"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_factory"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
+    "github.com/spacetimi/timi_shared_server/utils/logger"
+    "html/template"
+    "net/http"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Format used by html datetime-local inputs. Schedule times are always entered and shown in UTC
+const kScheduleTimeFormat = "2006-01-02T15:04"
+
+/**
+ * Handles: /admin/metadata/<space>/schedules
+ * Lists all scheduled actions for the space, and creates new ones when posted to with createSchedule=true
+ */
+func showMetadataSchedulesPage(httpResponseWriter http.ResponseWriter, request *http.Request, adminPageObject AdminPageObject, space metadata_typedefs.MetadataSpace) {
+    pageObject := AdminMetadataSchedulesPageObject{}
+    pageObject.AdminPageObject = adminPageObject
+    pageObject.Space = space.String()
+
+    // Add links for back navigation
+    pageObject.NavBackLinks = append(pageObject.NavBackLinks,
+                                     NavBackLink{
+                                         LinkName: space.String(),
+                                         Href: "/admin/metadata/" + space.String(),
+                                     })
+    pageObject.NavBackLinks = append(pageObject.NavBackLinks,
+                                     NavBackLink{
+                                         LinkName: "schedules",
+                                         Href: "/admin/metadata/" + space.String() + "/schedules",
+                                     })
+
+    err := request.ParseForm()
+    if err != nil {
+        logger.LogError("error parsing form for metadata schedules request" +
+                        "|request url=" + request.URL.Path +
+                        "|error=" + err.Error())
+        httpResponseWriter.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+
+    if request.Form.Get("createSchedule") == "true" {
+        messageToShow := "Successfully scheduled action."
+
+        actionType, err := metadata_typedefs.GetScheduledMetadataActionTypeFromString(request.Form.Get("actionType"))
+        if err == nil {
+            action := &metadata_typedefs.ScheduledMetadataAction{
+                Space: space,
+                ActionType: actionType,
+                CreatedBy: adminPageObject.LoggedInUser,
+            }
+            err = parseScheduledMetadataActionForm(request, action)
+            if err == nil {
+                err = metadata_service.ScheduleMetadataAction(action, request.Context())
+            }
+        }
+        if err != nil {
+            messageToShow = "Something went wrong scheduling action."
+            pageObject.HasError = true
+            pageObject.ErrorString = err.Error()
+        }
+
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: pageObject.AdminPageObject,
+            SimpleMessage: messageToShow,
+            BackLinkHref: "/admin/metadata/" + space.String() + "/schedules",
+        }
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    actions, err := metadata_service.GetScheduledMetadataActions(space, request.Context())
+    if err != nil {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: pageObject.AdminPageObject,
+            SimpleMessage: "Error loading scheduled actions: " + err.Error(),
+            BackLinkHref: "/admin/metadata/" + space.String(),
+        }
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+    for _, action := range actions {
+        pageObject.Schedules = append(pageObject.Schedules, newAdminScheduledMetadataAction(action))
+    }
+
+    allVersions := metadata_service.Instance().GetAllVersions(space)
+    pageObject.AllVersions = make([]string, len(allVersions))
+    copy(pageObject.AllVersions, allVersions)
+    sortVersionStringsDescending(pageObject.AllVersions)
+
+    for _, metadataFactory := range metadata_factory.GetRegisteredFactories() {
+        metadataItem := metadataFactory.Instantiate()
+        if metadataItem.GetMetadataSpace() == space {
+            pageObject.MetadataKeys = append(pageObject.MetadataKeys, metadataItem.GetKey())
+        }
+    }
+    sort.Strings(pageObject.MetadataKeys)
+
+    templates, err := template.ParseGlob(config.GetSharedTemplateFilesPath() + "/admin_tool/*")
+    if err != nil {
+        logger.LogError("error parsing templates" +
+                        "|request url=" + request.URL.Path +
+                        "|error=" + err.Error())
+        httpResponseWriter.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+
+    err = templates.ExecuteTemplate(httpResponseWriter, "metadata_schedules_template.html", pageObject)
+    if err != nil {
+        logger.LogError("Error executing templates" +
+                        "|request url=" + request.URL.String() +
+                        "|error=" + err.Error())
+        httpResponseWriter.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+}
+
+/**
+ * Handles: /admin/metadata/<space>/schedules/edit/<schedule id>
+ * Shows the pending action for editing, and saves it when posted to with saveSchedule=true
+ */
+func showMetadataEditSchedulePage(httpResponseWriter http.ResponseWriter, request *http.Request, adminPageObject AdminPageObject, space metadata_typedefs.MetadataSpace) {
+    pageObject := AdminEditMetadataSchedulePageObject{}
+    pageObject.AdminPageObject = adminPageObject
+    pageObject.Space = space.String()
+
+    // Add links for back navigation
+    pageObject.NavBackLinks = append(pageObject.NavBackLinks,
+                                     NavBackLink{
+                                         LinkName: space.String(),
+                                         Href: "/admin/metadata/" + space.String(),
+                                     })
+    pageObject.NavBackLinks = append(pageObject.NavBackLinks,
+                                     NavBackLink{
+                                         LinkName: "schedules",
+                                         Href: "/admin/metadata/" + space.String() + "/schedules",
+                                     })
+
+    action, ok := loadScheduledMetadataActionFromUrl(httpResponseWriter, request, pageObject.AdminPageObject, space)
+    if !ok {
+        return
+    }
+
+    err := request.ParseForm()
+    if err != nil {
+        logger.LogError("error parsing form for metadata edit schedule request" +
+                        "|request url=" + request.URL.Path +
+                        "|error=" + err.Error())
+        httpResponseWriter.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+
+    if request.Form.Get("saveSchedule") == "true" {
+        messageToShow := "Successfully updated scheduled action."
+
+        err = parseScheduledMetadataActionForm(request, action)
+        if err == nil {
+            err = metadata_service.UpdateScheduledMetadataAction(action, request.Context())
+        }
+        if err != nil {
+            messageToShow = "Something went wrong updating scheduled action."
+            pageObject.HasError = true
+            pageObject.ErrorString = err.Error()
+        } else {
+            logger.LogInfo("scheduled metadata action edited" +
+                           "|schedule id=" + strconv.FormatInt(action.ScheduleId, 10) +
+                           "|edited by=" + adminPageObject.LoggedInUser)
+        }
+
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: pageObject.AdminPageObject,
+            SimpleMessage: messageToShow,
+            BackLinkHref: "/admin/metadata/" + space.String() + "/schedules",
+        }
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    pageObject.Schedule = newAdminScheduledMetadataAction(action)
+
+    templates, err := template.ParseGlob(config.GetSharedTemplateFilesPath() + "/admin_tool/*")
+    if err != nil {
+        logger.LogError("error parsing templates" +
+                        "|request url=" + request.URL.Path +
+                        "|error=" + err.Error())
+        httpResponseWriter.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+
+    err = templates.ExecuteTemplate(httpResponseWriter, "metadata_edit_schedule_template.html", pageObject)
+    if err != nil {
+        logger.LogError("Error executing templates" +
+                        "|request url=" + request.URL.String() +
+                        "|error=" + err.Error())
+        httpResponseWriter.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+}
+
+/**
+ * Handles: /admin/metadata/<space>/schedules/cancel/<schedule id>
+ */
+func showMetadataCancelSchedulePage(httpResponseWriter http.ResponseWriter, request *http.Request, adminPageObject AdminPageObject, space metadata_typedefs.MetadataSpace) {
+    action, ok := loadScheduledMetadataActionFromUrl(httpResponseWriter, request, adminPageObject, space)
+    if !ok {
+        return
+    }
+
+    messageToShow := "Successfully cancelled scheduled action: " + action.Description()
+    err := metadata_service.CancelScheduledMetadataAction(action.ScheduleId, adminPageObject.LoggedInUser, request.Context())
+    if err != nil {
+        messageToShow = "Something went wrong cancelling scheduled action."
+        adminPageObject.HasError = true
+        adminPageObject.ErrorString = err.Error()
+    }
+
+    simpleMessagePageObject := AdminSimpleMessageObject{
+        AdminPageObject: adminPageObject,
+        SimpleMessage: messageToShow,
+        BackLinkHref: "/admin/metadata/" + space.String() + "/schedules",
+    }
+
+    showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+}
+
+/**
+ * Shows an error page and returns false if the schedule id in the url is invalid or belongs to another space
+ */
+func loadScheduledMetadataActionFromUrl(httpResponseWriter http.ResponseWriter, request *http.Request, adminPageObject AdminPageObject, space metadata_typedefs.MetadataSpace) (*metadata_typedefs.ScheduledMetadataAction, bool) {
+    scheduleId, err := strconv.ParseInt(filepath.Base(request.URL.Path), 10, 64)
+    if err != nil {
+        logger.LogError("error parsing schedule id from url" +
+                        "|request url=" + request.URL.Path +
+                        "|error=" + err.Error())
+        httpResponseWriter.WriteHeader(http.StatusNotFound)
+        return nil, false
+    }
+
+    action, err := metadata_service.GetScheduledMetadataAction(scheduleId, request.Context())
+    if err == nil && action.Space != space {
+        err = errors.New("scheduled action belongs to metadata space: " + action.Space.String())
+    }
+    if err != nil {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Invalid scheduled action",
+            BackLinkHref: "/admin/metadata/" + space.String() + "/schedules",
+        }
+        simpleMessagePageObject.HasError = true
+        simpleMessagePageObject.ErrorString = err.Error()
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return nil, false
+    }
+
+    return action, true
+}
+
+/**
+ * Fills in the execution time and the fields used by the action's type from the posted form
+ */
+func parseScheduledMetadataActionForm(request *http.Request, action *metadata_typedefs.ScheduledMetadataAction) error {
+    executeAt, err := time.ParseInLocation(kScheduleTimeFormat, request.Form.Get("executeAt"), time.UTC)
+    if err != nil {
+        return errors.New("error parsing execution time: " + err.Error())
+    }
+    action.ExecuteAtUnix = executeAt.Unix()
+
+    switch action.ActionType {
+    case metadata_typedefs.SCHEDULED_ACTION_SET_CURRENT_VERSIONS:
+        currentVersionsCSV := strings.Replace(request.Form.Get("currentVersionsCSV"), " ", "", -1)
+        action.CurrentVersions = strings.Split(currentVersionsCSV, ",")
+
+    case metadata_typedefs.SCHEDULED_ACTION_PUBLISH_ITEM:
+        action.Version = strings.TrimSpace(request.Form.Get("version"))
+        action.MetadataKey = strings.TrimSpace(request.Form.Get("metadataKey"))
+        action.Content = request.Form.Get("content")
+    }
+
+    return nil
+}
+
+func newAdminScheduledMetadataAction(action *metadata_typedefs.ScheduledMetadataAction) AdminScheduledMetadataAction {
+    return AdminScheduledMetadataAction{
+        ScheduleId: action.ScheduleId,
+        ActionType: string(action.ActionType),
+        Description: action.Description(),
+        ExecuteAt: time.Unix(action.ExecuteAtUnix, 0).UTC().Format(kScheduleTimeFormat),
+        Status: string(action.Status),
+        IsPending: action.IsPending(),
+        CreatedBy: action.CreatedBy,
+        Error: action.Error,
+        CurrentVersionsCSV: strings.Join(action.CurrentVersions, ","),
+        Version: action.Version,
+        MetadataKey: action.MetadataKey,
+        Content: action.Content,
+    }
+}
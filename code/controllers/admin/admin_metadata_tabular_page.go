@@ -0,0 +1,260 @@
+package admin
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "github.com/spacetimi/timi_shared_server/code/core"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_factory"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
+    "github.com/spacetimi/timi_shared_server/utils/logger"
+    "io"
+    "net/http"
+    "strings"
+    "time"
+)
+
+/**
+ * Handles: /admin/metadata/<space>/download_csv/<version>/<metadata item key>
+ */
+func showMetadataDownloadCSVPage(httpResponseWriter http.ResponseWriter, request *http.Request, adminPageObject AdminPageObject, space metadata_typedefs.MetadataSpace) {
+
+    tokens := strings.Split(request.URL.Path, "/")
+    metadataItemKey := tokens[len(tokens) - 1]
+    versionString := tokens[len(tokens) - 2]
+    backLinkHref := "/admin/metadata/" + space.String() + "/editVersion/" + versionString
+
+    version, err := core.GetAppVersionFromString(versionString)
+    if err != nil {
+        httpResponseWriter.WriteHeader(http.StatusNotFound)
+        return
+    }
+
+    validVersion, err := metadata_service.Instance().IsVersionValid(version.String(), space)
+    if !validVersion {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Invalid version: " + err.Error(),
+            BackLinkHref: "/admin/metadata/" + space.String(),
+        }
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    csvContents, err := getMetadataItemAsCSV(metadataItemKey, version, space)
+    if err != nil {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Error exporting " + metadataItemKey + " as csv",
+            BackLinkHref: backLinkHref,
+        }
+        simpleMessagePageObject.HasError = true
+        simpleMessagePageObject.ErrorString = err.Error()
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    httpResponseWriter.Header().Set("Content-Type", "text/csv")
+    httpResponseWriter.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.csv\"", metadataItemKey))
+
+    http.ServeContent(httpResponseWriter, request, metadataItemKey + ".csv", time.Now(), bytes.NewReader(csvContents))
+}
+
+/**
+ * Handles: /admin/metadata/<space>/upload_csv/<version>/<metadata item key>
+ */
+func showMetadataUploadCSVPage(httpResponseWriter http.ResponseWriter, request *http.Request, adminPageObject AdminPageObject, space metadata_typedefs.MetadataSpace) {
+
+    tokens := strings.Split(request.URL.Path, "/")
+    metadataItemKey := tokens[len(tokens) - 1]
+    versionString := tokens[len(tokens) - 2]
+    backLinkHref := "/admin/metadata/" + space.String() + "/editVersion/" + versionString
+
+    if request.Method != http.MethodPost {
+        httpResponseWriter.WriteHeader(http.StatusMethodNotAllowed)
+        return
+    }
+
+    version, err := core.GetAppVersionFromString(versionString)
+    if err != nil {
+        httpResponseWriter.WriteHeader(http.StatusNotFound)
+        return
+    }
+
+    validVersion, err := metadata_service.Instance().IsVersionValid(version.String(), space)
+    if !validVersion {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Invalid version: " + err.Error(),
+            BackLinkHref: "/admin/metadata/" + space.String(),
+        }
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    metadataUpToDate := metadata_service.CheckIfMetadataUpToDate(space, request.Context())
+    if !metadataUpToDate {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Metadata not up to date. Please hit Refresh and try again.",
+            BackLinkHref: backLinkHref,
+        }
+        simpleMessagePageObject.HasError = true
+        simpleMessagePageObject.ErrorString = "stale metadata"
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    err = request.ParseMultipartForm(32 << 20)
+    if err != nil {
+        logger.LogError("error parsing request for uploading metadata item csv" +
+                        "|metadata item key=" + metadataItemKey +
+                        "|error=" + err.Error())
+        httpResponseWriter.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+
+    uploadedFile, _, err := request.FormFile(metadataItemKey)
+    if err != nil {
+        logger.LogError("error getting file from request for uploading metadata item csv" +
+                        "|metadata item key=" + metadataItemKey +
+                        "|error=" + err.Error())
+        httpResponseWriter.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+    defer func() {
+        err = uploadedFile.Close()
+    }()
+
+    var buffer bytes.Buffer
+    _, err = io.Copy(&buffer, uploadedFile)
+    if err != nil {
+        logger.LogError("error copying file contents from request for uploading metadata item csv" +
+                        "|metadata item key=" + metadataItemKey +
+                        "|error=" + err.Error())
+        httpResponseWriter.WriteHeader(http.StatusInternalServerError)
+        return
+    }
+
+    metadataItem, errorList := getMetadataItemFromCSV(metadataItemKey, buffer.Bytes(), version, space)
+    if len(errorList) != 0 {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Error importing csv for " + metadataItemKey,
+            BackLinkHref: backLinkHref,
+        }
+        simpleMessagePageObject.HasError = true
+        simpleMessagePageObject.ErrorString = "bad csv"
+        simpleMessagePageObject.MessageExtras = errorList
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    defer metadata_service.ReleaseInstanceRW()
+    err = metadata_service.InstanceRWAsUser(adminPageObject.LoggedInUser).SetMetadataItem(metadataItem, version)
+    if err != nil {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Error saving " + metadataItemKey,
+            BackLinkHref: backLinkHref,
+        }
+        simpleMessagePageObject.HasError = true
+        simpleMessagePageObject.ErrorString = err.Error()
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+
+    err = metadata_service.MarkMetadataAsUpdated(space, request.Context())
+    if err != nil {
+        simpleMessagePageObject := AdminSimpleMessageObject{
+            AdminPageObject: adminPageObject,
+            SimpleMessage: "Error marking metadata as updated",
+            BackLinkHref: backLinkHref,
+        }
+        simpleMessagePageObject.HasError = true
+        simpleMessagePageObject.ErrorString = err.Error()
+
+        showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+        return
+    }
+    metadata_service.RefreshLastUpdatedTimestamps()
+
+    logger.LogInfo("Updated metadata item from csv" +
+                   "|metadata space=" + space.String() +
+                   "|version=" + version.String() +
+                   "|metadata item key=" + metadataItemKey)
+
+    simpleMessagePageObject := AdminSimpleMessageObject{
+        AdminPageObject: adminPageObject,
+        SimpleMessage: "Successfully saved metadata for " + metadataItemKey + " from csv",
+        BackLinkHref: backLinkHref,
+    }
+
+    showSimpleMessagePage(httpResponseWriter, request, simpleMessagePageObject)
+}
+
+func getMetadataItemAsCSV(metadataItemKey string, version *core.AppVersion, space metadata_typedefs.MetadataSpace) ([]byte, error) {
+    mapping := metadata_factory.GetTabularMapping(metadataItemKey)
+    if mapping == nil {
+        return nil, errors.New(metadataItemKey + " is not a tabular metadata item")
+    }
+
+    content, err := metadata_service.Instance().GetMetadataItemRawContent(metadataItemKey, version, space)
+    if err != nil {
+        return nil, err
+    }
+
+    var buffer bytes.Buffer
+    err = metadata_typedefs.ConvertMetadataJsonToCSV(content, mapping, &buffer)
+    if err != nil {
+        return nil, err
+    }
+    return buffer.Bytes(), nil
+}
+
+/**
+ * Converts the csv into the metadata item (keeping whatever else the item's current content in the version has besides its records),
+ * and validates it. Returns the errors of every bad row
+ */
+func getMetadataItemFromCSV(metadataItemKey string, csvContents []byte, version *core.AppVersion, space metadata_typedefs.MetadataSpace) (metadata_typedefs.IMetadataItem, []string) {
+    mapping := metadata_factory.GetTabularMapping(metadataItemKey)
+    if mapping == nil {
+        return nil, []string{metadataItemKey + " is not a tabular metadata item"}
+    }
+
+    metadataItem, err := metadata_factory.InstantiateMetadataItem(metadataItemKey)
+    if err != nil {
+        return nil, []string{"error instantiating metadata item: " + err.Error()}
+    }
+    if space != metadataItem.GetMetadataSpace() {
+        return nil, []string{"wrong metadata space for " + metadataItemKey +
+                             " (expected=" + metadataItem.GetMetadataSpace().String() +
+                             ", got=" + space.String() + ")"}
+    }
+
+    // Items not defined in the version yet start out empty
+    baseJson, _ := metadata_service.Instance().GetMetadataItemRawContent(metadataItemKey, version, space)
+
+    metadataJson, rowErrors := metadata_typedefs.ConvertCSVToMetadataJson(bytes.NewReader(csvContents), mapping, baseJson)
+    if len(rowErrors) != 0 {
+        var errorList []string
+        for _, rowError := range rowErrors {
+            errorList = append(errorList, rowError.Error())
+        }
+        return nil, errorList
+    }
+
+    err = metadata_typedefs.UnmarshalAndValidateMetadataItem([]byte(metadataJson), metadataItem)
+    if err != nil {
+        return nil, []string{"error validating " + metadataItemKey + ": " + err.Error()}
+    }
+
+    return metadataItem, nil
+}
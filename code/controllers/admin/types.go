@@ -1,5 +1,11 @@
 package admin
 
+import (
+    "encoding/json"
+    "github.com/spacetimi/timi_shared_server/code/core/services/localization_service"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
+)
+
 type AdminPageObject struct {
     IsLoggedIn bool
     LoggedInUser string
@@ -28,6 +34,8 @@ type AdminEditMetadataPageObject struct {
     Space string
     Version string
     Items []AdminMetadataItem
+    Platforms []string
+    HasLegacyHashes bool
 }
 
 type MetadataInfo struct {
@@ -35,13 +43,68 @@ type MetadataInfo struct {
     CurrentVersions []string
     CurrentVersionsCSV string
     AllVersions []string
+    VersionMappings []string
+    VersionMappingsText string
     IsUpToDate bool
+    CanSyncFromGit bool
 }
 
 type AdminMetadataItem struct {
     Key string
     Hash string
     Defined bool
+    PlatformOverrides []string
+    IsTabular bool
+}
+
+type AdminMetadataSchedulesPageObject struct {
+    AdminPageObject
+    Space string
+    AllVersions []string
+    MetadataKeys []string
+    Schedules []AdminScheduledMetadataAction
+}
+
+type AdminEditMetadataSchedulePageObject struct {
+    AdminPageObject
+    Space string
+    Schedule AdminScheduledMetadataAction
+}
+
+type AdminScheduledMetadataAction struct {
+    ScheduleId int64
+    ActionType string
+    Description string
+    ExecuteAt string // UTC, in the format of html datetime-local inputs
+    Status string
+    IsPending bool
+    CreatedBy string
+    Error string
+    CurrentVersionsCSV string
+    Version string
+    MetadataKey string
+    Content string
+}
+
+type AdminLocalizationPageObject struct {
+    AdminPageObject
+    Space string
+    Version string
+    AllVersions []string
+    DefaultLocale string
+    Locales []AdminLocaleInfo
+    MissingTranslations []AdminMissingTranslation
+}
+
+type AdminLocaleInfo struct {
+    Locale string
+    StringCount int
+    MissingCount int
+}
+
+type AdminMissingTranslation struct {
+    StringKey string
+    MissingLocales string
 }
 
 type AdminSimpleMessageObject struct {
@@ -49,4 +112,78 @@ type AdminSimpleMessageObject struct {
     SimpleMessage string
     MessageExtras []string
     BackLinkHref string
-}
\ No newline at end of file
+}
+/********** Admin api **********/
+
+type AdminApiResponse struct {
+    Success bool
+    ErrorMessage string `json:",omitempty"`
+    Result interface{} `json:",omitempty"`
+}
+
+type AdminApiMetadataSpaceInfo struct {
+    Space string
+    AllVersions []string
+    CurrentVersions []string
+    VersionMappings []*metadata_typedefs.MetadataVersionMapping
+    IsUpToDate bool
+    CanSyncFromGit bool
+}
+
+type AdminApiMetadataVersionInfo struct {
+    Space string
+    Version string
+    Items []AdminMetadataItem
+    HasLegacyHashes bool
+}
+
+type AdminApiSetCurrentVersionsRequest struct {
+    CurrentVersions []string
+}
+
+type AdminApiSetVersionMappingsRequest struct {
+    VersionMappings []*metadata_typedefs.MetadataVersionMapping
+}
+
+type AdminApiCreateVersionRequest struct {
+    Version string
+    MarkAsCurrent bool
+    CloneFrom string
+}
+
+type AdminApiMetadataItems struct {
+    Items map[string]json.RawMessage
+}
+
+type AdminApiSyncFromGitRequest struct {
+    GitRef string
+    Version string
+    MarkAsCurrent bool
+}
+
+type AdminApiScheduleRequest struct {
+    ActionType string
+    ExecuteAtUnix int64
+    CurrentVersions []string
+    Version string
+    MetadataKey string
+    Content string
+}
+
+type AdminApiUpgradeIntegrityResult struct {
+    UpgradedCount int
+}
+
+type AdminApiLocalizationInfo struct {
+    Space string
+    Version string
+    DefaultLocale string
+    AllVersions []string
+    Locales []AdminLocaleInfo
+    MissingTranslations []*localization_service.MissingTranslation
+}
+
+type AdminApiLocalizationImportResult struct {
+    Version string
+    Locales []AdminLocaleInfo
+}
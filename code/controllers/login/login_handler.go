@@ -6,8 +6,6 @@ import (
     "github.com/spacetimi/timi_shared_server/code/config"
 	"github.com/spacetimi/timi_shared_server/code/controllers/shared_routes"
 	"github.com/spacetimi/timi_shared_server/code/core/controller"
-    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service"
-    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
     "github.com/spacetimi/timi_shared_server/utils/logger"
     "net/http"
 )
@@ -54,17 +52,8 @@ func processLoginRequest(request *http.Request) LoginResponse {
 
 	// TODO: krisa: Use Appversion in GetMetaDataItem()
 	// and also insert AppVersion and/or LoginRequest into the context from this point downward?
-
-	mdUpToDate, err := metadata_service.Instance().IsMetadataHashUpToDate("MetadataTest", "f5499079646c8e6a3fded46d2903516d", metadata_typedefs.METADATA_SPACE_APP, loginRequest.AppVersion)
-	if err != nil {
-		logger.LogError("failed to find if metadata up to date|error=" + err.Error())
-	}
-
-	if mdUpToDate {
-		logger.LogInfo("metadata up to date")
-	} else {
-		logger.LogInfo("metadata not up to date")
-	}
+	// Clients keep their metadata up to date through the shared_routes.MetadataSync endpoint
+	logger.LogInfo("login request|app version=" + loginRequest.AppVersion.String())
 
 	return LoginResponse{Success:true, ErrorMessage:"", Body:"Successfully logged in to App: " + config.GetAppName()}
 }
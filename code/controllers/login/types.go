@@ -4,8 +4,6 @@ import (
 	"encoding/json"
 	"errors"
 	"github.com/spacetimi/timi_shared_server/code/core"
-	"strconv"
-	"strings"
 )
 
 /****************************************/
@@ -15,34 +13,24 @@ type LoginRequestParams struct {
 	AppVersionString string
 }
 
-func (loginRequestParams *LoginRequestParams) parse() (int64, int64, int64, error) {
+func (loginRequestParams *LoginRequestParams) parse() (int64, *core.AppVersion, error) {
 	if loginRequestParams.DeviceUID <= 0 {
-		return 0, 0, 0, errors.New("No DeviceUID sent")
+		return 0, nil, errors.New("No DeviceUID sent")
 	}
 
 	if loginRequestParams.AppVersionString == "" {
-		return 0, 0, 0, errors.New("No AppVersion sent")
+		return 0, nil, errors.New("No AppVersion sent")
 	}
-	tokens := strings.Split(loginRequestParams.AppVersionString, ".")
-	if len(tokens) != 2 {
-		return 0, 0, 0, errors.New("Malformed AppVersion sent|appVersion=" + loginRequestParams.AppVersionString)
-	}
-	majorVersion, err := strconv.ParseInt(tokens[0], 10, 64)
-	if err != nil {
-		return 0, 0, 0, errors.New("Invalid major version|error=" + err.Error())
-	}
-	if majorVersion <= 0 {
-		return 0, 0, 0, errors.New("Invalid major version|appVersion=" + loginRequestParams.AppVersionString)
-	}
-	minorVersion, err := strconv.ParseInt(tokens[1], 10, 32)
+	appVersion, err := core.GetAppVersionFromString(loginRequestParams.AppVersionString)
 	if err != nil {
-		return 0, 0, 0, errors.New("Invalid minor version|error=" + err.Error())
+		return 0, nil, errors.New("Malformed AppVersion sent|appVersion=" + loginRequestParams.AppVersionString + "|error=" + err.Error())
 	}
-	if minorVersion < 0 {
-		return 0, 0, 0, errors.New("Invalid minor version|appVersion=" + loginRequestParams.AppVersionString)
+	// Released apps start at major version 1
+	if appVersion.MajorVersion <= 0 {
+		return 0, nil, errors.New("Invalid major version|appVersion=" + loginRequestParams.AppVersionString)
 	}
 
-	return loginRequestParams.DeviceUID, majorVersion, minorVersion, nil
+	return loginRequestParams.DeviceUID, appVersion, nil
 }
 
 /****************************************/
@@ -54,10 +42,9 @@ type LoginRequest struct {
 
 func NewLoginRequest(params *LoginRequestParams) (*LoginRequest, error) {
 	lr := LoginRequest{}
-	lr.AppVersion = &core.AppVersion{}
 
 	var err error
-	lr.DeviceUID, lr.AppVersion.MajorVersion, lr.AppVersion.MinorVersion, err = params.parse()
+	lr.DeviceUID, lr.AppVersion, err = params.parse()
 	if err != nil {
 		return nil, err
 	}
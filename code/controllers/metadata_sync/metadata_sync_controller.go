@@ -0,0 +1,14 @@
+package metadata_sync
+
+import (
+	"github.com/spacetimi/timi_shared_server/code/core/controller"
+)
+
+type MetadataSyncController struct { // Implements IAppController
+}
+
+func (msc *MetadataSyncController) RouteHandlers() []controller.IRouteHandler {
+	return []controller.IRouteHandler{
+		&MetadataSyncHandler{},
+	}
+}
@@ -0,0 +1,154 @@
+package metadata_sync
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/spacetimi/timi_shared_server/code/controllers/shared_routes"
+	"github.com/spacetimi/timi_shared_server/code/core"
+	"github.com/spacetimi/timi_shared_server/code/core/controller"
+	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service"
+	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
+	"github.com/spacetimi/timi_shared_server/utils/logger"
+)
+
+// Responses smaller than this are not worth compressing
+const kGzipMinResponseBytes = 1024
+
+type MetadataSyncHandler struct { // Implements IRouteHandler
+}
+
+func (msh *MetadataSyncHandler) Routes() []controller.Route {
+	return []controller.Route{
+		controller.NewRoute(shared_routes.MetadataSync, []controller.RequestMethodType{controller.POST}),
+	}
+}
+
+func (msh *MetadataSyncHandler) HandlerFunc(httpResponseWriter http.ResponseWriter, request *http.Request, args *controller.HandlerFuncArgs) {
+	syncResponse := processMetadataSyncRequest(args)
+	responseBytes := syncResponse.Bytes()
+
+	httpResponseWriter.Header().Set("Content-Type", "application/json")
+	// Whether the response is gzipped depends on Accept-Encoding, so caches have to key it by Accept-Encoding too
+	httpResponseWriter.Header().Add("Vary", "Accept-Encoding")
+
+	if len(responseBytes) >= kGzipMinResponseBytes &&
+		strings.Contains(request.Header.Get("Accept-Encoding"), "gzip") {
+
+		httpResponseWriter.Header().Set("Content-Encoding", "gzip")
+		gzipWriter := gzip.NewWriter(httpResponseWriter)
+		_, err := gzipWriter.Write(responseBytes)
+		if err == nil {
+			err = gzipWriter.Close()
+		}
+		if err != nil {
+			logger.LogError("Something went wrong sending gzipped metadata sync response|error=" + err.Error())
+		}
+		return
+	}
+
+	_, err := httpResponseWriter.Write(responseBytes)
+	if err != nil {
+		logger.LogError("Something went wrong sending metadata sync response|error=" + err.Error())
+	}
+}
+
+func processMetadataSyncRequest(args *controller.HandlerFuncArgs) MetadataSyncResponse {
+
+	syncParamsJson, ok := args.PostArgs["sync_params"]
+	if !ok || len(syncParamsJson) <= 0 {
+		return MetadataSyncResponse{Success: false, ErrorMessage: "No sync params provided"}
+	}
+
+	syncParams := MetadataSyncRequestParams{}
+	err := json.Unmarshal([]byte(syncParamsJson), &syncParams)
+	if err != nil {
+		return MetadataSyncResponse{Success: false, ErrorMessage: "Unable to deserialize sync params json: " + err.Error()}
+	}
+
+	syncRequest, err := NewMetadataSyncRequest(&syncParams)
+	if err != nil {
+		return MetadataSyncResponse{Success: false, ErrorMessage: "Unable to construct sync request: " + err.Error()}
+	}
+
+	mdService := metadata_service.Instance()
+	if mdService == nil {
+		return MetadataSyncResponse{Success: false, ErrorMessage: "Metadata service unavailable"}
+	}
+
+	syncResponse := MetadataSyncResponse{Success: true}
+
+	syncResponse.AppMetadataVersion, syncResponse.AppManifest, syncResponse.AppItems, syncResponse.RemovedAppKeys, err = getMetadataSyncItems(mdService,
+		syncRequest.AppMetadataHashes,
+		metadata_typedefs.METADATA_SPACE_APP,
+		syncRequest.AppVersion,
+		syncRequest.Platform,
+		syncRequest.DeliveryMode)
+	if err != nil {
+		return MetadataSyncResponse{Success: false, ErrorMessage: "Unable to sync app metadata: " + err.Error()}
+	}
+
+	syncResponse.SharedMetadataVersion, syncResponse.SharedManifest, syncResponse.SharedItems, syncResponse.RemovedSharedKeys, err = getMetadataSyncItems(mdService,
+		syncRequest.SharedMetadataHashes,
+		metadata_typedefs.METADATA_SPACE_SHARED,
+		syncRequest.AppVersion,
+		syncRequest.Platform,
+		syncRequest.DeliveryMode)
+	if err != nil {
+		return MetadataSyncResponse{Success: false, ErrorMessage: "Unable to sync shared metadata: " + err.Error()}
+	}
+
+	return syncResponse
+}
+
+func getMetadataSyncItems(mdService *metadata_service.MetadataService,
+	clientHashes map[string]string,
+	space metadata_typedefs.MetadataSpace,
+	appVersion *core.AppVersion,
+	platform metadata_typedefs.MetadataPlatform,
+	deliveryMode string) (string, *metadata_typedefs.MetadataManifest, []*MetadataSyncItem, []string, error) {
+
+	version, err := mdService.ResolveMetadataVersion(appVersion, space)
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+
+	staleManifestItems, removedKeys, err := mdService.GetStaleMetadataManifestItems(clientHashes, space, version, platform)
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+
+	var syncItems []*MetadataSyncItem
+	for _, manifestItem := range staleManifestItems {
+		syncItem := &MetadataSyncItem{
+			MetadataKey: manifestItem.MetadataKey,
+			Hash:        manifestItem.GetEffectiveHash(platform),
+		}
+
+		// Download urls serve the base item, so items overridden for the platform are always sent inline
+		if deliveryMode == kDeliveryModeURL && !manifestItem.HasPlatformOverride(platform) {
+			downloadURL, err := mdService.GetMetadataDownloadURL(manifestItem.MetadataKey, space, version)
+			if err == nil {
+				syncItem.DownloadURL = downloadURL
+				syncItems = append(syncItems, syncItem)
+				continue
+			}
+			// Fall-through to sending the content inline
+		}
+
+		syncItem.Content, err = mdService.GetMetadataJsonByKey(manifestItem.MetadataKey, space, version, platform)
+		if err != nil {
+			logger.LogError("failed to get metadata content for client sync" +
+				"|metadata space=" + space.String() +
+				"|version=" + version.String() +
+				"|metadata key=" + manifestItem.MetadataKey +
+				"|error=" + err.Error())
+			return "", nil, nil, nil, err
+		}
+		syncItems = append(syncItems, syncItem)
+	}
+
+	return version.String(), mdService.GetSignedMetadataManifest(space, version), syncItems, removedKeys, nil
+}
@@ -0,0 +1,118 @@
+package metadata_sync
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/spacetimi/timi_shared_server/code/core"
+	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
+)
+
+/****************************************/
+
+const kDeliveryModeInline = "inline"
+const kDeliveryModeURL = "url"
+
+type MetadataSyncRequestParams struct {
+	AppVersionString     string
+	AppMetadataHashes    map[string]string // metadata key => hash held by the client
+	SharedMetadataHashes map[string]string // metadata key => hash held by the client
+
+	// Optional. "ios", "android" or "web" to receive metadata with the platform's overrides applied
+	Platform string
+
+	// "inline" (default) to receive stale content in the response,
+	// "url" to receive download urls instead (falls back to inline if the metadata source doesn't support it)
+	DeliveryMode string
+}
+
+/****************************************/
+
+type MetadataSyncRequest struct {
+	AppVersion           *core.AppVersion
+	AppMetadataHashes    map[string]string
+	SharedMetadataHashes map[string]string
+	Platform             metadata_typedefs.MetadataPlatform
+	DeliveryMode         string
+}
+
+func NewMetadataSyncRequest(params *MetadataSyncRequestParams) (*MetadataSyncRequest, error) {
+	if params.AppVersionString == "" {
+		return nil, errors.New("No AppVersion sent")
+	}
+
+	appVersion, err := core.GetAppVersionFromString(params.AppVersionString)
+	if err != nil {
+		return nil, errors.New("Malformed AppVersion sent|appVersion=" + params.AppVersionString + "|error=" + err.Error())
+	}
+
+	platform, err := metadata_typedefs.GetMetadataPlatformFromString(params.Platform)
+	if err != nil {
+		return nil, errors.New("Unknown Platform|platform=" + params.Platform)
+	}
+
+	msr := MetadataSyncRequest{
+		AppVersion:           appVersion,
+		AppMetadataHashes:    params.AppMetadataHashes,
+		SharedMetadataHashes: params.SharedMetadataHashes,
+		Platform:             platform,
+	}
+	if msr.AppMetadataHashes == nil {
+		msr.AppMetadataHashes = map[string]string{}
+	}
+	if msr.SharedMetadataHashes == nil {
+		msr.SharedMetadataHashes = map[string]string{}
+	}
+
+	switch params.DeliveryMode {
+	case "", kDeliveryModeInline:
+		msr.DeliveryMode = kDeliveryModeInline
+	case kDeliveryModeURL:
+		msr.DeliveryMode = kDeliveryModeURL
+	default:
+		return nil, errors.New("Unknown DeliveryMode|deliveryMode=" + params.DeliveryMode)
+	}
+
+	return &msr, nil
+}
+
+/****************************************/
+
+type MetadataSyncItem struct {
+	MetadataKey string
+	Hash        string
+	Content     string `json:",omitempty"`
+	DownloadURL string `json:",omitempty"`
+}
+
+type MetadataSyncResponse struct {
+	Success      bool
+	ErrorMessage string
+
+	// Metadata versions resolved for the client's app version
+	AppMetadataVersion    string
+	SharedMetadataVersion string
+
+	AppItems    []*MetadataSyncItem
+	SharedItems []*MetadataSyncItem
+
+	RemovedAppKeys    []string
+	RemovedSharedKeys []string
+
+	// Only sent when the manifests are signed, so that clients can check the signature
+	// and then the hash of every item they receive against the manifest
+	// (items overridden for the client's platform have the override applied, and are checked against the effective hash).
+	// The signature also covers the manifest's space and version (see MetadataManifestSigner)
+	AppManifest    *metadata_typedefs.MetadataManifest `json:",omitempty"`
+	SharedManifest *metadata_typedefs.MetadataManifest `json:",omitempty"`
+}
+
+func (msr *MetadataSyncResponse) Bytes() []byte {
+	j, err := json.Marshal(msr)
+	if err != nil {
+		return []byte("{}")
+	}
+	return j
+}
+
+/****************************************/
@@ -4,3 +4,4 @@ const HealthCheck = "/healthCheck"
 const Version = "/version"
 const Config = "/config"
 const Login = "/login"
+const MetadataSync = "/metadataSync"
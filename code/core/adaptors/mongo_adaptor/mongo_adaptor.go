@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/spacetimi/timi_shared_server/code/config"
 	"github.com/spacetimi/timi_shared_server/utils/logger"
@@ -72,16 +74,11 @@ func GetDataItemByPrimaryKeys(dbSpace DBSpace,
 		return errors.New("error getting collection: " + err.Error())
 	}
 
-	if len(primaryKeys) != len(primaryKeyValues) {
-		return errors.New(fmt.Sprintf("mismatched number of primary keys(%d) and values(%d)", len(primaryKeys), len(primaryKeyValues)))
+	filter, err := getPrimaryKeysFilter(primaryKeys, primaryKeyValues)
+	if err != nil {
+		return err
 	}
 
-	var filterConditions []bson.E
-	for i, primaryKeyValue := range primaryKeyValues {
-		filterConditions = append(filterConditions, bson.E{Key: primaryKeys[i], Value: primaryKeyValue})
-	}
-	filter := bson.D(filterConditions)
-
 	singleResult := collection.FindOne(ctx, filter)
 	if singleResult.Err() != nil {
 		return errors.New("error finding object matching primary key: " + singleResult.Err().Error())
@@ -95,6 +92,273 @@ func GetDataItemByPrimaryKeys(dbSpace DBSpace,
 	return nil
 }
 
+/**
+ * Returns the data item's document undecoded (eg: so that it can be migrated before decoding), along with the
+ * adaptor managed fields of the data item (see DataItemMetadata).
+ * Returns ErrDataItemNotFound if there is no such data item. Data items past their expiry time are treated as
+ * not found (mongo's ttl monitor only removes them periodically)
+ */
+func GetRawDataItemWithMetadataByPrimaryKeys(dbSpace DBSpace,
+	collectionName string,
+	primaryKeys []string, primaryKeyValues []interface{},
+	ctx context.Context) (bson.Raw, DataItemMetadata, error) {
+
+	metadata := DataItemMetadata{}
+
+	collection, err := getMongoCollection(dbSpace, collectionName)
+	if err != nil {
+		return nil, metadata, errors.New("error getting collection: " + err.Error())
+	}
+
+	filter, err := getPrimaryKeysFilter(primaryKeys, primaryKeyValues)
+	if err != nil {
+		return nil, metadata, err
+	}
+	// Also matches data items without an expiry time
+	filter = append(filter, bson.E{Key: ExpiresAtFieldName, Value: bson.M{"$not": bson.M{"$lte": time.Now()}}})
+
+	singleResult := collection.FindOne(ctx, filter)
+	if singleResult.Err() == mongo.ErrNoDocuments {
+		return nil, metadata, ErrDataItemNotFound
+	}
+	if singleResult.Err() != nil {
+		return nil, metadata, errors.New("error finding object matching primary key: " + singleResult.Err().Error())
+	}
+
+	raw, err := singleResult.DecodeBytes()
+	if err != nil {
+		return nil, metadata, errors.New("error reading object: " + err.Error())
+	}
+
+	return raw, getDataItemMetadata(raw), nil
+}
+
+/**
+ * Batch version of GetRawDataItemWithMetadataByPrimaryKeys, with a single query.
+ * The results are in the same order as primaryKeyValuesList, with a nil document for data items that weren't found
+ */
+func GetRawDataItemsWithMetadataByPrimaryKeys(dbSpace DBSpace,
+	collectionName string,
+	primaryKeys []string, primaryKeyValuesList [][]interface{},
+	ctx context.Context) ([]bson.Raw, []DataItemMetadata, error) {
+
+	raws := make([]bson.Raw, len(primaryKeyValuesList))
+	metadatas := make([]DataItemMetadata, len(primaryKeyValuesList))
+	if len(primaryKeyValuesList) == 0 {
+		return raws, metadatas, nil
+	}
+
+	collection, err := getMongoCollection(dbSpace, collectionName)
+	if err != nil {
+		return nil, nil, errors.New("error getting collection: " + err.Error())
+	}
+
+	// The same data item can be requested more than once
+	indicesByPrimaryKeyValues := make(map[string][]int)
+
+	var filter bson.D
+	if len(primaryKeys) == 1 {
+		var values bson.A
+		for i, primaryKeyValues := range primaryKeyValuesList {
+			if len(primaryKeyValues) != 1 {
+				return nil, nil, errors.New(fmt.Sprintf("mismatched number of primary keys(1) and values(%d)", len(primaryKeyValues)))
+			}
+			values = append(values, primaryKeyValues[0])
+			key := getPrimaryKeyValuesString(primaryKeyValues)
+			indicesByPrimaryKeyValues[key] = append(indicesByPrimaryKeyValues[key], i)
+		}
+		filter = bson.D{{Key: primaryKeys[0], Value: bson.M{"$in": values}}}
+	} else {
+		var conditions bson.A
+		for i, primaryKeyValues := range primaryKeyValuesList {
+			condition, err := getPrimaryKeysFilter(primaryKeys, primaryKeyValues)
+			if err != nil {
+				return nil, nil, err
+			}
+			conditions = append(conditions, condition)
+			key := getPrimaryKeyValuesString(primaryKeyValues)
+			indicesByPrimaryKeyValues[key] = append(indicesByPrimaryKeyValues[key], i)
+		}
+		filter = bson.D{{Key: "$or", Value: conditions}}
+	}
+	// Also matches data items without an expiry time
+	filter = append(filter, bson.E{Key: ExpiresAtFieldName, Value: bson.M{"$not": bson.M{"$lte": time.Now()}}})
+
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return nil, nil, errors.New("error reading data items from collection: " + err.Error())
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		// The cursor reuses Current for the next document
+		raw := make(bson.Raw, len(cursor.Current))
+		copy(raw, cursor.Current)
+
+		var primaryKeyValues []interface{}
+		for _, primaryKey := range primaryKeys {
+			var value interface{}
+			rawValue, err := raw.LookupErr(primaryKey)
+			if err == nil {
+				err = rawValue.Unmarshal(&value)
+			}
+			if err != nil {
+				return nil, nil, errors.New("error reading primary key " + primaryKey + " of data item: " + err.Error())
+			}
+			primaryKeyValues = append(primaryKeyValues, value)
+		}
+
+		metadata := getDataItemMetadata(raw)
+		for _, i := range indicesByPrimaryKeyValues[getPrimaryKeyValuesString(primaryKeyValues)] {
+			raws[i] = raw
+			metadatas[i] = metadata
+		}
+	}
+	if cursor.Err() != nil {
+		return nil, nil, errors.New("error iterating data items: " + cursor.Err().Error())
+	}
+
+	return raws, metadatas, nil
+}
+
+/**
+ * Returns the undecoded documents matching the filter in the given sort order, along with their adaptor managed
+ * fields. Data items past their expiry time are left out. A limit of 0 means no limit
+ */
+func FindRawDataItems(dbSpace DBSpace,
+	collectionName string,
+	filter bson.D,
+	sort bson.D,
+	limit int64,
+	ctx context.Context) ([]bson.Raw, []DataItemMetadata, error) {
+
+	collection, err := getMongoCollection(dbSpace, collectionName)
+	if err != nil {
+		return nil, nil, errors.New("error finding collection: " + err.Error())
+	}
+
+	// Also matches data items without an expiry time
+	filter = append(filter[:len(filter):len(filter)], bson.E{Key: ExpiresAtFieldName, Value: bson.M{"$not": bson.M{"$lte": time.Now()}}})
+
+	findOptions := options.Find().SetSort(sort)
+	if limit > 0 {
+		findOptions.SetLimit(limit)
+	}
+
+	cursor, err := collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, nil, errors.New("error reading data items from collection: " + err.Error())
+	}
+	defer cursor.Close(ctx)
+
+	var raws []bson.Raw
+	var metadatas []DataItemMetadata
+	for cursor.Next(ctx) {
+		// The cursor reuses Current for the next document
+		raw := make(bson.Raw, len(cursor.Current))
+		copy(raw, cursor.Current)
+		raws = append(raws, raw)
+		metadatas = append(metadatas, getDataItemMetadata(raw))
+	}
+	if cursor.Err() != nil {
+		return nil, nil, errors.New("error iterating data items: " + cursor.Err().Error())
+	}
+
+	return raws, metadatas, nil
+}
+
+/**
+ * Lists the indexes on the collection, including the _id index. A collection that doesn't exist has no indexes
+ */
+func ListIndexes(dbSpace DBSpace, collectionName string, ctx context.Context) ([]IndexInfo, error) {
+	collection, err := getMongoCollection(dbSpace, collectionName)
+	if err != nil {
+		return nil, errors.New("error finding collection: " + err.Error())
+	}
+
+	cursor, err := collection.Indexes().List(ctx)
+	if err != nil {
+		return nil, errors.New("error listing indexes: " + err.Error())
+	}
+	defer cursor.Close(ctx)
+
+	var indexes []IndexInfo
+	for cursor.Next(ctx) {
+		var index IndexInfo
+		err = cursor.Decode(&index)
+		if err != nil {
+			return nil, errors.New("error decoding index: " + err.Error())
+		}
+		indexes = append(indexes, index)
+	}
+	if cursor.Err() != nil {
+		return nil, errors.New("error iterating indexes: " + cursor.Err().Error())
+	}
+
+	return indexes, nil
+}
+
+/**
+ * Creates the indexes on the collection. Indexes that already exist (with the same options) are left as they are
+ */
+func CreateIndexes(dbSpace DBSpace,
+	collectionName string,
+	indexes []mongo.IndexModel,
+	ctx context.Context) error {
+
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	collection, err := getMongoCollection(dbSpace, collectionName)
+	if err != nil {
+		return errors.New("error finding collection: " + err.Error())
+	}
+
+	_, err = collection.Indexes().CreateMany(ctx, indexes)
+	if err != nil {
+		return errors.New("error creating indexes: " + err.Error())
+	}
+
+	return nil
+}
+
+/**
+ * Calls back with every data item in the collection stored at a schema version lower than the given one
+ * (including data items stored without a schema version). Stops at the first error returned by the callback
+ */
+func ForEachRawDataItemBelowSchemaVersion(dbSpace DBSpace,
+	collectionName string,
+	schemaVersion int,
+	callback func(raw bson.Raw, metadata DataItemMetadata) error,
+	ctx context.Context) error {
+
+	collection, err := getMongoCollection(dbSpace, collectionName)
+	if err != nil {
+		return errors.New("error finding collection: " + err.Error())
+	}
+
+	filter := bson.D{{Key: SchemaVersionFieldName, Value: bson.M{"$not": bson.M{"$gte": schemaVersion}}}}
+
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return errors.New("error reading data items from collection: " + err.Error())
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		err = callback(cursor.Current, getDataItemMetadata(cursor.Current))
+		if err != nil {
+			return err
+		}
+	}
+	if cursor.Err() != nil {
+		return errors.New("error iterating data items: " + cursor.Err().Error())
+	}
+
+	return nil
+}
+
 func GetDataItemsByFilter(dbSpace DBSpace,
 	collectionName string,
 	keys []string,
@@ -158,6 +422,332 @@ func WriteDataItemByPrimaryKeys(dbSpace DBSpace,
 	return nil
 }
 
+/**
+ * The document a data item is stored as, without the adaptor managed fields. Every write encodes data items with
+ * this, so anything that has to match the stored documents (eg: a cache) should too
+ */
+func MarshalDataItem(dataItemPtr interface{}) (bson.M, error) {
+	return reflection_utils.MarshalStructPtrToBson(dataItemPtr)
+}
+
+/**
+ * Writes the data item and increments its revision, returning the new revision.
+ * With expectedRevision set to anything other than AnyRevision, the write only goes through if the stored data item
+ * is still at that revision, and fails with ErrRevisionMismatch otherwise. Expected revision 0 means the data item
+ * must not have been written with a revision yet (it doesn't exist, or predates revisions), or must have expired
+ * (mongo removes expired data items only every so often, and reads already treat them as missing).
+ * If expiresAt is not zero, mongo removes the data item once it is past that time.
+ * The stored schema version is never lowered, so that a server running older code can't mark a data item that was
+ * already migrated as needing migration again
+ */
+func WriteRevisionedDataItemByPrimaryKeys(dbSpace DBSpace,
+	collectionName string,
+	primaryKeys []string,
+	dataItemPtr interface{},
+	expectedRevision int64,
+	expiresAt time.Time,
+	schemaVersion int,
+	ctx context.Context) (int64, error) {
+
+	if dataItemPtr == nil {
+		return 0, errors.New("data item pointer is null")
+	}
+
+	bsonMRepresentation, err := MarshalDataItem(dataItemPtr)
+	if err != nil {
+		return 0, errors.New("error serializing data item: " + err.Error())
+	}
+
+	return WriteRevisionedDocumentByPrimaryKeys(dbSpace, collectionName, primaryKeys, bsonMRepresentation,
+		expectedRevision, expiresAt, schemaVersion, ctx)
+}
+
+/**
+ * Same as WriteRevisionedDataItemByPrimaryKeys, for a data item's document (eg: one that was migrated without
+ * decoding it). The adaptor managed fields in the document are ignored
+ */
+func WriteRevisionedDocumentByPrimaryKeys(dbSpace DBSpace,
+	collectionName string,
+	primaryKeys []string,
+	document bson.M,
+	expectedRevision int64,
+	expiresAt time.Time,
+	schemaVersion int,
+	ctx context.Context) (int64, error) {
+
+	collection, err := getMongoCollection(dbSpace, collectionName)
+	if err != nil {
+		return 0, errors.New("error finding collection: " + err.Error())
+	}
+
+	if expectedRevision == 0 {
+		// If the data item exists at some revision, the upsert tries to insert a second one with the same primary
+		// keys, which the unique index turns into a duplicate key error
+		err = checkPrimaryKeysIndex(dbSpace, collectionName, primaryKeys, ctx)
+		if err != nil {
+			return 0, errors.New("error checking primary keys index: " + err.Error())
+		}
+	}
+
+	if !expiresAt.IsZero() {
+		err = ensureExpiryIndex(dbSpace, collectionName, ctx)
+		if err != nil {
+			return 0, errors.New("error creating ttl index: " + err.Error())
+		}
+	}
+
+	revision, err := updateRevisionedDocument(collection, primaryKeys, document, expectedRevision, expiresAt, schemaVersion, ctx)
+	if err != nil && err != ErrRevisionMismatch {
+		return 0, errors.New("error updating data item: " + err.Error())
+	}
+	return revision, err
+}
+
+/**
+ * Unconditional batch version of WriteRevisionedDataItemByPrimaryKeys, as a single (unordered) bulk write.
+ * Revisions are incremented the same way, but the new revisions aren't known.
+ * Returns an error per data item, in the same order as the data items (nil for the ones that were written)
+ */
+func WriteRevisionedDataItemsByPrimaryKeys(dbSpace DBSpace,
+	collectionName string,
+	primaryKeys []string,
+	dataItemPtrs []interface{},
+	expiresAt time.Time,
+	schemaVersion int,
+	ctx context.Context) []error {
+
+	errs := make([]error, len(dataItemPtrs))
+	setAllErrors := func(err error) []error {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+		return errs
+	}
+
+	collection, err := getMongoCollection(dbSpace, collectionName)
+	if err != nil {
+		return setAllErrors(errors.New("error finding collection: " + err.Error()))
+	}
+
+	if !expiresAt.IsZero() {
+		err = ensureExpiryIndex(dbSpace, collectionName, ctx)
+		if err != nil {
+			return setAllErrors(errors.New("error creating ttl index: " + err.Error()))
+		}
+	}
+
+	var models []mongo.WriteModel
+	var dataItemIndices []int // Index of the data item for each model
+	for i, dataItemPtr := range dataItemPtrs {
+		if dataItemPtr == nil {
+			errs[i] = errors.New("data item pointer is null")
+			continue
+		}
+
+		bsonMRepresentation, err := MarshalDataItem(dataItemPtr)
+		if err != nil {
+			errs[i] = errors.New("error serializing data item: " + err.Error())
+			continue
+		}
+
+		filter, err := getPrimaryKeysFilterFromBson(primaryKeys, bsonMRepresentation)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(filter).
+			SetUpdate(getRevisionedUpdate(bsonMRepresentation, expiresAt, schemaVersion)).
+			SetUpsert(true))
+		dataItemIndices = append(dataItemIndices, i)
+	}
+
+	if len(models) == 0 {
+		return errs
+	}
+
+	_, err = collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		bulkWriteException, ok := err.(mongo.BulkWriteException)
+		if !ok || bulkWriteException.WriteConcernError != nil {
+			// Don't know which data items were written
+			return setAllErrors(errors.New("error updating data items: " + err.Error()))
+		}
+		for _, writeError := range bulkWriteException.WriteErrors {
+			errs[dataItemIndices[writeError.Index]] = errors.New("error updating data item: " + writeError.Message)
+		}
+	}
+
+	return errs
+}
+
+/**
+ * Returns false if there was no data item matching the primary keys
+ */
+func DeleteDataItemByPrimaryKeys(dbSpace DBSpace,
+	collectionName string,
+	primaryKeys []string, primaryKeyValues []interface{},
+	ctx context.Context) (bool, error) {
+
+	collection, err := getMongoCollection(dbSpace, collectionName)
+	if err != nil {
+		return false, errors.New("error finding collection: " + err.Error())
+	}
+
+	filter, err := getPrimaryKeysFilter(primaryKeys, primaryKeyValues)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := collection.DeleteOne(ctx, filter)
+	if err != nil {
+		return false, errors.New("error deleting data item: " + err.Error())
+	}
+
+	return result.DeletedCount > 0, nil
+}
+
+/**
+ * Applies the writes in a single transaction: either all of them, or none. The transaction is retried on
+ * transient errors (eg: a write conflict with another transaction).
+ * Returns the new revision of each written data item (0 for deletes). If a write's expected revision didn't match,
+ * returns ErrRevisionMismatch and the index of that write (the index is -1 for other errors).
+ * Returns ErrTransactionsNotSupported if the db is a standalone server (see SupportsTransactions)
+ */
+func RunWritesInTransaction(dbSpace DBSpace, writes []TransactionWrite, ctx context.Context) ([]int64, int, error) {
+	supported, err := SupportsTransactions(dbSpace, ctx)
+	if err != nil {
+		return nil, -1, err
+	}
+	if !supported {
+		return nil, -1, ErrTransactionsNotSupported
+	}
+
+	client, err := getMongoClient(dbSpace)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	// Indexes can't be created inside a transaction, so check for or create the ones the writes need first,
+	// once per collection
+	indexedCollections := make(map[string]bool)
+	for _, write := range writes {
+		if write.DataItemPtr == nil || indexedCollections[write.CollectionName] {
+			continue
+		}
+		indexedCollections[write.CollectionName] = true
+
+		if write.ExpectedRevision == 0 {
+			err = checkPrimaryKeysIndex(dbSpace, write.CollectionName, write.PrimaryKeys, ctx)
+			if err != nil {
+				return nil, -1, errors.New("error checking primary keys index: " + err.Error())
+			}
+		}
+		if !write.ExpiresAt.IsZero() {
+			err = ensureExpiryIndex(dbSpace, write.CollectionName, ctx)
+			if err != nil {
+				return nil, -1, errors.New("error creating ttl index: " + err.Error())
+			}
+		}
+	}
+
+	collections := make([]*mongo.Collection, len(writes))
+	documents := make([]bson.M, len(writes))
+	for i, write := range writes {
+		collections[i], err = getMongoCollection(dbSpace, write.CollectionName)
+		if err != nil {
+			return nil, -1, errors.New("error finding collection: " + err.Error())
+		}
+
+		if write.DataItemPtr != nil {
+			documents[i], err = MarshalDataItem(write.DataItemPtr)
+			if err != nil {
+				return nil, -1, errors.New("error serializing data item: " + err.Error())
+			}
+		}
+	}
+
+	session, err := client.StartSession()
+	if err != nil {
+		return nil, -1, errors.New("error starting session: " + err.Error())
+	}
+	defer session.EndSession(ctx)
+
+	var revisions []int64
+	failedWriteIndex := -1
+
+	// Errors from mongo are returned as they are, for the transient ones to be retried
+	_, err = session.WithTransaction(ctx, func(sessionCtx mongo.SessionContext) (interface{}, error) {
+		revisions = make([]int64, len(writes))
+		failedWriteIndex = -1
+
+		for i, write := range writes {
+			if write.DataItemPtr == nil {
+				filter, err := getPrimaryKeysFilter(write.PrimaryKeys, write.PrimaryKeyValues)
+				if err != nil {
+					return nil, err
+				}
+				_, err = collections[i].DeleteOne(sessionCtx, filter)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			revision, err := updateRevisionedDocument(collections[i], write.PrimaryKeys, documents[i],
+				write.ExpectedRevision, write.ExpiresAt, write.SchemaVersion, sessionCtx)
+			if err != nil {
+				if err == ErrRevisionMismatch {
+					failedWriteIndex = i
+				}
+				return nil, err
+			}
+			revisions[i] = revision
+		}
+		return nil, nil
+	})
+
+	if err == ErrRevisionMismatch {
+		return nil, failedWriteIndex, err
+	}
+	if err != nil {
+		return nil, -1, errors.New("error running transaction: " + err.Error())
+	}
+
+	return revisions, -1, nil
+}
+
+/**
+ * Whether the db supports transactions, which needs it to be a replica set or a sharded cluster (dev setups often
+ * run a standalone server). Checked once per db space
+ */
+func SupportsTransactions(dbSpace DBSpace, ctx context.Context) (bool, error) {
+	if supported, ok := _dbSpacesSupportingTransactions.Load(dbSpace); ok {
+		return supported.(bool), nil
+	}
+
+	client, err := getMongoClient(dbSpace)
+	if err != nil {
+		return false, err
+	}
+
+	result := bson.M{}
+	err = client.Database("admin").RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&result)
+	if err != nil {
+		return false, errors.New("error checking db topology: " + err.Error())
+	}
+
+	_, isReplicaSet := result["setName"]
+	isShardRouter := result["msg"] == "isdbgrid"
+	supported := isReplicaSet || isShardRouter
+
+	_dbSpacesSupportingTransactions.Store(dbSpace, supported)
+	return supported, nil
+}
+
 func AtomicIncrement(dbSpace DBSpace,
 	collectionName string,
 	documentPrimaryKey string,
@@ -196,6 +786,88 @@ func AtomicIncrement(dbSpace DBSpace,
 	return newFieldValue, nil
 }
 
+/**
+ * Sets the given fields on the data item matching all the filter conditions.
+ * Returns false if no data item matched (eg: because a field used in the filter has since changed)
+ */
+func UpdateDataItemFieldsByFilter(dbSpace DBSpace,
+	collectionName string,
+	filterKeys []string, filterValues []interface{},
+	fieldNames []string, fieldValues []interface{},
+	ctx context.Context) (bool, error) {
+
+	collection, err := getMongoCollection(dbSpace, collectionName)
+	if err != nil {
+		return false, errors.New("error finding collection: " + err.Error())
+	}
+
+	if len(filterKeys) != len(filterValues) {
+		return false, errors.New(fmt.Sprintf("mismatched number of filter keys(%d) and values(%d)", len(filterKeys), len(filterValues)))
+	}
+	if len(fieldNames) != len(fieldValues) {
+		return false, errors.New(fmt.Sprintf("mismatched number of field names(%d) and values(%d)", len(fieldNames), len(fieldValues)))
+	}
+
+	var filterConditions []bson.E
+	for i, value := range filterValues {
+		filterConditions = append(filterConditions, bson.E{Key: filterKeys[i], Value: value})
+	}
+	filter := bson.D(filterConditions)
+
+	fieldsToSet := bson.M{}
+	for i, value := range fieldValues {
+		fieldsToSet[fieldNames[i]] = value
+	}
+
+	result, err := collection.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: fieldsToSet}})
+	if err != nil {
+		return false, errors.New("error updating data item: " + err.Error())
+	}
+
+	return result.MatchedCount > 0, nil
+}
+
+/**
+ * Sets the given fields on the data item matching all the filter conditions, creating it if there is none.
+ * All fields are set in a single (atomic) update
+ */
+func UpsertDataItemFields(dbSpace DBSpace,
+	collectionName string,
+	filterKeys []string, filterValues []interface{},
+	fieldNames []string, fieldValues []interface{},
+	ctx context.Context) error {
+
+	collection, err := getMongoCollection(dbSpace, collectionName)
+	if err != nil {
+		return errors.New("error finding collection: " + err.Error())
+	}
+
+	if len(filterKeys) != len(filterValues) {
+		return errors.New(fmt.Sprintf("mismatched number of filter keys(%d) and values(%d)", len(filterKeys), len(filterValues)))
+	}
+	if len(fieldNames) != len(fieldValues) {
+		return errors.New(fmt.Sprintf("mismatched number of field names(%d) and values(%d)", len(fieldNames), len(fieldValues)))
+	}
+
+	var filterConditions []bson.E
+	for i, value := range filterValues {
+		filterConditions = append(filterConditions, bson.E{Key: filterKeys[i], Value: value})
+	}
+	filter := bson.D(filterConditions)
+
+	fieldsToSet := bson.M{}
+	for i, value := range fieldValues {
+		fieldsToSet[fieldNames[i]] = value
+	}
+
+	_, err = collection.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: fieldsToSet}}, &options.UpdateOptions{Upsert: &kTrueConst})
+	if err != nil {
+		return errors.New("error upserting data item: " + err.Error())
+	}
+
+	return nil
+}
+
 // TODO: Use contexts correctly. Don't just use context.Background
 
 /*********** Private **********************************************************/
@@ -208,6 +880,15 @@ var _appDBName string
 var kTrueConst bool
 var kAtomicIncrementReturnDocumentOption options.ReturnDocument
 
+// Collections (per db space) known to have the ttl index, so that it is only created once per process, and
+// the unique primary keys index, so that it is only checked for once
+var _collectionsWithExpiryIndex sync.Map
+var _collectionsWithPrimaryKeysIndex sync.Map
+
+var _dbSpacesSupportingTransactions sync.Map
+
+const kDuplicateKeyErrorCode = 11000
+
 func createMongoClient(mongoURL string) *mongo.Client {
 	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(mongoURL))
 	if err != nil {
@@ -218,6 +899,16 @@ func createMongoClient(mongoURL string) *mongo.Client {
 	return client
 }
 
+func getMongoClient(dbSpace DBSpace) (*mongo.Client, error) {
+	switch dbSpace {
+	case SHARED_DB:
+		return _sharedMongoClient, nil
+	case APP_DB:
+		return _appMongoClient, nil
+	}
+	return nil, errors.New("invalid db space")
+}
+
 func getMongoCollection(dbSpace DBSpace, collectionName string) (*mongo.Collection, error) {
 	var database *mongo.Database
 	switch dbSpace {
@@ -238,6 +929,224 @@ func getMongoCollection(dbSpace DBSpace, collectionName string) (*mongo.Collecti
 	return collection, nil
 }
 
+func getPrimaryKeysFilter(primaryKeys []string, primaryKeyValues []interface{}) (bson.D, error) {
+	if len(primaryKeys) != len(primaryKeyValues) {
+		return nil, errors.New(fmt.Sprintf("mismatched number of primary keys(%d) and values(%d)", len(primaryKeys), len(primaryKeyValues)))
+	}
+
+	var filterConditions []bson.E
+	for i, primaryKeyValue := range primaryKeyValues {
+		filterConditions = append(filterConditions, bson.E{Key: primaryKeys[i], Value: primaryKeyValue})
+	}
+	return bson.D(filterConditions), nil
+}
+
+/**
+ * For matching data items to requested primary keys. Numbers match regardless of their width (eg: int vs int64),
+ * since mongo doesn't keep the go type
+ */
+func getPrimaryKeyValuesString(primaryKeyValues []interface{}) string {
+	var primaryKeyValuesString string
+	for _, value := range primaryKeyValues {
+		primaryKeyValuesString = primaryKeyValuesString + fmt.Sprintf("%v", value) + "\x00"
+	}
+	return primaryKeyValuesString
+}
+
+func getPrimaryKeysFilterFromBson(primaryKeys []string, bsonMRepresentation bson.M) (bson.D, error) {
+	var filterConditions []bson.E
+	for _, key := range primaryKeys {
+		value, ok := bsonMRepresentation[key]
+		if !ok {
+			return nil, errors.New("missing value for primary key: " + key)
+		}
+		filterConditions = append(filterConditions, bson.E{
+			Key:   key,
+			Value: value,
+		})
+	}
+	return bson.D(filterConditions), nil
+}
+
+func getDataItemMetadata(raw bson.Raw) DataItemMetadata {
+	metadata := DataItemMetadata{}
+	if value, err := raw.LookupErr(RevisionFieldName); err == nil {
+		// $inc creates the field as an int32, and mongo promotes it to an int64 if it overflows
+		if revision, ok := value.Int32OK(); ok {
+			metadata.Revision = int64(revision)
+		} else {
+			metadata.Revision, _ = value.Int64OK()
+		}
+	}
+	if value, err := raw.LookupErr(ExpiresAtFieldName); err == nil {
+		metadata.ExpiresAt, _ = value.TimeOK()
+	}
+	if value, err := raw.LookupErr(SchemaVersionFieldName); err == nil {
+		if schemaVersion, ok := value.Int32OK(); ok {
+			metadata.SchemaVersion = int(schemaVersion)
+		} else if schemaVersion, ok := value.Int64OK(); ok {
+			metadata.SchemaVersion = int(schemaVersion)
+		}
+	}
+	return metadata
+}
+
+func isDuplicateKeyError(err error) bool {
+	switch e := err.(type) {
+	case mongo.CommandError:
+		return e.Code == kDuplicateKeyErrorCode
+	case mongo.WriteException:
+		for _, writeError := range e.WriteErrors {
+			if writeError.Code == kDuplicateKeyErrorCode {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/**
+ * Writes that create a data item only if it is new rely on a unique index on the primary keys, which isn't
+ * created here (see storage_service.EnsureBlobIndexes): creating it fails on collections with duplicates, or with
+ * another index on the primary keys, and such writes must not go ahead without it
+ */
+func checkPrimaryKeysIndex(dbSpace DBSpace, collectionName string, primaryKeys []string, ctx context.Context) error {
+	cacheKey := fmt.Sprintf("%d:%s", dbSpace, collectionName)
+	if _, ok := _collectionsWithPrimaryKeysIndex.Load(cacheKey); ok {
+		return nil
+	}
+
+	indexes, err := ListIndexes(dbSpace, collectionName, ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range indexes {
+		if !index.Unique || index.PartialFilter != nil || len(index.Keys) != len(primaryKeys) {
+			continue
+		}
+		matches := true
+		for i, key := range index.Keys {
+			if key.Key != primaryKeys[i] {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			_collectionsWithPrimaryKeysIndex.Store(cacheKey, true)
+			return nil
+		}
+	}
+
+	return errors.New("collection has no unique index on the primary keys: " + collectionName)
+}
+
+func ensureExpiryIndex(dbSpace DBSpace, collectionName string, ctx context.Context) error {
+	cacheKey := fmt.Sprintf("%d:%s", dbSpace, collectionName)
+	if _, ok := _collectionsWithExpiryIndex.Load(cacheKey); ok {
+		return nil
+	}
+
+	collection, err := getMongoCollection(dbSpace, collectionName)
+	if err != nil {
+		return errors.New("error finding collection: " + err.Error())
+	}
+
+	// Creating an index that already exists is a no-op
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: ExpiresAtFieldName, Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return errors.New("error creating index: " + err.Error())
+	}
+
+	_collectionsWithExpiryIndex.Store(cacheKey, true)
+	return nil
+}
+
+/**
+ * The write of WriteRevisionedDocumentByPrimaryKeys, without creating the indexes it needs.
+ * Errors from mongo are returned as they are, so that transactions can tell transient errors apart
+ */
+func updateRevisionedDocument(collection *mongo.Collection,
+	primaryKeys []string,
+	document bson.M,
+	expectedRevision int64,
+	expiresAt time.Time,
+	schemaVersion int,
+	ctx context.Context) (int64, error) {
+
+	fieldsToSet := bson.M{}
+	for key, value := range document {
+		if key != "_id" && key != RevisionFieldName && key != SchemaVersionFieldName && key != ExpiresAtFieldName {
+			fieldsToSet[key] = value
+		}
+	}
+
+	filter, err := getPrimaryKeysFilterFromBson(primaryKeys, fieldsToSet)
+	if err != nil {
+		return 0, err
+	}
+
+	// Only upsert when the data item is expected to be new. Otherwise a data item deleted in the meantime would be
+	// silently re-created
+	upsert := true
+	switch {
+	case expectedRevision == AnyRevision:
+		// Unconditional write
+	case expectedRevision == 0:
+		// Relies on the unique primary keys index (see checkPrimaryKeysIndex). A data item that expired but wasn't
+		// removed by mongo yet is replaced, since reads already treat it as missing
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: RevisionFieldName, Value: bson.M{"$exists": false}}},
+			bson.D{{Key: ExpiresAtFieldName, Value: bson.M{"$lte": time.Now()}}},
+		}})
+	default:
+		filter = append(filter, bson.E{Key: RevisionFieldName, Value: expectedRevision})
+		upsert = false
+	}
+
+	result := collection.FindOneAndUpdate(ctx, filter,
+		getRevisionedUpdate(fieldsToSet, expiresAt, schemaVersion),
+		options.FindOneAndUpdate().
+			SetUpsert(upsert).
+			SetReturnDocument(options.After).
+			SetProjection(bson.M{RevisionFieldName: 1}))
+
+	if result.Err() != nil {
+		if result.Err() == mongo.ErrNoDocuments || isDuplicateKeyError(result.Err()) {
+			return 0, ErrRevisionMismatch
+		}
+		return 0, result.Err()
+	}
+
+	raw, err := result.DecodeBytes()
+	if err != nil {
+		return 0, err
+	}
+
+	return getDataItemMetadata(raw).Revision, nil
+}
+
+/**
+ * Sets the fields and increments the revision. Without an expiry time, removes the one the data item may have had,
+ * so that mongo doesn't remove a data item that is no longer meant to expire
+ */
+func getRevisionedUpdate(fieldsToSet bson.M, expiresAt time.Time, schemaVersion int) bson.D {
+	update := bson.D{
+		{Key: "$set", Value: fieldsToSet},
+		{Key: "$inc", Value: bson.M{RevisionFieldName: 1}},
+		{Key: "$max", Value: bson.M{SchemaVersionFieldName: schemaVersion}},
+	}
+	if expiresAt.IsZero() {
+		update = append(update, bson.E{Key: "$unset", Value: bson.M{ExpiresAtFieldName: ""}})
+	} else {
+		fieldsToSet[ExpiresAtFieldName] = expiresAt
+	}
+	return update
+}
+
 func insertOnDuplicateUpdateDataItem(dbSpace DBSpace,
 	collectionName string,
 	primaryKeys []string,
@@ -248,27 +1157,19 @@ func insertOnDuplicateUpdateDataItem(dbSpace DBSpace,
 		return errors.New("error finding collection: " + err.Error())
 	}
 
-	bsonMRepresentation, err := reflection_utils.MarshalStructPtrToBson(dataItemPtr)
+	bsonMRepresentation, err := MarshalDataItem(dataItemPtr)
 	if err != nil {
 		return errors.New("error serializing data item: " + err.Error())
 	}
 
-	var filterConditions []bson.E
-	for _, key := range primaryKeys {
-		value, ok := bsonMRepresentation[key]
-		if !ok {
-			return errors.New("missing value for primary key: " + key)
-		}
-		filterConditions = append(filterConditions, bson.E{
-			Key:   key,
-			Value: value,
-		})
+	filter, err := getPrimaryKeysFilterFromBson(primaryKeys, bsonMRepresentation)
+	if err != nil {
+		return err
 	}
-	filter := bson.D(filterConditions)
 
 	_, err = collection.UpdateOne(ctx, filter,
 		bson.D{
-			{"$set", bsonMRepresentation},
+			{Key: "$set", Value: bsonMRepresentation},
 		},
 		&options.UpdateOptions{Upsert: &kTrueConst})
 
@@ -1,8 +1,74 @@
 package mongo_adaptor
 
+import (
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
 type DBSpace int
 
 const (
 	SHARED_DB DBSpace = iota
 	APP_DB
 )
+
+/**
+ * Expiring data items store their expiry time in this field, with a ttl index on it so that mongo removes them
+ */
+const ExpiresAtFieldName = "_expiresAt"
+
+/**
+ * Incremented on every write through WriteRevisionedDataItemByPrimaryKeys
+ */
+const RevisionFieldName = "_revision"
+
+/**
+ * The schema version of the data item's document, for migrating documents written by older code
+ */
+const SchemaVersionFieldName = "_schemaVersion"
+
+// Expected revision for unconditional writes
+const AnyRevision int64 = -1
+
+var ErrRevisionMismatch = errors.New("data item was modified since it was read")
+
+var ErrDataItemNotFound = errors.New("data item not found")
+
+var ErrTransactionsNotSupported = errors.New("db does not support transactions (it needs to be a replica set or sharded cluster)")
+
+/**
+ * Fields that the adaptor keeps on data items, besides the data item's own fields
+ */
+type DataItemMetadata struct {
+	Revision      int64     // Zero if the data item was never written with a revision
+	ExpiresAt     time.Time // Zero if the data item does not expire
+	SchemaVersion int       // Zero if the data item was written before schema versions were stored
+}
+
+/**
+ * A write in a transaction (see RunWritesInTransaction). Writes the data item, or deletes it if DataItemPtr is nil
+ */
+type TransactionWrite struct {
+	CollectionName   string
+	PrimaryKeys      []string
+	PrimaryKeyValues []interface{} // Only needed for deletes
+	DataItemPtr      interface{}
+
+	// For writes. See WriteRevisionedDataItemByPrimaryKeys
+	ExpectedRevision int64
+	ExpiresAt        time.Time
+	SchemaVersion    int
+}
+
+/**
+ * An index on a collection, as it is in the db
+ */
+type IndexInfo struct {
+	Name               string `bson:"name"`
+	Keys               bson.D `bson:"key"`
+	Unique             bool   `bson:"unique"`
+	ExpireAfterSeconds *int32 `bson:"expireAfterSeconds"`      // Nil unless it is a ttl index
+	PartialFilter      bson.D `bson:"partialFilterExpression"` // Nil unless it is a partial index
+}
@@ -64,6 +64,37 @@ func Write(key string, value string, expiration time.Duration, ctx context.Conte
 	return nil
 }
 
+/**
+ * Writes the value only if the key does not already exist. Returns whether the value was written
+ */
+func WriteIfNotExists(key string, value string, expiration time.Duration, ctx context.Context) (bool, error) {
+	written, err := _client.SetNX(ctx, key, value, expiration).Result()
+	if err != nil {
+		return false, errors.New("error writing value for key: " + err.Error())
+	}
+
+	return written, nil
+}
+
+var _extendIfValueEqualsScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+/**
+ * Resets the key's expiration only if the key still holds the value, checked and extended atomically.
+ * Returns whether the expiration was extended
+ */
+func ExtendIfValueEquals(key string, value string, expiration time.Duration, ctx context.Context) (bool, error) {
+	extended, err := _extendIfValueEqualsScript.Run(ctx, _client, []string{key}, value, expiration.Milliseconds()).Int()
+	if err != nil {
+		return false, errors.New("error extending expiration for key: " + err.Error())
+	}
+
+	return extended == 1, nil
+}
+
 func Delete(key string, ctx context.Context) error {
 	err := _client.Del(ctx, key).Err()
 	if err != nil {
@@ -72,3 +103,151 @@ func Delete(key string, ctx context.Context) error {
 
 	return nil
 }
+
+/**
+ * Reads all the keys in a single round trip. The values and found flags are in the same order as the keys
+ */
+func ReadMultiple(keys []string, ctx context.Context) ([]string, []bool, error) {
+	values := make([]string, len(keys))
+	found := make([]bool, len(keys))
+	if len(keys) == 0 {
+		return values, found, nil
+	}
+
+	results, err := _client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return values, found, errors.New("error reading values for keys: " + err.Error())
+	}
+
+	for i, result := range results {
+		if value, ok := result.(string); ok {
+			values[i] = value
+			found[i] = true
+		}
+	}
+
+	return values, found, nil
+}
+
+/**
+ * Writes all the values in a single pipelined round trip, each with its own expiration
+ */
+func WriteMultiple(keys []string, values []string, expirations []time.Duration, ctx context.Context) error {
+	if len(keys) != len(values) || len(keys) != len(expirations) {
+		return errors.New("mismatched number of keys, values and expirations")
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	_, err := _client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			pipe.Set(ctx, key, values[i], expirations[i])
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.New("error writing values for keys: " + err.Error())
+	}
+
+	return nil
+}
+
+/**
+ * Same as WriteMultiple, but writes each value only if its key does not already exist
+ */
+func WriteMultipleIfNotExists(keys []string, values []string, expirations []time.Duration, ctx context.Context) error {
+	if len(keys) != len(values) || len(keys) != len(expirations) {
+		return errors.New("mismatched number of keys, values and expirations")
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	_, err := _client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			pipe.SetNX(ctx, key, values[i], expirations[i])
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.New("error writing values for keys: " + err.Error())
+	}
+
+	return nil
+}
+
+func DeleteMultiple(keys []string, ctx context.Context) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	err := _client.Del(ctx, keys...).Err()
+	if err != nil {
+		return errors.New("error deleting keys: " + err.Error())
+	}
+
+	return nil
+}
+
+func Publish(channel string, message string, ctx context.Context) error {
+	err := _client.Publish(ctx, channel, message).Err()
+	if err != nil {
+		return errors.New("error publishing message: " + err.Error())
+	}
+
+	return nil
+}
+
+/**
+ * Calls back (on a separate goroutine) with every message published to the channel, until ctx is done.
+ * The connection is re-established after errors, but messages published while it is down are lost: onReconnected
+ * is called once it is re-established, and onClosed once the subscription ends. Either can be nil
+ */
+func Subscribe(channel string,
+	callback func(message string),
+	onReconnected func(),
+	onClosed func(),
+	ctx context.Context) error {
+
+	pubSub := _client.Subscribe(ctx, channel)
+
+	// Wait for the subscription to be confirmed
+	_, err := pubSub.Receive(ctx)
+	if err != nil {
+		_ = pubSub.Close()
+		return errors.New("error subscribing to channel: " + err.Error())
+	}
+
+	go func() {
+		defer func() {
+			_ = pubSub.Close()
+			if onClosed != nil {
+				onClosed()
+			}
+		}()
+
+		// Subscriptions are confirmed again after reconnecting
+		messages := pubSub.ChannelWithSubscriptions(ctx, 100)
+		for {
+			select {
+			case message, ok := <-messages:
+				if !ok {
+					return
+				}
+				switch message := message.(type) {
+				case *redis.Message:
+					callback(message.Payload)
+				case *redis.Subscription:
+					if message.Kind == "subscribe" && onReconnected != nil {
+						onReconnected()
+					}
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
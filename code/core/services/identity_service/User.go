@@ -11,6 +11,12 @@ import (
 
 const kUBVersion = 1
 
+// Unique, so that user names and email addresses can't be taken twice even by concurrent sign-ups
+var kUserBlobIndexes = []storage_typedefs.BlobIndex{
+	{Fields: []string{"UserName"}, Unique: true},
+	{Fields: []string{"UserEmailAddress"}, Unique: true, IgnoreEmptyStrings: true},
+}
+
 // Implements IBlob
 type UserBlob struct {
 	UserId        int64
@@ -21,7 +27,10 @@ type UserBlob struct {
 	UserEmailAddress         string
 	UserEmailAddressVerified bool
 
-	storage_typedefs.BlobDescriptor `bson:"ignore"`
+	// Empty for users created before it was kept here, whose hash is in their (legacy) user name to id mapping
+	PasswordHash string
+
+	storage_typedefs.BlobDescriptor `bson:"-"`
 }
 
 func newUserBlob(userId int64) *UserBlob {
@@ -31,8 +40,8 @@ func newUserBlob(userId int64) *UserBlob {
 	user.BlobDescriptor = storage_typedefs.NewBlobDescriptor(storage_typedefs.STORAGE_SPACE_SHARED,
 		config.GetAppName()+"::user",
 		[]string{"UserId"},
-		kVersion,
-		true)
+		kUBVersion,
+		true).WithIndexes(kUserBlobIndexes...)
 	return &user
 }
 
@@ -46,3 +55,19 @@ func loadUserBlobByUserId(userId int64, ctx context.Context) (*UserBlob, error)
 
 	return user, nil
 }
+
+func loadUserBlobByUniqueField(fieldName string, value string, ctx context.Context) (*UserBlob, error) {
+	blobPtrs, _, err := storage_service.QueryBlobs(func() storage_typedefs.IBlob { return newUserBlob(0) },
+		storage_typedefs.BlobQuery{
+			Filters: []storage_typedefs.BlobFilter{{Field: fieldName, Op: storage_typedefs.BLOB_FILTER_EQ, Value: value}},
+			Limit:   1,
+		}, ctx)
+	if err != nil {
+		return nil, errors.New("error querying user blob: " + err.Error())
+	}
+	if len(blobPtrs) == 0 {
+		return nil, storage_typedefs.ErrBlobNotFound
+	}
+
+	return blobPtrs[0].(*UserBlob), nil
+}
@@ -11,13 +11,15 @@ import (
 
 const kUNIDMVersion = 1
 
-// Implements IBlob
+// Implements IBlob.
+// Legacy: users are looked up by the unique indexes on UserBlob, and new users don't get a mapping.
+// Only read for the password hash of users created before UserBlob had it
 type UserNameToIdMappingBlob struct {
 	UserName     string
 	PasswordHash string
 	UserId       int64
 
-	storage_typedefs.BlobDescriptor `bson:"ignore"`
+	storage_typedefs.BlobDescriptor `bson:"-"`
 }
 
 func newUserNameToIdMapping(userName string) *UserNameToIdMappingBlob {
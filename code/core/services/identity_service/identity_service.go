@@ -12,6 +12,7 @@ import (
 	"github.com/spacetimi/timi_shared_server/code/config"
 	"github.com/spacetimi/timi_shared_server/code/core/adaptors/mongo_adaptor"
 	"github.com/spacetimi/timi_shared_server/code/core/services/storage_service"
+	"github.com/spacetimi/timi_shared_server/code/core/services/storage_service/storage_typedefs"
 	"github.com/spacetimi/timi_shared_server/utils/encryption_utils"
 	"github.com/spacetimi/timi_shared_server/utils/logger"
 )
@@ -73,6 +74,9 @@ func Initialize() {
 	if err != nil {
 		logger.LogFatal("error making sure counters table is set up|error=" + err.Error())
 	}
+
+	storage_service.RegisterBlob(func() storage_typedefs.IBlob { return newUserBlob(0) })
+	storage_service.RegisterBlob(func() storage_typedefs.IBlob { return newUserNameToIdMapping("") })
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -87,17 +91,45 @@ func GetUserBlobById(userId int64, ctx context.Context) (*UserBlob, error) {
 	return user, nil
 }
 
+func GetUserBlobByUserName(userName string, ctx context.Context) (*UserBlob, error) {
+	user, err := loadUserBlobByUniqueField("UserName", userName, ctx)
+	if err != nil {
+		return nil, errors.New("error loading user blob: " + err.Error())
+	}
+
+	return user, nil
+}
+
+func GetUserBlobByEmailAddress(userEmailAddress string, ctx context.Context) (*UserBlob, error) {
+	if userEmailAddress == "" {
+		return nil, errors.New("empty email address")
+	}
+
+	user, err := loadUserBlobByUniqueField("UserEmailAddress", userEmailAddress, ctx)
+	if err != nil {
+		return nil, errors.New("error loading user blob: " + err.Error())
+	}
+
+	return user, nil
+}
+
 func CreateNewUser(userName string, password string, userEmailAddress string, ctx context.Context) (*UserBlob, error) {
-	uidm, err := loadUserNameToIdMappingByUserName(userName, ctx)
+	_, err := loadUserBlobByUniqueField("UserName", userName, ctx)
 	if err == nil {
 		return nil, errors.New("username \"" + userName + "\" already exists")
 	}
+	if err != storage_typedefs.ErrBlobNotFound {
+		return nil, errors.New("error checking whether username exists: " + err.Error())
+	}
 
 	if userEmailAddress != "" {
-		_, err := loadUserEmailToIdMappingByUserEmail(userEmailAddress, ctx)
+		_, err := loadUserBlobByUniqueField("UserEmailAddress", userEmailAddress, ctx)
 		if err == nil {
 			return nil, errors.New("email address \"" + userEmailAddress + "\" already in use")
 		}
+		if err != storage_typedefs.ErrBlobNotFound {
+			return nil, errors.New("error checking whether email address is in use: " + err.Error())
+		}
 	}
 
 	newUserId, err := createNewUserID()
@@ -110,31 +142,21 @@ func CreateNewUser(userName string, password string, userEmailAddress string, ct
 		return nil, errors.New("error creating hash of password: " + err.Error())
 	}
 
-	if userEmailAddress != "" {
-		ueidm := newUserEmailToIdMapping(userEmailAddress)
-		ueidm.UserId = newUserId
-		err = storage_service.SetBlob(ueidm, ctx)
-		if err != nil {
-			return nil, errors.New("error saving new user email to id mapping: " + err.Error())
-		}
-	}
-
+	// The checks above can race with another signup, in which case the unique indexes on the user blob make
+	// the second signup fail
 	newUserBlob := newUserBlob(newUserId)
 	newUserBlob.CreatedTime = time.Now().Unix()
 	newUserBlob.LastLoginTime = time.Now().Unix()
 	newUserBlob.UserName = userName
 	newUserBlob.UserEmailAddress = userEmailAddress
-	err = storage_service.SetBlob(newUserBlob, ctx)
-	if err != nil {
-		return nil, errors.New("error saving new user blob: " + err.Error())
-	}
+	newUserBlob.PasswordHash = passwordHash
 
-	uidm = newUserNameToIdMapping(userName)
-	uidm.PasswordHash = passwordHash
-	uidm.UserId = newUserId
-	err = storage_service.SetBlob(uidm, ctx)
+	err = storage_service.SetBlobIfUnchanged(newUserBlob, ctx)
 	if err != nil {
-		return nil, errors.New("error saving new user name to id mapping: " + err.Error())
+		if _, ok := err.(*storage_typedefs.BlobConflictError); ok {
+			return nil, errors.New("username \"" + userName + "\" or email address \"" + userEmailAddress + "\" already in use")
+		}
+		return nil, errors.New("error saving new user blob: " + err.Error())
 	}
 
 	return newUserBlob, nil
@@ -147,23 +169,14 @@ func UpdateUserPassword(user *UserBlob, password string, ctx context.Context) er
 		return errors.New("error creating hash of password: " + err.Error())
 	}
 
-	uidm, err := loadUserNameToIdMappingByUserName(user.UserName, ctx)
-	if err != nil {
-		logger.LogError("error loading user name to id mapping" +
-			"|user id=" + strconv.FormatInt(user.UserId, 10) +
-			"|user name=" + user.UserName +
-			"|error=" + err.Error())
-		return errors.New("error getting user name to id mapping: " + err.Error())
-	}
-
-	uidm.PasswordHash = passwordHash
-	err = storage_service.SetBlob(uidm, ctx)
+	user.PasswordHash = passwordHash
+	err = storage_service.SetBlob(user, ctx)
 	if err != nil {
-		logger.LogError("error saving user name to id mapping" +
+		logger.LogError("error saving user blob with new password" +
 			"|user id=" + strconv.FormatInt(user.UserId, 10) +
 			"|user name=" + user.UserName +
 			"|error=" + err.Error())
-		return errors.New("error saving new user name to id mapping: " + err.Error())
+		return errors.New("error saving user blob: " + err.Error())
 	}
 
 	return nil
@@ -185,36 +198,40 @@ func SetUserEmailAddressVerified(user *UserBlob, ctx context.Context) error {
 }
 
 func CheckAndGetUserBlobFromUserLoginCredentials(userName string, password string, ctx context.Context) (*UserBlob, error) {
-	uidm, err := loadUserNameToIdMappingByUserName(userName, ctx)
+	user, err := loadUserBlobByUniqueField("UserName", userName, ctx)
 	if err != nil {
-		return nil, errors.New("error loading user name to id mapping: " + err.Error())
+		return nil, errors.New("error loading user blob: " + err.Error())
 	}
 
-	passwordOk := encryption_utils.VerifyPasswordWithHash(password, uidm.PasswordHash)
+	passwordHash := user.PasswordHash
+	if passwordHash == "" {
+		passwordHash, err = loadLegacyPasswordHash(user, ctx)
+		if err != nil {
+			return nil, errors.New("error loading password hash: " + err.Error())
+		}
+	}
+
+	passwordOk := encryption_utils.VerifyPasswordWithHash(password, passwordHash)
 	if !passwordOk {
 		return nil, errors.New("password doesn't match")
 	}
 
-	user, err := loadUserBlobByUserId(uidm.UserId, ctx)
-	if err != nil {
-		return nil, errors.New("error loading user blob for id: " + strconv.FormatInt(uidm.UserId, 10))
+	if user.PasswordHash == "" {
+		// Move the hash to the user blob, so that the mapping isn't needed for this user any more
+		user.PasswordHash = passwordHash
+		err = storage_service.SetBlob(user, ctx)
+		if err != nil {
+			logger.LogError("error saving password hash to user blob" +
+				"|user id=" + strconv.FormatInt(user.UserId, 10) +
+				"|error=" + err.Error())
+		}
 	}
 
 	return user, nil
 }
 
 func CheckAndGetUserBlobFromUserEmailAddress(userEmailAddress string, ctx context.Context) (*UserBlob, error) {
-	ueidm, err := loadUserEmailToIdMappingByUserEmail(userEmailAddress, ctx)
-	if err != nil {
-		return nil, errors.New("error loading user email address to id mapping: " + err.Error())
-	}
-
-	user, err := loadUserBlobByUserId(ueidm.UserId, ctx)
-	if err != nil {
-		return nil, errors.New("error loading user blob for id: " + strconv.FormatInt(ueidm.UserId, 10))
-	}
-
-	return user, nil
+	return GetUserBlobByEmailAddress(userEmailAddress, ctx)
 }
 
 func CreateUserLoginToken(user *UserBlob) (string, error) {
@@ -277,3 +294,18 @@ func createNewUserID() (int64, error) {
 
 	return newUserId, nil
 }
+
+/**
+ * For users created before UserBlob had the password hash
+ */
+func loadLegacyPasswordHash(user *UserBlob, ctx context.Context) (string, error) {
+	uidm, err := loadUserNameToIdMappingByUserName(user.UserName, ctx)
+	if err != nil {
+		return "", errors.New("error loading user name to id mapping: " + err.Error())
+	}
+	if uidm.UserId != user.UserId {
+		return "", errors.New("user name to id mapping is for another user id: " + strconv.FormatInt(uidm.UserId, 10))
+	}
+
+	return uidm.PasswordHash, nil
+}
@@ -0,0 +1,218 @@
+package localization_service
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+)
+
+const kCSVKeyColumnHeader = "key"
+
+/**
+ * Writes a header row ("key", then each configured locale, default locale first), and then a row per string key.
+ * Cells of missing translations are left empty
+ */
+func ExportStringTablesToCSV(tables map[string]*StringTable, writer io.Writer) error {
+	keySet := make(map[string]bool)
+	for _, table := range tables {
+		for stringKey := range table.Strings {
+			keySet[stringKey] = true
+		}
+	}
+	keys := make([]string, 0, len(keySet))
+	for stringKey := range keySet {
+		keys = append(keys, stringKey)
+	}
+	sort.Strings(keys)
+
+	csvWriter := csv.NewWriter(writer)
+
+	header := append([]string{kCSVKeyColumnHeader}, _config.Locales...)
+	err := csvWriter.Write(header)
+	if err != nil {
+		return errors.New("error writing csv header: " + err.Error())
+	}
+
+	for _, stringKey := range keys {
+		row := []string{stringKey}
+		for _, locale := range _config.Locales {
+			message := ""
+			if table, ok := tables[locale]; ok {
+				message = table.Strings[stringKey]
+			}
+			row = append(row, message)
+		}
+		err = csvWriter.Write(row)
+		if err != nil {
+			return errors.New("error writing csv row for " + stringKey + ": " + err.Error())
+		}
+	}
+
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+/**
+ * Reads csv in the format written by ExportStringTablesToCSV. Columns can be in any order, and can be a subset of the locales.
+ * Returns a complete, validated string table for each locale column (empty cells are left out of the table)
+ */
+func ImportStringTablesFromCSV(reader io.Reader) ([]*StringTable, error) {
+	csvReader := csv.NewReader(reader)
+	rows, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, errors.New("error reading csv: " + err.Error())
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("empty csv")
+	}
+
+	header := rows[0]
+	if len(header) < 2 || header[0] != kCSVKeyColumnHeader {
+		return nil, errors.New("csv header must be '" + kCSVKeyColumnHeader + "' followed by locales")
+	}
+
+	tables := make([]*StringTable, 0, len(header)-1)
+	for _, localeHeader := range header[1:] {
+		locale := NormalizeLocale(localeHeader)
+		if !containsString(_config.Locales, locale) {
+			return nil, errors.New("locale not configured: " + localeHeader)
+		}
+		for _, table := range tables {
+			if table.Locale == locale {
+				return nil, errors.New("duplicate locale column: " + localeHeader)
+			}
+		}
+		tables = append(tables, &StringTable{Locale: locale, Strings: make(map[string]string), space: _config.metadataSpace})
+	}
+
+	seenKeys := make(map[string]bool)
+	for rowIndex, row := range rows[1:] {
+		stringKey := row[0]
+		if seenKeys[stringKey] {
+			return nil, errors.New("duplicate string key on row " + strconv.Itoa(rowIndex+2) + ": " + stringKey)
+		}
+		seenKeys[stringKey] = true
+
+		for i, table := range tables {
+			if row[i+1] != "" {
+				table.Strings[stringKey] = row[i+1]
+			}
+		}
+	}
+
+	for _, table := range tables {
+		err = table.Validate()
+		if err != nil {
+			return nil, errors.New("invalid strings for " + table.Locale + ": " + err.Error())
+		}
+	}
+
+	return tables, nil
+}
+
+type xliffDocument struct {
+	XMLName xml.Name  `xml:"urn:oasis:names:tc:xliff:document:1.2 xliff"`
+	Version string    `xml:"version,attr"`
+	File    xliffFile `xml:"file"`
+}
+
+type xliffFile struct {
+	SourceLanguage string           `xml:"source-language,attr"`
+	TargetLanguage string           `xml:"target-language,attr"`
+	Datatype       string           `xml:"datatype,attr"`
+	Original       string           `xml:"original,attr"`
+	TransUnits     []xliffTransUnit `xml:"body>trans-unit"`
+}
+
+type xliffTransUnit struct {
+	Id     string `xml:"id,attr"`
+	Source string `xml:"source"`
+	Target string `xml:"target"`
+}
+
+/**
+ * Writes an XLIFF 1.2 file for translating the default locale's strings into the locale.
+ * Strings that are not translated yet have an empty target
+ */
+func ExportStringTableToXLIFF(tables map[string]*StringTable, locale string, writer io.Writer) error {
+	defaultTable, ok := tables[_config.DefaultLocale]
+	if !ok {
+		return errors.New("no string table for the default locale")
+	}
+	targetTable, ok := tables[locale]
+	if !ok {
+		return errors.New("no string table for locale: " + locale)
+	}
+
+	document := xliffDocument{
+		Version: "1.2",
+		File: xliffFile{
+			SourceLanguage: _config.DefaultLocale,
+			TargetLanguage: locale,
+			Datatype:       "plaintext",
+			Original:       kStringTableMetadataKeyPrefix,
+		},
+	}
+	for _, stringKey := range getSortedStringKeys(defaultTable) {
+		document.File.TransUnits = append(document.File.TransUnits, xliffTransUnit{
+			Id:     stringKey,
+			Source: defaultTable.Strings[stringKey],
+			Target: targetTable.Strings[stringKey],
+		})
+	}
+
+	_, err := io.WriteString(writer, xml.Header)
+	if err != nil {
+		return errors.New("error writing xliff: " + err.Error())
+	}
+	encoder := xml.NewEncoder(writer)
+	encoder.Indent("", "  ")
+	err = encoder.Encode(document)
+	if err != nil {
+		return errors.New("error writing xliff: " + err.Error())
+	}
+	return nil
+}
+
+/**
+ * Reads an XLIFF 1.2 file (as written by ExportStringTableToXLIFF) into a complete, validated string table for its target language.
+ * Units with empty targets are left out of the table
+ */
+func ImportStringTableFromXLIFF(reader io.Reader) (*StringTable, error) {
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, errors.New("error reading xliff: " + err.Error())
+	}
+
+	document := xliffDocument{}
+	err = xml.Unmarshal(contents, &document)
+	if err != nil {
+		return nil, errors.New("error parsing xliff: " + err.Error())
+	}
+
+	locale := NormalizeLocale(document.File.TargetLanguage)
+	if !containsString(_config.Locales, locale) {
+		return nil, errors.New("locale not configured: " + document.File.TargetLanguage)
+	}
+
+	table := &StringTable{Locale: locale, Strings: make(map[string]string), space: _config.metadataSpace}
+	for _, transUnit := range document.File.TransUnits {
+		if _, ok := table.Strings[transUnit.Id]; ok {
+			return nil, errors.New("duplicate trans-unit id: " + transUnit.Id)
+		}
+		if transUnit.Target != "" {
+			table.Strings[transUnit.Id] = transUnit.Target
+		}
+	}
+
+	err = table.Validate()
+	if err != nil {
+		return nil, errors.New("invalid strings for " + locale + ": " + err.Error())
+	}
+
+	return table, nil
+}
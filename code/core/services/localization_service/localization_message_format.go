@@ -0,0 +1,480 @@
+package localization_service
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/**
+ * A subset of ICU MessageFormat:
+ *   simple arguments:  "Hello {name}"
+ *   numbers:           "{score, number}"
+ *   plurals:           "{count, plural, offset:1 =0 {no one} one {# friend} other {# friends}}"
+ *   selects:           "{gender, select, female {her} male {his} other {their}}"
+ *   quoting:           "''" is a literal apostrophe, and "'{...}'" is literal text
+ * Plural categories follow CLDR's rules for integers in common languages. Non-integers always use "other"
+ */
+
+type messagePart interface {
+	format(args map[string]interface{}, language string, pluralNumber *float64) (string, error)
+}
+
+type parsedMessage struct {
+	parts []messagePart
+}
+
+type textPart struct {
+	text string
+}
+
+// "#" inside a plural option, replaced by the plural number (minus the offset)
+type pluralNumberPart struct {
+}
+
+type argumentPart struct {
+	name     string
+	isNumber bool
+}
+
+type pluralPart struct {
+	name    string
+	offset  float64
+	options map[string]*parsedMessage // "=<n>" or plural category => message
+}
+
+type selectPart struct {
+	name    string
+	options map[string]*parsedMessage // value => message
+}
+
+func parseMessage(message string) (*parsedMessage, error) {
+	parser := messageParser{runes: []rune(message)}
+	parsed, err := parser.parseMessage(0, false)
+	if err != nil {
+		return nil, err
+	}
+	if parser.position < len(parser.runes) {
+		return nil, parser.newError("unexpected '}'")
+	}
+	return parsed, nil
+}
+
+func (pm *parsedMessage) format(args map[string]interface{}, language string, pluralNumber *float64) (string, error) {
+	var builder strings.Builder
+	for _, part := range pm.parts {
+		formatted, err := part.format(args, language, pluralNumber)
+		if err != nil {
+			return "", err
+		}
+		builder.WriteString(formatted)
+	}
+	return builder.String(), nil
+}
+
+func (tp *textPart) format(args map[string]interface{}, language string, pluralNumber *float64) (string, error) {
+	return tp.text, nil
+}
+
+func (pnp *pluralNumberPart) format(args map[string]interface{}, language string, pluralNumber *float64) (string, error) {
+	if pluralNumber == nil {
+		return "#", nil
+	}
+	return formatNumber(*pluralNumber), nil
+}
+
+func (ap *argumentPart) format(args map[string]interface{}, language string, pluralNumber *float64) (string, error) {
+	value, ok := args[ap.name]
+	if !ok {
+		return "", errors.New("missing argument: " + ap.name)
+	}
+
+	if ap.isNumber {
+		number, ok := toNumber(value)
+		if !ok {
+			return "", errors.New("argument is not a number: " + ap.name)
+		}
+		return formatNumber(number), nil
+	}
+
+	return toString(value), nil
+}
+
+func (pp *pluralPart) format(args map[string]interface{}, language string, pluralNumber *float64) (string, error) {
+	value, ok := args[pp.name]
+	if !ok {
+		return "", errors.New("missing argument: " + pp.name)
+	}
+	number, ok := toNumber(value)
+	if !ok {
+		return "", errors.New("plural argument is not a number: " + pp.name)
+	}
+
+	// Exact matches are checked against the number before the offset is applied
+	option, ok := pp.options["="+formatNumber(number)]
+	if !ok {
+		option, ok = pp.options[getPluralCategory(language, number-pp.offset)]
+	}
+	if !ok {
+		option = pp.options["other"]
+	}
+
+	numberAfterOffset := number - pp.offset
+	return option.format(args, language, &numberAfterOffset)
+}
+
+func (sp *selectPart) format(args map[string]interface{}, language string, pluralNumber *float64) (string, error) {
+	value, ok := args[sp.name]
+	if !ok {
+		return "", errors.New("missing argument: " + sp.name)
+	}
+
+	option, ok := sp.options[toString(value)]
+	if !ok {
+		option = sp.options["other"]
+	}
+	return option.format(args, language, pluralNumber)
+}
+
+/********** Parser **********/
+
+type messageParser struct {
+	runes    []rune
+	position int
+}
+
+func (mp *messageParser) newError(message string) error {
+	return errors.New(message + " at position " + strconv.Itoa(mp.position))
+}
+
+/**
+ * Parses until the end of the message, or until the '}' closing a nested message (which is left unconsumed)
+ */
+func (mp *messageParser) parseMessage(depth int, inPlural bool) (*parsedMessage, error) {
+	parsed := &parsedMessage{}
+	var text strings.Builder
+
+	flushText := func() {
+		if text.Len() != 0 {
+			parsed.parts = append(parsed.parts, &textPart{text: text.String()})
+			text.Reset()
+		}
+	}
+
+	for mp.position < len(mp.runes) {
+		r := mp.runes[mp.position]
+
+		switch {
+		case r == '\'':
+			mp.parseQuoted(&text, inPlural)
+
+		case r == '{':
+			flushText()
+			part, err := mp.parseArgument(depth)
+			if err != nil {
+				return nil, err
+			}
+			parsed.parts = append(parsed.parts, part)
+
+		case r == '}':
+			if depth == 0 {
+				return nil, mp.newError("unexpected '}'")
+			}
+			flushText()
+			return parsed, nil
+
+		case r == '#' && inPlural:
+			flushText()
+			parsed.parts = append(parsed.parts, &pluralNumberPart{})
+			mp.position++
+
+		default:
+			text.WriteRune(r)
+			mp.position++
+		}
+	}
+
+	if depth != 0 {
+		return nil, mp.newError("missing '}'")
+	}
+	flushText()
+	return parsed, nil
+}
+
+func (mp *messageParser) parseQuoted(text *strings.Builder, inPlural bool) {
+	mp.position++ // Opening apostrophe
+
+	if mp.position < len(mp.runes) && mp.runes[mp.position] == '\'' {
+		text.WriteRune('\'')
+		mp.position++
+		return
+	}
+
+	// An apostrophe only starts quoted text if it is followed by a special character
+	if mp.position >= len(mp.runes) || !(mp.runes[mp.position] == '{' || mp.runes[mp.position] == '}' || (inPlural && mp.runes[mp.position] == '#')) {
+		text.WriteRune('\'')
+		return
+	}
+
+	for mp.position < len(mp.runes) {
+		r := mp.runes[mp.position]
+		mp.position++
+		if r == '\'' {
+			if mp.position < len(mp.runes) && mp.runes[mp.position] == '\'' {
+				text.WriteRune('\'')
+				mp.position++
+				continue
+			}
+			return
+		}
+		text.WriteRune(r)
+	}
+}
+
+func (mp *messageParser) parseArgument(depth int) (messagePart, error) {
+	mp.position++ // '{'
+
+	name := mp.parseIdentifier()
+	if name == "" {
+		return nil, mp.newError("missing argument name")
+	}
+
+	mp.skipWhitespace()
+	if mp.consume('}') {
+		return &argumentPart{name: name}, nil
+	}
+	if !mp.consume(',') {
+		return nil, mp.newError("expected ',' or '}' after argument name")
+	}
+
+	argumentType := mp.parseIdentifier()
+	mp.skipWhitespace()
+
+	switch argumentType {
+	case "number":
+		// Number styles are accepted but ignored
+		for mp.position < len(mp.runes) && mp.runes[mp.position] != '}' {
+			mp.position++
+		}
+		if !mp.consume('}') {
+			return nil, mp.newError("missing '}'")
+		}
+		return &argumentPart{name: name, isNumber: true}, nil
+
+	case "plural", "selectordinal":
+		if !mp.consume(',') {
+			return nil, mp.newError("expected ',' after plural")
+		}
+		part := &pluralPart{name: name}
+
+		mp.skipWhitespace()
+		if strings.HasPrefix(string(mp.runes[mp.position:]), "offset:") {
+			mp.position += len("offset:")
+			offsetString := mp.parseIdentifier()
+			offset, err := strconv.ParseFloat(offsetString, 64)
+			if err != nil {
+				return nil, mp.newError("bad plural offset")
+			}
+			part.offset = offset
+		}
+
+		options, err := mp.parseOptions(depth, true)
+		if err != nil {
+			return nil, err
+		}
+		part.options = options
+		return part, nil
+
+	case "select":
+		if !mp.consume(',') {
+			return nil, mp.newError("expected ',' after select")
+		}
+		options, err := mp.parseOptions(depth, false)
+		if err != nil {
+			return nil, err
+		}
+		return &selectPart{name: name, options: options}, nil
+	}
+
+	return nil, mp.newError("unknown argument type: " + argumentType)
+}
+
+func (mp *messageParser) parseOptions(depth int, inPlural bool) (map[string]*parsedMessage, error) {
+	options := make(map[string]*parsedMessage)
+
+	for {
+		mp.skipWhitespace()
+		if mp.consume('}') {
+			break
+		}
+		if mp.position >= len(mp.runes) {
+			return nil, mp.newError("missing '}'")
+		}
+
+		selector := mp.parseIdentifier()
+		if selector == "" {
+			return nil, mp.newError("missing option selector")
+		}
+		mp.skipWhitespace()
+		if !mp.consume('{') {
+			return nil, mp.newError("expected '{' after option " + selector)
+		}
+
+		option, err := mp.parseMessage(depth+1, inPlural)
+		if err != nil {
+			return nil, err
+		}
+		mp.position++ // '}' closing the option
+		options[selector] = option
+	}
+
+	if _, ok := options["other"]; !ok {
+		return nil, mp.newError("missing 'other' option")
+	}
+	return options, nil
+}
+
+func (mp *messageParser) parseIdentifier() string {
+	mp.skipWhitespace()
+	start := mp.position
+	for mp.position < len(mp.runes) {
+		r := mp.runes[mp.position]
+		if r == '{' || r == '}' || r == ',' || r == '\'' || r == ' ' || r == '\t' || r == '\n' || r == '\r' {
+			break
+		}
+		mp.position++
+	}
+	return string(mp.runes[start:mp.position])
+}
+
+func (mp *messageParser) skipWhitespace() {
+	for mp.position < len(mp.runes) && strings.ContainsRune(" \t\n\r", mp.runes[mp.position]) {
+		mp.position++
+	}
+}
+
+func (mp *messageParser) consume(r rune) bool {
+	if mp.position < len(mp.runes) && mp.runes[mp.position] == r {
+		mp.position++
+		return true
+	}
+	return false
+}
+
+/********** Plural rules **********/
+
+/**
+ * CLDR plural category of an integer in the language. Non-integers are always "other"
+ */
+func getPluralCategory(language string, n float64) string {
+	if n != math.Trunc(n) {
+		return "other"
+	}
+	i := int64(math.Abs(n))
+	mod10 := i % 10
+	mod100 := i % 100
+
+	switch language {
+	case "ja", "zh", "ko", "vi", "th", "id", "ms", "lo", "my", "km":
+		return "other"
+
+	case "fr", "pt", "hi", "bn":
+		if i <= 1 {
+			return "one"
+		}
+		return "other"
+
+	case "ru", "uk", "be":
+		if mod10 == 1 && mod100 != 11 {
+			return "one"
+		}
+		if mod10 >= 2 && mod10 <= 4 && (mod100 < 12 || mod100 > 14) {
+			return "few"
+		}
+		return "many"
+
+	case "pl":
+		if i == 1 {
+			return "one"
+		}
+		if mod10 >= 2 && mod10 <= 4 && (mod100 < 12 || mod100 > 14) {
+			return "few"
+		}
+		return "many"
+
+	case "cs", "sk":
+		if i == 1 {
+			return "one"
+		}
+		if i >= 2 && i <= 4 {
+			return "few"
+		}
+		return "other"
+
+	case "ar":
+		switch {
+		case i == 0:
+			return "zero"
+		case i == 1:
+			return "one"
+		case i == 2:
+			return "two"
+		case mod100 >= 3 && mod100 <= 10:
+			return "few"
+		case mod100 >= 11:
+			return "many"
+		}
+		return "other"
+	}
+
+	// English and most other european languages
+	if i == 1 {
+		return "one"
+	}
+	return "other"
+}
+
+/********** Argument conversion **********/
+
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		number, err := strconv.ParseFloat(v, 64)
+		return number, err == nil
+	}
+	return 0, false
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	if number, ok := toNumber(value); ok {
+		return formatNumber(number)
+	}
+	return ""
+}
+
+func formatNumber(number float64) string {
+	return strconv.FormatFloat(number, 'f', -1, 64)
+}
@@ -0,0 +1,343 @@
+package localization_service
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spacetimi/timi_shared_server/code/core"
+	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service"
+	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_factory"
+	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
+	"github.com/spacetimi/timi_shared_server/utils/logger"
+)
+
+type Config struct {
+	// "shared" or "app"
+	Space string
+
+	// Last locale in every fallback chain, and the source of truth for which string keys exist
+	DefaultLocale string
+
+	// All locales with string tables (including the default locale)
+	Locales []string
+
+	metadataSpace metadata_typedefs.MetadataSpace
+}
+
+func (cfg *Config) OnConfigLoaded() {
+	switch strings.ToLower(cfg.Space) {
+	case "shared":
+		cfg.metadataSpace = metadata_typedefs.METADATA_SPACE_SHARED
+	case "app", "":
+		cfg.metadataSpace = metadata_typedefs.METADATA_SPACE_APP
+	default:
+		logger.LogFatal("unknown metadata space in localization service config" +
+			"|space=" + cfg.Space)
+	}
+
+	cfg.DefaultLocale = NormalizeLocale(cfg.DefaultLocale)
+	if cfg.DefaultLocale == "" {
+		cfg.DefaultLocale = "en"
+	}
+
+	locales := []string{cfg.DefaultLocale}
+	for _, locale := range cfg.Locales {
+		locale = NormalizeLocale(locale)
+		if locale != "" && !containsString(locales, locale) {
+			locales = append(locales, locale)
+		}
+	}
+	cfg.Locales = locales
+}
+
+var _config *Config
+
+// Parsed string tables, by metadata key and manifest hash (so they are shared by all versions with the same content)
+var _stringTableCache map[string]*cachedStringTable
+var _stringTableCacheMutex sync.Mutex
+
+const kMaxCachedStringTables = 64
+
+type cachedStringTable struct {
+	table    *StringTable
+	messages map[string]*parsedMessage
+}
+
+/**
+ * Must be initialized after the metadata service, since it registers a metadata factory for each locale's string table
+ */
+func Initialize(cfg *Config) {
+	_config = cfg
+	_stringTableCache = make(map[string]*cachedStringTable)
+
+	for _, locale := range cfg.Locales {
+		metadata_factory.RegisterFactory(GetStringTableMetadataKey(locale), StringTableFactory{Locale: locale, Space: cfg.metadataSpace})
+	}
+}
+
+func IsInitialized() bool {
+	return _config != nil
+}
+
+func GetDefaultLocale() string {
+	return _config.DefaultLocale
+}
+
+/**
+ * The default locale first
+ */
+func GetSupportedLocales() []string {
+	return _config.Locales
+}
+
+func GetMetadataSpace() metadata_typedefs.MetadataSpace {
+	return _config.metadataSpace
+}
+
+/**
+ * Locales to look a string up in, in order. eg: "pt_BR" => [pt-BR, pt, en]
+ * Only locales that are configured are included, and the default locale is always last
+ */
+func GetLocaleFallbackChain(locale string) []string {
+	var chain []string
+
+	tokens := strings.Split(NormalizeLocale(locale), "-")
+	for i := len(tokens); i > 0; i-- {
+		candidate := strings.Join(tokens[:i], "-")
+		if containsString(_config.Locales, candidate) && !containsString(chain, candidate) {
+			chain = append(chain, candidate)
+		}
+	}
+
+	if !containsString(chain, _config.DefaultLocale) {
+		chain = append(chain, _config.DefaultLocale)
+	}
+	return chain
+}
+
+/**
+ * Returns the message for the key in the first locale of the fallback chain that has it, or the key itself if no locale does.
+ * Quoting in the message is resolved, but messages with arguments are returned as they are (use FormatString for those)
+ */
+func GetString(key string, locale string, appVersion *core.AppVersion) string {
+	cached, _ := findStringTableWithKey(key, locale, appVersion)
+	if cached == nil {
+		return key
+	}
+
+	formatted, err := cached.messages[key].format(nil, "", nil)
+	if err != nil {
+		return cached.table.Strings[key]
+	}
+	return formatted
+}
+
+/**
+ * Formats the message for the key (found as in GetString) with the arguments.
+ * Plurals are chosen with the rules of the locale the message was found in
+ */
+func FormatString(key string, locale string, appVersion *core.AppVersion, args map[string]interface{}) (string, error) {
+	cached, foundInLocale := findStringTableWithKey(key, locale, appVersion)
+	if cached == nil {
+		return key, errors.New("no translation for string key: " + key)
+	}
+
+	formatted, err := cached.messages[key].format(args, getLanguage(foundInLocale), nil)
+	if err != nil {
+		return key, errors.New("error formatting " + key + " in " + foundInLocale + ": " + err.Error())
+	}
+	return formatted, nil
+}
+
+func findStringTableWithKey(key string, locale string, appVersion *core.AppVersion) (*cachedStringTable, string) {
+	for _, candidateLocale := range GetLocaleFallbackChain(locale) {
+		cached := getStringTable(candidateLocale, appVersion)
+		if cached == nil {
+			continue
+		}
+		if _, ok := cached.messages[key]; ok {
+			return cached, candidateLocale
+		}
+	}
+	return nil, ""
+}
+
+/**
+ * Returns nil if the locale has no string table in the version
+ */
+func getStringTable(locale string, appVersion *core.AppVersion) *cachedStringTable {
+	mds := metadata_service.Instance()
+	metadataKey := GetStringTableMetadataKey(locale)
+
+	version, err := mds.ResolveMetadataVersion(appVersion, _config.metadataSpace)
+	if err != nil {
+		logger.LogError("error resolving metadata version for string table" +
+			"|locale=" + locale +
+			"|app version=" + appVersion.String() +
+			"|error=" + err.Error())
+		return nil
+	}
+
+	manifestItem, err := mds.GetMetadataManifestItemInVersion(metadataKey, version, _config.metadataSpace)
+	if err != nil || manifestItem == nil {
+		return nil
+	}
+
+	cacheKey := metadataKey + "|" + manifestItem.Hash
+	_stringTableCacheMutex.Lock()
+	cached, ok := _stringTableCache[cacheKey]
+	_stringTableCacheMutex.Unlock()
+	if ok {
+		return cached
+	}
+
+	metadataJson, err := mds.GetMetadataJsonByKey(metadataKey, _config.metadataSpace, version, metadata_typedefs.METADATA_PLATFORM_NONE)
+	if err != nil {
+		logger.LogError("error getting string table" +
+			"|locale=" + locale +
+			"|version=" + version.String() +
+			"|error=" + err.Error())
+		return nil
+	}
+
+	cached, err = newCachedStringTable(metadataJson)
+	if err != nil {
+		logger.LogError("bad string table" +
+			"|locale=" + locale +
+			"|version=" + version.String() +
+			"|error=" + err.Error())
+		return nil
+	}
+
+	_stringTableCacheMutex.Lock()
+	if len(_stringTableCache) >= kMaxCachedStringTables {
+		// Tables of old versions pile up as strings are edited, just start over
+		_stringTableCache = make(map[string]*cachedStringTable)
+	}
+	_stringTableCache[cacheKey] = cached
+	_stringTableCacheMutex.Unlock()
+
+	return cached
+}
+
+func newCachedStringTable(metadataJson string) (*cachedStringTable, error) {
+	table := &StringTable{}
+	err := json.Unmarshal([]byte(metadataJson), table)
+	if err != nil {
+		return nil, errors.New("error deserializing string table: " + err.Error())
+	}
+	table.space = _config.metadataSpace
+
+	cached := &cachedStringTable{
+		table:    table,
+		messages: make(map[string]*parsedMessage, len(table.Strings)),
+	}
+	for stringKey, message := range table.Strings {
+		parsed, err := parseMessage(message)
+		if err != nil {
+			return nil, errors.New("bad message for " + stringKey + ": " + err.Error())
+		}
+		cached.messages[stringKey] = parsed
+	}
+
+	return cached, nil
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ * Returns the string tables of all configured locales in the metadata version (empty tables for locales that have none yet)
+ */
+func GetStringTablesInVersion(version *core.AppVersion) (map[string]*StringTable, error) {
+	mds := metadata_service.Instance()
+
+	manifestItems, err := mds.GetMetadataManifestItemsInVersion(version.String(), _config.metadataSpace)
+	if err != nil {
+		return nil, errors.New("error getting metadata manifest: " + err.Error())
+	}
+
+	tables := make(map[string]*StringTable, len(_config.Locales))
+	for _, locale := range _config.Locales {
+		table := &StringTable{Locale: locale, Strings: make(map[string]string), space: _config.metadataSpace}
+		tables[locale] = table
+
+		metadataKey := GetStringTableMetadataKey(locale)
+		defined := false
+		for _, manifestItem := range manifestItems {
+			if manifestItem.MetadataKey == metadataKey {
+				defined = true
+				break
+			}
+		}
+		if !defined {
+			continue
+		}
+
+		metadataJson, err := mds.GetMetadataItemRawContent(metadataKey, version, _config.metadataSpace)
+		if err != nil {
+			return nil, errors.New("error reading string table for " + locale + ": " + err.Error())
+		}
+		err = json.Unmarshal([]byte(metadataJson), table)
+		if err != nil {
+			return nil, errors.New("error deserializing string table for " + locale + ": " + err.Error())
+		}
+		if table.Strings == nil {
+			table.Strings = make(map[string]string)
+		}
+	}
+
+	return tables, nil
+}
+
+type MissingTranslation struct {
+	StringKey      string
+	MissingLocales []string
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ * Lists the string keys of the default locale that are missing (or empty) in other locales, sorted by key.
+ * Locales are expected to have their own translation even if a fallback locale has one
+ */
+func GetMissingTranslations(tables map[string]*StringTable) []*MissingTranslation {
+	defaultTable, ok := tables[_config.DefaultLocale]
+	if !ok {
+		return nil
+	}
+
+	var missingTranslations []*MissingTranslation
+	for _, stringKey := range getSortedStringKeys(defaultTable) {
+		missing := &MissingTranslation{StringKey: stringKey}
+		for _, locale := range _config.Locales[1:] {
+			table, ok := tables[locale]
+			if !ok || table.Strings[stringKey] == "" {
+				missing.MissingLocales = append(missing.MissingLocales, locale)
+			}
+		}
+		if len(missing.MissingLocales) != 0 {
+			missingTranslations = append(missingTranslations, missing)
+		}
+	}
+
+	return missingTranslations
+}
+
+func getSortedStringKeys(table *StringTable) []string {
+	keys := make([]string, 0, len(table.Strings))
+	for stringKey := range table.Strings {
+		keys = append(keys, stringKey)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package localization_service
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
+)
+
+const kStringTableMetadataKeyPrefix = "Strings_"
+
+/**
+ * The strings of one locale, stored as a metadata item (eg: "Strings_pt-BR") in the space the localization service is configured for.
+ * Messages are in ICU MessageFormat (see localization_message_format.go)
+ */
+type StringTable struct {
+	Locale  string
+	Strings map[string]string // string key => message
+
+	space metadata_typedefs.MetadataSpace
+}
+
+func GetStringTableMetadataKey(locale string) string {
+	return kStringTableMetadataKeyPrefix + locale
+}
+
+func (st *StringTable) GetKey() string {
+	return GetStringTableMetadataKey(st.Locale)
+}
+
+func (st *StringTable) GetMetadataSpace() metadata_typedefs.MetadataSpace {
+	return st.space
+}
+
+type StringTableFactory struct {
+	Locale string
+	Space  metadata_typedefs.MetadataSpace
+}
+
+func (stf StringTableFactory) Instantiate() metadata_typedefs.IMetadataItem {
+	return &stringTableForFactory{
+		StringTable: StringTable{
+			Locale: stf.Locale,
+			space:  stf.Space,
+		},
+		expectedLocale: stf.Locale,
+	}
+}
+
+/**
+ * Remembers which locale the item was instantiated for, so that Validate can catch a table uploaded under another locale's key
+ */
+type stringTableForFactory struct {
+	StringTable
+	expectedLocale string
+}
+
+func (stff *stringTableForFactory) GetKey() string {
+	return GetStringTableMetadataKey(stff.expectedLocale)
+}
+
+func (stff *stringTableForFactory) Validate() error {
+	if stff.Locale != stff.expectedLocale {
+		return errors.New("string table is for locale " + stff.Locale + ", expected " + stff.expectedLocale)
+	}
+	return stff.StringTable.Validate()
+}
+
+/**
+ * Meant to be called before saving new strings
+ */
+func (st *StringTable) Validate() error {
+	if st.Locale == "" {
+		return errors.New("string table with no locale")
+	}
+	if NormalizeLocale(st.Locale) != st.Locale {
+		return errors.New("locale is not normalized, expected: " + NormalizeLocale(st.Locale))
+	}
+
+	for stringKey, message := range st.Strings {
+		if stringKey == "" || strings.TrimSpace(stringKey) != stringKey {
+			return errors.New("bad string key: '" + stringKey + "'")
+		}
+		_, err := parseMessage(message)
+		if err != nil {
+			return errors.New("bad message for " + stringKey + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+/**
+ * "pt_br" => "pt-BR", "ZH-hant-tw" => "zh-Hant-TW"
+ */
+func NormalizeLocale(locale string) string {
+	tokens := strings.Split(strings.Replace(strings.TrimSpace(locale), "_", "-", -1), "-")
+	for i, token := range tokens {
+		switch {
+		case i == 0:
+			tokens[i] = strings.ToLower(token)
+		case len(token) == 4:
+			tokens[i] = strings.ToUpper(token[:1]) + strings.ToLower(token[1:])
+		case len(token) == 2:
+			tokens[i] = strings.ToUpper(token)
+		default:
+			tokens[i] = strings.ToLower(token)
+		}
+	}
+	return strings.Join(tokens, "-")
+}
+
+func getLanguage(locale string) string {
+	return strings.SplitN(locale, "-", 2)[0]
+}
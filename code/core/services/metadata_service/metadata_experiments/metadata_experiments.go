@@ -0,0 +1,189 @@
+package metadata_experiments
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
+	"github.com/spacetimi/timi_shared_server/utils/json_utils"
+)
+
+const ExperimentsMetadataKey = "Experiments"
+
+/**
+ * Experiment definitions, stored as a shared metadata item.
+ * Each experiment deterministically buckets users into one of its variants,
+ * and each variant can overlay (as a JSON merge patch, RFC 7386) any metadata items it wants to change
+ */
+type ExperimentsMetadata struct {
+	Experiments []*Experiment
+}
+
+type Experiment struct {
+	ExperimentId string
+	Enabled      bool
+
+	// Changing the salt reshuffles which users land in which variant
+	Salt string
+
+	Variants []*ExperimentVariant
+}
+
+type ExperimentVariant struct {
+	VariantId string
+
+	// Relative share of users that are bucketed into this variant
+	Weight int
+
+	// metadata item key => merge patch to apply on top of the base item
+	Overlays map[string]json.RawMessage `json:",omitempty"`
+}
+
+type ExperimentAssignment struct {
+	ExperimentId string
+	VariantId    string
+}
+
+func (em *ExperimentsMetadata) GetKey() string {
+	return ExperimentsMetadataKey
+}
+
+func (em *ExperimentsMetadata) GetMetadataSpace() metadata_typedefs.MetadataSpace {
+	return metadata_typedefs.METADATA_SPACE_SHARED
+}
+
+type ExperimentsMetadataFactory struct {
+}
+
+func (emf ExperimentsMetadataFactory) Instantiate() metadata_typedefs.IMetadataItem {
+	return &ExperimentsMetadata{}
+}
+
+/**
+ * Returns the variant the user is bucketed into, or nil if the experiment is disabled or has no variants with weight
+ */
+func (e *Experiment) GetVariantForUser(userId int64) *ExperimentVariant {
+	if !e.Enabled {
+		return nil
+	}
+
+	totalWeight := 0
+	for _, variant := range e.Variants {
+		if variant.Weight > 0 {
+			totalWeight += variant.Weight
+		}
+	}
+	if totalWeight == 0 {
+		return nil
+	}
+
+	bucket := int(getUserBucketHash(e.Salt, e.ExperimentId, userId) % uint64(totalWeight))
+	for _, variant := range e.Variants {
+		if variant.Weight <= 0 {
+			continue
+		}
+		if bucket < variant.Weight {
+			return variant
+		}
+		bucket -= variant.Weight
+	}
+
+	return nil
+}
+
+/**
+ * Assignments of the user in all enabled experiments, in the order the experiments are defined
+ */
+func (em *ExperimentsMetadata) GetAssignmentsForUser(userId int64) []*ExperimentAssignment {
+	var assignments []*ExperimentAssignment
+	for _, experiment := range em.Experiments {
+		variant := experiment.GetVariantForUser(userId)
+		if variant == nil {
+			continue
+		}
+		assignments = append(assignments, &ExperimentAssignment{
+			ExperimentId: experiment.ExperimentId,
+			VariantId:    variant.VariantId,
+		})
+	}
+
+	return assignments
+}
+
+/**
+ * Applies the overlays of the user's variants for the metadata item on top of its json.
+ * Returns the new json, and the assignments of the experiments that changed it
+ */
+func (em *ExperimentsMetadata) ApplyOverlaysForUser(metadataItemKey string, metadataJson string, userId int64) (string, []*ExperimentAssignment, error) {
+	var assignments []*ExperimentAssignment
+	for _, experiment := range em.Experiments {
+		variant := experiment.GetVariantForUser(userId)
+		if variant == nil {
+			continue
+		}
+
+		overlay, ok := variant.Overlays[metadataItemKey]
+		if !ok {
+			continue
+		}
+
+		mergedJson, err := json_utils.ApplyMergePatch([]byte(metadataJson), overlay)
+		if err != nil {
+			return "", nil, errors.New("error applying overlay for experiment " + experiment.ExperimentId + ": " + err.Error())
+		}
+		metadataJson = string(mergedJson)
+
+		assignments = append(assignments, &ExperimentAssignment{
+			ExperimentId: experiment.ExperimentId,
+			VariantId:    variant.VariantId,
+		})
+	}
+
+	return metadataJson, assignments, nil
+}
+
+/**
+ * Meant to be called before saving new experiment definitions
+ */
+func (em *ExperimentsMetadata) Validate() error {
+	experimentIds := make(map[string]bool)
+	for _, experiment := range em.Experiments {
+		if experiment.ExperimentId == "" {
+			return errors.New("experiment with no id")
+		}
+		if experimentIds[experiment.ExperimentId] {
+			return errors.New("duplicate experiment id: " + experiment.ExperimentId)
+		}
+		experimentIds[experiment.ExperimentId] = true
+
+		variantIds := make(map[string]bool)
+		for _, variant := range experiment.Variants {
+			if variant.VariantId == "" {
+				return errors.New("variant with no id in experiment: " + experiment.ExperimentId)
+			}
+			if variantIds[variant.VariantId] {
+				return errors.New("duplicate variant id in experiment " + experiment.ExperimentId + ": " + variant.VariantId)
+			}
+			variantIds[variant.VariantId] = true
+
+			if variant.Weight < 0 {
+				return errors.New("negative weight for variant " + variant.VariantId + " in experiment " + experiment.ExperimentId)
+			}
+			for metadataItemKey, overlay := range variant.Overlays {
+				if !json_utils.IsJsonObject(overlay) {
+					return errors.New("overlay for " + metadataItemKey + " in variant " + variant.VariantId + " is not a json object")
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func getUserBucketHash(salt string, experimentId string, userId int64) uint64 {
+	hash := sha256.Sum256([]byte(salt + ":" + experimentId + ":" + strconv.FormatInt(userId, 10)))
+	return binary.BigEndian.Uint64(hash[:8])
+}
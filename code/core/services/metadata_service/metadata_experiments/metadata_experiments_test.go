@@ -0,0 +1,201 @@
+package metadata_experiments
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func newTestExperiment(experimentId string, salt string, weights map[string]int) *Experiment {
+	experiment := &Experiment{
+		ExperimentId: experimentId,
+		Enabled:      true,
+		Salt:         salt,
+	}
+	for _, variantId := range []string{"control", "a", "b"} {
+		weight, ok := weights[variantId]
+		if !ok {
+			continue
+		}
+		experiment.Variants = append(experiment.Variants, &ExperimentVariant{VariantId: variantId, Weight: weight})
+	}
+	return experiment
+}
+
+func bucketTestUsers(experiment *Experiment, numUsers int) map[string]int {
+	counts := make(map[string]int)
+	for userId := int64(1); userId <= int64(numUsers); userId++ {
+		variant := experiment.GetVariantForUser(userId)
+		if variant == nil {
+			counts[""]++
+			continue
+		}
+		counts[variant.VariantId]++
+	}
+	return counts
+}
+
+func TestExperimentBucketingDistribution(t *testing.T) {
+	const kNumUsers = 20000
+	const kTolerance = 0.02
+
+	for _, weights := range []map[string]int{
+		{"control": 1, "a": 1},
+		{"control": 3, "a": 1},
+		{"control": 50, "a": 30, "b": 20},
+		{"control": 1, "a": 0, "b": 1},
+		{"a": 7},
+	} {
+		counts := bucketTestUsers(newTestExperiment("experiment", "salt", weights), kNumUsers)
+		if counts[""] != 0 {
+			t.Errorf("weights %v: %d users got no variant", weights, counts[""])
+		}
+
+		totalWeight := 0
+		for _, weight := range weights {
+			totalWeight += weight
+		}
+		for variantId, weight := range weights {
+			wantShare := float64(weight) / float64(totalWeight)
+			share := float64(counts[variantId]) / kNumUsers
+			if share < wantShare-kTolerance || share > wantShare+kTolerance {
+				t.Errorf("weights %v: variant %s got %.3f of users, want %.3f", weights, variantId, share, wantShare)
+			}
+		}
+		if weights["a"] == 0 && counts["a"] != 0 {
+			t.Errorf("weights %v: variant a has no weight but got %d users", weights, counts["a"])
+		}
+	}
+}
+
+func TestExperimentBucketingIsStable(t *testing.T) {
+	experiment := newTestExperiment("experiment", "salt", map[string]int{"control": 1, "a": 1, "b": 1})
+	sameExperiment := newTestExperiment("experiment", "salt", map[string]int{"control": 1, "a": 1, "b": 1})
+	resalted := newTestExperiment("experiment", "new salt", map[string]int{"control": 1, "a": 1, "b": 1})
+	otherExperiment := newTestExperiment("other experiment", "salt", map[string]int{"control": 1, "a": 1, "b": 1})
+
+	numResaltedMoves := 0
+	numOtherExperimentDifferences := 0
+	for userId := int64(1); userId <= 1000; userId++ {
+		variantId := experiment.GetVariantForUser(userId).VariantId
+		if experiment.GetVariantForUser(userId).VariantId != variantId ||
+			sameExperiment.GetVariantForUser(userId).VariantId != variantId {
+			t.Fatalf("user %d bucketed differently for the same experiment", userId)
+		}
+		if resalted.GetVariantForUser(userId).VariantId != variantId {
+			numResaltedMoves++
+		}
+		if otherExperiment.GetVariantForUser(userId).VariantId != variantId {
+			numOtherExperimentDifferences++
+		}
+	}
+
+	// About two thirds of the users should land elsewhere, for independent bucketings with three even variants
+	if numResaltedMoves < 500 {
+		t.Errorf("changing the salt moved only %d of 1000 users", numResaltedMoves)
+	}
+	if numOtherExperimentDifferences < 500 {
+		t.Errorf("only %d of 1000 users bucketed differently in another experiment", numOtherExperimentDifferences)
+	}
+}
+
+func TestExperimentGetVariantForUserNoVariant(t *testing.T) {
+	disabled := newTestExperiment("disabled", "salt", map[string]int{"control": 1, "a": 1})
+	disabled.Enabled = false
+	if counts := bucketTestUsers(disabled, 100); counts[""] != 100 {
+		t.Errorf("disabled experiment bucketed users: %v", counts)
+	}
+
+	if counts := bucketTestUsers(newTestExperiment("no variants", "salt", nil), 100); counts[""] != 100 {
+		t.Errorf("experiment without variants bucketed users: %v", counts)
+	}
+
+	noWeights := newTestExperiment("no weights", "salt", map[string]int{"control": 0, "a": 0})
+	if counts := bucketTestUsers(noWeights, 100); counts[""] != 100 {
+		t.Errorf("experiment without weights bucketed users: %v", counts)
+	}
+}
+
+func TestExperimentsMetadataApplyOverlaysForUser(t *testing.T) {
+	experiments := &ExperimentsMetadata{
+		Experiments: []*Experiment{
+			{
+				ExperimentId: "prices",
+				Enabled:      true,
+				Variants: []*ExperimentVariant{
+					{VariantId: "cheap", Weight: 1, Overlays: map[string]json.RawMessage{
+						"Shop": json.RawMessage(`{"Price":5}`),
+					}},
+				},
+			},
+			{
+				ExperimentId: "disabled",
+				Variants: []*ExperimentVariant{
+					{VariantId: "free", Weight: 1, Overlays: map[string]json.RawMessage{
+						"Shop": json.RawMessage(`{"Price":0}`),
+					}},
+				},
+			},
+			{
+				ExperimentId: "names",
+				Enabled:      true,
+				Variants: []*ExperimentVariant{
+					{VariantId: "renamed", Weight: 1, Overlays: map[string]json.RawMessage{
+						"Shop": json.RawMessage(`{"Name":"Store","Legacy":null}`),
+					}},
+				},
+			},
+		},
+	}
+
+	metadataJson, assignments, err := experiments.ApplyOverlaysForUser("Shop", `{"Name":"Shop","Price":10,"Legacy":true}`, 42)
+	if err != nil {
+		t.Fatalf("applying overlays: %v", err)
+	}
+
+	var got map[string]interface{}
+	err = json.Unmarshal([]byte(metadataJson), &got)
+	if err != nil {
+		t.Fatalf("deserializing %s: %v", metadataJson, err)
+	}
+	if got["Name"] != "Store" || got["Price"] != float64(5) || len(got) != 2 {
+		t.Errorf("got %s, want the overlays of the enabled experiments applied in order", metadataJson)
+	}
+
+	if len(assignments) != 2 ||
+		assignments[0].ExperimentId != "prices" || assignments[0].VariantId != "cheap" ||
+		assignments[1].ExperimentId != "names" || assignments[1].VariantId != "renamed" {
+		t.Errorf("got assignments %+v %+v", assignments[0], assignments[1])
+	}
+
+	metadataJson, assignments, err = experiments.ApplyOverlaysForUser("Inventory", `{"Slots":3}`, 42)
+	if err != nil || metadataJson != `{"Slots":3}` || len(assignments) != 0 {
+		t.Errorf("item without overlays changed: %s, %d assignments, error %v", metadataJson, len(assignments), err)
+	}
+}
+
+func TestExperimentsMetadataValidate(t *testing.T) {
+	testCases := []struct {
+		name        string
+		experiments []*Experiment
+		wantErr     bool
+	}{
+		{"valid", []*Experiment{newTestExperiment("e1", "", map[string]int{"control": 1, "a": 1}), newTestExperiment("e2", "", map[string]int{"a": 1})}, false},
+		{"no experiment id", []*Experiment{newTestExperiment("", "", map[string]int{"a": 1})}, true},
+		{"duplicate experiment id", []*Experiment{newTestExperiment("e1", "", map[string]int{"a": 1}), newTestExperiment("e1", "", map[string]int{"a": 1})}, true},
+		{"no variant id", []*Experiment{{ExperimentId: "e1", Variants: []*ExperimentVariant{{Weight: 1}}}}, true},
+		{"duplicate variant id", []*Experiment{{ExperimentId: "e1", Variants: []*ExperimentVariant{{VariantId: "a"}, {VariantId: "a"}}}}, true},
+		{"negative weight", []*Experiment{newTestExperiment("e1", "", map[string]int{"a": -1})}, true},
+		{"overlay not an object", []*Experiment{{ExperimentId: "e1", Variants: []*ExperimentVariant{
+			{VariantId: "a", Overlays: map[string]json.RawMessage{"Shop": json.RawMessage(`[1]`)}},
+		}}}, true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := (&ExperimentsMetadata{Experiments: testCase.experiments}).Validate()
+			if (err != nil) != testCase.wantErr {
+				t.Errorf("got error %v, want error: %v", err, testCase.wantErr)
+			}
+		})
+	}
+}
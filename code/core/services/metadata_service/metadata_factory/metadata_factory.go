@@ -41,4 +41,27 @@ func InstantiateMetadataItem(metadataItemKey string) (metadata_typedefs.IMetadat
 
 type IMetadataFactory interface {
     Instantiate() metadata_typedefs.IMetadataItem
-}
\ No newline at end of file
+}
+/**
+ * Implemented by factories of metadata items that are lists of records, so that they can also be edited as spreadsheets
+ */
+type ITabularMetadataFactory interface {
+    IMetadataFactory
+    GetTabularMapping() *metadata_typedefs.MetadataTabularMapping
+}
+
+/**
+ * Returns nil if the metadata item is not tabular
+ */
+func GetTabularMapping(metadataItemKey string) *metadata_typedefs.MetadataTabularMapping {
+    factory, ok := kMetadataFactories[metadataItemKey]
+    if !ok {
+        return nil
+    }
+
+    tabularFactory, ok := factory.(ITabularMetadataFactory)
+    if !ok {
+        return nil
+    }
+    return tabularFactory.GetTabularMapping()
+}
@@ -0,0 +1,274 @@
+package metadata_fetchers
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
+	"github.com/spacetimi/timi_shared_server/utils/file_utils"
+	"github.com/spacetimi/timi_shared_server/utils/logger"
+)
+
+/**
+ * Wraps a remote fetcher with a local disk cache:
+ *   <cache directory>/MetadataVersionList.json
+ *   <cache directory>/manifests/<version>.json
+ *   <cache directory>/items/<hash>.json
+ * Items are content-addressed by the hash in their manifest, so they are served from disk whenever the manifest
+ * still references the same content, and are verified against that hash whether they come from disk or the origin.
+ * The version list and manifests are always read from the origin, falling back to the last copies cached
+ * when the origin is unreachable
+ */
+type MetadataFetcherCached struct { // Implements IMetadataFetcher, IMetadataFetcherDecorator, IAtomicMetadataWriter
+	origin         metadata_typedefs.IMetadataFetcher
+	cacheDirectory string
+
+	// Manifests read so far, to look up the hashes of items (and platform overrides)
+	manifests      map[string]*metadata_typedefs.MetadataManifest // version => manifest
+	manifestsMutex sync.Mutex
+}
+
+func NewMetadataFetcherCached(origin metadata_typedefs.IMetadataFetcher, cacheDirectory string) (metadata_typedefs.IMetadataFetcher, error) {
+	for _, directory := range []string{cacheDirectory, filepath.Join(cacheDirectory, "manifests"), filepath.Join(cacheDirectory, "items")} {
+		err := os.MkdirAll(directory, 0755)
+		if err != nil {
+			return nil, errors.New("error creating metadata cache directory: " + err.Error())
+		}
+	}
+
+	mf := MetadataFetcherCached{
+		origin:         origin,
+		cacheDirectory: cacheDirectory,
+		manifests:      make(map[string]*metadata_typedefs.MetadataManifest),
+	}
+	return &mf, nil
+}
+
+/********** Begin IMetadataFetcher implementation **********/
+func (mf *MetadataFetcherCached) GetMetadataJsonByKey(key string, version string) (string, error) {
+	hash, err := mf.getItemHash(key, version)
+	if err != nil {
+		logger.LogWarning("metadata cache bypassed for item not in manifest" +
+			"|cache directory=" + mf.cacheDirectory +
+			"|version=" + version +
+			"|key=" + key +
+			"|error=" + err.Error())
+		return mf.origin.GetMetadataJsonByKey(key, version)
+	}
+
+	// Hashes are "<algorithm>:<digest>" (or bare legacy md5 digests)
+	cachedItemPath := filepath.Join(mf.cacheDirectory, "items", strings.Replace(hash, ":", "_", -1)+".json")
+	cachedJson, err := ioutil.ReadFile(cachedItemPath)
+	if err == nil {
+		if metadata_typedefs.VerifyMetadataJsonHash(string(cachedJson), hash) {
+			return string(cachedJson), nil
+		}
+		logger.LogWarning("discarding corrupt cached metadata item" +
+			"|path=" + cachedItemPath +
+			"|version=" + version +
+			"|key=" + key)
+		_ = os.Remove(cachedItemPath)
+	}
+
+	metadataJson, err := mf.origin.GetMetadataJsonByKey(key, version)
+	if err != nil {
+		return "", err
+	}
+
+	if !metadata_typedefs.VerifyMetadataJsonHash(metadataJson, hash) {
+		logger.LogError("metadata item from origin does not match its manifest hash" +
+			"|cache directory=" + mf.cacheDirectory +
+			"|version=" + version +
+			"|key=" + key +
+			"|manifest hash=" + hash)
+		return "", errors.New(metadata_typedefs.ERROR_FAILED_TO_READ_METADATA_FILE + ": hash mismatch")
+	}
+
+	mf.writeToCache(cachedItemPath, []byte(metadataJson))
+	return metadataJson, nil
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ */
+func (mf *MetadataFetcherCached) SetMetadataJsonByKey(key string, metadataJson string, version string) error {
+	return mf.origin.SetMetadataJsonByKey(key, metadataJson, version)
+}
+
+func (mf *MetadataFetcherCached) GetMetadataVersionList() (*metadata_typedefs.MetadataVersionList, error) {
+	cachedPath := filepath.Join(mf.cacheDirectory, "MetadataVersionList.json")
+
+	mvl, err := mf.origin.GetMetadataVersionList()
+	if err == nil {
+		mf.writeJsonToCache(cachedPath, mvl)
+		return mvl, nil
+	}
+
+	cachedMvl := metadata_typedefs.MetadataVersionList{}
+	cacheErr := file_utils.ReadJsonFileIntoJsonObject(cachedPath, &cachedMvl)
+	if cacheErr != nil {
+		return nil, err
+	}
+
+	logger.LogWarning("metadata source unreachable, using cached metadata version list" +
+		"|cache directory=" + mf.cacheDirectory +
+		"|error=" + err.Error())
+	cachedMvl.Initialize()
+	return &cachedMvl, nil
+}
+
+func (mf *MetadataFetcherCached) GetMetadataManifestForVersion(version string) (*metadata_typedefs.MetadataManifest, error) {
+	cachedPath := filepath.Join(mf.cacheDirectory, "manifests", version+".json")
+
+	manifest, err := mf.origin.GetMetadataManifestForVersion(version)
+	if err == nil {
+		mf.writeJsonToCache(cachedPath, manifest)
+		mf.setManifest(version, manifest)
+		return manifest, nil
+	}
+
+	cachedManifest := metadata_typedefs.MetadataManifest{}
+	cacheErr := file_utils.ReadJsonFileIntoJsonObject(cachedPath, &cachedManifest)
+	if cacheErr != nil {
+		return nil, err
+	}
+
+	logger.LogWarning("metadata source unreachable, using cached metadata manifest" +
+		"|cache directory=" + mf.cacheDirectory +
+		"|version=" + version +
+		"|error=" + err.Error())
+	cachedManifest.Initialize()
+	mf.setManifest(version, &cachedManifest)
+	return &cachedManifest, nil
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ */
+func (mf *MetadataFetcherCached) SetMetadataManifestForVersion(manifest *metadata_typedefs.MetadataManifest, version string) error {
+	err := mf.origin.SetMetadataManifestForVersion(manifest, version)
+	if err != nil {
+		return err
+	}
+
+	mf.onManifestSet(manifest, version)
+	return nil
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ */
+func (mf *MetadataFetcherCached) SetMetadataVersionList(mvl *metadata_typedefs.MetadataVersionList) error {
+	return mf.origin.SetMetadataVersionList(mvl)
+}
+
+/********** End IMetadataFetcher implementation **********/
+
+/********** Begin IAtomicMetadataWriter implementation **********/
+
+/**
+ * Only meant to be called from the admin tool / scripts.
+ * Fails if the origin can't write atomically (see metadata_typedefs.IAtomicMetadataWriter)
+ */
+func (mf *MetadataFetcherCached) SetMetadataJsonsWithManifest(metadataJsons map[string]string, manifest *metadata_typedefs.MetadataManifest, version string) error {
+	atomicWriter, ok := mf.origin.(metadata_typedefs.IAtomicMetadataWriter)
+	if !ok {
+		return errors.New("origin metadata fetcher does not support atomic writes")
+	}
+
+	err := atomicWriter.SetMetadataJsonsWithManifest(metadataJsons, manifest, version)
+	if err != nil {
+		return err
+	}
+
+	mf.onManifestSet(manifest, version)
+	return nil
+}
+
+/********** End IAtomicMetadataWriter implementation **********/
+
+/********** Begin IMetadataFetcherDecorator implementation **********/
+func (mf *MetadataFetcherCached) GetOriginMetadataFetcher() metadata_typedefs.IMetadataFetcher {
+	return mf.origin
+}
+
+/********** End IMetadataFetcherDecorator implementation **********/
+
+func (mf *MetadataFetcherCached) getItemHash(key string, version string) (string, error) {
+	mf.manifestsMutex.Lock()
+	manifest, ok := mf.manifests[version]
+	mf.manifestsMutex.Unlock()
+
+	if !ok {
+		var err error
+		manifest, err = mf.GetMetadataManifestForVersion(version)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	hash, ok := manifest.GetHashForStoredKey(key)
+	if !ok {
+		return "", errors.New("no such item in manifest")
+	}
+	return hash, nil
+}
+
+/**
+ * Items are then verified against the new manifest's hashes, instead of those of the manifest read before
+ */
+func (mf *MetadataFetcherCached) onManifestSet(manifest *metadata_typedefs.MetadataManifest, version string) {
+	mf.writeJsonToCache(filepath.Join(mf.cacheDirectory, "manifests", version+".json"), manifest)
+	mf.setManifest(version, manifest)
+}
+
+func (mf *MetadataFetcherCached) setManifest(version string, manifest *metadata_typedefs.MetadataManifest) {
+	mf.manifestsMutex.Lock()
+	mf.manifests[version] = manifest
+	mf.manifestsMutex.Unlock()
+}
+
+func (mf *MetadataFetcherCached) writeJsonToCache(path string, v interface{}) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		logger.LogWarning("error serializing metadata for cache" +
+			"|path=" + path +
+			"|error=" + err.Error())
+		return
+	}
+	mf.writeToCache(path, bytes)
+}
+
+/**
+ * Writes to a temporary file first and renames it into place, so that a crash never leaves a partial file in the cache.
+ * Failing to write to the cache is not fatal, the content was fetched fine
+ */
+func (mf *MetadataFetcherCached) writeToCache(path string, contents []byte) {
+	tempFile, err := ioutil.TempFile(filepath.Dir(path), ".tmp_")
+	if err != nil {
+		logger.LogWarning("error creating temporary file in metadata cache" +
+			"|path=" + path +
+			"|error=" + err.Error())
+		return
+	}
+
+	_, err = tempFile.Write(contents)
+	closeErr := tempFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tempFile.Name())
+		logger.LogWarning("error writing to metadata cache" +
+			"|path=" + path +
+			"|error=" + err.Error())
+	}
+}
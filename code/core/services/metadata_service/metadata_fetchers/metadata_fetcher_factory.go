@@ -1,6 +1,8 @@
 package metadata_fetchers
 
 import (
+	"path/filepath"
+
 	"github.com/spacetimi/timi_shared_server/code/config"
 	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
 	"github.com/spacetimi/timi_shared_server/utils/logger"
@@ -12,6 +14,12 @@ func NewMetadataFetcher(metadataSpace metadata_typedefs.MetadataSpace) metadata_
 	if metadataSpace == metadata_typedefs.METADATA_SPACE_SHARED {
 		if config.GetEnvironmentConfiguration().SharedMetadataSourceURL == "local" {
 			fetcher = NewMetadataFetcherFilesystem(config.GetSharedMetadataFilesPath())
+		} else if IsGitSourceURL(config.GetEnvironmentConfiguration().SharedMetadataSourceURL) {
+			fetcher = newMetadataFetcherGitOrDie(config.GetEnvironmentConfiguration().SharedMetadataSourceURL, metadataSpace)
+		} else if IsMongoSourceURL(config.GetEnvironmentConfiguration().SharedMetadataSourceURL) {
+			fetcher = newMetadataFetcherMongoOrDie(config.GetEnvironmentConfiguration().SharedMetadataSourceURL, metadataSpace)
+		} else if IsS3APISourceURL(config.GetEnvironmentConfiguration().SharedMetadataSourceURL) {
+			fetcher = newMetadataFetcherS3APIOrDie(config.GetEnvironmentConfiguration().SharedMetadataSourceURL, metadataSpace)
 		} else {
 			fetcher = NewMetadataFetcherS3(config.GetEnvironmentConfiguration().SharedMetadataSourceURL, config.GetEnvironmentConfiguration().AdminToolConfig.SharedMetadataS3BucketName)
 		}
@@ -20,15 +28,76 @@ func NewMetadataFetcher(metadataSpace metadata_typedefs.MetadataSpace) metadata_
 	if metadataSpace == metadata_typedefs.METADATA_SPACE_APP {
 		if config.GetEnvironmentConfiguration().AppMetadataSourceURL == "local" {
 			fetcher = NewMetadataFetcherFilesystem(config.GetAppMetadataFilesPath())
+		} else if IsGitSourceURL(config.GetEnvironmentConfiguration().AppMetadataSourceURL) {
+			fetcher = newMetadataFetcherGitOrDie(config.GetEnvironmentConfiguration().AppMetadataSourceURL, metadataSpace)
+		} else if IsMongoSourceURL(config.GetEnvironmentConfiguration().AppMetadataSourceURL) {
+			fetcher = newMetadataFetcherMongoOrDie(config.GetEnvironmentConfiguration().AppMetadataSourceURL, metadataSpace)
+		} else if IsS3APISourceURL(config.GetEnvironmentConfiguration().AppMetadataSourceURL) {
+			fetcher = newMetadataFetcherS3APIOrDie(config.GetEnvironmentConfiguration().AppMetadataSourceURL, metadataSpace)
 		} else {
 			fetcher = NewMetadataFetcherS3(config.GetEnvironmentConfiguration().AppMetadataSourceURL, config.GetEnvironmentConfiguration().AdminToolConfig.AppMetadataS3BucketName)
 		}
 	}
 
 	if fetcher == nil {
-		logger.LogFatal("Unable to create metadata fetcher|metadataspace=" + string(metadataSpace))
+		logger.LogFatal("Unable to create metadata fetcher|metadataspace=" + metadataSpace.String())
+		return nil
+	}
+
+	// Metadata on the local filesystem gains nothing from a disk cache
+	_, isLocal := fetcher.(*MetadataFetcherFilesystem)
+	if len(config.GetEnvironmentConfiguration().MetadataCacheDirectory) != 0 && !isLocal {
+		fetcher = newMetadataFetcherCachedOrDie(fetcher, metadataSpace)
+	}
+
+	return fetcher
+}
+
+func newMetadataFetcherCachedOrDie(origin metadata_typedefs.IMetadataFetcher, metadataSpace metadata_typedefs.MetadataSpace) metadata_typedefs.IMetadataFetcher {
+	cacheDirectory := filepath.Join(config.GetEnvironmentConfiguration().MetadataCacheDirectory, metadataSpace.String())
+	fetcher, err := NewMetadataFetcherCached(origin, cacheDirectory)
+	if err != nil {
+		logger.LogFatal("Unable to create cached metadata fetcher" +
+			"|metadataspace=" + metadataSpace.String() +
+			"|cache directory=" + cacheDirectory +
+			"|error=" + err.Error())
 		return nil
 	}
+	return fetcher
+}
 
+func newMetadataFetcherS3APIOrDie(sourceURL string, metadataSpace metadata_typedefs.MetadataSpace) metadata_typedefs.IMetadataFetcher {
+	fetcher, err := NewMetadataFetcherS3API(sourceURL, config.GetEnvironmentConfiguration().MetadataS3Config)
+	if err != nil {
+		logger.LogFatal("Unable to create s3 metadata fetcher" +
+			"|metadataspace=" + metadataSpace.String() +
+			"|source url=" + sourceURL +
+			"|error=" + err.Error())
+		return nil
+	}
+	return fetcher
+}
+
+func newMetadataFetcherMongoOrDie(sourceURL string, metadataSpace metadata_typedefs.MetadataSpace) metadata_typedefs.IMetadataFetcher {
+	fetcher, err := NewMetadataFetcherMongo(sourceURL)
+	if err != nil {
+		logger.LogFatal("Unable to create mongo metadata fetcher" +
+			"|metadataspace=" + metadataSpace.String() +
+			"|source url=" + sourceURL +
+			"|error=" + err.Error())
+		return nil
+	}
+	return fetcher
+}
+
+func newMetadataFetcherGitOrDie(sourceURL string, metadataSpace metadata_typedefs.MetadataSpace) metadata_typedefs.IMetadataFetcher {
+	fetcher, err := NewMetadataFetcherGit(sourceURL)
+	if err != nil {
+		logger.LogFatal("Unable to create git metadata fetcher" +
+			"|metadataspace=" + metadataSpace.String() +
+			"|source url=" + sourceURL +
+			"|error=" + err.Error())
+		return nil
+	}
 	return fetcher
 }
@@ -0,0 +1,267 @@
+package metadata_fetchers
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/spacetimi/timi_shared_server/code/config"
+	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
+	"github.com/spacetimi/timi_shared_server/utils/file_utils"
+	"github.com/spacetimi/timi_shared_server/utils/git_utils"
+	"github.com/spacetimi/timi_shared_server/utils/logger"
+)
+
+const kGitSourceURLScheme = "git://"
+const kGitDefaultBranch = "master"
+const kGitDefaultAuthor = "metadata_service"
+
+/**
+ * Reads metadata from a branch of a local git repo (checkout or bare), using the same layout as the filesystem fetcher:
+ *   MetadataVersionList.json, <version>/MetadataManifest.json, <version>/<key>.json
+ * Every write is a commit on the branch, authored by the admin who made it
+ * (the working tree of a checkout is never touched, so pull to see admin writes there)
+ */
+type MetadataFetcherGit struct { // Implements IMetadataFetcher, IAtomicMetadataWriter, IMetadataWriteAuthorSetter, IMetadataRefImporter
+	repoPath string
+	branch   string
+	author   string
+}
+
+func IsGitSourceURL(sourceURL string) bool {
+	return strings.HasPrefix(sourceURL, kGitSourceURLScheme)
+}
+
+/**
+ * sourceURL is of the form: git://<absolute path to repo>#<optional branch>
+ */
+func NewMetadataFetcherGit(sourceURL string) (metadata_typedefs.IMetadataFetcher, error) {
+	if !IsGitSourceURL(sourceURL) {
+		return nil, errors.New("not a git source url: " + sourceURL)
+	}
+
+	tokens := strings.SplitN(strings.TrimPrefix(sourceURL, kGitSourceURLScheme), "#", 2)
+	repoPath := tokens[0]
+	if !file_utils.DoesFileOrDirectoryExist(repoPath) {
+		return nil, errors.New("git repo not found: " + repoPath)
+	}
+
+	branch := kGitDefaultBranch
+	if len(tokens) == 2 && len(tokens[1]) != 0 {
+		branch = tokens[1]
+	}
+
+	mf := MetadataFetcherGit{
+		repoPath: repoPath,
+		branch:   branch,
+		author:   kGitDefaultAuthor,
+	}
+	return &mf, nil
+}
+
+/********** Begin IMetadataFetcher implementation **********/
+func (mf *MetadataFetcherGit) GetMetadataJsonByKey(key string, version string) (string, error) {
+	filePath := version + "/" + key + ".json"
+	fileContents, err := git_utils.ReadFileAtRef(mf.repoPath, mf.branch, filePath)
+	if err != nil {
+		logger.LogError(metadata_typedefs.ERROR_FAILED_TO_READ_METADATA_FILE +
+			"|repo=" + mf.repoPath +
+			"|branch=" + mf.branch +
+			"|path=" + filePath +
+			"|error=" + err.Error())
+		return "", errors.New(metadata_typedefs.ERROR_FAILED_TO_READ_METADATA_FILE)
+	}
+	return string(fileContents), nil
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ */
+func (mf *MetadataFetcherGit) SetMetadataJsonByKey(key string, metadataJson string, version string) error {
+	err := mf.commit(map[string][]byte{version + "/" + key + ".json": []byte(metadataJson)},
+		"Update "+key+" in metadata version "+version)
+	if err != nil {
+		return errors.New("error committing metadata item: " + err.Error())
+	}
+
+	return nil
+}
+
+func (mf *MetadataFetcherGit) GetMetadataVersionList() (*metadata_typedefs.MetadataVersionList, error) {
+	mvl := metadata_typedefs.MetadataVersionList{}
+
+	fileContents, err := git_utils.ReadFileAtRef(mf.repoPath, mf.branch, "MetadataVersionList.json")
+	if err != nil {
+		logger.LogError(metadata_typedefs.ERROR_FAILED_TO_READ_METADATA_VERSIONS_LIST +
+			"|repo=" + mf.repoPath +
+			"|branch=" + mf.branch +
+			"|error=" + err.Error())
+		return nil, errors.New(metadata_typedefs.ERROR_FAILED_TO_READ_METADATA_VERSIONS_LIST)
+	}
+
+	err = json.Unmarshal(fileContents, &mvl)
+	if err != nil {
+		logger.LogError(metadata_typedefs.ERROR_FAILED_TO_DESERIALIZE_METADATA_VERSIONS_LIST +
+			"|repo=" + mf.repoPath +
+			"|branch=" + mf.branch +
+			"|error=" + err.Error())
+		return nil, errors.New(metadata_typedefs.ERROR_FAILED_TO_DESERIALIZE_METADATA_VERSIONS_LIST)
+	}
+
+	mvl.Initialize()
+	return &mvl, nil
+}
+
+func (mf *MetadataFetcherGit) GetMetadataManifestForVersion(version string) (*metadata_typedefs.MetadataManifest, error) {
+	manifest := metadata_typedefs.MetadataManifest{}
+
+	filePath := version + "/MetadataManifest.json"
+	fileContents, err := git_utils.ReadFileAtRef(mf.repoPath, mf.branch, filePath)
+	if err != nil {
+		logger.LogError(metadata_typedefs.ERROR_FAILED_TO_READ_METADATA_MANIFEST +
+			"|repo=" + mf.repoPath +
+			"|branch=" + mf.branch +
+			"|path=" + filePath +
+			"|error=" + err.Error())
+		return nil, errors.New(metadata_typedefs.ERROR_FAILED_TO_READ_METADATA_MANIFEST)
+	}
+
+	err = json.Unmarshal(fileContents, &manifest)
+	if err != nil {
+		logger.LogError(metadata_typedefs.ERROR_FAILED_TO_DESERIALIZE_METADATA_MANIFEST +
+			"|repo=" + mf.repoPath +
+			"|branch=" + mf.branch +
+			"|path=" + filePath +
+			"|error=" + err.Error())
+		return nil, errors.New(metadata_typedefs.ERROR_FAILED_TO_DESERIALIZE_METADATA_MANIFEST)
+	}
+
+	manifest.Initialize()
+	return &manifest, nil
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ */
+func (mf *MetadataFetcherGit) SetMetadataManifestForVersion(manifest *metadata_typedefs.MetadataManifest, version string) error {
+	return mf.SetMetadataJsonsWithManifest(nil, manifest, version)
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ */
+func (mf *MetadataFetcherGit) SetMetadataVersionList(mvl *metadata_typedefs.MetadataVersionList) error {
+	bytes, err := serializeForGit(mvl)
+	if err != nil {
+		return errors.New("error serializing metadata version list: " + err.Error())
+	}
+
+	err = mf.commit(map[string][]byte{"MetadataVersionList.json": bytes}, "Update metadata version list")
+	if err != nil {
+		return errors.New("error committing metadata version list: " + err.Error())
+	}
+
+	return nil
+}
+
+/********** End IMetadataFetcher implementation **********/
+
+/********** Begin IAtomicMetadataWriter implementation **********/
+func (mf *MetadataFetcherGit) SetMetadataJsonsWithManifest(metadataJsons map[string]string, manifest *metadata_typedefs.MetadataManifest, version string) error {
+	manifestJson, err := serializeForGit(manifest)
+	if err != nil {
+		return errors.New("error serializing new manifest|error=" + err.Error())
+	}
+
+	files := map[string][]byte{version + "/MetadataManifest.json": manifestJson}
+	var keys []string
+	for key, metadataJson := range metadataJsons {
+		files[version+"/"+key+".json"] = []byte(metadataJson)
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	message := "Update manifest of metadata version " + version
+	if len(keys) != 0 {
+		message = "Update " + strings.Join(keys, ", ") + " in metadata version " + version
+	}
+
+	err = mf.commit(files, message)
+	if err != nil {
+		return errors.New("error committing metadata manifest: " + err.Error())
+	}
+
+	return nil
+}
+
+/********** End IAtomicMetadataWriter implementation **********/
+
+/********** Begin IMetadataWriteAuthorSetter implementation **********/
+func (mf *MetadataFetcherGit) SetMetadataWriteAuthor(author string) {
+	if len(author) == 0 {
+		author = kGitDefaultAuthor
+	}
+	mf.author = author
+}
+
+/********** End IMetadataWriteAuthorSetter implementation **********/
+
+/********** Begin IMetadataRefImporter implementation **********/
+
+/**
+ * Reads all the .json files at the root of the ref (eg: a tag made by designers) as metadata items named after the files
+ */
+func (mf *MetadataFetcherGit) GetMetadataJsonsAtRef(ref string) (map[string]string, error) {
+	_, ok := git_utils.ResolveCommit(mf.repoPath, ref)
+	if !ok {
+		return nil, errors.New("no such ref: " + ref)
+	}
+
+	fileNames, err := git_utils.ListFilesAtRef(mf.repoPath, ref, "")
+	if err != nil {
+		return nil, err
+	}
+
+	metadataJsons := make(map[string]string)
+	for _, fileName := range fileNames {
+		if !strings.HasSuffix(fileName, ".json") || fileName == "MetadataVersionList.json" {
+			continue
+		}
+
+		fileContents, err := git_utils.ReadFileAtRef(mf.repoPath, ref, fileName)
+		if err != nil {
+			return nil, err
+		}
+		metadataJsons[file_utils.GetFileNameWithoutExtension(fileName)] = string(fileContents)
+	}
+
+	return metadataJsons, nil
+}
+
+/********** End IMetadataRefImporter implementation **********/
+
+func (mf *MetadataFetcherGit) commit(files map[string][]byte, message string) error {
+	author := git_utils.GitSignature{Name: mf.author}
+	committer := git_utils.GitSignature{Name: kGitDefaultAuthor}
+
+	commitSha, err := git_utils.CommitFiles(mf.repoPath, mf.branch, files, message, author, committer)
+	if err != nil {
+		return err
+	}
+
+	logger.LogInfo("committed metadata change" +
+		"|repo=" + mf.repoPath +
+		"|branch=" + mf.branch +
+		"|commit=" + commitSha +
+		"|author=" + mf.author +
+		"|message=" + message)
+	return nil
+}
+
+func serializeForGit(v interface{}) ([]byte, error) {
+	if config.GetEnvironmentConfiguration().AppEnvironment == config.PRODUCTION {
+		return json.Marshal(v)
+	}
+	return json.MarshalIndent(v, "", "    ")
+}
@@ -0,0 +1,267 @@
+package metadata_fetchers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/spacetimi/timi_shared_server/code/config"
+	"github.com/spacetimi/timi_shared_server/code/core/adaptors/mongo_adaptor"
+	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
+	"github.com/spacetimi/timi_shared_server/utils/logger"
+)
+
+const kMongoSourceURLScheme = "mongo://"
+const kMongoDefaultCollectionName = "metadata"
+
+const kMongoDocumentIdKey = "DocumentId"
+const kMongoVersionListDocumentId = "MetadataVersionList"
+const kMongoVersionDocumentIdPrefix = "version:"
+
+/**
+ * Stores metadata in a mongo collection:
+ *   one document holding the version list, and
+ *   one document per version holding the manifest and all the items (including platform overrides) of the version
+ * Keeping a version in a single document makes writing items along with the manifest atomic
+ * (note that this limits a version's metadata to mongo's max document size of 16MB)
+ */
+type MetadataFetcherMongo struct { // Implements IMetadataFetcher, IAtomicMetadataWriter
+	dbSpace        mongo_adaptor.DBSpace
+	collectionName string
+}
+
+type metadataMongoDocument struct {
+	DocumentId string
+
+	// Version list document
+	Json string
+
+	// Version documents
+	Manifest string
+	Items    map[string]string // metadata key => metadata json
+}
+
+func IsMongoSourceURL(sourceURL string) bool {
+	return strings.HasPrefix(sourceURL, kMongoSourceURLScheme)
+}
+
+/**
+ * sourceURL is of the form: mongo://<shared|app>/<optional collection name>
+ * where shared / app picks the db configured in mongo_adaptor
+ */
+func NewMetadataFetcherMongo(sourceURL string) (metadata_typedefs.IMetadataFetcher, error) {
+	if !IsMongoSourceURL(sourceURL) {
+		return nil, errors.New("not a mongo source url: " + sourceURL)
+	}
+
+	tokens := strings.SplitN(strings.TrimPrefix(sourceURL, kMongoSourceURLScheme), "/", 2)
+
+	var dbSpace mongo_adaptor.DBSpace
+	switch tokens[0] {
+	case "shared":
+		dbSpace = mongo_adaptor.SHARED_DB
+	case "app":
+		dbSpace = mongo_adaptor.APP_DB
+	default:
+		return nil, errors.New("unknown db space in mongo source url: " + sourceURL)
+	}
+
+	collectionName := kMongoDefaultCollectionName
+	if len(tokens) == 2 && len(strings.Trim(tokens[1], "/")) != 0 {
+		collectionName = strings.Trim(tokens[1], "/")
+	}
+
+	mf := MetadataFetcherMongo{
+		dbSpace:        dbSpace,
+		collectionName: collectionName,
+	}
+	return &mf, nil
+}
+
+/********** Begin IMetadataFetcher implementation **********/
+func (mf *MetadataFetcherMongo) GetMetadataJsonByKey(key string, version string) (string, error) {
+	document, err := mf.readDocument(kMongoVersionDocumentIdPrefix + version)
+	if err != nil {
+		logger.LogError(metadata_typedefs.ERROR_FAILED_TO_READ_METADATA_FILE +
+			"|collection=" + mf.collectionName +
+			"|version=" + version +
+			"|key=" + key +
+			"|error=" + err.Error())
+		return "", errors.New(metadata_typedefs.ERROR_FAILED_TO_READ_METADATA_FILE)
+	}
+
+	metadataJson, ok := document.Items[key]
+	if !ok {
+		logger.LogError(metadata_typedefs.ERROR_FAILED_TO_READ_METADATA_FILE +
+			"|collection=" + mf.collectionName +
+			"|version=" + version +
+			"|key=" + key +
+			"|error=no such item")
+		return "", errors.New(metadata_typedefs.ERROR_FAILED_TO_READ_METADATA_FILE)
+	}
+
+	return metadataJson, nil
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ */
+func (mf *MetadataFetcherMongo) SetMetadataJsonByKey(key string, metadataJson string, version string) error {
+	err := validateMongoMetadataKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = mongo_adaptor.UpsertDataItemFields(mf.dbSpace,
+		mf.collectionName,
+		[]string{kMongoDocumentIdKey}, []interface{}{kMongoVersionDocumentIdPrefix + version},
+		[]string{"Items." + key}, []interface{}{metadataJson},
+		context.Background())
+	if err != nil {
+		return errors.New("error saving metadata item: " + err.Error())
+	}
+
+	return nil
+}
+
+func (mf *MetadataFetcherMongo) GetMetadataVersionList() (*metadata_typedefs.MetadataVersionList, error) {
+	mvl := metadata_typedefs.MetadataVersionList{}
+
+	document, err := mf.readDocument(kMongoVersionListDocumentId)
+	if err != nil {
+		logger.LogError(metadata_typedefs.ERROR_FAILED_TO_READ_METADATA_VERSIONS_LIST +
+			"|collection=" + mf.collectionName +
+			"|error=" + err.Error())
+		return nil, errors.New(metadata_typedefs.ERROR_FAILED_TO_READ_METADATA_VERSIONS_LIST)
+	}
+
+	err = json.Unmarshal([]byte(document.Json), &mvl)
+	if err != nil {
+		logger.LogError(metadata_typedefs.ERROR_FAILED_TO_DESERIALIZE_METADATA_VERSIONS_LIST +
+			"|collection=" + mf.collectionName +
+			"|error=" + err.Error())
+		return nil, errors.New(metadata_typedefs.ERROR_FAILED_TO_DESERIALIZE_METADATA_VERSIONS_LIST)
+	}
+
+	mvl.Initialize()
+	return &mvl, nil
+}
+
+func (mf *MetadataFetcherMongo) GetMetadataManifestForVersion(version string) (*metadata_typedefs.MetadataManifest, error) {
+	manifest := metadata_typedefs.MetadataManifest{}
+
+	document, err := mf.readDocument(kMongoVersionDocumentIdPrefix + version)
+	if err != nil {
+		logger.LogError(metadata_typedefs.ERROR_FAILED_TO_READ_METADATA_MANIFEST +
+			"|collection=" + mf.collectionName +
+			"|version=" + version +
+			"|error=" + err.Error())
+		return nil, errors.New(metadata_typedefs.ERROR_FAILED_TO_READ_METADATA_MANIFEST)
+	}
+
+	err = json.Unmarshal([]byte(document.Manifest), &manifest)
+	if err != nil {
+		logger.LogError(metadata_typedefs.ERROR_FAILED_TO_DESERIALIZE_METADATA_MANIFEST +
+			"|collection=" + mf.collectionName +
+			"|version=" + version +
+			"|error=" + err.Error())
+		return nil, errors.New(metadata_typedefs.ERROR_FAILED_TO_DESERIALIZE_METADATA_MANIFEST)
+	}
+
+	manifest.Initialize()
+	return &manifest, nil
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ */
+func (mf *MetadataFetcherMongo) SetMetadataManifestForVersion(manifest *metadata_typedefs.MetadataManifest, version string) error {
+	return mf.SetMetadataJsonsWithManifest(nil, manifest, version)
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ */
+func (mf *MetadataFetcherMongo) SetMetadataVersionList(mvl *metadata_typedefs.MetadataVersionList) error {
+	bytes, err := serializeForMongo(mvl)
+	if err != nil {
+		return errors.New("error serializing metadata version list: " + err.Error())
+	}
+
+	err = mongo_adaptor.UpsertDataItemFields(mf.dbSpace,
+		mf.collectionName,
+		[]string{kMongoDocumentIdKey}, []interface{}{kMongoVersionListDocumentId},
+		[]string{"Json"}, []interface{}{string(bytes)},
+		context.Background())
+	if err != nil {
+		return errors.New("error saving metadata version list: " + err.Error())
+	}
+
+	return nil
+}
+
+/********** End IMetadataFetcher implementation **********/
+
+/********** Begin IAtomicMetadataWriter implementation **********/
+func (mf *MetadataFetcherMongo) SetMetadataJsonsWithManifest(metadataJsons map[string]string, manifest *metadata_typedefs.MetadataManifest, version string) error {
+	manifestJson, err := serializeForMongo(manifest)
+	if err != nil {
+		return errors.New("error serializing new manifest|error=" + err.Error())
+	}
+
+	fieldNames := []string{"Manifest"}
+	fieldValues := []interface{}{string(manifestJson)}
+	for key, metadataJson := range metadataJsons {
+		err = validateMongoMetadataKey(key)
+		if err != nil {
+			return err
+		}
+		fieldNames = append(fieldNames, "Items."+key)
+		fieldValues = append(fieldValues, metadataJson)
+	}
+
+	err = mongo_adaptor.UpsertDataItemFields(mf.dbSpace,
+		mf.collectionName,
+		[]string{kMongoDocumentIdKey}, []interface{}{kMongoVersionDocumentIdPrefix + version},
+		fieldNames, fieldValues,
+		context.Background())
+	if err != nil {
+		return errors.New("error saving metadata manifest: " + err.Error())
+	}
+
+	return nil
+}
+
+/********** End IAtomicMetadataWriter implementation **********/
+
+func (mf *MetadataFetcherMongo) readDocument(documentId string) (*metadataMongoDocument, error) {
+	document := &metadataMongoDocument{}
+	err := mongo_adaptor.GetDataItemByPrimaryKeys(mf.dbSpace,
+		mf.collectionName,
+		[]string{kMongoDocumentIdKey}, []interface{}{documentId},
+		document,
+		context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+func serializeForMongo(v interface{}) ([]byte, error) {
+	if config.GetEnvironmentConfiguration().AppEnvironment == config.PRODUCTION {
+		return json.Marshal(v)
+	}
+	return json.MarshalIndent(v, "", "    ")
+}
+
+/**
+ * Items are stored as fields of the version document, so their keys cannot contain field path characters
+ */
+func validateMongoMetadataKey(key string) error {
+	if len(key) == 0 || strings.ContainsAny(key, ".$") {
+		return errors.New("metadata key cannot be used as a mongo field name: " + key)
+	}
+	return nil
+}
@@ -147,3 +147,10 @@ func (mf *MetadataFetcherS3) SetMetadataVersionList(mvl *metadata_typedefs.Metad
 }
 
 /********** End IMetadataFetcher implementation **********/
+
+/********** Begin IMetadataDownloadURLProvider implementation **********/
+func (mf *MetadataFetcherS3) GetMetadataDownloadURLByKey(key string, version string) (string, error) {
+	return mf.url + "/" + version + "/" + key + ".json", nil
+}
+
+/********** End IMetadataDownloadURLProvider implementation **********/
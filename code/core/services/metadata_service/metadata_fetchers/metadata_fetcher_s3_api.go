@@ -0,0 +1,224 @@
+package metadata_fetchers
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spacetimi/timi_shared_server/code/config"
+	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
+	"github.com/spacetimi/timi_shared_server/utils/aws_helper"
+	"github.com/spacetimi/timi_shared_server/utils/logger"
+)
+
+const kS3SourceURLScheme = "s3://"
+
+/**
+ * Reads and writes metadata through the S3 API with credentials, so that the bucket can (and should) stay private
+ * Works with any S3-compatible store, through MetadataS3Configuration.Endpoint
+ */
+type MetadataFetcherS3API struct { // Implements IMetadataFetcher, IMetadataDownloadURLProvider
+	client     *s3.S3
+	bucketName string
+	keyPrefix  string
+
+	presignedURLExpiry time.Duration
+}
+
+func IsS3APISourceURL(sourceURL string) bool {
+	return strings.HasPrefix(sourceURL, kS3SourceURLScheme)
+}
+
+/**
+ * sourceURL is of the form: s3://<bucket name>/<optional key prefix>
+ */
+func NewMetadataFetcherS3API(sourceURL string, s3Config config.MetadataS3Configuration) (metadata_typedefs.IMetadataFetcher, error) {
+	if !IsS3APISourceURL(sourceURL) {
+		return nil, errors.New("not an s3 source url: " + sourceURL)
+	}
+
+	tokens := strings.SplitN(strings.TrimPrefix(sourceURL, kS3SourceURLScheme), "/", 2)
+	bucketName := tokens[0]
+	if len(bucketName) == 0 {
+		return nil, errors.New("missing bucket name in s3 source url: " + sourceURL)
+	}
+	keyPrefix := ""
+	if len(tokens) == 2 {
+		keyPrefix = strings.Trim(tokens[1], "/")
+	}
+
+	clientOptions := aws_helper.S3ClientOptions{
+		Region:         s3Config.Region,
+		Endpoint:       s3Config.Endpoint,
+		ForcePathStyle: s3Config.ForcePathStyle,
+		AccessKeyId:    s3Config.AccessKeyId,
+	}
+	if len(s3Config.AccessKeyId) != 0 {
+		secretAccessKey, err := s3Config.SecretAccessKeyConfig.GetPassword()
+		if err != nil {
+			return nil, errors.New("error getting s3 secret access key: " + err.Error())
+		}
+		clientOptions.SecretAccessKey = secretAccessKey
+	}
+
+	client, err := aws_helper.NewS3Client(clientOptions)
+	if err != nil {
+		return nil, errors.New("error creating s3 client: " + err.Error())
+	}
+
+	mf := MetadataFetcherS3API{
+		client:             client,
+		bucketName:         bucketName,
+		keyPrefix:          keyPrefix,
+		presignedURLExpiry: time.Duration(s3Config.PresignedURLExpirySeconds) * time.Second,
+	}
+	return &mf, nil
+}
+
+/********** Begin IMetadataFetcher implementation **********/
+func (mf *MetadataFetcherS3API) GetMetadataJsonByKey(key string, version string) (string, error) {
+	objectKey := mf.getObjectKey(version + "/" + key + ".json")
+	fileContents, err := aws_helper.ReadFromS3(mf.client, mf.bucketName, objectKey)
+	if err != nil {
+		logger.LogError(metadata_typedefs.ERROR_FAILED_TO_READ_METADATA_FILE +
+			"|bucket=" + mf.bucketName +
+			"|key=" + objectKey +
+			"|error=" + err.Error())
+		return "", errors.New(metadata_typedefs.ERROR_FAILED_TO_READ_METADATA_FILE)
+	}
+	return string(fileContents), nil
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ */
+func (mf *MetadataFetcherS3API) SetMetadataJsonByKey(key string, metadataJson string, version string) error {
+	err := aws_helper.UploadToS3Private(mf.client, []byte(metadataJson), mf.bucketName, mf.getObjectKey(version+"/"+key+".json"))
+	if err != nil {
+		return errors.New("error uploading metadata item: " + err.Error())
+	}
+
+	return nil
+}
+
+func (mf *MetadataFetcherS3API) GetMetadataVersionList() (*metadata_typedefs.MetadataVersionList, error) {
+	mvl := metadata_typedefs.MetadataVersionList{}
+
+	objectKey := mf.getObjectKey("MetadataVersionList.json")
+	fileContents, err := aws_helper.ReadFromS3(mf.client, mf.bucketName, objectKey)
+	if err != nil {
+		logger.LogError(metadata_typedefs.ERROR_FAILED_TO_READ_METADATA_VERSIONS_LIST +
+			"|bucket=" + mf.bucketName +
+			"|key=" + objectKey +
+			"|error=" + err.Error())
+		return nil, errors.New(metadata_typedefs.ERROR_FAILED_TO_READ_METADATA_VERSIONS_LIST)
+	}
+
+	err = json.Unmarshal(fileContents, &mvl)
+	if err != nil {
+		logger.LogError(metadata_typedefs.ERROR_FAILED_TO_DESERIALIZE_METADATA_VERSIONS_LIST +
+			"|bucket=" + mf.bucketName +
+			"|key=" + objectKey +
+			"|error=" + err.Error())
+		return nil, errors.New(metadata_typedefs.ERROR_FAILED_TO_DESERIALIZE_METADATA_VERSIONS_LIST)
+	}
+
+	mvl.Initialize()
+	return &mvl, nil
+}
+
+func (mf *MetadataFetcherS3API) GetMetadataManifestForVersion(version string) (*metadata_typedefs.MetadataManifest, error) {
+	manifest := metadata_typedefs.MetadataManifest{}
+
+	objectKey := mf.getObjectKey(version + "/" + "MetadataManifest.json")
+	fileContents, err := aws_helper.ReadFromS3(mf.client, mf.bucketName, objectKey)
+	if err != nil {
+		logger.LogError(metadata_typedefs.ERROR_FAILED_TO_READ_METADATA_MANIFEST +
+			"|bucket=" + mf.bucketName +
+			"|key=" + objectKey +
+			"|error=" + err.Error())
+		return nil, errors.New(metadata_typedefs.ERROR_FAILED_TO_READ_METADATA_MANIFEST)
+	}
+
+	err = json.Unmarshal(fileContents, &manifest)
+	if err != nil {
+		logger.LogError(metadata_typedefs.ERROR_FAILED_TO_DESERIALIZE_METADATA_MANIFEST +
+			"|bucket=" + mf.bucketName +
+			"|key=" + objectKey +
+			"|error=" + err.Error())
+		return nil, errors.New(metadata_typedefs.ERROR_FAILED_TO_DESERIALIZE_METADATA_MANIFEST)
+	}
+
+	manifest.Initialize()
+	return &manifest, nil
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ */
+func (mf *MetadataFetcherS3API) SetMetadataManifestForVersion(manifest *metadata_typedefs.MetadataManifest, version string) error {
+	var err error
+	var manifestJson []byte
+	if config.GetEnvironmentConfiguration().AppEnvironment == config.PRODUCTION {
+		manifestJson, err = json.Marshal(manifest)
+	} else {
+		manifestJson, err = json.MarshalIndent(manifest, "", "    ")
+	}
+	if err != nil {
+		return errors.New("error serializing new manifest|error=" + err.Error())
+	}
+
+	err = aws_helper.UploadToS3Private(mf.client, manifestJson, mf.bucketName, mf.getObjectKey(version+"/MetadataManifest.json"))
+	if err != nil {
+		return errors.New("error uploading metadata manifest: " + err.Error())
+	}
+
+	return nil
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ */
+func (mf *MetadataFetcherS3API) SetMetadataVersionList(mvl *metadata_typedefs.MetadataVersionList) error {
+
+	var bytes []byte
+	var err error
+
+	if config.GetEnvironmentConfiguration().AppEnvironment == config.PRODUCTION {
+		bytes, err = json.Marshal(mvl)
+	} else {
+		bytes, err = json.MarshalIndent(mvl, "", "    ")
+	}
+	if err != nil {
+		return errors.New("error serializing metadata version list: " + err.Error())
+	}
+
+	err = aws_helper.UploadToS3Private(mf.client, bytes, mf.bucketName, mf.getObjectKey("MetadataVersionList.json"))
+	if err != nil {
+		return errors.New("error uploading metadata version list: " + err.Error())
+	}
+
+	return nil
+}
+
+/********** End IMetadataFetcher implementation **********/
+
+/********** Begin IMetadataDownloadURLProvider implementation **********/
+func (mf *MetadataFetcherS3API) GetMetadataDownloadURLByKey(key string, version string) (string, error) {
+	if mf.presignedURLExpiry <= 0 {
+		return "", errors.New("presigned download urls are disabled")
+	}
+
+	return aws_helper.GetPresignedDownloadURL(mf.client, mf.bucketName, mf.getObjectKey(version+"/"+key+".json"), mf.presignedURLExpiry)
+}
+
+/********** End IMetadataDownloadURLProvider implementation **********/
+
+func (mf *MetadataFetcherS3API) getObjectKey(path string) string {
+	if len(mf.keyPrefix) == 0 {
+		return path
+	}
+	return mf.keyPrefix + "/" + path
+}
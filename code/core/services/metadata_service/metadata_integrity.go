@@ -0,0 +1,184 @@
+package metadata_service
+
+import (
+    "errors"
+    "github.com/spacetimi/timi_shared_server/code/config"
+    "github.com/spacetimi/timi_shared_server/code/core"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
+    "github.com/spacetimi/timi_shared_server/utils/logger"
+    "strconv"
+    "sync"
+)
+
+var manifestSigner *metadata_typedefs.MetadataManifestSigner
+var manifestSignerOnce sync.Once
+
+/**
+ * Returns nil if manifest signing is not configured
+ */
+func getManifestSigner() *metadata_typedefs.MetadataManifestSigner {
+    manifestSignerOnce.Do(func() {
+        signingConfig := config.GetEnvironmentConfiguration().MetadataSigningConfig
+        if signingConfig.Algorithm == "" {
+            return
+        }
+
+        secret := ""
+        if signingConfig.KeyConfig.Source != "" {
+            var err error
+            secret, err = signingConfig.KeyConfig.GetPassword()
+            if err != nil {
+                logger.LogFatal("error getting metadata signing key|error=" + err.Error())
+                return
+            }
+        }
+
+        signer, err := metadata_typedefs.NewMetadataManifestSigner(signingConfig.Algorithm, secret, signingConfig.PublicKey)
+        if err != nil {
+            logger.LogFatal("error creating metadata manifest signer|error=" + err.Error())
+            return
+        }
+        manifestSigner = signer
+    })
+
+    return manifestSigner
+}
+
+/**
+ * Unsigned manifests, and manifests signed before signatures covered the space and version,
+ * are let through (with a warning) unless signatures are required
+ */
+func verifyManifestSignature(manifest *metadata_typedefs.MetadataManifest, space metadata_typedefs.MetadataSpace, version *core.AppVersion) error {
+    signer := getManifestSigner()
+    if signer == nil {
+        return nil
+    }
+    requireSignatures := config.GetEnvironmentConfiguration().MetadataSigningConfig.RequireSignatures
+
+    if manifest.Signature == "" && !requireSignatures {
+        logger.LogWarning("loading unsigned metadata manifest" +
+                          "|metadata space=" + space.String() +
+                          "|version=" + version.String())
+        return nil
+    }
+
+    err := signer.Verify(manifest, space, version)
+    if err == metadata_typedefs.ErrLegacyManifestSignature && !requireSignatures {
+        logger.LogWarning("loading metadata manifest with legacy signature, re-sign it to check its version" +
+                          "|metadata space=" + space.String() +
+                          "|version=" + version.String())
+        return nil
+    }
+    return err
+}
+
+/**
+ * Must be called on every manifest before it is saved, since the signature covers all of its items.
+ * Servers that can only verify signatures save manifests unsigned (unless signatures are required),
+ * for a server with the signing key to re-sign them later (eg: with UpgradeMetadataManifestIntegrity)
+ */
+func signManifest(manifest *metadata_typedefs.MetadataManifest, space metadata_typedefs.MetadataSpace, version *core.AppVersion) error {
+    signer := getManifestSigner()
+    if signer == nil {
+        // Drop any signature from when signing was configured, it no longer matches the items
+        manifest.Signature = ""
+        return nil
+    }
+
+    if !signer.CanSign() {
+        if config.GetEnvironmentConfiguration().MetadataSigningConfig.RequireSignatures {
+            return errors.New("signatures are required, but no signing key is configured to sign the manifest")
+        }
+        logger.LogWarning("no metadata signing key configured, saving manifest unsigned" +
+                          "|metadata space=" + space.String() +
+                          "|version=" + version.String())
+        // Any old signature no longer matches the items
+        manifest.Signature = ""
+        return nil
+    }
+
+    return signer.Sign(manifest, space, version)
+}
+
+/**
+ * Checks content fetched for the key (an item's key, or a platform override's key) against the hash in the manifest
+ */
+func verifyMetadataJsonAgainstManifest(key string, metadataJson string, manifest *metadata_typedefs.MetadataManifest) error {
+    hash, ok := manifest.GetHashForStoredKey(key)
+    if !ok {
+        return errors.New("metadata key not in manifest: " + key)
+    }
+
+    if !metadata_typedefs.VerifyMetadataJsonHash(metadataJson, hash) {
+        return errors.New("metadata content does not match manifest hash: " + key)
+    }
+
+    return nil
+}
+
+/**
+ * Returns the manifest for the version if it is signed (so that clients can verify it), or nil
+ */
+func (ms *MetadataService) GetSignedMetadataManifest(space metadata_typedefs.MetadataSpace, version *core.AppVersion) *metadata_typedefs.MetadataManifest {
+    msa := ms.getMetadataServiceSpace(space)
+
+    manifest, err := msa.getMetadataManifestForVersion(version)
+    if err != nil || manifest.Signature == "" {
+        return nil
+    }
+    return manifest
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ * Rehashes the items (and platform overrides) that still have legacy md5 hashes with sha256, and re-signs the manifest.
+ * Every item's content is verified against its old hash first.
+ * Returns the number of hashes upgraded. Clients will download the upgraded items again on their next sync
+ */
+func (ms *MetadataService) UpgradeMetadataManifestIntegrity(version *core.AppVersion, space metadata_typedefs.MetadataSpace) (int, error) {
+    msa := ms.getMetadataServiceSpace(space)
+
+    manifest, err := msa.getMetadataManifestForVersion(version)
+    if err != nil {
+        return 0, errors.New("error getting metadata manifest for version: " + err.Error())
+    }
+
+    upgradedCount := 0
+    for _, manifestItem := range manifest.MetadataManifestItems {
+        if metadata_typedefs.IsLegacyMetadataHash(manifestItem.Hash) {
+            metadataJson, err := msa.getMetadataJsonForKey(manifestItem.MetadataKey, version)
+            if err != nil {
+                return 0, errors.New("error reading " + manifestItem.MetadataKey + ": " + err.Error())
+            }
+            manifestItem.Hash = metadata_typedefs.GetMetadataJsonHash(metadataJson)
+            upgradedCount++
+        }
+
+        for platformString, overrideHash := range manifestItem.PlatformOverrides {
+            if !metadata_typedefs.IsLegacyMetadataHash(overrideHash) {
+                continue
+            }
+            platform, err := metadata_typedefs.GetMetadataPlatformFromString(platformString)
+            if err != nil {
+                return 0, errors.New("unknown platform override on " + manifestItem.MetadataKey + ": " + platformString)
+            }
+            overrideJson, err := msa.getMetadataJsonForKey(metadata_typedefs.GetPlatformOverrideKey(manifestItem.MetadataKey, platform), version)
+            if err != nil {
+                return 0, errors.New("error reading " + platformString + " override of " + manifestItem.MetadataKey + ": " + err.Error())
+            }
+            manifestItem.PlatformOverrides[platformString] = metadata_typedefs.GetMetadataJsonHash(overrideJson)
+            upgradedCount++
+        }
+    }
+
+    err = msa.setMetadataManifestForVersion(manifest, version)
+    if err != nil {
+        return 0, errors.New("error saving upgraded manifest: " + err.Error())
+    }
+
+    logger.LogInfo("upgraded metadata manifest integrity" +
+                   "|metadata space=" + space.String() +
+                   "|version=" + version.String() +
+                   "|upgraded hash count=" + strconv.Itoa(upgradedCount))
+    return upgradedCount, nil
+}
@@ -0,0 +1,423 @@
+package metadata_service
+
+import (
+    "context"
+    "errors"
+    "github.com/spacetimi/timi_shared_server/code/config"
+    "github.com/spacetimi/timi_shared_server/code/core"
+    "github.com/spacetimi/timi_shared_server/code/core/adaptors/mongo_adaptor"
+    "github.com/spacetimi/timi_shared_server/code/core/adaptors/redis_adaptor"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_factory"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
+    "github.com/spacetimi/timi_shared_server/utils/logger"
+    "os"
+    "sort"
+    "strconv"
+    "time"
+)
+
+const kMetadataSchedulesCollectionName = "metadata_schedules"
+const kMetadataSchedulesPrimaryKey = "ScheduleId"
+
+const kCountersCollectionName = "counters"
+const kCountersPrimaryKey = "counter_name"
+const kCountersValueKey = "counter_value"
+const kCountersMetadataScheduleIdValue = "metadata_schedule_id"
+
+const kRedisKeyPrefixMetadataSchedulerLeader = "metadata_scheduler_leader:"
+
+var schedulerId string
+
+/**
+ * Adds a pending action to the schedule. Fills in the schedule id, status and creation time
+ * Only meant to be called from the admin tool / scripts
+ */
+func ScheduleMetadataAction(action *metadata_typedefs.ScheduledMetadataAction, ctx context.Context) error {
+    if action == nil {
+        return errors.New("scheduled action is null")
+    }
+
+    err := validateScheduledMetadataAction(action)
+    if err != nil {
+        return errors.New("invalid scheduled action: " + err.Error())
+    }
+
+    scheduleIdInterface, err := mongo_adaptor.AtomicIncrement(mongo_adaptor.SHARED_DB,
+        kCountersCollectionName,
+        kCountersPrimaryKey,
+        kCountersMetadataScheduleIdValue,
+        kCountersValueKey,
+        int64(1),
+        ctx)
+    if err != nil {
+        return errors.New("error creating new schedule id: " + err.Error())
+    }
+    scheduleId, ok := scheduleIdInterface.(int64)
+    if !ok {
+        return errors.New("failed type assertion when creating new schedule id")
+    }
+
+    action.ScheduleId = scheduleId
+    action.AppName = getAppNameForSchedules(action.Space)
+    action.Status = metadata_typedefs.SCHEDULED_ACTION_STATUS_PENDING
+    action.CreatedAtUnix = time.Now().Unix()
+    action.ExecutedAtUnix = 0
+    action.Error = ""
+
+    err = mongo_adaptor.WriteDataItemByPrimaryKeys(mongo_adaptor.SHARED_DB,
+        kMetadataSchedulesCollectionName,
+        []string{kMetadataSchedulesPrimaryKey},
+        action,
+        ctx)
+    if err != nil {
+        return errors.New("error saving scheduled action: " + err.Error())
+    }
+
+    logger.LogInfo("scheduled metadata action" +
+                   "|schedule id=" + strconv.FormatInt(action.ScheduleId, 10) +
+                   "|metadata space=" + action.Space.String() +
+                   "|action=" + action.Description() +
+                   "|execute at=" + time.Unix(action.ExecuteAtUnix, 0).UTC().Format(time.RFC3339) +
+                   "|created by=" + action.CreatedBy)
+    return nil
+}
+
+/**
+ * Returns all scheduled actions (in any status) for the space, ordered by execution time
+ */
+func GetScheduledMetadataActions(space metadata_typedefs.MetadataSpace, ctx context.Context) ([]*metadata_typedefs.ScheduledMetadataAction, error) {
+    dataItems, err := mongo_adaptor.GetDataItemsByFilter(mongo_adaptor.SHARED_DB,
+        kMetadataSchedulesCollectionName,
+        []string{"AppName", "Space"},
+        []interface{}{getAppNameForSchedules(space), space},
+        func() interface{} { return &metadata_typedefs.ScheduledMetadataAction{} },
+        ctx)
+    if err != nil {
+        return nil, errors.New("error reading scheduled actions: " + err.Error())
+    }
+
+    var actions []*metadata_typedefs.ScheduledMetadataAction
+    for _, dataItem := range dataItems {
+        action, ok := dataItem.(*metadata_typedefs.ScheduledMetadataAction)
+        if !ok {
+            return nil, errors.New("failed type assertion reading scheduled actions")
+        }
+        actions = append(actions, action)
+    }
+
+    sort.SliceStable(actions, func(i, j int) bool {
+        return actions[i].ExecuteAtUnix < actions[j].ExecuteAtUnix
+    })
+
+    return actions, nil
+}
+
+func GetScheduledMetadataAction(scheduleId int64, ctx context.Context) (*metadata_typedefs.ScheduledMetadataAction, error) {
+    action := &metadata_typedefs.ScheduledMetadataAction{}
+    err := mongo_adaptor.GetDataItemByPrimaryKeys(mongo_adaptor.SHARED_DB,
+        kMetadataSchedulesCollectionName,
+        []string{kMetadataSchedulesPrimaryKey},
+        []interface{}{scheduleId},
+        action,
+        ctx)
+    if err != nil {
+        return nil, errors.New("error reading scheduled action: " + err.Error())
+    }
+
+    return action, nil
+}
+
+/**
+ * Updates the execution time and contents of a scheduled action. Fails if the action is no longer pending
+ * Only meant to be called from the admin tool / scripts
+ */
+func UpdateScheduledMetadataAction(action *metadata_typedefs.ScheduledMetadataAction, ctx context.Context) error {
+    if action == nil {
+        return errors.New("scheduled action is null")
+    }
+
+    err := validateScheduledMetadataAction(action)
+    if err != nil {
+        return errors.New("invalid scheduled action: " + err.Error())
+    }
+
+    updated, err := mongo_adaptor.UpdateDataItemFieldsByFilter(mongo_adaptor.SHARED_DB,
+        kMetadataSchedulesCollectionName,
+        []string{kMetadataSchedulesPrimaryKey, "Status"},
+        []interface{}{action.ScheduleId, metadata_typedefs.SCHEDULED_ACTION_STATUS_PENDING},
+        []string{"ExecuteAtUnix", "CurrentVersions", "Version", "MetadataKey", "Content"},
+        []interface{}{action.ExecuteAtUnix, action.CurrentVersions, action.Version, action.MetadataKey, action.Content},
+        ctx)
+    if err != nil {
+        return errors.New("error updating scheduled action: " + err.Error())
+    }
+    if !updated {
+        return errors.New("scheduled action is no longer pending")
+    }
+
+    logger.LogInfo("updated scheduled metadata action" +
+                   "|schedule id=" + strconv.FormatInt(action.ScheduleId, 10) +
+                   "|metadata space=" + action.Space.String() +
+                   "|action=" + action.Description() +
+                   "|execute at=" + time.Unix(action.ExecuteAtUnix, 0).UTC().Format(time.RFC3339))
+    return nil
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ */
+func CancelScheduledMetadataAction(scheduleId int64, cancelledBy string, ctx context.Context) error {
+    cancelled, err := mongo_adaptor.UpdateDataItemFieldsByFilter(mongo_adaptor.SHARED_DB,
+        kMetadataSchedulesCollectionName,
+        []string{kMetadataSchedulesPrimaryKey, "Status"},
+        []interface{}{scheduleId, metadata_typedefs.SCHEDULED_ACTION_STATUS_PENDING},
+        []string{"Status", "Error"},
+        []interface{}{metadata_typedefs.SCHEDULED_ACTION_STATUS_CANCELLED, "cancelled by " + cancelledBy},
+        ctx)
+    if err != nil {
+        return errors.New("error cancelling scheduled action: " + err.Error())
+    }
+    if !cancelled {
+        return errors.New("scheduled action is no longer pending")
+    }
+
+    logger.LogInfo("cancelled scheduled metadata action" +
+                   "|schedule id=" + strconv.FormatInt(scheduleId, 10) +
+                   "|cancelled by=" + cancelledBy)
+    return nil
+}
+
+/*********** Private **********************************************************/
+
+/**
+ * Every api-server runs the scheduler, but only the one holding the (per space) leader lock in redis executes actions
+ */
+func startScheduler(ctx context.Context) {
+    pollSeconds := config.GetEnvironmentConfiguration().MetadataSchedulerPollSeconds
+    if pollSeconds <= 0 {
+        logger.LogInfo("metadata scheduler disabled")
+        return
+    }
+
+    hostname, _ := os.Hostname()
+    schedulerId = hostname + ":" + strconv.Itoa(os.Getpid())
+
+    ticker := time.NewTicker(time.Second * time.Duration(pollSeconds))
+    for range ticker.C {
+        for _, space := range []metadata_typedefs.MetadataSpace{metadata_typedefs.METADATA_SPACE_SHARED, metadata_typedefs.METADATA_SPACE_APP} {
+            if !tryTakeSchedulerLeadership(space, time.Second * time.Duration(3 * pollSeconds), ctx) {
+                continue
+            }
+            executeDueScheduledActions(space, ctx)
+        }
+    }
+}
+
+func tryTakeSchedulerLeadership(space metadata_typedefs.MetadataSpace, leaseDuration time.Duration, ctx context.Context) bool {
+    key := kRedisKeyPrefixMetadataSchedulerLeader + space.String()
+    if space == metadata_typedefs.METADATA_SPACE_APP {
+        key += ":" + config.GetAppName()
+    }
+
+    taken, err := redis_adaptor.WriteIfNotExists(key, schedulerId, leaseDuration, ctx)
+    if err != nil {
+        logger.LogError("error taking metadata scheduler leadership" +
+                        "|redis key=" + key +
+                        "|error=" + err.Error())
+        return false
+    }
+    if taken {
+        logger.LogInfo("took metadata scheduler leadership" +
+                       "|metadata space=" + space.String() +
+                       "|scheduler id=" + schedulerId)
+        return true
+    }
+
+    // Extend the lease if still the leader. Checked and extended atomically, so that a lease
+    // that expired and was taken by another scheduler in between is never overwritten
+    extended, err := redis_adaptor.ExtendIfValueEquals(key, schedulerId, leaseDuration, ctx)
+    if err != nil {
+        logger.LogError("error extending metadata scheduler leadership" +
+                        "|redis key=" + key +
+                        "|error=" + err.Error())
+        return false
+    }
+    return extended
+}
+
+func executeDueScheduledActions(space metadata_typedefs.MetadataSpace, ctx context.Context) {
+    actions, err := GetScheduledMetadataActions(space, ctx)
+    if err != nil {
+        logger.LogError("error loading scheduled metadata actions" +
+                        "|metadata space=" + space.String() +
+                        "|error=" + err.Error())
+        return
+    }
+
+    now := time.Now().Unix()
+    for _, action := range actions {
+        if !action.IsPending() || action.ExecuteAtUnix > now {
+            continue
+        }
+
+        // Claim the action so that it is never executed twice, even if leadership changes hands mid-way
+        claimed, err := mongo_adaptor.UpdateDataItemFieldsByFilter(mongo_adaptor.SHARED_DB,
+            kMetadataSchedulesCollectionName,
+            []string{kMetadataSchedulesPrimaryKey, "Status"},
+            []interface{}{action.ScheduleId, metadata_typedefs.SCHEDULED_ACTION_STATUS_PENDING},
+            []string{"Status"},
+            []interface{}{metadata_typedefs.SCHEDULED_ACTION_STATUS_RUNNING},
+            ctx)
+        if err != nil || !claimed {
+            continue
+        }
+
+        status := metadata_typedefs.SCHEDULED_ACTION_STATUS_DONE
+        errorString := ""
+        err = executeScheduledAction(action, ctx)
+        if err != nil {
+            status = metadata_typedefs.SCHEDULED_ACTION_STATUS_FAILED
+            errorString = err.Error()
+            logger.LogError("error executing scheduled metadata action" +
+                            "|schedule id=" + strconv.FormatInt(action.ScheduleId, 10) +
+                            "|metadata space=" + space.String() +
+                            "|action=" + action.Description() +
+                            "|error=" + err.Error())
+        } else {
+            logger.LogInfo("executed scheduled metadata action" +
+                           "|schedule id=" + strconv.FormatInt(action.ScheduleId, 10) +
+                           "|metadata space=" + space.String() +
+                           "|action=" + action.Description())
+        }
+
+        _, err = mongo_adaptor.UpdateDataItemFieldsByFilter(mongo_adaptor.SHARED_DB,
+            kMetadataSchedulesCollectionName,
+            []string{kMetadataSchedulesPrimaryKey},
+            []interface{}{action.ScheduleId},
+            []string{"Status", "ExecutedAtUnix", "Error"},
+            []interface{}{status, time.Now().Unix(), errorString},
+            ctx)
+        if err != nil {
+            logger.LogError("error saving status of scheduled metadata action" +
+                            "|schedule id=" + strconv.FormatInt(action.ScheduleId, 10) +
+                            "|status=" + string(status) +
+                            "|error=" + err.Error())
+        }
+    }
+}
+
+func executeScheduledAction(action *metadata_typedefs.ScheduledMetadataAction, ctx context.Context) error {
+    switch action.ActionType {
+
+    case metadata_typedefs.SCHEDULED_ACTION_SET_CURRENT_VERSIONS:
+        err := setCurrentVersionsForScheduledAction(action)
+        if err != nil {
+            return err
+        }
+
+    case metadata_typedefs.SCHEDULED_ACTION_PUBLISH_ITEM:
+        metadataItem, version, err := parseMetadataItemForScheduledAction(action)
+        if err != nil {
+            return err
+        }
+        err = setMetadataItemForScheduledAction(action, metadataItem, version)
+        if err != nil {
+            return err
+        }
+
+    default:
+        return errors.New("unknown action type: " + string(action.ActionType))
+    }
+
+    err := MarkMetadataAsUpdated(action.Space, ctx)
+    if err != nil {
+        return errors.New("error marking metadata as updated: " + err.Error())
+    }
+    RefreshLastUpdatedTimestamps()
+
+    return nil
+}
+
+func setCurrentVersionsForScheduledAction(action *metadata_typedefs.ScheduledMetadataAction) error {
+    defer ReleaseInstanceRW()
+    return InstanceRWAsUser(getWriteAuthorForScheduledAction(action)).SetCurrentVersions(action.CurrentVersions, action.Space)
+}
+
+func setMetadataItemForScheduledAction(action *metadata_typedefs.ScheduledMetadataAction, metadataItem metadata_typedefs.IMetadataItem, version *core.AppVersion) error {
+    defer ReleaseInstanceRW()
+    return InstanceRWAsUser(getWriteAuthorForScheduledAction(action)).SetMetadataItem(metadataItem, version)
+}
+
+func getWriteAuthorForScheduledAction(action *metadata_typedefs.ScheduledMetadataAction) string {
+    return "scheduler (" + action.CreatedBy + ")"
+}
+
+func validateScheduledMetadataAction(action *metadata_typedefs.ScheduledMetadataAction) error {
+    if action.ExecuteAtUnix <= 0 {
+        return errors.New("missing execution time")
+    }
+    if action.Space != metadata_typedefs.METADATA_SPACE_SHARED && action.Space != metadata_typedefs.METADATA_SPACE_APP {
+        return errors.New("invalid metadata space")
+    }
+
+    switch action.ActionType {
+
+    case metadata_typedefs.SCHEDULED_ACTION_SET_CURRENT_VERSIONS:
+        if len(action.CurrentVersions) == 0 {
+            return errors.New("no current versions")
+        }
+        for _, versionString := range action.CurrentVersions {
+            valid, err := Instance().IsVersionValid(versionString, action.Space)
+            if !valid {
+                return errors.New("invalid version " + versionString + ": " + err.Error())
+            }
+        }
+
+    case metadata_typedefs.SCHEDULED_ACTION_PUBLISH_ITEM:
+        _, _, err := parseMetadataItemForScheduledAction(action)
+        if err != nil {
+            return err
+        }
+
+    default:
+        return errors.New("unknown action type: " + string(action.ActionType))
+    }
+
+    return nil
+}
+
+func parseMetadataItemForScheduledAction(action *metadata_typedefs.ScheduledMetadataAction) (metadata_typedefs.IMetadataItem, *core.AppVersion, error) {
+    valid, err := Instance().IsVersionValid(action.Version, action.Space)
+    if !valid {
+        return nil, nil, errors.New("invalid version " + action.Version + ": " + err.Error())
+    }
+    version, err := core.GetAppVersionFromString(action.Version)
+    if err != nil {
+        return nil, nil, errors.New("error parsing version: " + err.Error())
+    }
+
+    metadataItem, err := metadata_factory.InstantiateMetadataItem(action.MetadataKey)
+    if err != nil {
+        return nil, nil, errors.New("error instantiating metadata item " + action.MetadataKey + ": " + err.Error())
+    }
+    if metadataItem.GetMetadataSpace() != action.Space {
+        return nil, nil, errors.New("wrong metadata space for " + action.MetadataKey)
+    }
+
+    err = metadata_typedefs.UnmarshalAndValidateMetadataItem([]byte(action.Content), metadataItem)
+    if err != nil {
+        return nil, nil, errors.New("error deserializing " + action.MetadataKey + ": " + err.Error())
+    }
+
+    return metadataItem, version, nil
+}
+
+/**
+ * Shared metadata is common to all apps, so its schedules are not tied to any one app
+ */
+func getAppNameForSchedules(space metadata_typedefs.MetadataSpace) string {
+    if space == metadata_typedefs.METADATA_SPACE_SHARED {
+        return ""
+    }
+    return config.GetAppName()
+}
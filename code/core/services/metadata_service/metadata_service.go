@@ -5,8 +5,12 @@ import (
 	"encoding/json"
 	"errors"
 	"github.com/spacetimi/timi_shared_server/code/core"
+	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_experiments"
+	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_factory"
 	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
 	"github.com/spacetimi/timi_shared_server/utils/logger"
+	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -20,6 +24,14 @@ func Initialize() {
 	instance = createInstance()
 	go startAutoUpdater(metadata_typedefs.METADATA_SPACE_SHARED, context.Background())
 	go startAutoUpdater(metadata_typedefs.METADATA_SPACE_APP, context.Background())
+	go startScheduler(context.Background())
+}
+
+/**
+ * For command line tools: loads metadata like Initialize, but does not start the auto updaters or the scheduler
+ */
+func InitializeForScript() {
+	instance = createInstance()
 }
 
 func createInstance() *MetadataService {
@@ -60,6 +72,24 @@ func InstanceRW() *MetadataService {
 	instance = createInstance()
 	return instance
 }
+
+/**
+ * Same as InstanceRW, but attributes the writes to the user,
+ * for metadata sources that keep a history of who changed what (eg: git)
+ */
+func InstanceRWAsUser(username string) *MetadataService {
+	rwInstance := InstanceRW()
+
+	for _, msa := range []*MetadataServiceSpace{rwInstance.sharedMDServiceSpace, rwInstance.appMDServiceSpace} {
+		authorSetter, ok := metadata_typedefs.GetOriginMetadataFetcher(msa.mdFetcher).(metadata_typedefs.IMetadataWriteAuthorSetter)
+		if ok {
+			authorSetter.SetMetadataWriteAuthor(username)
+		}
+	}
+
+	return rwInstance
+}
+
 /**
  * MUST be called after taking an InstanceRW
  * Failing to call this will lead to deadlocks
@@ -148,6 +178,43 @@ func (ms *MetadataService) GetLatestDefinedVersion(space metadata_typedefs.Metad
 	return msa.mdVersionList.GetLatestVersionDefined()
 }
 
+/**
+ * Resolves the metadata version that an app version should use (see MetadataVersionList.ResolveVersion)
+ */
+func (ms *MetadataService) ResolveMetadataVersion(appVersion *core.AppVersion, space metadata_typedefs.MetadataSpace) (*core.AppVersion, error) {
+	msa := ms.getMetadataServiceSpace(space)
+
+	version, err := msa.mdVersionList.ResolveVersion(appVersion)
+	if err != nil {
+		return nil, errors.New("error resolving metadata version: " + err.Error())
+	}
+
+	return version, nil
+}
+
+func (ms *MetadataService) GetVersionMappings(space metadata_typedefs.MetadataSpace) []*metadata_typedefs.MetadataVersionMapping {
+	msa := ms.getMetadataServiceSpace(space)
+
+	return msa.mdVersionList.VersionMappings
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ */
+func (ms *MetadataService) SetVersionMappings(mappings []*metadata_typedefs.MetadataVersionMapping, space metadata_typedefs.MetadataSpace) error {
+	msa := ms.getMetadataServiceSpace(space)
+
+	err := msa.setVersionMappings(mappings)
+	if err != nil {
+		logger.LogError("error updating version mappings" +
+						"|metadata space=" + space.String() +
+						"|error=" + err.Error())
+		return errors.New("couldn't update version mappings: " + err.Error())
+	}
+
+	return nil
+}
+
 func (ms *MetadataService) IsVersionValid(versionString string, space metadata_typedefs.MetadataSpace) (bool, error) {
 	msa := ms.getMetadataServiceSpace(space)
 
@@ -219,7 +286,68 @@ func (ms *MetadataService) IsMetadataHashUpToDate(key string, hash string, space
 	return result, nil
 }
 
-func (ms *MetadataService) GetMetadataItem(itemPtr metadata_typedefs.IMetadataItem, version *core.AppVersion) error {
+/**
+ * Compares the metadata hashes held by a client on a platform against the manifest for the version.
+ * Returns the manifest items that the client is missing or has stale copies of
+ * (use MetadataManifestItem.GetEffectiveHash for their new hashes),
+ * and the keys held by the client that no longer exist in the version
+ */
+func (ms *MetadataService) GetStaleMetadataManifestItems(clientHashes map[string]string, space metadata_typedefs.MetadataSpace, version *core.AppVersion, platform metadata_typedefs.MetadataPlatform) ([]*metadata_typedefs.MetadataManifestItem, []string, error) {
+	msa := ms.getMetadataServiceSpace(space)
+
+	staleItems, removedKeys, err := msa.getStaleManifestItems(clientHashes, version, platform)
+	if err != nil {
+		logger.LogError("failed to find stale metadata items|space=" + space.String() +
+			"|version=" + version.String() +
+			"|error=" + err.Error())
+		return nil, nil, errors.New("failed to check client metadata hashes")
+	}
+
+	return staleItems, removedKeys, nil
+}
+
+/**
+ * Returns the serialized content of a metadata item with the platform's override (if any) applied,
+ * served from the cache for current versions
+ */
+func (ms *MetadataService) GetMetadataJsonByKey(metadataItemKey string, space metadata_typedefs.MetadataSpace, version *core.AppVersion, platform metadata_typedefs.MetadataPlatform) (string, error) {
+	msa := ms.getMetadataServiceSpace(space)
+
+	metadataJson, err := msa.getMetadataJsonForKeyOnPlatform(metadataItemKey, version, platform)
+	if err != nil {
+		return "", errors.New("error getting metadata json: " + err.Error())
+	}
+
+	return metadataJson, nil
+}
+
+/**
+ * Returns a url that game clients can download a metadata item's content from directly.
+ * Fails if the metadata source for the space does not support direct downloads
+ */
+func (ms *MetadataService) GetMetadataDownloadURL(metadataItemKey string, space metadata_typedefs.MetadataSpace, version *core.AppVersion) (string, error) {
+	msa := ms.getMetadataServiceSpace(space)
+
+	url, err := msa.getMetadataDownloadURLForKey(metadataItemKey, version)
+	if err != nil {
+		return "", errors.New("error getting metadata download url: " + err.Error())
+	}
+
+	return url, nil
+}
+
+/**
+ * Loads the metadata item for the metadata version resolved from the app version
+ */
+func (ms *MetadataService) GetMetadataItem(itemPtr metadata_typedefs.IMetadataItem, appVersion *core.AppVersion) error {
+	return ms.GetMetadataItemForPlatform(itemPtr, appVersion, metadata_typedefs.METADATA_PLATFORM_NONE)
+}
+
+/**
+ * Loads the metadata item for the metadata version resolved from the app version,
+ * with the platform's override (if any) applied on top of the base item
+ */
+func (ms *MetadataService) GetMetadataItemForPlatform(itemPtr metadata_typedefs.IMetadataItem, appVersion *core.AppVersion, platform metadata_typedefs.MetadataPlatform) error {
 	if itemPtr == nil {
 		logger.LogError("itemPtr is null")
 		return errors.New("itemPtr is null")
@@ -227,20 +355,29 @@ func (ms *MetadataService) GetMetadataItem(itemPtr metadata_typedefs.IMetadataIt
 
 	msa := ms.getMetadataServiceSpace(itemPtr.GetMetadataSpace())
 
+	version, err := msa.mdVersionList.ResolveVersion(appVersion)
+	if err != nil {
+		logger.LogError("Could not resolve metadata version|metadata_space=" + itemPtr.GetMetadataSpace().String() +
+						"|metadata_key=" + itemPtr.GetKey() +
+						"|app version=" + appVersion.String() +
+						"|error=" + err.Error())
+		return errors.New("failed to find metadata version")
+	}
+
 	var metadataJson string
-	var err error
-	metadataJson, err = msa.getMetadataJsonForItem(itemPtr, version)
+	metadataJson, err = msa.getMetadataJsonForKeyOnPlatform(itemPtr.GetKey(), version, platform)
 
 	if err != nil {
 		logger.LogError("Could not find metadata|metadata_space=" + itemPtr.GetMetadataSpace().String() +
 						"|metadata_key=" + itemPtr.GetKey() +
 						"|version=" + version.String() +
+						"|platform=" + platform.String() +
 						"|error=" + err.Error())
 		return errors.New("failed to find metadata")
 	}
 
 	if metadataJson == "" {
-		logger.LogError("Could not find metadata|metadata_space=" + string(itemPtr.GetMetadataSpace()) +
+		logger.LogError("Could not find metadata|metadata_space=" + itemPtr.GetMetadataSpace().String() +
 			            "|metadata_key=" + itemPtr.GetKey() +
 						"|version=" + version.String())
 		return errors.New("failed to find metadata")
@@ -248,7 +385,7 @@ func (ms *MetadataService) GetMetadataItem(itemPtr metadata_typedefs.IMetadataIt
 
 	err = json.Unmarshal([]byte(metadataJson), itemPtr)
 	if err != nil {
-		logger.LogError("Error deserializing metadata json|metadata_space=" + string(itemPtr.GetMetadataSpace()) +
+		logger.LogError("Error deserializing metadata json|metadata_space=" + itemPtr.GetMetadataSpace().String() +
 			            "|metadata_key=" + itemPtr.GetKey() +
 						"|version=" + version.String() +
 			            "|error=" + err.Error())
@@ -258,6 +395,123 @@ func (ms *MetadataService) GetMetadataItem(itemPtr metadata_typedefs.IMetadataIt
 	return nil
 }
 
+/**
+ * Like GetMetadataItemForPlatform, but also applies the overlays of the experiment variants the user is bucketed into.
+ * Experiment assignments that changed the item are logged, once per user and variant (see LogExperimentAssignments)
+ */
+func (ms *MetadataService) GetMetadataItemForUser(itemPtr metadata_typedefs.IMetadataItem, appVersion *core.AppVersion, platform metadata_typedefs.MetadataPlatform, userId int64) error {
+	if itemPtr == nil {
+		logger.LogError("itemPtr is null")
+		return errors.New("itemPtr is null")
+	}
+
+	msa := ms.getMetadataServiceSpace(itemPtr.GetMetadataSpace())
+
+	version, err := msa.mdVersionList.ResolveVersion(appVersion)
+	if err != nil {
+		logger.LogError("Could not resolve metadata version|metadata_space=" + itemPtr.GetMetadataSpace().String() +
+						"|metadata_key=" + itemPtr.GetKey() +
+						"|app version=" + appVersion.String() +
+						"|error=" + err.Error())
+		return errors.New("failed to find metadata version")
+	}
+
+	metadataJson, err := msa.getMetadataJsonForKeyOnPlatform(itemPtr.GetKey(), version, platform)
+	if err != nil || metadataJson == "" {
+		logger.LogError("Could not find metadata|metadata_space=" + itemPtr.GetMetadataSpace().String() +
+						"|metadata_key=" + itemPtr.GetKey() +
+						"|version=" + version.String() +
+						"|platform=" + platform.String())
+		return errors.New("failed to find metadata")
+	}
+
+	experiments := ms.getExperimentsMetadata(appVersion)
+	if experiments != nil {
+		var assignments []*metadata_experiments.ExperimentAssignment
+		metadataJson, assignments, err = experiments.ApplyOverlaysForUser(itemPtr.GetKey(), metadataJson, userId)
+		if err != nil {
+			logger.LogError("Error applying experiment overlays|metadata_space=" + itemPtr.GetMetadataSpace().String() +
+							"|metadata_key=" + itemPtr.GetKey() +
+							"|version=" + version.String() +
+							"|user id=" + strconv.FormatInt(userId, 10) +
+							"|error=" + err.Error())
+			return errors.New("failed applying experiment overlays")
+		}
+		logNewExperimentAssignments(userId, appVersion, itemPtr.GetKey(), assignments)
+	}
+
+	err = json.Unmarshal([]byte(metadataJson), itemPtr)
+	if err != nil {
+		logger.LogError("Error deserializing metadata json|metadata_space=" + itemPtr.GetMetadataSpace().String() +
+						"|metadata_key=" + itemPtr.GetKey() +
+						"|version=" + version.String() +
+						"|user id=" + strconv.FormatInt(userId, 10) +
+						"|error=" + err.Error())
+		return errors.New("failed deserializing metadata")
+	}
+
+	return nil
+}
+
+/**
+ * Returns (and logs, once per user and variant) the variants of all enabled experiments that the user is bucketed into
+ */
+func (ms *MetadataService) GetExperimentAssignmentsForUser(userId int64, appVersion *core.AppVersion) []*metadata_experiments.ExperimentAssignment {
+	experiments := ms.getExperimentsMetadata(appVersion)
+	if experiments == nil {
+		return nil
+	}
+
+	assignments := experiments.GetAssignmentsForUser(userId)
+	logNewExperimentAssignments(userId, appVersion, "", assignments)
+
+	return assignments
+}
+
+/**
+ * Assignments are logged one per line in a fixed format, so that analysis can join on user id and experiment id
+ */
+func LogExperimentAssignments(userId int64, appVersion *core.AppVersion, metadataItemKey string, assignments []*metadata_experiments.ExperimentAssignment) {
+	for _, assignment := range assignments {
+		logger.LogInfo("experiment assignment" +
+					   "|user id=" + strconv.FormatInt(userId, 10) +
+					   "|experiment id=" + assignment.ExperimentId +
+					   "|variant id=" + assignment.VariantId +
+					   "|app version=" + appVersion.String() +
+					   "|metadata key=" + metadataItemKey)
+	}
+}
+
+// Assignments this process already logged (see logNewExperimentAssignments)
+var loggedExperimentAssignments = make(map[string]bool)
+var loggedExperimentAssignmentsMutex sync.Mutex
+
+const kMaxLoggedExperimentAssignments = 100000
+
+/**
+ * LogExperimentAssignments, for the assignments this process hasn't logged yet, since metadata reads apply the same
+ * experiments for the same users over and over. Once too many have been logged, starts over
+ */
+func logNewExperimentAssignments(userId int64, appVersion *core.AppVersion, metadataItemKey string, assignments []*metadata_experiments.ExperimentAssignment) {
+	var newAssignments []*metadata_experiments.ExperimentAssignment
+
+	loggedExperimentAssignmentsMutex.Lock()
+	for _, assignment := range assignments {
+		assignmentKey := strconv.FormatInt(userId, 10) + ":" + assignment.ExperimentId + ":" + assignment.VariantId
+		if loggedExperimentAssignments[assignmentKey] {
+			continue
+		}
+		if len(loggedExperimentAssignments) >= kMaxLoggedExperimentAssignments {
+			loggedExperimentAssignments = make(map[string]bool)
+		}
+		loggedExperimentAssignments[assignmentKey] = true
+		newAssignments = append(newAssignments, assignment)
+	}
+	loggedExperimentAssignmentsMutex.Unlock()
+
+	LogExperimentAssignments(userId, appVersion, metadataItemKey, newAssignments)
+}
+
 /**
  * Only meant to be called from the admin tool / scripts
  */
@@ -295,6 +549,227 @@ func (ms *MetadataService) SetMetadataItem(itemPtr metadata_typedefs.IMetadataIt
 	return nil
 }
 
+/**
+ * Only meant to be called from the admin tool / scripts
+ */
+func (ms *MetadataService) SetMetadataItemPlatformOverride(metadataItemKey string, overrideJson string, version *core.AppVersion, space metadata_typedefs.MetadataSpace, platform metadata_typedefs.MetadataPlatform) error {
+	msa := ms.getMetadataServiceSpace(space)
+
+	err := msa.setMetadataPlatformOverride(metadataItemKey, overrideJson, version, platform)
+	if err != nil {
+		logger.LogError("error saving metadata platform override" +
+						"|version=" + version.String() +
+						"|metadata key=" + metadataItemKey +
+						"|platform=" + platform.String() +
+						"|error=" + err.Error())
+		return errors.New("error saving metadata platform override: " + err.Error())
+	}
+
+	return nil
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ */
+func (ms *MetadataService) RemoveMetadataItemPlatformOverride(metadataItemKey string, version *core.AppVersion, space metadata_typedefs.MetadataSpace, platform metadata_typedefs.MetadataPlatform) error {
+	msa := ms.getMetadataServiceSpace(space)
+
+	err := msa.removeMetadataPlatformOverride(metadataItemKey, version, platform)
+	if err != nil {
+		logger.LogError("error removing metadata platform override" +
+						"|version=" + version.String() +
+						"|metadata key=" + metadataItemKey +
+						"|platform=" + platform.String() +
+						"|error=" + err.Error())
+		return errors.New("error removing metadata platform override: " + err.Error())
+	}
+
+	return nil
+}
+
+/**
+ * Whether the space's metadata source can import versions from refs (eg: git tags)
+ */
+func (ms *MetadataService) CanImportMetadataFromRef(space metadata_typedefs.MetadataSpace) bool {
+	msa := ms.getMetadataServiceSpace(space)
+
+	_, ok := metadata_typedefs.GetOriginMetadataFetcher(msa.mdFetcher).(metadata_typedefs.IMetadataRefImporter)
+	return ok
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ * Creates a new version holding all the metadata items found at the ref of the metadata source.
+ * Every item is validated before anything is written
+ */
+func (ms *MetadataService) ImportMetadataVersionFromRef(ref string, newVersion *core.AppVersion, space metadata_typedefs.MetadataSpace, markAsCurrent bool) error {
+	msa := ms.getMetadataServiceSpace(space)
+
+	refImporter, ok := metadata_typedefs.GetOriginMetadataFetcher(msa.mdFetcher).(metadata_typedefs.IMetadataRefImporter)
+	if !ok {
+		return errors.New("metadata source does not support importing from refs")
+	}
+
+	metadataJsons, err := refImporter.GetMetadataJsonsAtRef(ref)
+	if err != nil {
+		return errors.New("error reading metadata at ref: " + err.Error())
+	}
+	if len(metadataJsons) == 0 {
+		return errors.New("no metadata items found at ref " + ref)
+	}
+
+	for metadataItemKey, metadataJson := range metadataJsons {
+		metadataItem, err := metadata_factory.InstantiateMetadataItem(metadataItemKey)
+		if err != nil {
+			return errors.New("unknown metadata item " + metadataItemKey + ": " + err.Error())
+		}
+		if metadataItem.GetMetadataSpace() != space {
+			return errors.New("wrong metadata space for " + metadataItemKey)
+		}
+
+		err = metadata_typedefs.UnmarshalAndValidateMetadataItem([]byte(metadataJson), metadataItem)
+		if err != nil {
+			return errors.New("invalid metadata item " + metadataItemKey + ": " + err.Error())
+		}
+	}
+
+	err = ms.CreateNewVersion(newVersion, space, markAsCurrent)
+	if err != nil {
+		return errors.New("error creating new version: " + err.Error())
+	}
+
+	err = msa.setMetadataJsons(metadataJsons, newVersion)
+	if err != nil {
+		logger.LogError("error saving metadata imported from ref" +
+						"|metadata space=" + space.String() +
+						"|ref=" + ref +
+						"|version=" + newVersion.String() +
+						"|error=" + err.Error())
+		return errors.New("error saving imported metadata: " + err.Error())
+	}
+
+	logger.LogInfo("imported metadata version from ref" +
+				   "|metadata space=" + space.String() +
+				   "|ref=" + ref +
+				   "|version=" + newVersion.String() +
+				   "|item count=" + strconv.Itoa(len(metadataJsons)))
+	return nil
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ * Saves metadata items by key, for tools that do not have the factories of the items' types.
+ * The caller is responsible for validating the jsons
+ */
+func (ms *MetadataService) SetMetadataItemsRawContent(metadataJsons map[string]string, version *core.AppVersion, space metadata_typedefs.MetadataSpace) error {
+	msa := ms.getMetadataServiceSpace(space)
+
+	for metadataItemKey, metadataJson := range metadataJsons {
+		if strings.Contains(metadataItemKey, "@") {
+			return errors.New("platform overrides cannot be saved as metadata items: " + metadataItemKey)
+		}
+		if !json.Valid([]byte(metadataJson)) {
+			return errors.New("invalid json for metadata item: " + metadataItemKey)
+		}
+	}
+
+	err := msa.setMetadataJsons(metadataJsons, version)
+	if err != nil {
+		logger.LogError("error saving metadata items" +
+						"|metadata space=" + space.String() +
+						"|version=" + version.String() +
+						"|error=" + err.Error())
+		return errors.New("error saving metadata items: " + err.Error())
+	}
+
+	return nil
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ * Creates a new version with the same items (and platform overrides) as an existing one
+ */
+func (ms *MetadataService) CloneMetadataVersion(fromVersion *core.AppVersion, newVersion *core.AppVersion, space metadata_typedefs.MetadataSpace, markAsCurrent bool) error {
+	msa := ms.getMetadataServiceSpace(space)
+
+	if !msa.mdVersionList.IsVersionValid(fromVersion) {
+		return errors.New("no such version: " + fromVersion.String())
+	}
+	fromManifest, err := msa.getMetadataManifestForVersion(fromVersion)
+	if err != nil {
+		return errors.New("error getting metadata manifest for version: " + err.Error())
+	}
+
+	// Read everything before creating the new version, so that a failure does not leave a half cloned version behind
+	metadataJsons := make(map[string]string)
+	for _, manifestItem := range fromManifest.MetadataManifestItems {
+		storedKeys := []string{manifestItem.MetadataKey}
+		for platformString := range manifestItem.PlatformOverrides {
+			platform, err := metadata_typedefs.GetMetadataPlatformFromString(platformString)
+			if err != nil {
+				return errors.New("bad platform override in manifest for " + manifestItem.MetadataKey + ": " + err.Error())
+			}
+			storedKeys = append(storedKeys, metadata_typedefs.GetPlatformOverrideKey(manifestItem.MetadataKey, platform))
+		}
+
+		for _, storedKey := range storedKeys {
+			metadataJson, err := msa.getMetadataJsonForKey(storedKey, fromVersion)
+			if err != nil {
+				return errors.New("error reading " + storedKey + ": " + err.Error())
+			}
+			metadataJsons[storedKey] = metadataJson
+		}
+	}
+
+	// Copy of the manifest. Hashes stay the same since the contents do
+	manifestBytes, err := json.Marshal(fromManifest)
+	if err != nil {
+		return errors.New("error copying metadata manifest: " + err.Error())
+	}
+	newManifest := &metadata_typedefs.MetadataManifest{}
+	err = json.Unmarshal(manifestBytes, newManifest)
+	if err != nil {
+		return errors.New("error copying metadata manifest: " + err.Error())
+	}
+	newManifest.Initialize()
+
+	err = ms.CreateNewVersion(newVersion, space, markAsCurrent)
+	if err != nil {
+		return errors.New("error creating new version: " + err.Error())
+	}
+
+	err = msa.setMetadataJsonsWithManifest(metadataJsons, newManifest, newVersion)
+	if err != nil {
+		logger.LogError("error saving cloned metadata version" +
+						"|metadata space=" + space.String() +
+						"|from version=" + fromVersion.String() +
+						"|new version=" + newVersion.String() +
+						"|error=" + err.Error())
+		return errors.New("error saving cloned metadata: " + err.Error())
+	}
+
+	logger.LogInfo("cloned metadata version" +
+				   "|metadata space=" + space.String() +
+				   "|from version=" + fromVersion.String() +
+				   "|new version=" + newVersion.String() +
+				   "|item count=" + strconv.Itoa(len(fromManifest.MetadataManifestItems)))
+	return nil
+}
+
+/**
+ * Returns nil if no experiments are defined for the app version
+ */
+func (ms *MetadataService) getExperimentsMetadata(appVersion *core.AppVersion) *metadata_experiments.ExperimentsMetadata {
+	msa := ms.getMetadataServiceSpace(metadata_typedefs.METADATA_SPACE_SHARED)
+
+	version, err := msa.mdVersionList.ResolveVersion(appVersion)
+	if err != nil {
+		return nil
+	}
+
+	return msa.getExperimentsMetadata(version)
+}
+
 func (ms *MetadataService) getMetadataServiceSpace(space metadata_typedefs.MetadataSpace) *MetadataServiceSpace {
 	var msa *MetadataServiceSpace
 
@@ -1,15 +1,16 @@
 package metadata_service
 
 import (
-    "crypto/md5"
-    "encoding/hex"
     "encoding/json"
     "errors"
     "github.com/spacetimi/timi_shared_server/code/config"
     "github.com/spacetimi/timi_shared_server/code/core"
+    "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_experiments"
     "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_fetchers"
     "github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
+    "github.com/spacetimi/timi_shared_server/utils/json_utils"
     "github.com/spacetimi/timi_shared_server/utils/logger"
+    "sync"
 )
 
 type MetadataServiceSpace struct {
@@ -20,6 +21,15 @@ type MetadataServiceSpace struct {
     /* Cache of metadata for versions marked as current */
     mdCache map[string]*metadata_typedefs.MetadataCache			// version => MetadataCache for version
     mdManifests map[string]*metadata_typedefs.MetadataManifest 	// version => MetadataManifest for version
+
+    /* Experiments parsed from each version's experiments item, since they are applied on every metadata read */
+    mdExperiments map[string]*parsedExperiments					// version => experiments for version
+    mdExperimentsMutex sync.Mutex
+}
+
+type parsedExperiments struct {
+    hash string // Of the experiments item they were parsed from
+    experiments *metadata_experiments.ExperimentsMetadata
 }
 
 func newMetadataServiceSpace(metadataSpace metadata_typedefs.MetadataSpace) *MetadataServiceSpace {
@@ -44,6 +54,18 @@ func newMetadataServiceSpace(metadataSpace metadata_typedefs.MetadataSpace) *Met
                             "|version=" + version +
                             "|error=" + err.Error())
         }
+        parsedVersion, err := core.GetAppVersionFromString(version)
+        if err != nil {
+            logger.LogFatal("failed to parse metadata version|metadata_space=" + metadataSpace.String() +
+                            "|version=" + version +
+                            "|error=" + err.Error())
+        }
+        err = verifyManifestSignature(manifest, metadataSpace, parsedVersion)
+        if err != nil {
+            logger.LogFatal("failed to verify metadata manifest signature|metadata_space=" + metadataSpace.String() +
+                            "|version=" + version +
+                            "|error=" + err.Error())
+        }
         msa.mdManifests[version] = manifest
     }
 
@@ -72,7 +94,39 @@ func newMetadataServiceSpace(metadataSpace metadata_typedefs.MetadataSpace) *Met
                                 "|key=" + manifestItem.MetadataKey +
                                 "|error=" + err.Error())
             }
+            err = verifyMetadataJsonAgainstManifest(manifestItem.MetadataKey, json, manifestForVersion)
+            if err != nil {
+                logger.LogFatal("failed to verify preloaded metadata|metadata_space=" + metadataSpace.String() +
+                                "|version=" + currentVersion +
+                                "|error=" + err.Error())
+            }
             metadataCacheForVersion.Cache[manifestItem.MetadataKey] = json
+
+            for platformString := range manifestItem.PlatformOverrides {
+                platform, err := metadata_typedefs.GetMetadataPlatformFromString(platformString)
+                if err != nil {
+                    logger.LogError("skipping unknown platform override while preloading metadata|metadata_space=" + metadataSpace.String() +
+                                    "|version=" + currentVersion +
+                                    "|key=" + manifestItem.MetadataKey +
+                                    "|error=" + err.Error())
+                    continue
+                }
+                overrideKey := metadata_typedefs.GetPlatformOverrideKey(manifestItem.MetadataKey, platform)
+                overrideJson, err := msa.mdFetcher.GetMetadataJsonByKey(overrideKey, currentVersion)
+                if err != nil {
+                    logger.LogFatal("failed to preload metadata platform override|metadata_space=" + metadataSpace.String() +
+                                    "|version=" + currentVersion +
+                                    "|key=" + overrideKey +
+                                    "|error=" + err.Error())
+                }
+                err = verifyMetadataJsonAgainstManifest(overrideKey, overrideJson, manifestForVersion)
+                if err != nil {
+                    logger.LogFatal("failed to verify preloaded metadata platform override|metadata_space=" + metadataSpace.String() +
+                                    "|version=" + currentVersion +
+                                    "|error=" + err.Error())
+                }
+                metadataCacheForVersion.Cache[overrideKey] = overrideJson
+            }
         }
     }
 
@@ -92,6 +146,51 @@ func (msa *MetadataServiceSpace) getMetadataManifestForVersion(version *core.App
     return manifest, nil
 }
 
+/**
+ * Returns nil if no experiments are defined for the version.
+ * The experiments item is parsed once per version, and again only when its hash in the manifest changes
+ */
+func (msa *MetadataServiceSpace) getExperimentsMetadata(version *core.AppVersion) *metadata_experiments.ExperimentsMetadata {
+    manifest, err := msa.getMetadataManifestForVersion(version)
+    if err != nil {
+        return nil
+    }
+    hash, ok := manifest.GetHashForStoredKey(metadata_experiments.ExperimentsMetadataKey)
+    if !ok {
+        return nil
+    }
+
+    msa.mdExperimentsMutex.Lock()
+    parsed, ok := msa.mdExperiments[version.String()]
+    msa.mdExperimentsMutex.Unlock()
+    if ok && parsed.hash == hash {
+        return parsed.experiments
+    }
+
+    // Experiments that fail to parse are remembered as nil, so that the error is only logged once
+    var experiments *metadata_experiments.ExperimentsMetadata
+    experimentsJson, err := msa.getMetadataJsonForKey(metadata_experiments.ExperimentsMetadataKey, version)
+    if err == nil && experimentsJson != "" {
+        experiments = &metadata_experiments.ExperimentsMetadata{}
+        err = json.Unmarshal([]byte(experimentsJson), experiments)
+        if err != nil {
+            logger.LogError("Error deserializing experiments metadata" +
+                            "|version=" + version.String() +
+                            "|error=" + err.Error())
+            experiments = nil
+        }
+    }
+
+    msa.mdExperimentsMutex.Lock()
+    if msa.mdExperiments == nil {
+        msa.mdExperiments = make(map[string]*parsedExperiments)
+    }
+    msa.mdExperiments[version.String()] = &parsedExperiments{hash: hash, experiments: experiments}
+    msa.mdExperimentsMutex.Unlock()
+
+    return experiments
+}
+
 /**
  * Only meant to be called from the admin tool / scripts
  */
@@ -100,9 +199,14 @@ func (msa *MetadataServiceSpace) setMetadataManifestForVersion(manifest *metadat
         return errors.New("invalid version")
     }
 
+    err := signManifest(manifest, msa.mdSpace, version)
+    if err != nil {
+        return errors.New("error signing manifest|error=" + err.Error())
+    }
+
     msa.mdManifests[version.String()] = manifest
 
-    err :=  msa.mdFetcher.SetMetadataManifestForVersion(manifest, version.String())
+    err = msa.mdFetcher.SetMetadataManifestForVersion(manifest, version.String())
     if err != nil {
         return errors.New("error saving new manifest|error=" + err.Error())
     }
@@ -110,6 +214,71 @@ func (msa *MetadataServiceSpace) setMetadataManifestForVersion(manifest *metadat
     return nil
 }
 
+/**
+ * Only meant to be called from the admin tool / scripts
+ * Saves the metadata jsons and the manifest referencing them atomically, if the fetcher supports it
+ */
+func (msa *MetadataServiceSpace) setMetadataJsonsWithManifest(metadataJsons map[string]string, manifest *metadata_typedefs.MetadataManifest, version *core.AppVersion) error {
+    if msa.mdVersionList.IsVersionValid(version) == false {
+        return errors.New("invalid version")
+    }
+
+    err := signManifest(manifest, msa.mdSpace, version)
+    if err != nil {
+        return errors.New("error signing manifest|error=" + err.Error())
+    }
+
+    msa.mdManifests[version.String()] = manifest
+
+    atomicWriter, ok := metadata_typedefs.GetOriginMetadataFetcher(msa.mdFetcher).(metadata_typedefs.IAtomicMetadataWriter)
+    if ok {
+        // Through the decorators that pass atomic writes on (eg: the cached fetcher, which needs to know of the new manifest)
+        if decoratedWriter, isDecorated := msa.mdFetcher.(metadata_typedefs.IAtomicMetadataWriter); isDecorated {
+            atomicWriter = decoratedWriter
+        }
+        err := atomicWriter.SetMetadataJsonsWithManifest(metadataJsons, manifest, version.String())
+        if err != nil {
+            return errors.New("error saving metadata jsons with manifest|error=" + err.Error())
+        }
+        return nil
+    }
+
+    for key, metadataJson := range metadataJsons {
+        err := msa.mdFetcher.SetMetadataJsonByKey(key, metadataJson, version.String())
+        if err != nil {
+            return errors.New("error saving metadata json|key=" + key + "|error=" + err.Error())
+        }
+    }
+
+    err = msa.mdFetcher.SetMetadataManifestForVersion(manifest, version.String())
+    if err != nil {
+        return errors.New("error saving new manifest|error=" + err.Error())
+    }
+
+    return nil
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ * Saves raw metadata jsons (already validated by the caller) along with the updated manifest
+ */
+func (msa *MetadataServiceSpace) setMetadataJsons(metadataJsons map[string]string, version *core.AppVersion) error {
+    manifest, err := msa.getMetadataManifestForVersion(version)
+    if err != nil {
+        return errors.New("error getting metadata manifest for version|error=" + err.Error())
+    }
+
+    cachedMetadataForVersion, isCached := msa.mdCache[version.String()]
+    for key, metadataJson := range metadataJsons {
+        manifest.SetManifestItem(key, getHashForMetadataJson(metadataJson))
+        if isCached {
+            cachedMetadataForVersion.Cache[key] = metadataJson
+        }
+    }
+
+    return msa.setMetadataJsonsWithManifest(metadataJsons, manifest, version)
+}
+
 func (msa *MetadataServiceSpace) isMetadataHashUpToDate(key string, hash string, version *core.AppVersion) (bool, error) {
     manifest, err := msa.getMetadataManifestForVersion(version)
     if err != nil {
@@ -124,7 +293,7 @@ func (msa *MetadataServiceSpace) isMetadataHashUpToDate(key string, hash string,
     return manifestItem.Hash == hash, nil
 }
 
-func (msa *MetadataServiceSpace) getMetadataJsonForItem(itemPtr metadata_typedefs.IMetadataItem, version *core.AppVersion) (string, error) {
+func (msa *MetadataServiceSpace) getMetadataJsonForKey(key string, version *core.AppVersion) (string, error) {
     if msa.mdVersionList.IsVersionValid(version) == false {
         return "", errors.New("invalid version")
     }
@@ -133,14 +302,14 @@ func (msa *MetadataServiceSpace) getMetadataJsonForItem(itemPtr metadata_typedef
     if msa.mdVersionList.IsVersionCurrent(version) {
         cachedMetadataForVersion, ok := msa.mdCache[version.String()]
         if ok {
-            cachedMetadata, ok := cachedMetadataForVersion.Cache[itemPtr.GetKey()]
+            cachedMetadata, ok := cachedMetadataForVersion.Cache[key]
             if ok {
                 return cachedMetadata, nil
 
             } else {
                 logger.LogWarning("failed to find cached metadata item|metadata_space=" + msa.mdSpace.String() +
                                   "|version=" + version.String() +
-                                  "|key=" + itemPtr.GetKey())
+                                  "|key=" + key)
             }
         } else {
             logger.LogWarning("failed to find cached metadata|metadata_space=" + msa.mdSpace.String() +
@@ -150,13 +319,99 @@ func (msa *MetadataServiceSpace) getMetadataJsonForItem(itemPtr metadata_typedef
 
     // Else, load from fetcher
 
-    metadataJson, err := msa.mdFetcher.GetMetadataJsonByKey(itemPtr.GetKey(), version.String())
+    metadataJson, err := msa.mdFetcher.GetMetadataJsonByKey(key, version.String())
     if err != nil {
         return "", errors.New("failed to find metadata from fetcher")
     }
+
+    manifest, err := msa.getMetadataManifestForVersion(version)
+    if err != nil {
+        return "", err
+    }
+    err = verifyMetadataJsonAgainstManifest(key, metadataJson, manifest)
+    if err != nil {
+        logger.LogError("failed to verify metadata from fetcher|metadata_space=" + msa.mdSpace.String() +
+                        "|version=" + version.String() +
+                        "|error=" + err.Error())
+        return "", errors.New("failed to verify metadata from fetcher: " + err.Error())
+    }
+
     return metadataJson, nil
 }
 
+/**
+ * Returns the item's json with the platform's override (if any) applied on top of it
+ */
+func (msa *MetadataServiceSpace) getMetadataJsonForKeyOnPlatform(key string, version *core.AppVersion, platform metadata_typedefs.MetadataPlatform) (string, error) {
+    metadataJson, err := msa.getMetadataJsonForKey(key, version)
+    if err != nil {
+        return "", err
+    }
+
+    if platform == metadata_typedefs.METADATA_PLATFORM_NONE {
+        return metadataJson, nil
+    }
+
+    manifest, err := msa.getMetadataManifestForVersion(version)
+    if err != nil {
+        return "", err
+    }
+    manifestItem := manifest.GetManifestItem(key)
+    if manifestItem == nil || !manifestItem.HasPlatformOverride(platform) {
+        return metadataJson, nil
+    }
+
+    overrideJson, err := msa.getMetadataJsonForKey(metadata_typedefs.GetPlatformOverrideKey(key, platform), version)
+    if err != nil {
+        return "", errors.New("failed to find platform override: " + err.Error())
+    }
+
+    mergedJson, err := json_utils.ApplyMergePatch([]byte(metadataJson), []byte(overrideJson))
+    if err != nil {
+        return "", errors.New("failed to apply platform override: " + err.Error())
+    }
+
+    return string(mergedJson), nil
+}
+
+/**
+ * Compares the hashes a client on a platform holds against the manifest for the version.
+ * Returns the manifest items the client is missing or holds stale copies of,
+ * and the keys the client holds that are no longer in the manifest
+ */
+func (msa *MetadataServiceSpace) getStaleManifestItems(clientHashes map[string]string, version *core.AppVersion, platform metadata_typedefs.MetadataPlatform) ([]*metadata_typedefs.MetadataManifestItem, []string, error) {
+    manifest, err := msa.getMetadataManifestForVersion(version)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    var staleItems []*metadata_typedefs.MetadataManifestItem
+    for _, manifestItem := range manifest.MetadataManifestItems {
+        clientHash, ok := clientHashes[manifestItem.MetadataKey]
+        if !ok || clientHash != manifestItem.GetEffectiveHash(platform) {
+            staleItems = append(staleItems, manifestItem)
+        }
+    }
+
+    var removedKeys []string
+    for key := range clientHashes {
+        if manifest.GetManifestItem(key) == nil {
+            removedKeys = append(removedKeys, key)
+        }
+    }
+
+    return staleItems, removedKeys, nil
+}
+
+func (msa *MetadataServiceSpace) getMetadataDownloadURLForKey(key string, version *core.AppVersion) (string, error) {
+    urlProvider, ok := metadata_typedefs.GetOriginMetadataFetcher(msa.mdFetcher).(metadata_typedefs.IMetadataDownloadURLProvider)
+    if !ok {
+        return "", errors.New("metadata source does not support download urls")
+    }
+
+    return urlProvider.GetMetadataDownloadURLByKey(key, version.String())
+}
+
 /**
  * Only meant to be called from the admin tool / scripts
  */
@@ -191,27 +446,90 @@ func (msa *MetadataServiceSpace) setMetadataJsonForItem(itemPtr metadata_typedef
         cachedMetadataForVersion.Cache[itemPtr.GetKey()] = metadataJson
     }
 
-    // Save the metadata item
-    err = msa.mdFetcher.SetMetadataJsonByKey(itemPtr.GetKey(), metadataJson, version.String())
+    // Generate hash of the file's contents
+    hash := getHashForMetadataJson(metadataJson)
+
+    // Save the metadata item along with the updated metadata manifest for this version
+    manifest, err := msa.getMetadataManifestForVersion(version)
+    if err != nil {
+        return errors.New("error getting metadata manifest for version|error=" + err.Error())
+    }
+    manifest.SetManifestItem(itemPtr.GetKey(), hash)
+    err = msa.setMetadataJsonsWithManifest(map[string]string{itemPtr.GetKey(): metadataJson}, manifest, version)
     if err != nil {
         return errors.New("error saving metadata json|error=" + err.Error())
     }
 
-    // Generate hash of the file's contents
-    hashBytes := md5.Sum([]byte(metadataJson))
-    hash := hex.EncodeToString(hashBytes[:])
+    return nil
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ */
+func (msa *MetadataServiceSpace) setMetadataPlatformOverride(key string, overrideJson string, version *core.AppVersion, platform metadata_typedefs.MetadataPlatform) error {
+    if msa.mdVersionList.IsVersionValid(version) == false {
+        return errors.New("invalid version")
+    }
+    if platform == metadata_typedefs.METADATA_PLATFORM_NONE {
+        return errors.New("invalid platform")
+    }
+    if !json_utils.IsJsonObject([]byte(overrideJson)) {
+        return errors.New("platform override must be a json object")
+    }
 
-    // Update the metadata manifest for this version
     manifest, err := msa.getMetadataManifestForVersion(version)
     if err != nil {
         return errors.New("error getting metadata manifest for version|error=" + err.Error())
     }
-    manifest.SetManifestItem(itemPtr.GetKey(), hash)
+    if manifest.GetManifestItem(key) == nil {
+        return errors.New("no base metadata item defined for key: " + key)
+    }
+
+    overrideKey := metadata_typedefs.GetPlatformOverrideKey(key, platform)
+
+    // If version is marked as current, also update the cache
+    if msa.mdVersionList.IsVersionCurrent(version) {
+        cachedMetadataForVersion, ok := msa.mdCache[version.String()]
+        if !ok {
+            return errors.New("failed to find cached metadata for version (this should theoretically never happen)")
+        }
+        cachedMetadataForVersion.Cache[overrideKey] = overrideJson
+    }
+
+    // Save the override along with the updated metadata manifest for this version
+    err = manifest.SetManifestItemPlatformOverride(key, platform, getHashForMetadataJson(overrideJson))
+    if err != nil {
+        return errors.New("error updating manifest item|error=" + err.Error())
+    }
+    err = msa.setMetadataJsonsWithManifest(map[string]string{overrideKey: overrideJson}, manifest, version)
+    if err != nil {
+        return errors.New("error saving metadata platform override json|error=" + err.Error())
+    }
+
+    return nil
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ * The override's content is left in place, but is no longer referenced by the manifest
+ */
+func (msa *MetadataServiceSpace) removeMetadataPlatformOverride(key string, version *core.AppVersion, platform metadata_typedefs.MetadataPlatform) error {
+    manifest, err := msa.getMetadataManifestForVersion(version)
+    if err != nil {
+        return errors.New("error getting metadata manifest for version|error=" + err.Error())
+    }
+
+    manifest.RemoveManifestItemPlatformOverride(key, platform)
     err = msa.setMetadataManifestForVersion(manifest, version)
     if err != nil {
         return errors.New("error updating metadata manifest for version|error=" + err.Error())
     }
 
+    cachedMetadataForVersion, ok := msa.mdCache[version.String()]
+    if ok {
+        delete(cachedMetadataForVersion.Cache, metadata_typedefs.GetPlatformOverrideKey(key, platform))
+    }
+
     return nil
 }
 
@@ -242,6 +560,26 @@ func (msa *MetadataServiceSpace) setCurrentVersions(newCurrentVersions []*core.A
     return nil
 }
 
+/**
+ * Only meant to be called from the admin tool / scripts
+ */
+func (msa *MetadataServiceSpace) setVersionMappings(mappings []*metadata_typedefs.MetadataVersionMapping) error {
+    previousMappings := msa.mdVersionList.VersionMappings
+
+    err := msa.mdVersionList.SetVersionMappings(mappings)
+    if err != nil {
+        return errors.New("invalid version mappings: " + err.Error())
+    }
+
+    err = msa.mdFetcher.SetMetadataVersionList(msa.mdVersionList)
+    if err != nil {
+        msa.mdVersionList.VersionMappings = previousMappings
+        return errors.New("could not save version mappings| error=" + err.Error())
+    }
+
+    return nil
+}
+
 /**
  * Only meant to be called from the admin tool / scripts
  */
@@ -264,6 +602,10 @@ func (msa *MetadataServiceSpace) createNewVersion(version *core.AppVersion, mark
     // Create empty manifest for new version
     newManifest := &metadata_typedefs.MetadataManifest{}
     newManifest.Initialize()
+    err = signManifest(newManifest, msa.mdSpace, version)
+    if err != nil {
+        return errors.New("error signing metadata manifest for new version: " + err.Error())
+    }
     msa.mdManifests[version.String()] = newManifest
 
     err = msa.mdFetcher.SetMetadataManifestForVersion(newManifest, version.String())
@@ -273,3 +615,7 @@ func (msa *MetadataServiceSpace) createNewVersion(version *core.AppVersion, mark
 
     return nil
 }
+
+func getHashForMetadataJson(metadataJson string) string {
+    return metadata_typedefs.GetMetadataJsonHash(metadataJson)
+}
@@ -0,0 +1,32 @@
+package metadata_typedefs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/spacetimi/timi_shared_server/utils/encryption_utils"
+)
+
+/**
+ * Hashes of metadata content are self-describing: "sha256:<hex digest>".
+ * Hashes without an algorithm prefix are legacy md5 hex digests, which are still verified
+ * until the version's manifest is upgraded (see MetadataService.UpgradeMetadataManifestIntegrity)
+ */
+const kMetadataHashPrefixSHA256 = "sha256:"
+
+func GetMetadataJsonHash(metadataJson string) string {
+	hashBytes := sha256.Sum256([]byte(metadataJson))
+	return kMetadataHashPrefixSHA256 + hex.EncodeToString(hashBytes[:])
+}
+
+func IsLegacyMetadataHash(hash string) bool {
+	return !strings.HasPrefix(hash, kMetadataHashPrefixSHA256)
+}
+
+func VerifyMetadataJsonHash(metadataJson string, hash string) bool {
+	if IsLegacyMetadataHash(hash) {
+		return encryption_utils.Generate_md5_hash(metadataJson) == hash
+	}
+	return GetMetadataJsonHash(metadataJson) == hash
+}
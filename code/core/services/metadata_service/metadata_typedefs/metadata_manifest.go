@@ -1,13 +1,43 @@
 package metadata_typedefs
 
+import (
+	"errors"
+	"strings"
+)
+
 type MetadataManifestItem struct {
 	MetadataKey string
 	Hash string
+
+	// Per-platform overlays (JSON merge patches) applied on top of the base item
+	PlatformOverrides map[string]string `json:",omitempty"`	// platform => hash of the override
+}
+
+func (mmi *MetadataManifestItem) HasPlatformOverride(platform MetadataPlatform) bool {
+	if platform == METADATA_PLATFORM_NONE {
+		return false
+	}
+	_, ok := mmi.PlatformOverrides[platform.String()]
+	return ok
+}
+
+/**
+ * Hash of the item as seen by a client on the platform, ie, the base item with the platform's override (if any) applied.
+ * For overridden items this is a sha256 hash over the base and override hashes, so that it changes whenever either does
+ */
+func (mmi *MetadataManifestItem) GetEffectiveHash(platform MetadataPlatform) string {
+	if !mmi.HasPlatformOverride(platform) {
+		return mmi.Hash
+	}
+	return GetMetadataJsonHash(mmi.Hash + ":" + mmi.PlatformOverrides[platform.String()])
 }
 
 type MetadataManifest struct {
 	MetadataManifestItems []*MetadataManifestItem
 
+	// Optional. "<algorithm>:<base64 signature>" over the space, version and manifest items, see MetadataManifestSigner
+	Signature string `json:",omitempty"`
+
 	_itemsAsMap map[string]*MetadataManifestItem 	// key => metadata manifest item for key
 }
 
@@ -31,6 +61,27 @@ func (mm *MetadataManifest) GetManifestItem(key string) *MetadataManifestItem {
 	return manifestItem
 }
 
+/**
+ * Hash of the content stored under the key, which is either an item's key or a platform override's key
+ */
+func (mm *MetadataManifest) GetHashForStoredKey(key string) (string, bool) {
+	manifestItem := mm.GetManifestItem(key)
+	if manifestItem != nil {
+		return manifestItem.Hash, true
+	}
+
+	tokens := strings.SplitN(key, "@", 2)
+	if len(tokens) != 2 {
+		return "", false
+	}
+	manifestItem = mm.GetManifestItem(tokens[0])
+	if manifestItem == nil {
+		return "", false
+	}
+	hash, ok := manifestItem.PlatformOverrides[tokens[1]]
+	return hash, ok
+}
+
 /**
  * Only meant to be called from the admin tool / scripts
  */
@@ -50,3 +101,34 @@ func (mm *MetadataManifest) SetManifestItem(key string, hash string) {
 	mm.MetadataManifestItems = append(mm.MetadataManifestItems, manifestItem)
 	mm._itemsAsMap[key] = manifestItem
 }
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ */
+func (mm *MetadataManifest) SetManifestItemPlatformOverride(key string, platform MetadataPlatform, hash string) error {
+	manifestItem := mm.GetManifestItem(key)
+	if manifestItem == nil {
+		return errors.New("no base metadata item to override")
+	}
+
+	if manifestItem.PlatformOverrides == nil {
+		manifestItem.PlatformOverrides = make(map[string]string)
+	}
+	manifestItem.PlatformOverrides[platform.String()] = hash
+	return nil
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ */
+func (mm *MetadataManifest) RemoveManifestItemPlatformOverride(key string, platform MetadataPlatform) {
+	manifestItem := mm.GetManifestItem(key)
+	if manifestItem == nil {
+		return
+	}
+
+	delete(manifestItem.PlatformOverrides, platform.String())
+	if len(manifestItem.PlatformOverrides) == 0 {
+		manifestItem.PlatformOverrides = nil
+	}
+}
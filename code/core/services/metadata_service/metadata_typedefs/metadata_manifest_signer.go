@@ -0,0 +1,204 @@
+package metadata_typedefs
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/spacetimi/timi_shared_server/code/core"
+)
+
+const MANIFEST_SIGNATURE_ALGORITHM_HMAC_SHA256 = "hmac-sha256"
+const MANIFEST_SIGNATURE_ALGORITHM_ED25519 = "ed25519"
+
+/**
+ * The manifest was signed before signatures covered the space and version, so it could be another version's manifest.
+ * Re-sign it (eg: with MetadataService.UpgradeMetadataManifestIntegrity)
+ */
+var ErrLegacyManifestSignature = errors.New("manifest signature does not cover its space and version")
+
+/**
+ * Signs manifests, and verifies their signatures, so that servers (and, with ed25519, clients)
+ * can confirm that the manifest, and through its hashes the metadata, were written by our tooling.
+ * hmac-sha256 needs the shared secret to sign and to verify.
+ * ed25519 needs the private key to sign, and only the public key to verify
+ */
+type MetadataManifestSigner struct {
+	algorithm string
+
+	hmacKey []byte
+
+	ed25519PrivateKey ed25519.PrivateKey
+	ed25519PublicKey  ed25519.PublicKey
+}
+
+/**
+ * secret is the hmac key, or the base64 ed25519 private key (or its seed). It can be empty on servers that only verify ed25519 signatures
+ * publicKey is the base64 ed25519 public key. It is derived from the private key if empty
+ */
+func NewMetadataManifestSigner(algorithm string, secret string, publicKey string) (*MetadataManifestSigner, error) {
+	signer := &MetadataManifestSigner{algorithm: algorithm}
+
+	switch algorithm {
+	case MANIFEST_SIGNATURE_ALGORITHM_HMAC_SHA256:
+		if len(secret) == 0 {
+			return nil, errors.New("hmac signing needs a secret")
+		}
+		signer.hmacKey = []byte(secret)
+
+	case MANIFEST_SIGNATURE_ALGORITHM_ED25519:
+		if len(secret) != 0 {
+			keyBytes, err := base64.StdEncoding.DecodeString(secret)
+			if err != nil {
+				return nil, errors.New("error decoding ed25519 private key: " + err.Error())
+			}
+			switch len(keyBytes) {
+			case ed25519.SeedSize:
+				signer.ed25519PrivateKey = ed25519.NewKeyFromSeed(keyBytes)
+			case ed25519.PrivateKeySize:
+				signer.ed25519PrivateKey = keyBytes
+			default:
+				return nil, errors.New("ed25519 private key has the wrong size")
+			}
+			signer.ed25519PublicKey = signer.ed25519PrivateKey.Public().(ed25519.PublicKey)
+		}
+
+		if len(publicKey) != 0 {
+			keyBytes, err := base64.StdEncoding.DecodeString(publicKey)
+			if err != nil {
+				return nil, errors.New("error decoding ed25519 public key: " + err.Error())
+			}
+			if len(keyBytes) != ed25519.PublicKeySize {
+				return nil, errors.New("ed25519 public key has the wrong size")
+			}
+			signer.ed25519PublicKey = keyBytes
+		}
+
+		if signer.ed25519PublicKey == nil {
+			return nil, errors.New("ed25519 signing needs a private or public key")
+		}
+
+	default:
+		return nil, errors.New("unknown manifest signature algorithm: " + algorithm)
+	}
+
+	return signer, nil
+}
+
+func (mms *MetadataManifestSigner) CanSign() bool {
+	return mms.hmacKey != nil || mms.ed25519PrivateKey != nil
+}
+
+func (mms *MetadataManifestSigner) Sign(manifest *MetadataManifest, space MetadataSpace, version *core.AppVersion) error {
+	if !mms.CanSign() {
+		return errors.New("no signing key configured")
+	}
+
+	signedBytes, err := manifest.getSignedBytes(space, version)
+	if err != nil {
+		return err
+	}
+
+	var signature []byte
+	switch mms.algorithm {
+	case MANIFEST_SIGNATURE_ALGORITHM_HMAC_SHA256:
+		signature = mms.getHmac(signedBytes)
+	case MANIFEST_SIGNATURE_ALGORITHM_ED25519:
+		signature = ed25519.Sign(mms.ed25519PrivateKey, signedBytes)
+	}
+
+	manifest.Signature = mms.algorithm + ":" + base64.StdEncoding.EncodeToString(signature)
+	return nil
+}
+
+/**
+ * Fails unless the manifest was signed as the manifest of this space and version.
+ * Returns ErrLegacyManifestSignature if the signature is valid, but from before signatures covered those
+ */
+func (mms *MetadataManifestSigner) Verify(manifest *MetadataManifest, space MetadataSpace, version *core.AppVersion) error {
+	if len(manifest.Signature) == 0 {
+		return errors.New("manifest is not signed")
+	}
+
+	tokens := strings.SplitN(manifest.Signature, ":", 2)
+	if len(tokens) != 2 || tokens[0] != mms.algorithm {
+		return errors.New("manifest is not signed with " + mms.algorithm)
+	}
+	signature, err := base64.StdEncoding.DecodeString(tokens[1])
+	if err != nil {
+		return errors.New("error decoding manifest signature: " + err.Error())
+	}
+
+	signedBytes, err := manifest.getSignedBytes(space, version)
+	if err != nil {
+		return err
+	}
+	if mms.isValidSignature(signature, signedBytes) {
+		return nil
+	}
+
+	legacySignedBytes, err := manifest.getLegacySignedBytes()
+	if err != nil {
+		return err
+	}
+	if mms.isValidSignature(signature, legacySignedBytes) {
+		return ErrLegacyManifestSignature
+	}
+
+	return errors.New("invalid manifest signature")
+}
+
+func (mms *MetadataManifestSigner) isValidSignature(signature []byte, signedBytes []byte) bool {
+	switch mms.algorithm {
+	case MANIFEST_SIGNATURE_ALGORITHM_HMAC_SHA256:
+		return hmac.Equal(signature, mms.getHmac(signedBytes))
+	case MANIFEST_SIGNATURE_ALGORITHM_ED25519:
+		return ed25519.Verify(mms.ed25519PublicKey, signedBytes, signature)
+	}
+	return false
+}
+
+func (mms *MetadataManifestSigner) getHmac(data []byte) []byte {
+	mac := hmac.New(sha256.New, mms.hmacKey)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+/**
+ * The signature covers the json of the manifest's space, version and items, eg:
+ *   {"Space":"app","Version":"1.2","MetadataManifestItems":[...]}
+ * so that a manifest can't be passed off as another version's. Version is as written by AppVersion.String().
+ * json.Marshal writes struct fields in order and map keys sorted, so this is stable across servers (and clients)
+ */
+type signedManifest struct {
+	Space                 string
+	Version               string
+	MetadataManifestItems []*MetadataManifestItem
+}
+
+func (mm *MetadataManifest) getSignedBytes(space MetadataSpace, version *core.AppVersion) ([]byte, error) {
+	signedBytes, err := json.Marshal(signedManifest{
+		Space:                 space.String(),
+		Version:               version.String(),
+		MetadataManifestItems: mm.MetadataManifestItems,
+	})
+	if err != nil {
+		return nil, errors.New("error serializing manifest for signature: " + err.Error())
+	}
+	return signedBytes, nil
+}
+
+/**
+ * Signatures used to cover the json of the manifest items only
+ */
+func (mm *MetadataManifest) getLegacySignedBytes() ([]byte, error) {
+	signedBytes, err := json.Marshal(mm.MetadataManifestItems)
+	if err != nil {
+		return nil, errors.New("error serializing manifest items for signature: " + err.Error())
+	}
+	return signedBytes, nil
+}
@@ -0,0 +1,76 @@
+package metadata_typedefs
+
+import (
+	"errors"
+)
+
+type ScheduledMetadataActionType string
+const (
+	SCHEDULED_ACTION_SET_CURRENT_VERSIONS ScheduledMetadataActionType = "set_current_versions"
+	SCHEDULED_ACTION_PUBLISH_ITEM         ScheduledMetadataActionType = "publish_item"
+)
+
+func GetScheduledMetadataActionTypeFromString(s string) (ScheduledMetadataActionType, error) {
+	switch ScheduledMetadataActionType(s) {
+	case SCHEDULED_ACTION_SET_CURRENT_VERSIONS:
+		return SCHEDULED_ACTION_SET_CURRENT_VERSIONS, nil
+	case SCHEDULED_ACTION_PUBLISH_ITEM:
+		return SCHEDULED_ACTION_PUBLISH_ITEM, nil
+	}
+	return "", errors.New("unknown scheduled metadata action type: " + s)
+}
+
+type ScheduledMetadataActionStatus string
+const (
+	SCHEDULED_ACTION_STATUS_PENDING   ScheduledMetadataActionStatus = "pending"
+	SCHEDULED_ACTION_STATUS_RUNNING   ScheduledMetadataActionStatus = "running"
+	SCHEDULED_ACTION_STATUS_DONE      ScheduledMetadataActionStatus = "done"
+	SCHEDULED_ACTION_STATUS_FAILED    ScheduledMetadataActionStatus = "failed"
+	SCHEDULED_ACTION_STATUS_CANCELLED ScheduledMetadataActionStatus = "cancelled"
+)
+
+/**
+ * A change to metadata that is applied automatically at a specific (UTC) time by the metadata scheduler.
+ *   set_current_versions: marks CurrentVersions as the current versions of the space
+ *   publish_item: saves Content as the metadata item MetadataKey in Version
+ */
+type ScheduledMetadataAction struct {
+	ScheduleId    int64
+	AppName       string
+	Space         MetadataSpace
+	ActionType    ScheduledMetadataActionType
+	ExecuteAtUnix int64
+
+	CurrentVersions []string
+
+	Version     string
+	MetadataKey string
+	Content     string
+
+	Status         ScheduledMetadataActionStatus
+	CreatedBy      string
+	CreatedAtUnix  int64
+	ExecutedAtUnix int64
+	Error          string
+}
+
+func (action *ScheduledMetadataAction) IsPending() bool {
+	return action.Status == SCHEDULED_ACTION_STATUS_PENDING
+}
+
+/**
+ * Short human readable description of what the action will do
+ */
+func (action *ScheduledMetadataAction) Description() string {
+	switch action.ActionType {
+	case SCHEDULED_ACTION_SET_CURRENT_VERSIONS:
+		description := "Set current versions to:"
+		for _, version := range action.CurrentVersions {
+			description += " " + version
+		}
+		return description
+	case SCHEDULED_ACTION_PUBLISH_ITEM:
+		return "Publish " + action.MetadataKey + " in version " + action.Version
+	}
+	return "Unknown action: " + string(action.ActionType)
+}
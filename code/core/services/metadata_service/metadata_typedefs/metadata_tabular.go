@@ -0,0 +1,325 @@
+package metadata_typedefs
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	TABULAR_COLUMN_TYPE_STRING = "string"
+	TABULAR_COLUMN_TYPE_INT    = "int"
+	TABULAR_COLUMN_TYPE_FLOAT  = "float"
+	TABULAR_COLUMN_TYPE_BOOL   = "bool"
+	TABULAR_COLUMN_TYPE_LIST   = "list" // List of strings, separated by ';' in the cell
+	TABULAR_COLUMN_TYPE_JSON   = "json" // Any json value, written as is in the cell
+)
+
+const kTabularListSeparator = ";"
+
+/**
+ * How a metadata item that is a list of records maps to a spreadsheet: a row per record, and a column per field.
+ * Record fields without a column are dropped on import, so the columns should cover every field of the record type
+ */
+type MetadataTabularMapping struct {
+	// Dot separated path of the list of records in the item's json (eg: "Weapons"), or "" if the item's json is the list itself.
+	// Everything else in the item's json is kept as it is on import
+	RecordsPath string
+
+	Columns []*MetadataTabularColumn
+}
+
+type MetadataTabularColumn struct {
+	Header   string
+	JsonPath string // Dot separated path of the field in a record's json (eg: "Cost.Gold")
+	Type     string // One of TABULAR_COLUMN_TYPE_*. Defaults to string
+	Required bool   // If not, empty cells leave the field out of the record
+}
+
+type MetadataTabularRowError struct {
+	Row     int // As numbered in spreadsheets: the header is row 1
+	Column  string
+	Message string
+}
+
+func (mtre *MetadataTabularRowError) Error() string {
+	if mtre.Column == "" {
+		return "row " + strconv.Itoa(mtre.Row) + ": " + mtre.Message
+	}
+	return "row " + strconv.Itoa(mtre.Row) + ", column " + mtre.Column + ": " + mtre.Message
+}
+
+/**
+ * Writes a header row, and then a row per record in the item's json
+ */
+func ConvertMetadataJsonToCSV(metadataJson string, mapping *MetadataTabularMapping, writer io.Writer) error {
+	root, err := decodeTabularJson([]byte(metadataJson))
+	if err != nil {
+		return errors.New("error deserializing metadata json: " + err.Error())
+	}
+
+	var records []interface{}
+	recordsValue, ok := getTabularJsonPath(root, mapping.RecordsPath)
+	if ok && recordsValue != nil {
+		records, ok = recordsValue.([]interface{})
+		if !ok {
+			return errors.New("records at '" + mapping.RecordsPath + "' are not a list")
+		}
+	}
+
+	csvWriter := csv.NewWriter(writer)
+
+	header := make([]string, 0, len(mapping.Columns))
+	for _, column := range mapping.Columns {
+		header = append(header, column.Header)
+	}
+	err = csvWriter.Write(header)
+	if err != nil {
+		return errors.New("error writing csv header: " + err.Error())
+	}
+
+	for i, record := range records {
+		row := make([]string, 0, len(mapping.Columns))
+		for _, column := range mapping.Columns {
+			value, _ := getTabularJsonPath(record, column.JsonPath)
+			cell, err := formatTabularCell(value, column)
+			if err != nil {
+				return &MetadataTabularRowError{Row: i + 2, Column: column.Header, Message: err.Error()}
+			}
+			row = append(row, cell)
+		}
+		err = csvWriter.Write(row)
+		if err != nil {
+			return errors.New("error writing csv row: " + err.Error())
+		}
+	}
+
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
+
+/**
+ * Builds the item's json from csv written by ConvertMetadataJsonToCSV (columns can be in any order, and optional ones can be left out).
+ * The records replace the ones in baseJson (the item's current json, or "" for a new item).
+ * Returns every bad row, rather than stopping at the first one
+ */
+func ConvertCSVToMetadataJson(reader io.Reader, mapping *MetadataTabularMapping, baseJson string) (string, []*MetadataTabularRowError) {
+	csvReader := csv.NewReader(reader)
+	rows, err := csvReader.ReadAll()
+	if err != nil {
+		return "", []*MetadataTabularRowError{{Row: 1, Message: "error reading csv: " + err.Error()}}
+	}
+	if len(rows) == 0 {
+		return "", []*MetadataTabularRowError{{Row: 1, Message: "empty csv"}}
+	}
+
+	// Map the header to the columns
+	columnsByIndex := make([]*MetadataTabularColumn, len(rows[0]))
+	var rowErrors []*MetadataTabularRowError
+	for i, header := range rows[0] {
+		for _, column := range mapping.Columns {
+			if strings.TrimSpace(header) == column.Header {
+				columnsByIndex[i] = column
+				break
+			}
+		}
+		if columnsByIndex[i] == nil {
+			rowErrors = append(rowErrors, &MetadataTabularRowError{Row: 1, Column: header, Message: "unknown column"})
+		}
+	}
+	for _, column := range mapping.Columns {
+		if !column.Required {
+			continue
+		}
+		found := false
+		for _, mappedColumn := range columnsByIndex {
+			if mappedColumn == column {
+				found = true
+				break
+			}
+		}
+		if !found {
+			rowErrors = append(rowErrors, &MetadataTabularRowError{Row: 1, Column: column.Header, Message: "missing required column"})
+		}
+	}
+	if len(rowErrors) != 0 {
+		return "", rowErrors
+	}
+
+	records := make([]interface{}, 0, len(rows)-1)
+	for rowIndex, row := range rows[1:] {
+		record := make(map[string]interface{})
+		for i, cell := range row {
+			column := columnsByIndex[i]
+			if cell == "" {
+				if column.Required {
+					rowErrors = append(rowErrors, &MetadataTabularRowError{Row: rowIndex + 2, Column: column.Header, Message: "required"})
+				}
+				continue
+			}
+
+			value, err := parseTabularCell(cell, column)
+			if err != nil {
+				rowErrors = append(rowErrors, &MetadataTabularRowError{Row: rowIndex + 2, Column: column.Header, Message: err.Error()})
+				continue
+			}
+			setTabularJsonPath(record, column.JsonPath, value)
+		}
+		records = append(records, record)
+	}
+	if len(rowErrors) != 0 {
+		return "", rowErrors
+	}
+
+	var root interface{} = records
+	if mapping.RecordsPath != "" {
+		var base map[string]interface{}
+		if baseJson != "" {
+			baseValue, err := decodeTabularJson([]byte(baseJson))
+			if err == nil {
+				base, _ = baseValue.(map[string]interface{})
+			}
+		}
+		if base == nil {
+			base = make(map[string]interface{})
+		}
+		setTabularJsonPath(base, mapping.RecordsPath, records)
+		root = base
+	}
+
+	metadataJson, err := json.Marshal(root)
+	if err != nil {
+		return "", []*MetadataTabularRowError{{Row: 1, Message: "error serializing metadata json: " + err.Error()}}
+	}
+	return string(metadataJson), nil
+}
+
+func formatTabularCell(value interface{}, column *MetadataTabularColumn) (string, error) {
+	if value == nil {
+		return "", nil
+	}
+
+	switch column.Type {
+	case TABULAR_COLUMN_TYPE_LIST:
+		list, ok := value.([]interface{})
+		if !ok {
+			return "", errors.New("not a list")
+		}
+		var items []string
+		for _, item := range list {
+			itemString, ok := item.(string)
+			if !ok {
+				return "", errors.New("list items must be strings")
+			}
+			items = append(items, itemString)
+		}
+		return strings.Join(items, kTabularListSeparator), nil
+
+	case TABULAR_COLUMN_TYPE_JSON:
+		bytes, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		return string(bytes), nil
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", errors.New("not a " + column.Type + " (use a json column for objects and lists)")
+}
+
+func parseTabularCell(cell string, column *MetadataTabularColumn) (interface{}, error) {
+	switch column.Type {
+	case TABULAR_COLUMN_TYPE_INT:
+		_, err := strconv.ParseInt(strings.TrimSpace(cell), 10, 64)
+		if err != nil {
+			return nil, errors.New("not an integer: " + cell)
+		}
+		return json.Number(strings.TrimSpace(cell)), nil
+
+	case TABULAR_COLUMN_TYPE_FLOAT:
+		_, err := strconv.ParseFloat(strings.TrimSpace(cell), 64)
+		if err != nil {
+			return nil, errors.New("not a number: " + cell)
+		}
+		return json.Number(strings.TrimSpace(cell)), nil
+
+	case TABULAR_COLUMN_TYPE_BOOL:
+		b, err := strconv.ParseBool(strings.TrimSpace(strings.ToLower(cell)))
+		if err != nil {
+			return nil, errors.New("not true or false: " + cell)
+		}
+		return b, nil
+
+	case TABULAR_COLUMN_TYPE_LIST:
+		var items []interface{}
+		for _, item := range strings.Split(cell, kTabularListSeparator) {
+			items = append(items, strings.TrimSpace(item))
+		}
+		return items, nil
+
+	case TABULAR_COLUMN_TYPE_JSON:
+		value, err := decodeTabularJson([]byte(cell))
+		if err != nil {
+			return nil, errors.New("bad json: " + err.Error())
+		}
+		return value, nil
+	}
+
+	return cell, nil
+}
+
+/**
+ * Keeps numbers as json.Number, so that large integers survive the round trip
+ */
+func decodeTabularJson(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value interface{}
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func getTabularJsonPath(value interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return value, true
+	}
+	for _, field := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		value, ok = object[field]
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func setTabularJsonPath(object map[string]interface{}, path string, value interface{}) {
+	fields := strings.Split(path, ".")
+	for _, field := range fields[:len(fields)-1] {
+		child, ok := object[field].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			object[field] = child
+		}
+		object = child
+	}
+	object[fields[len(fields)-1]] = value
+}
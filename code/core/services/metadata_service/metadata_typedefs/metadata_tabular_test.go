@@ -0,0 +1,130 @@
+package metadata_typedefs
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var kTestTabularMapping = &MetadataTabularMapping{
+	RecordsPath: "Weapons",
+	Columns: []*MetadataTabularColumn{
+		{Header: "Id", JsonPath: "Id", Type: TABULAR_COLUMN_TYPE_INT, Required: true},
+		{Header: "Name", JsonPath: "Name", Type: TABULAR_COLUMN_TYPE_STRING},
+		{Header: "Gold", JsonPath: "Cost.Gold", Type: TABULAR_COLUMN_TYPE_FLOAT},
+		{Header: "Ranged", JsonPath: "Ranged", Type: TABULAR_COLUMN_TYPE_BOOL},
+		{Header: "Tags", JsonPath: "Tags", Type: TABULAR_COLUMN_TYPE_LIST},
+		{Header: "Extra", JsonPath: "Extra", Type: TABULAR_COLUMN_TYPE_JSON},
+	},
+}
+
+func TestMetadataTabularCSVRoundTrip(t *testing.T) {
+	testCases := []struct {
+		name         string
+		metadataJson string
+		wantCSV      string
+	}{
+		{"plain",
+			`{"Version":3,"Weapons":[{"Id":1,"Name":"Sword","Cost":{"Gold":12.5},"Ranged":false,"Tags":["melee","steel"],"Extra":{"Rarity":2}}]}`,
+			"Id,Name,Gold,Ranged,Tags,Extra\n1,Sword,12.5,false,melee;steel,\"{\"\"Rarity\"\":2}\"\n"},
+		{"quoting",
+			`{"Weapons":[{"Id":2,"Name":"Bow, \"Long\"\nof the North","Extra":[1,"a,b"]}]}`,
+			"Id,Name,Gold,Ranged,Tags,Extra\n2,\"Bow, \"\"Long\"\"\nof the North\",,,,\"[1,\"\"a,b\"\"]\"\n"},
+		{"large integers and padded strings",
+			`{"Weapons":[{"Id":9007199254740993,"Name":" padded "}]}`,
+			"Id,Name,Gold,Ranged,Tags,Extra\n9007199254740993,\" padded \",,,,\n"},
+		{"no records", `{"Weapons":[]}`, "Id,Name,Gold,Ranged,Tags,Extra\n"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var csvBuffer bytes.Buffer
+			err := ConvertMetadataJsonToCSV(testCase.metadataJson, kTestTabularMapping, &csvBuffer)
+			if err != nil {
+				t.Fatalf("exporting: %v", err)
+			}
+			if csvBuffer.String() != testCase.wantCSV {
+				t.Errorf("exported %q, want %q", csvBuffer.String(), testCase.wantCSV)
+			}
+
+			metadataJson, rowErrors := ConvertCSVToMetadataJson(&csvBuffer, kTestTabularMapping, testCase.metadataJson)
+			if len(rowErrors) != 0 {
+				t.Fatalf("importing: %v", rowErrors[0])
+			}
+			assertSameTabularJson(t, metadataJson, testCase.metadataJson)
+		})
+	}
+}
+
+func importTestCSV(t *testing.T, csv string, baseJson string) string {
+	t.Helper()
+
+	metadataJson, rowErrors := ConvertCSVToMetadataJson(strings.NewReader(csv), kTestTabularMapping, baseJson)
+	if len(rowErrors) != 0 {
+		t.Fatalf("importing %q: %v", csv, rowErrors[0])
+	}
+	return metadataJson
+}
+
+func TestConvertCSVToMetadataJson(t *testing.T) {
+	// Columns can come in any order, and be left out
+	assertSameTabularJson(t, importTestCSV(t, "Tags,Id\n\"a; b\",1\n,2\n", ""),
+		`{"Weapons":[{"Id":1,"Tags":["a","b"]},{"Id":2}]}`)
+
+	// Everything other than the records is kept from the base json, and the records are replaced
+	assertSameTabularJson(t, importTestCSV(t, "Id,Name\n1,Axe\n", `{"Version":3,"Weapons":[{"Id":7,"Name":"Old"}]}`),
+		`{"Version":3,"Weapons":[{"Id":1,"Name":"Axe"}]}`)
+
+	// Headers and bools are trimmed
+	assertSameTabularJson(t, importTestCSV(t, " Id ,Ranged\n1, TRUE \n", ""),
+		`{"Weapons":[{"Id":1,"Ranged":true}]}`)
+}
+
+func TestConvertCSVToMetadataJsonRowErrors(t *testing.T) {
+	expectRowErrors := func(csv string, wantErrors ...string) {
+		t.Helper()
+
+		_, rowErrors := ConvertCSVToMetadataJson(strings.NewReader(csv), kTestTabularMapping, "")
+		if len(rowErrors) != len(wantErrors) {
+			t.Errorf("importing %q: got %d errors (%v), want %d", csv, len(rowErrors), rowErrors, len(wantErrors))
+			return
+		}
+		for i, rowError := range rowErrors {
+			if !strings.HasPrefix(rowError.Error(), wantErrors[i]) {
+				t.Errorf("importing %q: got error %q, want %q", csv, rowError.Error(), wantErrors[i])
+			}
+		}
+	}
+
+	expectRowErrors("", "row 1: empty csv")
+	expectRowErrors("Id,Damage\n1,5\n", "row 1, column Damage: unknown column")
+	expectRowErrors("Name\nSword\n", "row 1, column Id: missing required column")
+	expectRowErrors("Id,Name\n1,\"Sword\n", "row 1: error reading csv")
+
+	// Every bad row and column is reported, not just the first one
+	expectRowErrors("Id,Gold,Ranged,Extra\n,1,true,\nx,y,maybe,{\n3,1,false,\n",
+		"row 2, column Id: required",
+		"row 3, column Id: not an integer: x",
+		"row 3, column Gold: not a number: y",
+		"row 3, column Ranged: not true or false: maybe",
+		"row 3, column Extra: bad json")
+}
+
+func assertSameTabularJson(t *testing.T, got string, want string) {
+	t.Helper()
+
+	gotValue, err := decodeTabularJson([]byte(got))
+	if err != nil {
+		t.Fatalf("deserializing %s: %v", got, err)
+	}
+	wantValue, err := decodeTabularJson([]byte(want))
+	if err != nil {
+		t.Fatalf("deserializing %s: %v", want, err)
+	}
+	if !reflect.DeepEqual(gotValue, wantValue) {
+		gotJson, _ := json.Marshal(gotValue)
+		t.Errorf("got %s, want %s", gotJson, want)
+	}
+}
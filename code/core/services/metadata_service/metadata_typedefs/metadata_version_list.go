@@ -9,16 +9,71 @@ type MetadataVersionList struct {
 	Versions []string
 	CurrentVersions []string
 
+	// Explicit app-version => metadata-version mappings. Checked (in order) before the default resolution
+	VersionMappings []*MetadataVersionMapping `json:",omitempty"`
+
 	_versionsAsMap map[string]bool
 }
 
+/**
+ * Maps every app version in [MinAppVersion, MaxAppVersion] (inclusive) to MetadataVersion.
+ * Aliases are mappings with MinAppVersion == MaxAppVersion
+ */
+type MetadataVersionMapping struct {
+	MinAppVersion string
+	MaxAppVersion string
+	MetadataVersion string
+}
+
+func (mvm *MetadataVersionMapping) String() string {
+	if mvm.MinAppVersion == mvm.MaxAppVersion {
+		return mvm.MinAppVersion + "=" + mvm.MetadataVersion
+	}
+	return mvm.MinAppVersion + ".." + mvm.MaxAppVersion + "=" + mvm.MetadataVersion
+}
+
+func (mvm *MetadataVersionMapping) parse() (*core.AppVersion, *core.AppVersion, *core.AppVersion, error) {
+	minAppVersion, err := core.GetAppVersionFromString(mvm.MinAppVersion)
+	if err != nil {
+		return nil, nil, nil, errors.New("error parsing min app version: " + err.Error())
+	}
+	maxAppVersion, err := core.GetAppVersionFromString(mvm.MaxAppVersion)
+	if err != nil {
+		return nil, nil, nil, errors.New("error parsing max app version: " + err.Error())
+	}
+	metadataVersion, err := core.GetAppVersionFromString(mvm.MetadataVersion)
+	if err != nil {
+		return nil, nil, nil, errors.New("error parsing metadata version: " + err.Error())
+	}
+	if minAppVersion.Compare(maxAppVersion) > 0 {
+		return nil, nil, nil, errors.New("min app version greater than max app version")
+	}
+	return minAppVersion, maxAppVersion, metadataVersion, nil
+}
+
 func (mvl *MetadataVersionList) Initialize() {
+	// Normalize version strings (eg: "1.2.0" => "1.2") so that they match AppVersion.String()
+	for i, version := range mvl.Versions {
+		mvl.Versions[i] = normalizeVersionString(version)
+	}
+	for i, version := range mvl.CurrentVersions {
+		mvl.CurrentVersions[i] = normalizeVersionString(version)
+	}
+
 	mvl._versionsAsMap = make(map[string]bool)
 	for _, version := range mvl.Versions {
 		mvl._versionsAsMap[version] = true
 	}
 }
 
+func normalizeVersionString(versionString string) string {
+	version, err := core.GetAppVersionFromString(versionString)
+	if err != nil {
+		return versionString
+	}
+	return version.String()
+}
+
 func (mvl *MetadataVersionList) IsVersionValid(version *core.AppVersion) bool {
 	_, ok := mvl._versionsAsMap[version.String()]
 	return ok
@@ -68,3 +123,65 @@ func (mvl *MetadataVersionList) GetLatestVersionDefined() (*core.AppVersion, err
     return latestVersion, nil
 }
 
+/**
+ * Resolves the metadata version to use for an app version:
+ * 1. The first explicit version mapping whose range contains the app version
+ * 2. The metadata version equal to the app version
+ * 3. The highest defined metadata version lower than the app version
+ */
+func (mvl *MetadataVersionList) ResolveVersion(appVersion *core.AppVersion) (*core.AppVersion, error) {
+	for _, mapping := range mvl.VersionMappings {
+		minAppVersion, maxAppVersion, metadataVersion, err := mapping.parse()
+		if err != nil {
+			return nil, errors.New("bad version mapping (" + mapping.String() + "): " + err.Error())
+		}
+		if appVersion.Compare(minAppVersion) >= 0 && appVersion.Compare(maxAppVersion) <= 0 {
+			if !mvl.IsVersionValid(metadataVersion) {
+				return nil, errors.New("version mapping (" + mapping.String() + ") points to undefined version")
+			}
+			return metadataVersion, nil
+		}
+	}
+
+	if mvl.IsVersionValid(appVersion) {
+		return appVersion, nil
+	}
+
+	var resolvedVersion *core.AppVersion
+	for _, versionString := range mvl.Versions {
+		version, err := core.GetAppVersionFromString(versionString)
+		if err != nil {
+			continue
+		}
+		if version.Compare(appVersion) > 0 {
+			continue
+		}
+		if resolvedVersion == nil ||
+		   resolvedVersion.Compare(version) < 0 {
+			resolvedVersion = version
+		}
+	}
+
+	if resolvedVersion == nil {
+		return nil, errors.New("no metadata version defined for app version: " + appVersion.String())
+	}
+	return resolvedVersion, nil
+}
+
+/**
+ * Only meant to be called from the admin tool / scripts
+ */
+func (mvl *MetadataVersionList) SetVersionMappings(mappings []*MetadataVersionMapping) error {
+	for _, mapping := range mappings {
+		_, _, metadataVersion, err := mapping.parse()
+		if err != nil {
+			return errors.New("bad version mapping (" + mapping.String() + "): " + err.Error())
+		}
+		if !mvl.IsVersionValid(metadataVersion) {
+			return errors.New("version mapping (" + mapping.String() + ") points to undefined version")
+		}
+	}
+
+	mvl.VersionMappings = mappings
+	return nil
+}
@@ -0,0 +1,138 @@
+package metadata_typedefs
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spacetimi/timi_shared_server/code/core"
+)
+
+func newTestVersionList(versions []string, mappings []*MetadataVersionMapping) *MetadataVersionList {
+	mvl := &MetadataVersionList{
+		Versions:        versions,
+		VersionMappings: mappings,
+	}
+	mvl.Initialize()
+	return mvl
+}
+
+func resolveTestVersion(t *testing.T, mvl *MetadataVersionList, appVersionString string) (*core.AppVersion, error) {
+	t.Helper()
+
+	appVersion, err := core.GetAppVersionFromString(appVersionString)
+	if err != nil {
+		t.Fatalf("parsing app version %s: %v", appVersionString, err)
+	}
+	return mvl.ResolveVersion(appVersion)
+}
+
+func TestMetadataVersionListResolveVersion(t *testing.T) {
+	mvl := newTestVersionList(
+		[]string{"1.0", "1.2", "1.2.5", "2.0.0-beta.1", "2.0"},
+		[]*MetadataVersionMapping{
+			{MinAppVersion: "1.5", MaxAppVersion: "1.7.9", MetadataVersion: "1.2"},
+			{MinAppVersion: "3.0.0-rc.1", MaxAppVersion: "3.0.0-rc.1", MetadataVersion: "2.0.0-beta.1"},
+			// Never reached for 1.6: the first mapping containing the app version wins
+			{MinAppVersion: "1.6", MaxAppVersion: "1.6", MetadataVersion: "1.0"},
+		})
+
+	expectResolved := func(appVersion string, want string) {
+		t.Helper()
+
+		resolvedVersion, err := resolveTestVersion(t, mvl, appVersion)
+		if err != nil {
+			t.Errorf("resolving %s: %v", appVersion, err)
+			return
+		}
+		if resolvedVersion.String() != want {
+			t.Errorf("resolved %s to %s, want %s", appVersion, resolvedVersion.String(), want)
+		}
+	}
+
+	// Exact matches, including versions written differently
+	expectResolved("1.0", "1.0")
+	expectResolved("1.0.0", "1.0")
+	expectResolved("1.2.5", "1.2.5")
+	expectResolved("2.0.0-beta.1", "2.0.0-beta.1")
+
+	// Fallback to the highest lower version
+	expectResolved("1.1", "1.0")
+	expectResolved("1.2.4", "1.2")
+	expectResolved("1.4", "1.2.5")
+	expectResolved("1.9", "1.2.5")
+	expectResolved("2.0.0-alpha", "1.2.5")
+	expectResolved("2.0.0-beta.2", "2.0.0-beta.1")
+	expectResolved("2.1", "2.0")
+	expectResolved("3.0.0-rc.2", "2.0")
+
+	// Mappings, with inclusive bounds
+	expectResolved("1.5", "1.2")
+	expectResolved("1.6", "1.2")
+	expectResolved("1.7.9", "1.2")
+	expectResolved("1.7.10", "1.2.5")
+	expectResolved("3.0.0-rc.1", "2.0.0-beta.1")
+	expectResolved("3.0.0-rc.1+123", "2.0.0-beta.1")
+}
+
+func TestMetadataVersionListResolveVersionErrors(t *testing.T) {
+	testCases := []struct {
+		name       string
+		versions   []string
+		mappings   []*MetadataVersionMapping
+		appVersion string
+		wantErr    string
+	}{
+		{"older than every version", []string{"1.0", "2.0"}, nil, "0.9", "no metadata version defined"},
+		{"pre-release of the first version", []string{"1.0"}, nil, "1.0.0-beta", "no metadata version defined"},
+		{"mapping to undefined version", []string{"1.0"},
+			[]*MetadataVersionMapping{{MinAppVersion: "1.0", MaxAppVersion: "2.0", MetadataVersion: "1.5"}},
+			"1.2", "points to undefined version"},
+		{"malformed mapping", []string{"1.0"},
+			[]*MetadataVersionMapping{{MinAppVersion: "x", MaxAppVersion: "2.0", MetadataVersion: "1.0"}},
+			"1.2", "bad version mapping"},
+		{"inverted mapping", []string{"1.0"},
+			[]*MetadataVersionMapping{{MinAppVersion: "2.0", MaxAppVersion: "1.0", MetadataVersion: "1.0"}},
+			"1.2", "bad version mapping"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, err := resolveTestVersion(t, newTestVersionList(testCase.versions, testCase.mappings), testCase.appVersion)
+			if err == nil || !strings.Contains(err.Error(), testCase.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, testCase.wantErr)
+			}
+		})
+	}
+}
+
+func TestMetadataVersionListSetVersionMappings(t *testing.T) {
+	mvl := newTestVersionList([]string{"1.0"}, nil)
+
+	err := mvl.SetVersionMappings([]*MetadataVersionMapping{
+		{MinAppVersion: "1.1", MaxAppVersion: "1.1", MetadataVersion: "1.0"},
+		{MinAppVersion: "1.2", MaxAppVersion: "1.9", MetadataVersion: "1.0"},
+	})
+	if err != nil {
+		t.Fatalf("setting an alias and a range: %v", err)
+	}
+	if resolvedVersion, err := resolveTestVersion(t, mvl, "1.5"); err != nil || resolvedVersion.String() != "1.0" {
+		t.Errorf("resolved 1.5 to %v (error %v) after setting the mappings", resolvedVersion, err)
+	}
+
+	err = mvl.SetVersionMappings([]*MetadataVersionMapping{{MinAppVersion: "1.1", MaxAppVersion: "1.1", MetadataVersion: "1.1"}})
+	if err == nil {
+		t.Errorf("set a mapping to an undefined version")
+	}
+	err = mvl.SetVersionMappings([]*MetadataVersionMapping{{MinAppVersion: "1.9", MaxAppVersion: "1.1", MetadataVersion: "1.0"}})
+	if err == nil {
+		t.Errorf("set an inverted mapping")
+	}
+	if len(mvl.VersionMappings) != 2 {
+		t.Errorf("bad mappings replaced the good ones: %d mappings", len(mvl.VersionMappings))
+	}
+
+	err = mvl.SetVersionMappings(nil)
+	if err != nil || len(mvl.VersionMappings) != 0 {
+		t.Errorf("clearing the mappings: %d left, error %v", len(mvl.VersionMappings), err)
+	}
+}
@@ -1,5 +1,11 @@
 package metadata_typedefs
 
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
 type MetadataSpace int
 const (
 	METADATA_SPACE_SHARED MetadataSpace = iota
@@ -15,11 +21,90 @@ func (ms MetadataSpace)String() string {
 	return "unknown"
 }
 
+/**
+ * Platforms that can override the base metadata items in a version
+ */
+type MetadataPlatform int
+const (
+	METADATA_PLATFORM_NONE MetadataPlatform = iota
+	METADATA_PLATFORM_IOS
+	METADATA_PLATFORM_ANDROID
+	METADATA_PLATFORM_WEB
+)
+func (mp MetadataPlatform)String() string {
+	switch mp {
+	case METADATA_PLATFORM_NONE:
+		return ""
+	case METADATA_PLATFORM_IOS:
+		return "ios"
+	case METADATA_PLATFORM_ANDROID:
+		return "android"
+	case METADATA_PLATFORM_WEB:
+		return "web"
+	}
+	return "unknown"
+}
+
+var AllMetadataPlatforms = []MetadataPlatform{
+	METADATA_PLATFORM_IOS,
+	METADATA_PLATFORM_ANDROID,
+	METADATA_PLATFORM_WEB,
+}
+
+func GetMetadataPlatformFromString(s string) (MetadataPlatform, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return METADATA_PLATFORM_NONE, nil
+	case "ios":
+		return METADATA_PLATFORM_IOS, nil
+	case "android":
+		return METADATA_PLATFORM_ANDROID, nil
+	case "web":
+		return METADATA_PLATFORM_WEB, nil
+	}
+	return METADATA_PLATFORM_NONE, errors.New("unknown metadata platform: " + s)
+}
+
+/**
+ * Platform overrides are stored alongside the base item, under the base item's key suffixed with the platform
+ */
+func GetPlatformOverrideKey(key string, platform MetadataPlatform) string {
+	return key + "@" + platform.String()
+}
+
 type IMetadataItem interface {
 	GetKey() string
 	GetMetadataSpace() MetadataSpace
 }
 
+/**
+ * Optionally implemented by metadata items that need checks beyond deserializing successfully
+ * before they are saved
+ */
+type IValidatableMetadataItem interface {
+	Validate() error
+}
+
+/**
+ * Deserializes the json into the item, and validates the item if it supports validation
+ */
+func UnmarshalAndValidateMetadataItem(metadataJson []byte, itemPtr IMetadataItem) error {
+	err := json.Unmarshal(metadataJson, itemPtr)
+	if err != nil {
+		return err
+	}
+
+	validatableItem, ok := itemPtr.(IValidatableMetadataItem)
+	if ok {
+		err = validatableItem.Validate()
+		if err != nil {
+			return errors.New("validation failed: " + err.Error())
+		}
+	}
+
+	return nil
+}
+
 type IMetadataFetcher interface {
 	GetMetadataJsonByKey(key string, version string) (string, error)
 	GetMetadataVersionList() (*MetadataVersionList, error)
@@ -33,6 +118,58 @@ type IMetadataFetcher interface {
 	SetMetadataManifestForVersion(manifest *MetadataManifest, version string) error
 }
 
+/**
+ * Optionally implemented by fetchers whose content can be downloaded directly by game clients
+ * (instead of the api-servers sending the content inline)
+ */
+type IMetadataDownloadURLProvider interface {
+	GetMetadataDownloadURLByKey(key string, version string) (string, error)
+}
+
+/**
+ * Optionally implemented by fetchers that can save metadata items and the manifest that references them
+ * in a single atomic write, so that readers never see one without the other
+ */
+type IAtomicMetadataWriter interface {
+	SetMetadataJsonsWithManifest(metadataJsons map[string]string, manifest *MetadataManifest, version string) error
+}
+
+/**
+ * Optionally implemented by fetchers that record who made each write (eg: as commit authors)
+ */
+type IMetadataWriteAuthorSetter interface {
+	SetMetadataWriteAuthor(author string)
+}
+
+/**
+ * Optionally implemented by fetchers that can read a complete set of metadata items
+ * from a ref outside the fetcher's own version layout (eg: a tagged commit in a git repo)
+ */
+type IMetadataRefImporter interface {
+	GetMetadataJsonsAtRef(ref string) (map[string]string, error) // metadata key => metadata json
+}
+
+/**
+ * Implemented by fetchers that wrap another fetcher (eg: to cache it).
+ * The optional fetcher interfaces above are looked up on the origin fetcher
+ */
+type IMetadataFetcherDecorator interface {
+	GetOriginMetadataFetcher() IMetadataFetcher
+}
+
+/**
+ * Unwraps decorators down to the fetcher that actually talks to the metadata source
+ */
+func GetOriginMetadataFetcher(fetcher IMetadataFetcher) IMetadataFetcher {
+	for {
+		decorator, ok := fetcher.(IMetadataFetcherDecorator)
+		if !ok {
+			return fetcher
+		}
+		fetcher = decorator.GetOriginMetadataFetcher()
+	}
+}
+
 // Error strings
 const ERROR_FAILED_TO_READ_METADATA_FILE  = "failed to read metadata file"
 const ERROR_FAILED_TO_READ_METADATA_VERSIONS_LIST  = "failed to read metadata versions list"
@@ -0,0 +1,347 @@
+package storage_service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/spacetimi/timi_shared_server/code/core/adaptors/mongo_adaptor"
+	"github.com/spacetimi/timi_shared_server/code/core/adaptors/redis_adaptor"
+	"github.com/spacetimi/timi_shared_server/code/core/services/storage_service/storage_typedefs"
+	"github.com/spacetimi/timi_shared_server/utils/logger"
+	"github.com/spacetimi/timi_shared_server/utils/reflection_utils"
+)
+
+/**
+ * Batch version of GetBlobByPrimaryKeys, for loading many blobs at once (eg: a friends list or a leaderboard page).
+ * The blobs need their primary keys set, and can be of different blob types.
+ * Cached blobs are read from memory (see BlobCachePolicy.LocalCacheMaxAge) or from redis in a single round trip,
+ * the rest from the db with a single query per blob type, and those are then cached in a single round trip.
+ * Returns an error per blob, in the same order as the blobs (nil for the ones that were read).
+ * Blobs that don't exist get storage_typedefs.ErrBlobNotFound
+ */
+func GetBlobsByPrimaryKeys(outBlobPtrs []storage_typedefs.IBlob, ctx context.Context) []error {
+	errs := make([]error, len(outBlobPtrs))
+	primaryKeyValuesList := make([][]interface{}, len(outBlobPtrs))
+	redisKeys := make([]string, len(outBlobPtrs)) // Empty for blobs that aren't cached in redis
+
+	var pending []int
+	for i, blobPtr := range outBlobPtrs {
+		if blobPtr == nil {
+			errs[i] = errors.New("blob ptr is nil")
+			continue
+		}
+
+		primaryKeyValues, err := reflection_utils.GetFieldValuesFromStructPtr(blobPtr, blobPtr.GetPrimaryKeys())
+		if err != nil {
+			errs[i] = errors.New("error getting primary key values from blob: " + err.Error())
+			continue
+		}
+		primaryKeyValuesList[i] = primaryKeyValues
+
+		if blobPtr.IsRedisAllowed() {
+			redisKeys[i] = getRedisKey(blobPtr.GetBlobName(), primaryKeyValues, blobPtr.GetVersion())
+		}
+		pending = append(pending, i)
+	}
+
+	// Check in memory and redis first
+	pending = readBlobsFromCaches(outBlobPtrs, redisKeys, pending, errs, ctx)
+
+	// Read the rest from the db
+	var redisKeysToCache []string
+	var blobsToCache []storage_typedefs.IBlob
+	var redisExpirations []time.Duration
+	var redisKeysOfMisses []string
+	var negativeTTLs []time.Duration
+
+	for _, group := range groupBlobsByCollection(outBlobPtrs, pending) {
+		firstBlobPtr := outBlobPtrs[group[0]]
+
+		dbSpace, err := getDBSpaceFromStorageSpace(firstBlobPtr.GetStorageSpace())
+		if err != nil {
+			setErrorForBlobs(errs, group, errors.New("error resolving db space: "+err.Error()))
+			continue
+		}
+
+		var groupPrimaryKeyValuesList [][]interface{}
+		for _, i := range group {
+			groupPrimaryKeyValuesList = append(groupPrimaryKeyValuesList, primaryKeyValuesList[i])
+		}
+
+		raws, metadatas, err := mongo_adaptor.GetRawDataItemsWithMetadataByPrimaryKeys(dbSpace,
+			firstBlobPtr.GetBlobName(), firstBlobPtr.GetPrimaryKeys(), groupPrimaryKeyValuesList, ctx)
+		if err != nil {
+			setErrorForBlobs(errs, group, errors.New("error getting blobs from db: "+err.Error()))
+			continue
+		}
+
+		for j, i := range group {
+			if raws[j] == nil {
+				atomic.AddUint64(&_blobCacheStats.DBMisses, 1)
+				errs[i] = storage_typedefs.ErrBlobNotFound
+				negativeTTL := outBlobPtrs[i].GetCachePolicy().NegativeTTL
+				if redisKeys[i] != "" && negativeTTL > 0 {
+					redisKeysOfMisses = append(redisKeysOfMisses, redisKeys[i])
+					negativeTTLs = append(negativeTTLs, negativeTTL)
+				}
+				continue
+			}
+			atomic.AddUint64(&_blobCacheStats.DBHits, 1)
+
+			redisExpiration, err := decodeBlobFromDB(raws[j], metadatas[j], outBlobPtrs[i], primaryKeyValuesList[i], ctx)
+			if err != nil {
+				errs[i] = errors.New("error decoding blob from db: " + err.Error())
+				continue
+			}
+
+			if redisKeys[i] != "" && redisExpiration > 0 {
+				redisKeysToCache = append(redisKeysToCache, redisKeys[i])
+				blobsToCache = append(blobsToCache, outBlobPtrs[i])
+				redisExpirations = append(redisExpirations, redisExpiration)
+			}
+		}
+	}
+
+	// Write the blobs read from the db to redis for faster reads next time
+	writeBlobsToRedis(redisKeysToCache, blobsToCache, redisExpirations, ctx)
+	writeBlobMissesToRedis(redisKeysOfMisses, negativeTTLs, ctx)
+
+	return errs
+}
+
+/**
+ * Batch version of SetBlob, with a single bulk write per blob type. The blobs can be of different blob types.
+ * The bulk write doesn't return the blobs' new revisions, so instead of updating the blobs cached in redis, they are
+ * evicted (in a single round trip) for the next read to cache them with their revisions. For the same reason,
+ * the written blobs have to be read again before using them with SetBlobIfUnchanged.
+ * Returns an error per blob, in the same order as the blobs (nil for the ones that were written)
+ */
+func SetBlobs(blobPtrs []storage_typedefs.IBlob, ctx context.Context) []error {
+	errs := make([]error, len(blobPtrs))
+
+	var pending []int
+	for i, blobPtr := range blobPtrs {
+		if blobPtr == nil {
+			errs[i] = errors.New("blob ptr is nil")
+			continue
+		}
+		pending = append(pending, i)
+	}
+
+	var redisKeysToEvict []string
+	var evictedBlobIndices []int
+	var locallyCachedRedisKeys []string
+
+	for _, group := range groupBlobsByCollection(blobPtrs, pending) {
+		firstBlobPtr := blobPtrs[group[0]]
+
+		dbSpace, err := getDBSpaceFromStorageSpace(firstBlobPtr.GetStorageSpace())
+		if err != nil {
+			setErrorForBlobs(errs, group, errors.New("error resolving db space: "+err.Error()))
+			continue
+		}
+
+		ensureBlobIndexes(firstBlobPtr, dbSpace, ctx)
+
+		var expiresAt time.Time
+		if firstBlobPtr.GetTTL() > 0 {
+			expiresAt = time.Now().Add(firstBlobPtr.GetTTL())
+		}
+
+		var dataItemPtrs []interface{}
+		for _, i := range group {
+			dataItemPtrs = append(dataItemPtrs, blobPtrs[i])
+		}
+
+		writeErrs := mongo_adaptor.WriteRevisionedDataItemsByPrimaryKeys(dbSpace, firstBlobPtr.GetBlobName(),
+			firstBlobPtr.GetPrimaryKeys(), dataItemPtrs, expiresAt, firstBlobPtr.GetVersion(), ctx)
+
+		for j, i := range group {
+			if writeErrs[j] != nil {
+				errs[i] = errors.New("error writing blob to db: " + writeErrs[j].Error())
+				continue
+			}
+			// Unknown
+			blobPtrs[i].SetRevision(0)
+
+			if blobPtrs[i].IsRedisAllowed() {
+				primaryKeyValues, err := reflection_utils.GetFieldValuesFromStructPtr(blobPtrs[i], blobPtrs[i].GetPrimaryKeys())
+				if err != nil {
+					errs[i] = errors.New("blob written to db, but error getting primary key values to evict it from redis: " + err.Error())
+					continue
+				}
+				redisKey := getRedisKey(blobPtrs[i].GetBlobName(), primaryKeyValues, blobPtrs[i].GetVersion())
+				redisKeysToEvict = append(redisKeysToEvict, redisKey)
+				evictedBlobIndices = append(evictedBlobIndices, i)
+				if isLocalCacheEnabled(blobPtrs[i]) {
+					locallyCachedRedisKeys = append(locallyCachedRedisKeys, redisKey)
+				}
+			}
+		}
+	}
+
+	// Reads would keep returning the old blobs from redis, so fail the writes if they can't be evicted
+	err := redis_adaptor.DeleteMultiple(redisKeysToEvict, ctx)
+	invalidateLocallyCachedBlobs(locallyCachedRedisKeys, ctx)
+	if err != nil {
+		setErrorForBlobs(errs, evictedBlobIndices, errors.New("blob written to db, but error evicting it from redis: "+err.Error()))
+	}
+
+	return errs
+}
+
+/***** Private ******************************************************************/
+
+/**
+ * Batch version of readBlobFromCaches. Returns the indices of the blobs that weren't cached. Blobs cached as
+ * missing get storage_typedefs.ErrBlobNotFound
+ */
+func readBlobsFromCaches(outBlobPtrs []storage_typedefs.IBlob, redisKeys []string, indices []int, errs []error, ctx context.Context) []int {
+	var keys []string
+	var keyIndices []int
+	var misses []int
+	invalidationCounts := make(map[int]uint64) // For the blobs cached in memory that weren't there
+	for _, i := range indices {
+		if redisKeys[i] == "" {
+			misses = append(misses, i)
+			continue
+		}
+
+		if isLocalCacheEnabled(outBlobPtrs[i]) {
+			value, ok, invalidationCount := getFromLocalCache(redisKeys[i])
+			if ok {
+				ok, errs[i] = decodeCachedBlobValue(value, outBlobPtrs[i], redisKeys[i], "local cache")
+			}
+			if ok {
+				atomic.AddUint64(&_blobCacheStats.LocalCacheHits, 1)
+				continue
+			}
+			atomic.AddUint64(&_blobCacheStats.LocalCacheMisses, 1)
+			invalidationCounts[i] = invalidationCount
+		}
+
+		keys = append(keys, redisKeys[i])
+		keyIndices = append(keyIndices, i)
+	}
+
+	values, found, err := redis_adaptor.ReadMultiple(keys, ctx)
+	if err != nil {
+		logger.LogError("error reading blobs from redis" +
+			"|blob count=" + strconv.Itoa(len(keys)) +
+			"|error=" + err.Error())
+		// Fall-through. Read them all from the db
+	}
+
+	for k, i := range keyIndices {
+		if !found[k] {
+			atomic.AddUint64(&_blobCacheStats.RedisMisses, 1)
+			misses = append(misses, i)
+			continue
+		}
+		atomic.AddUint64(&_blobCacheStats.RedisHits, 1)
+		var ok bool
+		ok, errs[i] = decodeCachedBlobValue(values[k], outBlobPtrs[i], redisKeys[i], "redis")
+		if !ok {
+			misses = append(misses, i)
+			continue
+		}
+		if invalidationCount, ok := invalidationCounts[i]; ok {
+			putInLocalCache(redisKeys[i], values[k], outBlobPtrs[i].GetCachePolicy().LocalCacheMaxAge, invalidationCount)
+		}
+	}
+
+	return misses
+}
+
+/**
+ * Returns false if the value couldn't be decoded, in which case the blob is read from the next tier.
+ * Blobs cached as missing return storage_typedefs.ErrBlobNotFound
+ */
+func decodeCachedBlobValue(value string, outBlobPtr storage_typedefs.IBlob, redisKey string, tierName string) (bool, error) {
+	if value == kRedisBlobNotFoundValue {
+		return true, storage_typedefs.ErrBlobNotFound
+	}
+
+	err := decodeBlobFromRedis(value, outBlobPtr)
+	if err != nil {
+		logger.LogError("error deserializing blob from " + tierName +
+			"|blob name=" + outBlobPtr.GetBlobName() +
+			"|redis key=" + redisKey +
+			"|error=" + err.Error())
+		return false, nil
+	}
+	return true, nil
+}
+
+func writeBlobsToRedis(redisKeys []string, blobPtrs []storage_typedefs.IBlob, expirations []time.Duration, ctx context.Context) {
+	var keys []string
+	var values []string
+	var keyExpirations []time.Duration
+	for i, blobPtr := range blobPtrs {
+		value, err := serializeBlobForRedis(blobPtr)
+		if err != nil {
+			logger.LogError("error serializing blob for redis" +
+				"|blob name=" + blobPtr.GetBlobName() +
+				"|redis key=" + redisKeys[i] +
+				"|error=" + err.Error())
+			continue
+		}
+		keys = append(keys, redisKeys[i])
+		values = append(values, value)
+		keyExpirations = append(keyExpirations, getJitteredExpiration(expirations[i], blobPtr.GetCachePolicy().TTLJitter))
+	}
+
+	err := redis_adaptor.WriteMultiple(keys, values, keyExpirations, ctx)
+	if err != nil {
+		logger.LogError("error saving blobs to redis" +
+			"|blob count=" + strconv.Itoa(len(keys)) +
+			"|error=" + err.Error())
+	}
+}
+
+/**
+ * Only where nothing is cached yet, so as not to overwrite a blob that was written since it was read as missing
+ */
+func writeBlobMissesToRedis(redisKeys []string, negativeTTLs []time.Duration, ctx context.Context) {
+	values := make([]string, len(redisKeys))
+	for i := range values {
+		values[i] = kRedisBlobNotFoundValue
+	}
+
+	err := redis_adaptor.WriteMultipleIfNotExists(redisKeys, values, negativeTTLs, ctx)
+	if err != nil {
+		logger.LogError("error saving blob misses to redis" +
+			"|blob count=" + strconv.Itoa(len(redisKeys)) +
+			"|error=" + err.Error())
+	}
+}
+
+/**
+ * Groups the blobs at the given indices by the collection they are stored in, in the order the collections
+ * first appear
+ */
+func groupBlobsByCollection(blobPtrs []storage_typedefs.IBlob, indices []int) [][]int {
+	var groups [][]int
+	groupIndexByCollection := make(map[string]int)
+	for _, i := range indices {
+		collection := fmt.Sprintf("%d:%s", blobPtrs[i].GetStorageSpace(), blobPtrs[i].GetBlobName())
+		groupIndex, ok := groupIndexByCollection[collection]
+		if !ok {
+			groupIndex = len(groups)
+			groupIndexByCollection[collection] = groupIndex
+			groups = append(groups, nil)
+		}
+		groups[groupIndex] = append(groups[groupIndex], i)
+	}
+	return groups
+}
+
+func setErrorForBlobs(errs []error, indices []int, err error) {
+	for _, i := range indices {
+		errs[i] = err
+	}
+}
@@ -0,0 +1,204 @@
+package storage_service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spacetimi/timi_shared_server/code/core/adaptors/mongo_adaptor"
+	"github.com/spacetimi/timi_shared_server/code/core/services/storage_service/storage_typedefs"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/**
+ * Blob reads per cache tier, since the server started. Local cache counts are only for blobs cached in memory
+ * (see BlobCachePolicy.LocalCacheMaxAge). Reads of blobs cached as missing count as hits
+ */
+type BlobCacheStats struct {
+	LocalCacheHits    uint64
+	LocalCacheMisses  uint64
+	LocalCacheEntries int
+	RedisHits         uint64
+	RedisMisses       uint64
+	DBHits            uint64
+	DBMisses          uint64 // The blob didn't exist
+}
+
+func GetBlobCacheStats() BlobCacheStats {
+	stats := BlobCacheStats{
+		LocalCacheHits:   atomic.LoadUint64(&_blobCacheStats.LocalCacheHits),
+		LocalCacheMisses: atomic.LoadUint64(&_blobCacheStats.LocalCacheMisses),
+		RedisHits:        atomic.LoadUint64(&_blobCacheStats.RedisHits),
+		RedisMisses:      atomic.LoadUint64(&_blobCacheStats.RedisMisses),
+		DBHits:           atomic.LoadUint64(&_blobCacheStats.DBHits),
+		DBMisses:         atomic.LoadUint64(&_blobCacheStats.DBMisses),
+	}
+
+	_localCache.mutex.Lock()
+	stats.LocalCacheEntries = _localCache.lru.Len()
+	_localCache.mutex.Unlock()
+
+	return stats
+}
+
+/***** Private ******************************************************************/
+
+var _blobCacheStats BlobCacheStats
+
+// Cached in redis for blobs that don't exist (see BlobCachePolicy.NegativeTTL). Not valid json, so it can't be a blob
+const kRedisBlobNotFoundValue = "!blob-not-found"
+
+/**
+ * A db read of a blob that concurrent readers of the same blob wait on, instead of reading it themselves
+ */
+type blobReadCall struct {
+	done chan struct{}
+
+	raw           bson.Raw
+	schemaVersion int
+	revision      int64 // After the read, since a migrated blob can be written back while reading it
+	err           error
+}
+
+var _blobReadCalls = make(map[string]*blobReadCall)
+var _blobReadCallsMutex sync.Mutex
+
+/**
+ * readBlobFromDB, shared by the concurrent reads of the same blob. The blob is read (and cached in redis) once,
+ * and every reader decodes what was read. Like a read from redis, a coalesced read can return the blob as it
+ * was just before a concurrent write
+ */
+func readBlobFromDBCoalesced(outBlobPtr storage_typedefs.IBlob,
+	dbSpace mongo_adaptor.DBSpace,
+	primaryKeyValues []interface{},
+	redisKey string,
+	ctx context.Context) error {
+
+	callKey := fmt.Sprintf("%d:%s", dbSpace, getRedisKey(outBlobPtr.GetBlobName(), primaryKeyValues, outBlobPtr.GetVersion()))
+
+	_blobReadCallsMutex.Lock()
+	call, inProgress := _blobReadCalls[callKey]
+	if !inProgress {
+		blobPtr := newBlobForCoalescedRead(outBlobPtr)
+		if blobPtr == nil {
+			_blobReadCallsMutex.Unlock()
+			_, _, err := readBlobFromDB(outBlobPtr, dbSpace, primaryKeyValues, redisKey, ctx)
+			return err
+		}
+		call = &blobReadCall{done: make(chan struct{})}
+		_blobReadCalls[callKey] = call
+		go call.read(callKey, blobPtr, dbSpace, primaryKeyValues, redisKey)
+	}
+	_blobReadCallsMutex.Unlock()
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return errors.New("context done while waiting for blob read: " + ctx.Err().Error())
+	}
+	if call.err != nil {
+		return call.err
+	}
+
+	_, err := decodeBlobDocument(call.raw, call.schemaVersion, outBlobPtr)
+	if err != nil {
+		return errors.New("error decoding blob from db: " + err.Error())
+	}
+	outBlobPtr.SetRevision(call.revision)
+	return nil
+}
+
+// How long a coalesced read can take. It isn't bound to any one reader's context, so that a reader giving up
+// (eg: its request was cancelled) doesn't fail the other readers
+const kCoalescedBlobReadTimeout = 10 * time.Second
+
+var kBlobDescriptorType = reflect.TypeOf(storage_typedefs.BlobDescriptor{})
+
+func (call *blobReadCall) read(callKey string,
+	blobPtr storage_typedefs.IBlob,
+	dbSpace mongo_adaptor.DBSpace,
+	primaryKeyValues []interface{},
+	redisKey string) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), kCoalescedBlobReadTimeout)
+	defer cancel()
+
+	raw, metadata, err := readBlobFromDB(blobPtr, dbSpace, primaryKeyValues, redisKey, ctx)
+	call.err = err
+	if err == nil {
+		call.raw = raw
+		call.schemaVersion = metadata.SchemaVersion
+		call.revision = blobPtr.GetRevision()
+	}
+
+	_blobReadCallsMutex.Lock()
+	delete(_blobReadCalls, callKey)
+	_blobReadCallsMutex.Unlock()
+	close(call.done)
+}
+
+/**
+ * A new blob of the same type as the reader's, with only its blob descriptor and primary keys copied over, for the
+ * coalesced read to read into (the reader's blob can't be used, since the reader can stop waiting for the read).
+ * Returns nil for blobs that aren't structs embedding a storage_typedefs.BlobDescriptor
+ */
+func newBlobForCoalescedRead(outBlobPtr storage_typedefs.IBlob) storage_typedefs.IBlob {
+	source := reflect.ValueOf(outBlobPtr)
+	if source.Kind() != reflect.Ptr || source.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	source = source.Elem()
+
+	isPrimaryKey := make(map[string]bool)
+	for _, primaryKey := range outBlobPtr.GetPrimaryKeys() {
+		isPrimaryKey[primaryKey] = true
+	}
+
+	copyPtr := reflect.New(source.Type())
+	hasDescriptor := false
+	for i := 0; i < source.NumField(); i++ {
+		field := source.Type().Field(i)
+		isDescriptor := field.Type == kBlobDescriptorType
+		if !isDescriptor && !isPrimaryKey[field.Name] {
+			continue
+		}
+		if !copyPtr.Elem().Field(i).CanSet() {
+			return nil
+		}
+		copyPtr.Elem().Field(i).Set(source.Field(i))
+		hasDescriptor = hasDescriptor || isDescriptor
+	}
+
+	blobPtr, ok := copyPtr.Interface().(storage_typedefs.IBlob)
+	if !hasDescriptor || !ok {
+		return nil
+	}
+	return blobPtr
+}
+
+/**
+ * Shortens the expiration by a random fraction of up to jitter. Never lengthens it, since expiring blobs
+ * must not outlive their expiry in the db
+ */
+func getJitteredExpiration(expiration time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 || expiration <= 0 {
+		return expiration
+	}
+	if jitter > 1 {
+		jitter = 1
+	}
+	maxReduction := int64(float64(expiration) * jitter)
+	if maxReduction <= 0 {
+		return expiration
+	}
+	jittered := expiration - time.Duration(rand.Int63n(maxReduction))
+	if jittered <= 0 {
+		return expiration
+	}
+	return jittered
+}
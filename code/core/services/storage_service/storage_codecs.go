@@ -0,0 +1,212 @@
+package storage_service
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spacetimi/timi_shared_server/code/core/adaptors/mongo_adaptor"
+	"github.com/spacetimi/timi_shared_server/code/core/services/storage_service/storage_typedefs"
+	"github.com/spacetimi/timi_shared_server/utils/logger"
+	"github.com/vmihailenco/msgpack/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/**
+ * Registers a codec for blobs to use in their cache policy (see BlobCachePolicy.Codec).
+ * Every server reading the blobs from redis needs the codec registered, so register it before using the blobs
+ */
+func RegisterBlobCodec(name storage_typedefs.BlobCodec, codec storage_typedefs.IBlobCodec) error {
+	if name == "" || strings.Contains(string(name), kRedisValueHeaderSeparator) {
+		return errors.New("bad blob codec name: " + string(name))
+	}
+
+	_blobCodecsMutex.Lock()
+	defer _blobCodecsMutex.Unlock()
+
+	if _, ok := _blobCodecs[name]; ok {
+		logger.LogWarning("replacing already registered blob codec" +
+			"|codec=" + string(name))
+	}
+	_blobCodecs[name] = codec
+	return nil
+}
+
+/***** Private ******************************************************************/
+
+/**
+ * Blobs are stored in redis as:
+ *   kRedisValuePrefix codec : compression : revision : encoded blob
+ * Values without the prefix were written before codecs, as json with the revision added to it
+ */
+const kRedisValuePrefix = "\x01"
+const kRedisValueHeaderSeparator = ":"
+
+const kRedisValueCompressionNone = ""
+const kRedisValueCompressionGzip = "gzip"
+
+var _blobCodecs = map[storage_typedefs.BlobCodec]storage_typedefs.IBlobCodec{
+	storage_typedefs.BLOB_CODEC_JSON:    jsonBlobCodec{},
+	storage_typedefs.BLOB_CODEC_BSON:    bsonBlobCodec{},
+	storage_typedefs.BLOB_CODEC_MSGPACK: msgpackBlobCodec{},
+}
+var _blobCodecsMutex sync.RWMutex
+
+type jsonBlobCodec struct{}
+
+func (codec jsonBlobCodec) Encode(blobPtr storage_typedefs.IBlob) ([]byte, error) {
+	return json.Marshal(blobPtr)
+}
+
+func (codec jsonBlobCodec) Decode(data []byte, outBlobPtr storage_typedefs.IBlob) error {
+	return json.Unmarshal(data, outBlobPtr)
+}
+
+/**
+ * Encodes the blob as the same document it is stored as in the db, and decodes it the same way db reads do
+ */
+type bsonBlobCodec struct{}
+
+func (codec bsonBlobCodec) Encode(blobPtr storage_typedefs.IBlob) ([]byte, error) {
+	document, err := mongo_adaptor.MarshalDataItem(blobPtr)
+	if err != nil {
+		return nil, err
+	}
+	return bson.Marshal(document)
+}
+
+func (codec bsonBlobCodec) Decode(data []byte, outBlobPtr storage_typedefs.IBlob) error {
+	return bson.Unmarshal(data, outBlobPtr)
+}
+
+type msgpackBlobCodec struct{}
+
+func (codec msgpackBlobCodec) Encode(blobPtr storage_typedefs.IBlob) ([]byte, error) {
+	return msgpack.Marshal(blobPtr)
+}
+
+func (codec msgpackBlobCodec) Decode(data []byte, outBlobPtr storage_typedefs.IBlob) error {
+	return msgpack.Unmarshal(data, outBlobPtr)
+}
+
+func getBlobCodec(name storage_typedefs.BlobCodec) (storage_typedefs.IBlobCodec, error) {
+	if name == "" {
+		name = storage_typedefs.BLOB_CODEC_JSON
+	}
+
+	_blobCodecsMutex.RLock()
+	defer _blobCodecsMutex.RUnlock()
+
+	codec, ok := _blobCodecs[name]
+	if !ok {
+		return nil, errors.New("unknown blob codec: " + string(name))
+	}
+	return codec, nil
+}
+
+func serializeBlobForRedis(blobPtr storage_typedefs.IBlob) (string, error) {
+	cachePolicy := blobPtr.GetCachePolicy()
+	codecName := cachePolicy.Codec
+	if codecName == "" {
+		codecName = storage_typedefs.BLOB_CODEC_JSON
+	}
+
+	codec, err := getBlobCodec(codecName)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := codec.Encode(blobPtr)
+	if err != nil {
+		return "", errors.New("error serializing blob: " + err.Error())
+	}
+
+	compression := kRedisValueCompressionNone
+	if cachePolicy.CompressAboveBytes > 0 && len(data) > cachePolicy.CompressAboveBytes {
+		var buffer bytes.Buffer
+		writer := gzip.NewWriter(&buffer)
+		_, err = writer.Write(data)
+		if err == nil {
+			err = writer.Close()
+		}
+		if err != nil {
+			return "", errors.New("error compressing serialized blob: " + err.Error())
+		}
+		data = buffer.Bytes()
+		compression = kRedisValueCompressionGzip
+	}
+
+	return kRedisValuePrefix + string(codecName) +
+		kRedisValueHeaderSeparator + compression +
+		kRedisValueHeaderSeparator + strconv.FormatInt(blobPtr.GetRevision(), 10) +
+		kRedisValueHeaderSeparator + string(data), nil
+}
+
+/**
+ * Decodes with the codec the value was written with, which isn't necessarily the blob's current codec
+ */
+func decodeBlobFromRedis(redisValue string, outBlobPtr storage_typedefs.IBlob) error {
+	if !strings.HasPrefix(redisValue, kRedisValuePrefix) {
+		err := json.Unmarshal([]byte(redisValue), outBlobPtr)
+		if err != nil {
+			return err
+		}
+		outBlobPtr.SetRevision(getRevisionFromRedisValue(redisValue))
+		return nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(redisValue, kRedisValuePrefix), kRedisValueHeaderSeparator, 4)
+	if len(parts) != 4 {
+		return errors.New("bad header in redis value")
+	}
+	codecName, compression, revisionString, data := parts[0], parts[1], parts[2], []byte(parts[3])
+
+	revision, err := strconv.ParseInt(revisionString, 10, 64)
+	if err != nil {
+		return errors.New("bad revision in redis value: " + err.Error())
+	}
+
+	switch compression {
+	case kRedisValueCompressionNone:
+	case kRedisValueCompressionGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err == nil {
+			data, err = ioutil.ReadAll(reader)
+		}
+		if err != nil {
+			return errors.New("error decompressing redis value: " + err.Error())
+		}
+	default:
+		return errors.New("unknown compression in redis value: " + compression)
+	}
+
+	codec, err := getBlobCodec(storage_typedefs.BlobCodec(codecName))
+	if err != nil {
+		return err
+	}
+	err = codec.Decode(data, outBlobPtr)
+	if err != nil {
+		return err
+	}
+
+	outBlobPtr.SetRevision(revision)
+	return nil
+}
+
+/**
+ * For values written before codecs. Blobs written to redis before revisions were added read as revision 0
+ */
+func getRevisionFromRedisValue(redisValue string) int64 {
+	revision := redisBlobRevision{}
+	_ = json.Unmarshal([]byte(redisValue), &revision)
+	return revision.Revision
+}
+
+type redisBlobRevision struct {
+	Revision int64 `json:"_revision"`
+}
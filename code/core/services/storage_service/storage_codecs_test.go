@@ -0,0 +1,203 @@
+package storage_service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spacetimi/timi_shared_server/code/core/adaptors/mongo_adaptor"
+	"github.com/spacetimi/timi_shared_server/code/core/services/storage_service/storage_typedefs"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type codecTestBlob struct {
+	PlayerId int64
+	Name     string
+	Nickname string `json:"nick" bson:"nick"`
+	Scores   []int
+	Items    map[string]int
+
+	storage_typedefs.BlobDescriptor `bson:"-"`
+}
+
+func newCodecTestBlob(codec storage_typedefs.BlobCodec, compressAboveBytes int) *codecTestBlob {
+	cachePolicy := storage_typedefs.DefaultBlobCachePolicy
+	cachePolicy.Codec = codec
+	cachePolicy.CompressAboveBytes = compressAboveBytes
+
+	blob := &codecTestBlob{}
+	blob.BlobDescriptor = storage_typedefs.NewBlobDescriptor(storage_typedefs.STORAGE_SPACE_APP,
+		"codec_test",
+		[]string{"PlayerId"},
+		1,
+		true).WithCachePolicy(cachePolicy)
+	return blob
+}
+
+func TestBlobCodecsRoundTrip(t *testing.T) {
+	testCases := []struct {
+		name               string
+		codec              storage_typedefs.BlobCodec
+		compressAboveBytes int
+	}{
+		{"default", "", 0},
+		{"json", storage_typedefs.BLOB_CODEC_JSON, 0},
+		{"bson", storage_typedefs.BLOB_CODEC_BSON, 0},
+		{"json gzip", storage_typedefs.BLOB_CODEC_JSON, 1},
+		{"bson gzip", storage_typedefs.BLOB_CODEC_BSON, 1},
+		{"msgpack", storage_typedefs.BLOB_CODEC_MSGPACK, 0},
+		{"msgpack gzip", storage_typedefs.BLOB_CODEC_MSGPACK, 1},
+		{"below compression threshold", storage_typedefs.BLOB_CODEC_BSON, 1 << 20},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			blob := newCodecTestBlob(testCase.codec, testCase.compressAboveBytes)
+			blob.PlayerId = 42
+			blob.Name = "timi"
+			blob.Nickname = "tagged field"
+			blob.Scores = []int{3, 1, 2}
+			blob.Items = map[string]int{"sword": 1, "shield": 2}
+			blob.SetRevision(7)
+
+			value, err := serializeBlobForRedis(blob)
+			if err != nil {
+				t.Fatalf("serializing: %v", err)
+			}
+
+			decoded := newCodecTestBlob(testCase.codec, testCase.compressAboveBytes)
+			err = decodeBlobFromRedis(value, decoded)
+			if err != nil {
+				t.Fatalf("decoding: %v", err)
+			}
+
+			if decoded.PlayerId != blob.PlayerId ||
+				decoded.Name != blob.Name ||
+				decoded.Nickname != blob.Nickname ||
+				!reflect.DeepEqual(decoded.Scores, blob.Scores) ||
+				!reflect.DeepEqual(decoded.Items, blob.Items) {
+				t.Errorf("decoded %+v, want %+v", *decoded, *blob)
+			}
+			if decoded.GetRevision() != 7 {
+				t.Errorf("decoded revision %d, want 7", decoded.GetRevision())
+			}
+			if decoded.GetBlobName() != "codec_test" {
+				t.Errorf("decoding changed the blob descriptor: blob name %q", decoded.GetBlobName())
+			}
+		})
+	}
+}
+
+func TestBsonBlobCodecMatchesStoredDocument(t *testing.T) {
+	blob := newCodecTestBlob(storage_typedefs.BLOB_CODEC_BSON, 0)
+	blob.PlayerId = 42
+	blob.Name = "timi"
+	blob.Nickname = "tagged field"
+	blob.Scores = []int{3, 1, 2}
+	blob.Items = map[string]int{"sword": 1}
+
+	value, err := serializeBlobForRedis(blob)
+	if err != nil {
+		t.Fatalf("serializing: %v", err)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, kRedisValuePrefix), kRedisValueHeaderSeparator, 4)
+	cached := bson.M{}
+	err = bson.Unmarshal([]byte(parts[3]), &cached)
+	if err != nil {
+		t.Fatalf("decoding cached document: %v", err)
+	}
+
+	// What WriteRevisionedDataItemByPrimaryKeys sets in mongo, round tripped through bson like the db does
+	document, err := mongo_adaptor.MarshalDataItem(blob)
+	if err != nil {
+		t.Fatalf("marshalling stored document: %v", err)
+	}
+	documentBytes, err := bson.Marshal(document)
+	if err != nil {
+		t.Fatalf("encoding stored document: %v", err)
+	}
+	stored := bson.M{}
+	err = bson.Unmarshal(documentBytes, &stored)
+	if err != nil {
+		t.Fatalf("decoding stored document: %v", err)
+	}
+
+	if !reflect.DeepEqual(cached, stored) {
+		t.Errorf("cached document %v, stored document %v", cached, stored)
+	}
+	for _, key := range []string{"PlayerId", "Name", "nick", "Scores", "Items"} {
+		if _, ok := stored[key]; !ok {
+			t.Errorf("stored document %v has no %s", stored, key)
+		}
+	}
+	if len(stored) != 5 {
+		t.Errorf("stored document %v has fields besides the blob's own (eg: the blob descriptor)", stored)
+	}
+}
+
+func TestDecodeBlobFromRedisWithOtherCodec(t *testing.T) {
+	// Written by a server whose blob still used json, read by one that switched to bson
+	blob := newCodecTestBlob(storage_typedefs.BLOB_CODEC_JSON, 0)
+	blob.Name = "timi"
+	value, err := serializeBlobForRedis(blob)
+	if err != nil {
+		t.Fatalf("serializing: %v", err)
+	}
+
+	decoded := newCodecTestBlob(storage_typedefs.BLOB_CODEC_BSON, 0)
+	err = decodeBlobFromRedis(value, decoded)
+	if err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+	if decoded.Name != "timi" {
+		t.Errorf("decoded name %q, want %q", decoded.Name, "timi")
+	}
+}
+
+func TestDecodeBlobFromRedisLegacyValues(t *testing.T) {
+	testCases := []struct {
+		name         string
+		value        string
+		wantName     string
+		wantRevision int64
+	}{
+		{"with revision", `{"PlayerId":1,"Name":"timi","_revision":5}`, "timi", 5},
+		{"before revisions", `{"PlayerId":1,"Name":"timi"}`, "timi", 0},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			decoded := newCodecTestBlob("", 0)
+			err := decodeBlobFromRedis(testCase.value, decoded)
+			if err != nil {
+				t.Fatalf("decoding: %v", err)
+			}
+			if decoded.Name != testCase.wantName || decoded.GetRevision() != testCase.wantRevision {
+				t.Errorf("decoded name %q revision %d, want %q revision %d",
+					decoded.Name, decoded.GetRevision(), testCase.wantName, testCase.wantRevision)
+			}
+		})
+	}
+}
+
+func TestDecodeBlobFromRedisBadValues(t *testing.T) {
+	testCases := []struct {
+		name    string
+		value   string
+		wantErr string
+	}{
+		{"missing header parts", kRedisValuePrefix + "json:", "bad header"},
+		{"bad revision", kRedisValuePrefix + "json::x:{}", "bad revision"},
+		{"unknown compression", kRedisValuePrefix + "json:zip:1:{}", "unknown compression"},
+		{"unknown codec", kRedisValuePrefix + "yaml::1:{}", "unknown blob codec"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := decodeBlobFromRedis(testCase.value, newCodecTestBlob("", 0))
+			if err == nil || !strings.Contains(err.Error(), testCase.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, testCase.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+package storage_service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spacetimi/timi_shared_server/code/core/adaptors/mongo_adaptor"
+	"github.com/spacetimi/timi_shared_server/code/core/services/storage_service/storage_typedefs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/**
+ * Registers a blob so that EnsureBlobIndexes manages its indexes.
+ * blobFactory returns a new (empty) blob. Blobs with registered migrations are registered too
+ */
+func RegisterBlob(blobFactory func() storage_typedefs.IBlob) {
+	blobName := blobFactory().GetBlobName()
+
+	_registeredBlobsMutex.Lock()
+	defer _registeredBlobsMutex.Unlock()
+
+	_registeredBlobs[blobName] = blobFactory
+}
+
+/**
+ * Names of the registered blobs, sorted
+ */
+func GetRegisteredBlobNames() []string {
+	_registeredBlobsMutex.RLock()
+	defer _registeredBlobsMutex.RUnlock()
+
+	var blobNames []string
+	for blobName := range _registeredBlobs {
+		blobNames = append(blobNames, blobName)
+	}
+	sort.Strings(blobNames)
+	return blobNames
+}
+
+/**
+ * How a blob's indexes in the db compare to the indexes it declares: a unique index on its primary keys,
+ * its secondary indexes (see BlobDescriptor.WithIndexes), and a ttl index for expiring blobs
+ */
+type BlobIndexReport struct {
+	BlobName string
+	InSync   []string `json:",omitempty"`
+
+	// Declared but not in the db. Created, unless it was a dry run
+	Missing []string `json:",omitempty"`
+	Created []string `json:",omitempty"`
+
+	// In the db on the same fields, but with different options (eg: not unique). These are left as they are,
+	// since fixing them means dropping the index, and possibly cleaning up data (eg: duplicates)
+	Mismatched []string `json:",omitempty"`
+
+	// In the db but not declared (other than the _id index). These are left as they are
+	Undeclared []string `json:",omitempty"`
+
+	Errors []string `json:",omitempty"`
+}
+
+func (report *BlobIndexReport) HasDrift() bool {
+	return len(report.Missing) > len(report.Created) || len(report.Mismatched) > 0 || len(report.Undeclared) > 0
+}
+
+/**
+ * Compares the (registered) blob's declared indexes with its indexes in the db, and creates the missing ones.
+ * With dryRun, only reports
+ */
+func EnsureBlobIndexes(blobName string, dryRun bool, ctx context.Context) (*BlobIndexReport, error) {
+	return ensureRegisteredBlobIndexes(blobName, dryRun, false, ctx)
+}
+
+/**
+ * EnsureBlobIndexes for every registered blob. Stops at the first blob whose indexes can't be read
+ */
+func EnsureAllBlobIndexes(dryRun bool, ctx context.Context) ([]*BlobIndexReport, error) {
+	return ensureAllRegisteredBlobIndexes(dryRun, false, ctx)
+}
+
+/**
+ * Same as EnsureAllBlobIndexes, but only creates the indexes that storage_service relies on: the unique primary
+ * keys index (without which blobs can't be created only if they are new, see SetBlobIfUnchanged), the ttl
+ * index of expiring blobs, and unique secondary indexes (which keep values, eg: user names, from being taken twice).
+ * Servers do this on startup, since these indexes aren't created when writing blobs
+ */
+func EnsureRequiredBlobIndexes(ctx context.Context) ([]*BlobIndexReport, error) {
+	return ensureAllRegisteredBlobIndexes(false, true, ctx)
+}
+
+/***** Private ******************************************************************/
+
+var _registeredBlobs = make(map[string]func() storage_typedefs.IBlob)
+var _registeredBlobsMutex sync.RWMutex
+
+const kIdIndexName = "_id_"
+
+type declaredBlobIndex struct {
+	name               string
+	keys               bson.D
+	unique             bool
+	expireAfterSeconds *int32
+	partialFilter      bson.D
+	isRequired         bool // See EnsureRequiredBlobIndexes
+}
+
+/**
+ * With requiredOnly, missing indexes that aren't required are reported, but not created
+ */
+func ensureRegisteredBlobIndexes(blobName string, dryRun bool, requiredOnly bool, ctx context.Context) (*BlobIndexReport, error) {
+	_registeredBlobsMutex.RLock()
+	blobFactory, ok := _registeredBlobs[blobName]
+	_registeredBlobsMutex.RUnlock()
+	if !ok {
+		return nil, errors.New("blob is not registered: " + blobName)
+	}
+
+	blob := blobFactory()
+	dbSpace, err := getDBSpaceFromStorageSpace(blob.GetStorageSpace())
+	if err != nil {
+		return nil, errors.New("error resolving db space: " + err.Error())
+	}
+
+	existingIndexes, err := mongo_adaptor.ListIndexes(dbSpace, blobName, ctx)
+	if err != nil {
+		return nil, errors.New("error listing indexes: " + err.Error())
+	}
+
+	report := &BlobIndexReport{BlobName: blobName}
+	matched := make(map[string]bool)
+
+	for _, declared := range getDeclaredBlobIndexes(blob) {
+		var existing *mongo_adaptor.IndexInfo
+		for i := range existingIndexes {
+			if getIndexKeysString(existingIndexes[i].Keys) == getIndexKeysString(declared.keys) {
+				existing = &existingIndexes[i]
+				break
+			}
+		}
+
+		if existing != nil {
+			matched[existing.Name] = true
+			declaredOptions := describeIndexOptions(declared.unique, declared.expireAfterSeconds, declared.partialFilter)
+			existingOptions := describeIndexOptions(existing.Unique, existing.ExpireAfterSeconds, existing.PartialFilter)
+			if declaredOptions == existingOptions {
+				report.InSync = append(report.InSync, declared.name)
+			} else {
+				report.Mismatched = append(report.Mismatched, existing.Name+
+					": declared "+declaredOptions+", in db "+existingOptions)
+			}
+			continue
+		}
+
+		report.Missing = append(report.Missing, declared.name)
+		if dryRun || (requiredOnly && !declared.isRequired) {
+			continue
+		}
+		// One at a time, so that one bad index (eg: unique, on data with duplicates) doesn't stop the others
+		err = mongo_adaptor.CreateIndexes(dbSpace, blobName, []mongo.IndexModel{declared.getModel()}, ctx)
+		if err != nil {
+			report.Errors = append(report.Errors, declared.name+": "+err.Error())
+			continue
+		}
+		report.Created = append(report.Created, declared.name)
+	}
+
+	for _, existing := range existingIndexes {
+		if existing.Name != kIdIndexName && !matched[existing.Name] {
+			report.Undeclared = append(report.Undeclared, existing.Name)
+		}
+	}
+
+	return report, nil
+}
+
+func ensureAllRegisteredBlobIndexes(dryRun bool, requiredOnly bool, ctx context.Context) ([]*BlobIndexReport, error) {
+	var reports []*BlobIndexReport
+	for _, blobName := range GetRegisteredBlobNames() {
+		report, err := ensureRegisteredBlobIndexes(blobName, dryRun, requiredOnly, ctx)
+		if err != nil {
+			return reports, errors.New("error ensuring indexes for " + blobName + ": " + err.Error())
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+func newDeclaredBlobIndex(index storage_typedefs.BlobIndex) declaredBlobIndex {
+	declared := declaredBlobIndex{
+		name:   index.GetName(),
+		unique: index.Unique,
+	}
+	for _, field := range index.Fields {
+		fieldName, direction := getSortFieldAndDirection(field)
+		declared.keys = append(declared.keys, bson.E{Key: fieldName, Value: direction})
+		if index.IgnoreEmptyStrings {
+			declared.partialFilter = append(declared.partialFilter,
+				bson.E{Key: fieldName, Value: bson.D{{Key: "$gt", Value: ""}}})
+		}
+	}
+	return declared
+}
+
+func (declared *declaredBlobIndex) getModel() mongo.IndexModel {
+	indexOptions := options.Index().SetName(declared.name)
+	if declared.unique {
+		indexOptions.SetUnique(true)
+	}
+	if declared.expireAfterSeconds != nil {
+		indexOptions.SetExpireAfterSeconds(*declared.expireAfterSeconds)
+	}
+	if declared.partialFilter != nil {
+		indexOptions.SetPartialFilterExpression(declared.partialFilter)
+	}
+	return mongo.IndexModel{Keys: declared.keys, Options: indexOptions}
+}
+
+/**
+ * The blob's indexes: the required ones, and the secondary ones that storage_service creates when the blob is used
+ */
+func getDeclaredBlobIndexes(blob storage_typedefs.IBlob) []declaredBlobIndex {
+	primaryKeysIndex := newDeclaredBlobIndex(storage_typedefs.BlobIndex{Fields: blob.GetPrimaryKeys(), Unique: true})
+	primaryKeysIndex.isRequired = true
+	declaredIndexes := []declaredBlobIndex{primaryKeysIndex}
+
+	if blob.GetTTL() > 0 {
+		expireAfterSeconds := int32(0)
+		expiryIndex := newDeclaredBlobIndex(storage_typedefs.BlobIndex{Fields: []string{mongo_adaptor.ExpiresAtFieldName}})
+		expiryIndex.expireAfterSeconds = &expireAfterSeconds
+		expiryIndex.isRequired = true
+		declaredIndexes = append(declaredIndexes, expiryIndex)
+	}
+
+	for _, index := range blob.GetIndexes() {
+		declared := newDeclaredBlobIndex(index)
+		declared.isRequired = index.Unique
+		duplicate := false
+		for _, other := range declaredIndexes {
+			if getIndexKeysString(other.keys) == getIndexKeysString(declared.keys) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			declaredIndexes = append(declaredIndexes, declared)
+		}
+	}
+
+	return declaredIndexes
+}
+
+/**
+ * Eg: "UserName_1_Score_-1". Index directions read from the db can be any number type
+ */
+func getIndexKeysString(keys bson.D) string {
+	var parts []string
+	for _, key := range keys {
+		parts = append(parts, key.Key+"_"+fmt.Sprint(key.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+func describeIndexOptions(unique bool, expireAfterSeconds *int32, partialFilter bson.D) string {
+	var parts []string
+	if unique {
+		parts = append(parts, "unique")
+	}
+	if expireAfterSeconds != nil {
+		parts = append(parts, fmt.Sprintf("ttl %ds", *expireAfterSeconds))
+	}
+	if partialFilter != nil {
+		partialFilterJson, err := bson.MarshalExtJSON(partialFilter, false, false)
+		if err != nil {
+			partialFilterJson = []byte("?")
+		}
+		parts = append(parts, "partial "+string(partialFilterJson))
+	}
+	if len(parts) == 0 {
+		return "plain"
+	}
+	return strings.Join(parts, ", ")
+}
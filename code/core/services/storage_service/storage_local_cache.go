@@ -0,0 +1,267 @@
+package storage_service
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spacetimi/timi_shared_server/code/core/adaptors/redis_adaptor"
+	"github.com/spacetimi/timi_shared_server/code/core/services/storage_service/storage_typedefs"
+	"github.com/spacetimi/timi_shared_server/utils/logger"
+)
+
+/**
+ * Bounds the number of blobs cached in memory (see BlobCachePolicy.LocalCacheMaxAge). The least recently used
+ * blobs are dropped first. Defaults to kDefaultLocalCacheMaxEntries
+ */
+func SetLocalCacheMaxEntries(maxEntries int) {
+	_localCache.mutex.Lock()
+	defer _localCache.mutex.Unlock()
+
+	_localCache.maxEntries = maxEntries
+	_localCache.removeOverflow()
+}
+
+/***** Private ******************************************************************/
+
+const kDefaultLocalCacheMaxEntries = 10000
+
+const kLocalCacheInvalidationsChannel = "storage_service::local_cache_invalidations"
+
+// How long to wait before trying to subscribe to invalidations again after failing to
+const kLocalCacheSubscribeRetryInterval = 10 * time.Second
+
+/**
+ * Blobs are cached in memory as their redis values, so that every read decodes its own copy of the blob
+ */
+type localCacheEntry struct {
+	key       string
+	value     string
+	expiresAt time.Time
+}
+
+type localCache struct {
+	mutex      sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	lru        *list.List // Most recently used first
+
+	// Incremented on every invalidation. A value read from redis is only cached if there was no invalidation
+	// while reading it, since it could be the value that the invalidation was for
+	invalidationCount uint64
+
+	// The local cache is only used while subscribed to invalidations from the other servers
+	isSubscribed         bool
+	lastSubscribeAttempt time.Time
+}
+
+var _localCache = &localCache{
+	maxEntries: kDefaultLocalCacheMaxEntries,
+	entries:    make(map[string]*list.Element),
+	lru:        list.New(),
+}
+
+// Identifies this server's invalidations, so that it skips its own when they come back through redis
+var _localCacheNodeId = fmt.Sprintf("%s:%d:%d", getHostName(), os.Getpid(), time.Now().UnixNano())
+
+type localCacheInvalidation struct {
+	NodeId    string
+	RedisKeys []string
+}
+
+func isLocalCacheEnabled(blobPtr storage_typedefs.IBlob) bool {
+	return blobPtr.IsRedisAllowed() && blobPtr.GetCachePolicy().LocalCacheMaxAge > 0
+}
+
+/**
+ * Returns the blob's cached redis value, if any, and the invalidation count to pass to putInLocalCache
+ * for caching a value read after this
+ */
+func getFromLocalCache(redisKey string) (string, bool, uint64) {
+	if !ensureLocalCacheSubscribed() {
+		return "", false, 0
+	}
+
+	_localCache.mutex.Lock()
+	defer _localCache.mutex.Unlock()
+
+	element, ok := _localCache.entries[redisKey]
+	if !ok {
+		return "", false, _localCache.invalidationCount
+	}
+	entry := element.Value.(*localCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		_localCache.lru.Remove(element)
+		delete(_localCache.entries, redisKey)
+		return "", false, _localCache.invalidationCount
+	}
+
+	_localCache.lru.MoveToFront(element)
+	return entry.value, true, _localCache.invalidationCount
+}
+
+func putInLocalCache(redisKey string, value string, maxAge time.Duration, invalidationCount uint64) {
+	_localCache.mutex.Lock()
+	defer _localCache.mutex.Unlock()
+
+	if !_localCache.isSubscribed || invalidationCount != _localCache.invalidationCount {
+		return
+	}
+
+	entry := &localCacheEntry{key: redisKey, value: value, expiresAt: time.Now().Add(maxAge)}
+	if element, ok := _localCache.entries[redisKey]; ok {
+		element.Value = entry
+		_localCache.lru.MoveToFront(element)
+		return
+	}
+	_localCache.entries[redisKey] = _localCache.lru.PushFront(entry)
+	_localCache.removeOverflow()
+}
+
+/**
+ * Drops the blob from this server's memory, and tells the other servers to drop it too.
+ * Call after the blob was set or deleted
+ */
+func invalidateLocallyCachedBlob(blobPtr storage_typedefs.IBlob, redisKey string, ctx context.Context) {
+	if isLocalCacheEnabled(blobPtr) {
+		invalidateLocallyCachedBlobs([]string{redisKey}, ctx)
+	}
+}
+
+/**
+ * Same as invalidateLocallyCachedBlob, for the redis keys of blobs that are cached in memory
+ */
+func invalidateLocallyCachedBlobs(redisKeys []string, ctx context.Context) {
+	if len(redisKeys) == 0 {
+		return
+	}
+
+	removeFromLocalCache(redisKeys)
+
+	message, err := json.Marshal(localCacheInvalidation{NodeId: _localCacheNodeId, RedisKeys: redisKeys})
+	if err == nil {
+		err = redis_adaptor.Publish(kLocalCacheInvalidationsChannel, string(message), ctx)
+	}
+	if err != nil {
+		logger.LogError("error publishing local cache invalidation" +
+			"|redis keys=" + fmt.Sprintf("%v", redisKeys) +
+			"|error=" + err.Error())
+	}
+}
+
+func removeFromLocalCache(redisKeys []string) {
+	_localCache.mutex.Lock()
+	defer _localCache.mutex.Unlock()
+
+	_localCache.invalidationCount++
+	for _, redisKey := range redisKeys {
+		if element, ok := _localCache.entries[redisKey]; ok {
+			_localCache.lru.Remove(element)
+			delete(_localCache.entries, redisKey)
+		}
+	}
+}
+
+/**
+ * Subscribes to the other servers' invalidations the first time the local cache is used.
+ * Returns false if not subscribed (the local cache isn't used then)
+ */
+func ensureLocalCacheSubscribed() bool {
+	_localCache.mutex.Lock()
+	if _localCache.isSubscribed ||
+		time.Since(_localCache.lastSubscribeAttempt) < kLocalCacheSubscribeRetryInterval {
+		isSubscribed := _localCache.isSubscribed
+		_localCache.mutex.Unlock()
+		return isSubscribed
+	}
+	_localCache.lastSubscribeAttempt = time.Now()
+	_localCache.mutex.Unlock()
+
+	err := redis_adaptor.Subscribe(kLocalCacheInvalidationsChannel,
+		onLocalCacheInvalidation,
+		onLocalCacheInvalidationsReconnected,
+		onLocalCacheInvalidationsClosed,
+		context.Background())
+	if err != nil {
+		logger.LogError("error subscribing to local cache invalidations. not caching blobs in memory" +
+			"|error=" + err.Error())
+		return false
+	}
+
+	_localCache.mutex.Lock()
+	_localCache.isSubscribed = true
+	_localCache.mutex.Unlock()
+	return true
+}
+
+func onLocalCacheInvalidation(message string) {
+	invalidation := localCacheInvalidation{}
+	err := json.Unmarshal([]byte(message), &invalidation)
+	if err != nil {
+		logger.LogError("error decoding local cache invalidation" +
+			"|message=" + message +
+			"|error=" + err.Error())
+		return
+	}
+
+	if invalidation.NodeId != _localCacheNodeId {
+		removeFromLocalCache(invalidation.RedisKeys)
+	}
+}
+
+/**
+ * Invalidations published while the connection was down were lost, so any cached blob could be stale
+ */
+func onLocalCacheInvalidationsReconnected() {
+	logger.LogWarning("reconnected to local cache invalidations. dropping all blobs cached in memory")
+
+	_localCache.mutex.Lock()
+	defer _localCache.mutex.Unlock()
+
+	_localCache.removeAll()
+}
+
+/**
+ * Stops using the local cache until subscribed again
+ */
+func onLocalCacheInvalidationsClosed() {
+	logger.LogWarning("unsubscribed from local cache invalidations. not caching blobs in memory until subscribed again")
+
+	_localCache.mutex.Lock()
+	defer _localCache.mutex.Unlock()
+
+	_localCache.isSubscribed = false
+	_localCache.removeAll()
+}
+
+/**
+ * Expects the mutex to be locked
+ */
+func (lc *localCache) removeAll() {
+	lc.invalidationCount++
+	lc.entries = make(map[string]*list.Element)
+	lc.lru.Init()
+}
+
+/**
+ * Expects the mutex to be locked
+ */
+func (lc *localCache) removeOverflow() {
+	for lc.lru.Len() > lc.maxEntries && lc.lru.Len() > 0 {
+		element := lc.lru.Back()
+		lc.lru.Remove(element)
+		delete(lc.entries, element.Value.(*localCacheEntry).key)
+	}
+}
+
+func getHostName() string {
+	hostName, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostName
+}
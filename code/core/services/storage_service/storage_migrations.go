@@ -0,0 +1,250 @@
+package storage_service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spacetimi/timi_shared_server/code/core/adaptors/mongo_adaptor"
+	"github.com/spacetimi/timi_shared_server/code/core/adaptors/redis_adaptor"
+	"github.com/spacetimi/timi_shared_server/code/core/services/storage_service/storage_typedefs"
+	"github.com/spacetimi/timi_shared_server/utils/logger"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/**
+ * Upgrades a stored blob's document from one schema version to the next, in place.
+ * Nested documents are bson.M, and arrays are bson.A
+ */
+type BlobMigration func(document bson.M) error
+
+/**
+ * Registers the migrations for a blob, keyed by the schema version each one upgrades from.
+ * blobFactory returns a new (empty) blob. Its version is the version that stored blobs are migrated up to.
+ * Version steps without a migration leave the document as it is (the schema change didn't need stored blobs to
+ * change). Blobs stored before schema versions were persisted count as version 0.
+ *
+ * Blobs are migrated whenever they are read. With writeBackOnRead, the migrated blob is also written back to the db.
+ * Either way, MigrateBlobs migrates all stored blobs in one go
+ */
+func RegisterBlobMigrations(blobFactory func() storage_typedefs.IBlob,
+	migrations map[int]BlobMigration,
+	writeBackOnRead bool) {
+
+	blobName := blobFactory().GetBlobName()
+	RegisterBlob(blobFactory)
+
+	_blobMigrationsMutex.Lock()
+	defer _blobMigrationsMutex.Unlock()
+
+	if _, ok := _blobMigrations[blobName]; ok {
+		logger.LogWarning("replacing already registered blob migrations" +
+			"|blob name=" + blobName)
+	}
+	_blobMigrations[blobName] = &registeredBlobMigrations{
+		blobFactory:     blobFactory,
+		migrations:      migrations,
+		writeBackOnRead: writeBackOnRead,
+	}
+}
+
+/**
+ * Names of the blobs with registered migrations, sorted
+ */
+func GetBlobNamesWithMigrations() []string {
+	_blobMigrationsMutex.RLock()
+	defer _blobMigrationsMutex.RUnlock()
+
+	var blobNames []string
+	for blobName := range _blobMigrations {
+		blobNames = append(blobNames, blobName)
+	}
+	sort.Strings(blobNames)
+	return blobNames
+}
+
+type BlobMigrationResult struct {
+	BlobName  string
+	ToVersion int
+	Migrated  int
+	Skipped   int // Modified by another writer while being migrated. They get migrated on their next read
+}
+
+/**
+ * Migrates every stored blob of the (registered) blob name that is below the blob's current version.
+ * Safe to run while servers are using the blobs, and to re-run after a failure: only blobs that still need
+ * migrating are touched. With dryRun, the migrations are run but nothing is written
+ */
+func MigrateBlobs(blobName string, dryRun bool, ctx context.Context) (*BlobMigrationResult, error) {
+	_blobMigrationsMutex.RLock()
+	registered, ok := _blobMigrations[blobName]
+	_blobMigrationsMutex.RUnlock()
+	if !ok {
+		return nil, errors.New("no migrations registered for blob: " + blobName)
+	}
+
+	blob := registered.blobFactory()
+	dbSpace, err := getDBSpaceFromStorageSpace(blob.GetStorageSpace())
+	if err != nil {
+		return nil, errors.New("error resolving db space: " + err.Error())
+	}
+
+	result := &BlobMigrationResult{
+		BlobName:  blobName,
+		ToVersion: blob.GetVersion(),
+	}
+
+	err = mongo_adaptor.ForEachRawDataItemBelowSchemaVersion(dbSpace, blobName, blob.GetVersion(),
+		func(raw bson.Raw, metadata mongo_adaptor.DataItemMetadata) error {
+
+			document := bson.M{}
+			err := bson.Unmarshal(raw, &document)
+			if err != nil {
+				return errors.New("error decoding blob " + fmt.Sprintf("%v", document["_id"]) + ": " + err.Error())
+			}
+
+			err = migrateBlobDocument(blobName, document, metadata.SchemaVersion, blob.GetVersion())
+			if err != nil {
+				return errors.New("error migrating blob " + fmt.Sprintf("%v", document["_id"]) + ": " + err.Error())
+			}
+
+			if dryRun {
+				result.Migrated++
+				return nil
+			}
+
+			// Keeps the blob's expiry time, which is in the document
+			_, err = mongo_adaptor.WriteRevisionedDocumentByPrimaryKeys(dbSpace, blobName, blob.GetPrimaryKeys(), document,
+				metadata.Revision, time.Time{}, blob.GetVersion(), ctx)
+			if err == mongo_adaptor.ErrRevisionMismatch {
+				result.Skipped++
+				return nil
+			}
+			if err != nil {
+				return errors.New("error writing migrated blob " + fmt.Sprintf("%v", document["_id"]) + ": " + err.Error())
+			}
+			result.Migrated++
+
+			// Cached blobs are already at the current version (the version is part of the redis key), but
+			// their revision is now stale
+			if blob.IsRedisAllowed() {
+				evictMigratedBlobFromRedis(blob, document, ctx)
+			}
+
+			return nil
+		}, ctx)
+
+	logger.LogInfo("migrated blobs" +
+		"|blob name=" + blobName +
+		"|to version=" + strconv.Itoa(result.ToVersion) +
+		"|migrated=" + strconv.Itoa(result.Migrated) +
+		"|skipped=" + strconv.Itoa(result.Skipped) +
+		"|dry run=" + strconv.FormatBool(dryRun))
+
+	return result, err
+}
+
+/***** Private ******************************************************************/
+
+type registeredBlobMigrations struct {
+	blobFactory     func() storage_typedefs.IBlob
+	migrations      map[int]BlobMigration // By the version they upgrade from
+	writeBackOnRead bool
+}
+
+var _blobMigrations = make(map[string]*registeredBlobMigrations)
+var _blobMigrationsMutex sync.RWMutex
+
+/**
+ * Decodes the blob's document into the blob, migrating it first if it is at an older version.
+ * Returns whether it was migrated
+ */
+func decodeBlobDocument(raw bson.Raw, schemaVersion int, blobPtr storage_typedefs.IBlob) (bool, error) {
+	_blobMigrationsMutex.RLock()
+	_, hasMigrations := _blobMigrations[blobPtr.GetBlobName()]
+	_blobMigrationsMutex.RUnlock()
+
+	if schemaVersion >= blobPtr.GetVersion() || !hasMigrations {
+		// Documents at a newer version (written by newer code during a deploy) are read as they are.
+		// Fields this code doesn't know about are left untouched when it writes the blob
+		err := bson.Unmarshal(raw, blobPtr)
+		if err != nil {
+			return false, errors.New("error decoding blob: " + err.Error())
+		}
+		return false, nil
+	}
+
+	document := bson.M{}
+	err := bson.Unmarshal(raw, &document)
+	if err != nil {
+		return false, errors.New("error decoding document: " + err.Error())
+	}
+
+	err = migrateBlobDocument(blobPtr.GetBlobName(), document, schemaVersion, blobPtr.GetVersion())
+	if err != nil {
+		return false, errors.New("error migrating blob from version " + strconv.Itoa(schemaVersion) + ": " + err.Error())
+	}
+
+	migratedRaw, err := bson.Marshal(document)
+	if err != nil {
+		return false, errors.New("error encoding migrated document: " + err.Error())
+	}
+	err = bson.Unmarshal(migratedRaw, blobPtr)
+	if err != nil {
+		return false, errors.New("error decoding migrated blob: " + err.Error())
+	}
+
+	return true, nil
+}
+
+func migrateBlobDocument(blobName string, document bson.M, fromVersion int, toVersion int) error {
+	_blobMigrationsMutex.RLock()
+	registered, ok := _blobMigrations[blobName]
+	_blobMigrationsMutex.RUnlock()
+	if !ok {
+		// Nothing to do for any of the version steps
+		return nil
+	}
+
+	for version := fromVersion; version < toVersion; version++ {
+		migration, ok := registered.migrations[version]
+		if !ok {
+			continue
+		}
+		err := migration(document)
+		if err != nil {
+			return errors.New("error in migration from version " + strconv.Itoa(version) + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+func shouldWriteBackMigratedBlob(blobName string) bool {
+	_blobMigrationsMutex.RLock()
+	defer _blobMigrationsMutex.RUnlock()
+
+	registered, ok := _blobMigrations[blobName]
+	return ok && registered.writeBackOnRead
+}
+
+func evictMigratedBlobFromRedis(blob storage_typedefs.IBlob, document bson.M, ctx context.Context) {
+	var primaryKeyValues []interface{}
+	for _, primaryKey := range blob.GetPrimaryKeys() {
+		primaryKeyValues = append(primaryKeyValues, document[primaryKey])
+	}
+
+	redisKey := getRedisKey(blob.GetBlobName(), primaryKeyValues, blob.GetVersion())
+	err := redis_adaptor.Delete(redisKey, ctx)
+	invalidateLocallyCachedBlob(blob, redisKey, ctx)
+	if err != nil {
+		logger.LogError("error evicting migrated blob from redis" +
+			"|blob name=" + blob.GetBlobName() +
+			"|primary key values=" + fmt.Sprintf("%#v", primaryKeyValues) +
+			"|error=" + err.Error())
+	}
+}
@@ -0,0 +1,264 @@
+package storage_service
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/spacetimi/timi_shared_server/code/core/adaptors/mongo_adaptor"
+	"github.com/spacetimi/timi_shared_server/code/core/services/storage_service/storage_typedefs"
+	"github.com/spacetimi/timi_shared_server/utils/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/**
+ * Returns a page of the blobs matching the query, each decoded into a new blob from blobFactory, and the cursor
+ * for the next page (empty if this was the last page).
+ * Queries should filter and sort on the blob's indexes (see BlobDescriptor.WithIndexes). Query results are read
+ * from the db, not redis
+ */
+func QueryBlobs(blobFactory func() storage_typedefs.IBlob,
+	query storage_typedefs.BlobQuery,
+	ctx context.Context) ([]storage_typedefs.IBlob, string, error) {
+
+	prototypeBlobPtr := blobFactory()
+
+	dbSpace, err := getDBSpaceFromStorageSpace(prototypeBlobPtr.GetStorageSpace())
+	if err != nil {
+		return nil, "", errors.New("error resolving db space: " + err.Error())
+	}
+
+	ensureBlobIndexes(prototypeBlobPtr, dbSpace, ctx)
+
+	filter, err := getBlobQueryFilter(query.Filters)
+	if err != nil {
+		return nil, "", errors.New("bad filters: " + err.Error())
+	}
+
+	sortFields := getBlobQuerySortFields(query.SortBy, prototypeBlobPtr.GetPrimaryKeys())
+	if query.Cursor != "" {
+		cursorCondition, err := getBlobQueryCursorCondition(query.Cursor, sortFields)
+		if err != nil {
+			return nil, "", errors.New("bad cursor: " + err.Error())
+		}
+		filter = append(filter, cursorCondition)
+	}
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = storage_typedefs.DefaultBlobQueryLimit
+	}
+	if limit > storage_typedefs.MaxBlobQueryLimit {
+		limit = storage_typedefs.MaxBlobQueryLimit
+	}
+
+	// One more than the limit, to know if there is a next page
+	raws, metadatas, err := mongo_adaptor.FindRawDataItems(dbSpace, prototypeBlobPtr.GetBlobName(),
+		filter, getBlobQuerySort(sortFields), int64(limit+1), ctx)
+	if err != nil {
+		return nil, "", errors.New("error querying blobs from db: " + err.Error())
+	}
+
+	var nextCursor string
+	if len(raws) > limit {
+		raws = raws[:limit]
+		nextCursor, err = getBlobQueryCursor(raws[limit-1], sortFields)
+		if err != nil {
+			return nil, "", errors.New("error creating cursor for next page: " + err.Error())
+		}
+	}
+
+	blobPtrs := make([]storage_typedefs.IBlob, 0, len(raws))
+	for i, raw := range raws {
+		blobPtr := blobFactory()
+		_, err = decodeBlobFromDB(raw, metadatas[i], blobPtr, nil, ctx)
+		if err != nil {
+			return nil, "", errors.New("error decoding blob from db: " + err.Error())
+		}
+		blobPtrs = append(blobPtrs, blobPtr)
+	}
+
+	return blobPtrs, nextCursor, nil
+}
+
+/***** Private ******************************************************************/
+
+// Collections (per db space) whose blob indexes were created by this process
+var _collectionsWithBlobIndexes sync.Map
+
+/**
+ * Creates the blob's secondary indexes, once per process. Failures are logged and not retried until the next
+ * restart, since they usually need fixing the data first (eg: duplicates for a unique index)
+ */
+func ensureBlobIndexes(blobPtr storage_typedefs.IBlob, dbSpace mongo_adaptor.DBSpace, ctx context.Context) {
+	if len(blobPtr.GetIndexes()) == 0 {
+		return
+	}
+
+	cacheKey := fmt.Sprintf("%d:%s", dbSpace, blobPtr.GetBlobName())
+	if _, ok := _collectionsWithBlobIndexes.Load(cacheKey); ok {
+		return
+	}
+	_collectionsWithBlobIndexes.Store(cacheKey, true)
+
+	err := mongo_adaptor.CreateIndexes(dbSpace, blobPtr.GetBlobName(), getBlobIndexModels(blobPtr.GetIndexes()), ctx)
+	if err != nil {
+		logger.LogError("error creating blob indexes" +
+			"|blob name=" + blobPtr.GetBlobName() +
+			"|error=" + err.Error())
+	}
+}
+
+func getBlobIndexModels(indexes []storage_typedefs.BlobIndex) []mongo.IndexModel {
+	var models []mongo.IndexModel
+	for _, index := range indexes {
+		declared := newDeclaredBlobIndex(index)
+		models = append(models, declared.getModel())
+	}
+	return models
+}
+
+func getBlobQueryFilter(filters []storage_typedefs.BlobFilter) (bson.D, error) {
+	// Conditions on the same field are combined, since a filter can't have a field twice
+	conditionsByField := make(map[string]bson.M)
+	var fields []string
+
+	for _, filter := range filters {
+		switch filter.Op {
+		case storage_typedefs.BLOB_FILTER_EQ,
+			storage_typedefs.BLOB_FILTER_NE,
+			storage_typedefs.BLOB_FILTER_LT,
+			storage_typedefs.BLOB_FILTER_LTE,
+			storage_typedefs.BLOB_FILTER_GT,
+			storage_typedefs.BLOB_FILTER_GTE,
+			storage_typedefs.BLOB_FILTER_IN:
+		default:
+			return nil, errors.New("unknown filter op " + string(filter.Op) + " on field " + filter.Field)
+		}
+		if filter.Field == "" || strings.HasPrefix(filter.Field, "$") {
+			return nil, errors.New("bad filter field: " + filter.Field)
+		}
+
+		conditions, ok := conditionsByField[filter.Field]
+		if !ok {
+			conditions = bson.M{}
+			conditionsByField[filter.Field] = conditions
+			fields = append(fields, filter.Field)
+		}
+		conditions[string(filter.Op)] = filter.Value
+	}
+
+	filter := bson.D{}
+	for _, field := range fields {
+		filter = append(filter, bson.E{Key: field, Value: conditionsByField[field]})
+	}
+	return filter, nil
+}
+
+/**
+ * The requested sort fields, followed by the primary keys that aren't among them
+ */
+func getBlobQuerySortFields(sortBy []string, primaryKeys []string) []string {
+	sortFields := append([]string{}, sortBy...)
+	for _, primaryKey := range primaryKeys {
+		found := false
+		for _, sortField := range sortBy {
+			fieldName, _ := getSortFieldAndDirection(sortField)
+			if fieldName == primaryKey {
+				found = true
+				break
+			}
+		}
+		if !found {
+			sortFields = append(sortFields, primaryKey)
+		}
+	}
+	return sortFields
+}
+
+func getBlobQuerySort(sortFields []string) bson.D {
+	var sort bson.D
+	for _, sortField := range sortFields {
+		fieldName, direction := getSortFieldAndDirection(sortField)
+		sort = append(sort, bson.E{Key: fieldName, Value: direction})
+	}
+	return sort
+}
+
+func getSortFieldAndDirection(sortField string) (string, int) {
+	if strings.HasPrefix(sortField, "-") {
+		return strings.TrimPrefix(sortField, "-"), -1
+	}
+	return sortField, 1
+}
+
+/**
+ * Cursors hold the sort field values of the last blob of the page, to continue after it
+ */
+type blobQueryCursor struct {
+	SortFields []string
+	Values     []bson.RawValue
+}
+
+func getBlobQueryCursor(lastRaw bson.Raw, sortFields []string) (string, error) {
+	cursor := blobQueryCursor{SortFields: sortFields}
+	for _, sortField := range sortFields {
+		fieldName, _ := getSortFieldAndDirection(sortField)
+		value, err := lastRaw.LookupErr(strings.Split(fieldName, ".")...)
+		if err != nil {
+			return "", errors.New("sort field " + fieldName + " is not set on every blob")
+		}
+		cursor.Values = append(cursor.Values, value)
+	}
+
+	bytes, err := bson.Marshal(cursor)
+	if err != nil {
+		return "", errors.New("error encoding cursor: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+/**
+ * Matches the blobs after the cursor's blob in the sort order:
+ *   f1 after v1, or (f1 = v1 and f2 after v2), or ...
+ */
+func getBlobQueryCursorCondition(cursorString string, sortFields []string) (bson.E, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(cursorString)
+	if err != nil {
+		return bson.E{}, errors.New("error decoding cursor: " + err.Error())
+	}
+
+	cursor := blobQueryCursor{}
+	err = bson.Unmarshal(bytes, &cursor)
+	if err != nil {
+		return bson.E{}, errors.New("error decoding cursor: " + err.Error())
+	}
+
+	if len(cursor.Values) != len(sortFields) || strings.Join(cursor.SortFields, ",") != strings.Join(sortFields, ",") {
+		return bson.E{}, errors.New("cursor is from a query with a different sort order")
+	}
+
+	var alternatives bson.A
+	for i, sortField := range sortFields {
+		alternative := bson.D{}
+		for j := 0; j < i; j++ {
+			fieldName, _ := getSortFieldAndDirection(sortFields[j])
+			alternative = append(alternative, bson.E{Key: fieldName, Value: cursor.Values[j]})
+		}
+
+		fieldName, direction := getSortFieldAndDirection(sortField)
+		op := "$gt"
+		if direction < 0 {
+			op = "$lt"
+		}
+		alternative = append(alternative, bson.E{Key: fieldName, Value: bson.M{op: cursor.Values[i]}})
+
+		alternatives = append(alternatives, alternative)
+	}
+
+	return bson.E{Key: "$or", Value: alternatives}, nil
+}
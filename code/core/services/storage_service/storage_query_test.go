@@ -0,0 +1,116 @@
+package storage_service
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestBlobQueryCursorCondition(t *testing.T) {
+	lastBlob := bson.D{
+		{Key: "PlayerId", Value: int64(42)},
+		{Key: "Level", Value: int32(7)},
+		{Key: "Name", Value: "timi"},
+		{Key: "Stats", Value: bson.D{{Key: "Wins", Value: 3.5}}},
+	}
+
+	testCases := []struct {
+		name       string
+		sortFields []string
+		want       bson.A
+	}{
+		{"single field",
+			[]string{"PlayerId"},
+			bson.A{
+				bson.D{{Key: "PlayerId", Value: bson.M{"$gt": int64(42)}}},
+			}},
+		{"descending field then tie breaker",
+			[]string{"-Level", "PlayerId"},
+			bson.A{
+				bson.D{{Key: "Level", Value: bson.M{"$lt": int32(7)}}},
+				bson.D{{Key: "Level", Value: int32(7)}, {Key: "PlayerId", Value: bson.M{"$gt": int64(42)}}},
+			}},
+		{"nested and string fields",
+			[]string{"-Stats.Wins", "Name", "-PlayerId"},
+			bson.A{
+				bson.D{{Key: "Stats.Wins", Value: bson.M{"$lt": 3.5}}},
+				bson.D{{Key: "Stats.Wins", Value: 3.5}, {Key: "Name", Value: bson.M{"$gt": "timi"}}},
+				bson.D{{Key: "Stats.Wins", Value: 3.5}, {Key: "Name", Value: "timi"}, {Key: "PlayerId", Value: bson.M{"$lt": int64(42)}}},
+			}},
+	}
+
+	lastRaw, err := bson.Marshal(lastBlob)
+	if err != nil {
+		t.Fatalf("serializing blob: %v", err)
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cursor, err := getBlobQueryCursor(lastRaw, testCase.sortFields)
+			if err != nil {
+				t.Fatalf("encoding cursor: %v", err)
+			}
+			if strings.ContainsAny(cursor, "+/=") {
+				t.Errorf("cursor %q is not url safe", cursor)
+			}
+
+			condition, err := getBlobQueryCursorCondition(cursor, testCase.sortFields)
+			if err != nil {
+				t.Fatalf("decoding cursor: %v", err)
+			}
+
+			// Compare the serialized filters, since the cursor's values decode as bson.RawValue
+			got, err := bson.Marshal(bson.D{condition})
+			if err != nil {
+				t.Fatalf("serializing condition: %v", err)
+			}
+			want, err := bson.Marshal(bson.D{{Key: "$or", Value: testCase.want}})
+			if err != nil {
+				t.Fatalf("serializing expected condition: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("got condition %s, want %s", bson.Raw(got), bson.Raw(want))
+			}
+		})
+	}
+}
+
+func TestBlobQueryCursorErrors(t *testing.T) {
+	lastRaw, err := bson.Marshal(bson.D{{Key: "PlayerId", Value: int64(42)}, {Key: "Level", Value: int32(7)}})
+	if err != nil {
+		t.Fatalf("serializing blob: %v", err)
+	}
+
+	_, err = getBlobQueryCursor(lastRaw, []string{"PlayerId", "Missing"})
+	if err == nil || !strings.Contains(err.Error(), "sort field Missing is not set") {
+		t.Errorf("got error %v for a missing sort field", err)
+	}
+
+	cursor, err := getBlobQueryCursor(lastRaw, []string{"-Level", "PlayerId"})
+	if err != nil {
+		t.Fatalf("encoding cursor: %v", err)
+	}
+
+	// The cursor is tied to the sort order it was created for
+	_, err = getBlobQueryCursorCondition(cursor, []string{"Level", "PlayerId"})
+	if err == nil || !strings.Contains(err.Error(), "different sort order") {
+		t.Errorf("got error %v for a cursor used with another direction", err)
+	}
+	_, err = getBlobQueryCursorCondition(cursor, []string{"-Level", "Name"})
+	if err == nil || !strings.Contains(err.Error(), "different sort order") {
+		t.Errorf("got error %v for a cursor used with other fields", err)
+	}
+	_, err = getBlobQueryCursorCondition(cursor, []string{"-Level"})
+	if err == nil || !strings.Contains(err.Error(), "different sort order") {
+		t.Errorf("got error %v for a cursor used with fewer fields", err)
+	}
+
+	for _, badCursor := range []string{"not a cursor!", "bm90IGJzb24"} {
+		_, err = getBlobQueryCursorCondition(badCursor, []string{"-Level", "PlayerId"})
+		if err == nil || !strings.Contains(err.Error(), "error decoding cursor") {
+			t.Errorf("got error %v for cursor %q", err, badCursor)
+		}
+	}
+}
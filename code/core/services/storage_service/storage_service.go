@@ -2,19 +2,26 @@ package storage_service
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand"
 	"reflect"
 	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/spacetimi/timi_shared_server/code/core/adaptors/mongo_adaptor"
 	"github.com/spacetimi/timi_shared_server/code/core/adaptors/redis_adaptor"
 	"github.com/spacetimi/timi_shared_server/code/core/services/storage_service/storage_typedefs"
 	"github.com/spacetimi/timi_shared_server/utils/logger"
 	"github.com/spacetimi/timi_shared_server/utils/reflection_utils"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
+/**
+ * Reads the blob with the primary keys set on it, from redis if it is cached there, otherwise from the db.
+ * Returns storage_typedefs.ErrBlobNotFound if the blob doesn't exist
+ */
 func GetBlobByPrimaryKeys(outBlobPtr storage_typedefs.IBlob,
 	ctx context.Context) error {
 
@@ -27,22 +34,13 @@ func GetBlobByPrimaryKeys(outBlobPtr storage_typedefs.IBlob,
 		return errors.New("error getting primary key values from blob: " + err.Error())
 	}
 
-	// Check in redis first
+	// Check in memory and redis first
 	var redisKey string
 	if outBlobPtr.IsRedisAllowed() {
 		redisKey = getRedisKey(outBlobPtr.GetBlobName(), primaryKeyValues, outBlobPtr.GetVersion())
-		redisValue, redisOk := redis_adaptor.Read(redisKey, ctx)
-		if redisOk {
-			err := json.Unmarshal([]byte(redisValue), outBlobPtr)
-			if err == nil {
-				// Successfully read the blob from redis
-				return nil
-			}
-			logger.LogError("error deserializing blob from redis" +
-				"|blob name=" + outBlobPtr.GetBlobName() +
-				"|primary key values=" + fmt.Sprintf("%#v", primaryKeyValues) +
-				"|error=" + err.Error())
-			// Fall-through
+		cached, err := readBlobFromCaches(outBlobPtr, redisKey, primaryKeyValues, ctx)
+		if cached {
+			return err
 		}
 	}
 
@@ -52,30 +50,123 @@ func GetBlobByPrimaryKeys(outBlobPtr storage_typedefs.IBlob,
 		return errors.New("error resolving db space: " + err.Error())
 	}
 
-	collectionName := outBlobPtr.GetBlobName()
-	primaryKeys := outBlobPtr.GetPrimaryKeys()
+	if outBlobPtr.GetCachePolicy().CoalesceReads {
+		return readBlobFromDBCoalesced(outBlobPtr, dbSpace, primaryKeyValues, redisKey, ctx)
+	}
+	_, _, err = readBlobFromDB(outBlobPtr, dbSpace, primaryKeyValues, redisKey, ctx)
+	return err
+}
+
+/**
+ * Writes the blob regardless of what is stored. Use SetBlobIfUnchanged (or UpdateBlob) for read-modify-writes
+ * that can race with other writers
+ */
+func SetBlob(blobPtr storage_typedefs.IBlob, ctx context.Context) error {
+	return setBlob(blobPtr, mongo_adaptor.AnyRevision, ctx)
+}
+
+/**
+ * Writes the blob only if the stored blob is still at the revision it was read at (or doesn't exist, for a new blob).
+ * Fails with a *storage_typedefs.BlobConflictError otherwise.
+ * New blobs need the unique primary keys index, so register the blob for servers to create it (see RegisterBlob)
+ */
+func SetBlobIfUnchanged(blobPtr storage_typedefs.IBlob, ctx context.Context) error {
+	if blobPtr == nil {
+		return errors.New("blob ptr is nil")
+	}
+	return setBlob(blobPtr, blobPtr.GetRevision(), ctx)
+}
+
+/**
+ * Read-modify-write of a blob, retried with a freshly read blob if another writer modified it in the meantime.
+ * blobFactory returns a new blob with its primary keys set (the blob must already exist), and modify applies
+ * the change to it. Returns the written blob, or a *storage_typedefs.BlobConflictError if every attempt conflicted
+ */
+func UpdateBlob(blobFactory func() storage_typedefs.IBlob,
+	modify func(blobPtr storage_typedefs.IBlob) error,
+	ctx context.Context) (storage_typedefs.IBlob, error) {
+
+	var err error
+	for attempt := 1; attempt <= kUpdateBlobMaxAttempts; attempt++ {
+		blobPtr := blobFactory()
+
+		err = GetBlobByPrimaryKeys(blobPtr, ctx)
+		if err != nil {
+			return nil, errors.New("error reading blob: " + err.Error())
+		}
+
+		err = modify(blobPtr)
+		if err != nil {
+			return nil, errors.New("error modifying blob: " + err.Error())
+		}
+
+		err = SetBlobIfUnchanged(blobPtr, ctx)
+		if err == nil {
+			return blobPtr, nil
+		}
+		if _, isConflict := err.(*storage_typedefs.BlobConflictError); !isConflict {
+			return nil, err
+		}
+
+		// Back off for a random bit, so that the conflicting writers don't collide again
+		backoff := time.Duration(rand.Int63n(int64(attempt) * int64(kUpdateBlobBackoffPerAttempt)))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, errors.New("context done while retrying blob update: " + ctx.Err().Error())
+		}
+	}
+
+	logger.LogWarning("giving up on blob update after conflicts" +
+		"|blob name=" + err.(*storage_typedefs.BlobConflictError).BlobName +
+		"|attempts=" + strconv.Itoa(kUpdateBlobMaxAttempts))
+	return nil, err
+}
+
+/**
+ * Removes the blob from the db and evicts it from redis. Deleting a blob that doesn't exist is not an error
+ */
+func DeleteBlob(blobPtr storage_typedefs.IBlob, ctx context.Context) error {
 
-	err = mongo_adaptor.GetDataItemByPrimaryKeys(dbSpace, collectionName, primaryKeys, primaryKeyValues, outBlobPtr, ctx)
+	if blobPtr == nil {
+		return errors.New("blob ptr is nil")
+	}
+
+	primaryKeyValues, err := reflection_utils.GetFieldValuesFromStructPtr(blobPtr, blobPtr.GetPrimaryKeys())
 	if err != nil {
-		return errors.New("error getting blob from db: " + err.Error())
+		return errors.New("error getting primary key values from blob: " + err.Error())
 	}
 
-	// Write the blob to redis for faster reads next time
-	if outBlobPtr.IsRedisAllowed() {
-		err = writeBlobToRedis(redisKey, outBlobPtr, ctx)
+	dbSpace, err := getDBSpaceFromStorageSpace(blobPtr.GetStorageSpace())
+	if err != nil {
+		return errors.New("error resolving db space: " + err.Error())
+	}
+
+	_, err = mongo_adaptor.DeleteDataItemByPrimaryKeys(dbSpace, blobPtr.GetBlobName(), blobPtr.GetPrimaryKeys(), primaryKeyValues, ctx)
+	if err != nil {
+		return errors.New("error deleting blob from db: " + err.Error())
+	}
+
+	// Evict after deleting from the db, so that a concurrent read can't re-populate redis from the db
+	// with the deleted blob. If this fails, reads would keep returning the blob from redis, so fail the delete
+	if blobPtr.IsRedisAllowed() {
+		redisKey := getRedisKey(blobPtr.GetBlobName(), primaryKeyValues, blobPtr.GetVersion())
+		err = redis_adaptor.Delete(redisKey, ctx)
+		invalidateLocallyCachedBlob(blobPtr, redisKey, ctx)
 		if err != nil {
-			logger.LogError("error saving blob to redis" +
-				"|blob name=" + outBlobPtr.GetBlobName() +
-				"|primary key values=" + fmt.Sprintf("%#v", primaryKeyValues) +
-				"|error=" + err.Error())
-			// Fall-through
+			return errors.New("blob deleted from db, but error evicting it from redis: " + err.Error())
 		}
 	}
 
 	return nil
 }
 
-func SetBlob(blobPtr storage_typedefs.IBlob, ctx context.Context) error {
+/***** Private ******************************************************************/
+
+const kUpdateBlobMaxAttempts = 5
+const kUpdateBlobBackoffPerAttempt = 20 * time.Millisecond
+
+func setBlob(blobPtr storage_typedefs.IBlob, expectedRevision int64, ctx context.Context) error {
 
 	if blobPtr == nil {
 		return errors.New("blob ptr is nil")
@@ -89,10 +180,41 @@ func SetBlob(blobPtr storage_typedefs.IBlob, ctx context.Context) error {
 	collectionName := blobPtr.GetBlobName()
 	primaryKeys := blobPtr.GetPrimaryKeys()
 
-	err = mongo_adaptor.WriteDataItemByPrimaryKeys(dbSpace, collectionName, primaryKeys, blobPtr, ctx)
+	ensureBlobIndexes(blobPtr, dbSpace, ctx)
+
+	var expiresAt time.Time
+	redisExpiration := redis_adaptor.EXPIRATION_DEFAULT
+	if blobPtr.GetTTL() > 0 {
+		expiresAt = time.Now().Add(blobPtr.GetTTL())
+		redisExpiration = blobPtr.GetTTL()
+	}
+
+	revision, err := mongo_adaptor.WriteRevisionedDataItemByPrimaryKeys(dbSpace, collectionName, primaryKeys, blobPtr, expectedRevision, expiresAt, blobPtr.GetVersion(), ctx)
+	if err == mongo_adaptor.ErrRevisionMismatch {
+		primaryKeyValues, _ := reflection_utils.GetFieldValuesFromStructPtr(blobPtr, primaryKeys)
+		// The blob in redis is likely the stale one that was read, so evict it for a retry to read the latest from the db
+		if blobPtr.IsRedisAllowed() && primaryKeyValues != nil {
+			redisKey := getRedisKey(blobPtr.GetBlobName(), primaryKeyValues, blobPtr.GetVersion())
+			err = redis_adaptor.Delete(redisKey, ctx)
+			if err != nil {
+				logger.LogError("error evicting conflicting blob from redis" +
+					"|blob name=" + blobPtr.GetBlobName() +
+					"|primary key values=" + fmt.Sprintf("%#v", primaryKeyValues) +
+					"|error=" + err.Error())
+				// Fall-through
+			}
+			invalidateLocallyCachedBlob(blobPtr, redisKey, ctx)
+		}
+		return &storage_typedefs.BlobConflictError{
+			BlobName:         blobPtr.GetBlobName(),
+			PrimaryKeyValues: primaryKeyValues,
+			ExpectedRevision: expectedRevision,
+		}
+	}
 	if err != nil {
 		return errors.New("error writing blob to db: " + err.Error())
 	}
+	blobPtr.SetRevision(revision)
 
 	// Also write the blob to redis
 	if blobPtr.IsRedisAllowed() {
@@ -104,7 +226,7 @@ func SetBlob(blobPtr storage_typedefs.IBlob, ctx context.Context) error {
 			// Fall-through
 		} else {
 			redisKey := getRedisKey(blobPtr.GetBlobName(), primaryKeyValues, blobPtr.GetVersion())
-			err = writeBlobToRedis(redisKey, blobPtr, ctx)
+			err = writeBlobToRedis(redisKey, blobPtr, redisExpiration, ctx)
 			if err != nil {
 				logger.LogError("error saving blob to redis" +
 					"|blob name=" + blobPtr.GetBlobName() +
@@ -112,13 +234,127 @@ func SetBlob(blobPtr storage_typedefs.IBlob, ctx context.Context) error {
 					"|error=" + err.Error())
 				// Fall-through
 			}
+			invalidateLocallyCachedBlob(blobPtr, redisKey, ctx)
 		}
 	}
 
 	return nil
 }
 
-/***** Private ******************************************************************/
+/**
+ * Reads the blob from memory (if the blob is cached in memory), or from redis. Returns false if it was in neither.
+ * Blobs cached as missing are returned as storage_typedefs.ErrBlobNotFound
+ */
+func readBlobFromCaches(outBlobPtr storage_typedefs.IBlob,
+	redisKey string,
+	primaryKeyValues []interface{},
+	ctx context.Context) (bool, error) {
+
+	useLocalCache := isLocalCacheEnabled(outBlobPtr)
+	var invalidationCount uint64
+	if useLocalCache {
+		var value string
+		var ok bool
+		value, ok, invalidationCount = getFromLocalCache(redisKey)
+		if ok {
+			atomic.AddUint64(&_blobCacheStats.LocalCacheHits, 1)
+			if value == kRedisBlobNotFoundValue {
+				return true, storage_typedefs.ErrBlobNotFound
+			}
+			err := decodeBlobFromRedis(value, outBlobPtr)
+			if err == nil {
+				return true, nil
+			}
+			logger.LogError("error deserializing blob from local cache" +
+				"|blob name=" + outBlobPtr.GetBlobName() +
+				"|primary key values=" + fmt.Sprintf("%#v", primaryKeyValues) +
+				"|error=" + err.Error())
+			// Fall-through
+		} else {
+			atomic.AddUint64(&_blobCacheStats.LocalCacheMisses, 1)
+		}
+	}
+
+	redisValue, redisOk := redis_adaptor.Read(redisKey, ctx)
+	if !redisOk {
+		atomic.AddUint64(&_blobCacheStats.RedisMisses, 1)
+		return false, nil
+	}
+	atomic.AddUint64(&_blobCacheStats.RedisHits, 1)
+
+	if redisValue == kRedisBlobNotFoundValue {
+		if useLocalCache {
+			putInLocalCache(redisKey, redisValue, outBlobPtr.GetCachePolicy().LocalCacheMaxAge, invalidationCount)
+		}
+		return true, storage_typedefs.ErrBlobNotFound
+	}
+
+	err := decodeBlobFromRedis(redisValue, outBlobPtr)
+	if err != nil {
+		logger.LogError("error deserializing blob from redis" +
+			"|blob name=" + outBlobPtr.GetBlobName() +
+			"|primary key values=" + fmt.Sprintf("%#v", primaryKeyValues) +
+			"|error=" + err.Error())
+		return false, nil
+	}
+
+	if useLocalCache {
+		putInLocalCache(redisKey, redisValue, outBlobPtr.GetCachePolicy().LocalCacheMaxAge, invalidationCount)
+	}
+	return true, nil
+}
+
+/**
+ * Reads the blob from the db and caches it in redis (redisKey is empty if the blob isn't cached in redis).
+ * Also returns the document as it was read, for coalesced reads to decode
+ */
+func readBlobFromDB(outBlobPtr storage_typedefs.IBlob,
+	dbSpace mongo_adaptor.DBSpace,
+	primaryKeyValues []interface{},
+	redisKey string,
+	ctx context.Context) (bson.Raw, mongo_adaptor.DataItemMetadata, error) {
+
+	raw, metadata, err := mongo_adaptor.GetRawDataItemWithMetadataByPrimaryKeys(dbSpace, outBlobPtr.GetBlobName(), outBlobPtr.GetPrimaryKeys(), primaryKeyValues, ctx)
+	if err == mongo_adaptor.ErrDataItemNotFound {
+		atomic.AddUint64(&_blobCacheStats.DBMisses, 1)
+		negativeTTL := outBlobPtr.GetCachePolicy().NegativeTTL
+		if redisKey != "" && negativeTTL > 0 {
+			// Only if nothing is cached yet, so as not to overwrite a blob that was written since it was read as missing
+			_, err = redis_adaptor.WriteIfNotExists(redisKey, kRedisBlobNotFoundValue, negativeTTL, ctx)
+			if err != nil {
+				logger.LogError("error saving blob miss to redis" +
+					"|blob name=" + outBlobPtr.GetBlobName() +
+					"|primary key values=" + fmt.Sprintf("%#v", primaryKeyValues) +
+					"|error=" + err.Error())
+				// Fall-through
+			}
+		}
+		return nil, metadata, storage_typedefs.ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, metadata, errors.New("error getting blob from db: " + err.Error())
+	}
+	atomic.AddUint64(&_blobCacheStats.DBHits, 1)
+
+	redisExpiration, err := decodeBlobFromDB(raw, metadata, outBlobPtr, primaryKeyValues, ctx)
+	if err != nil {
+		return nil, metadata, errors.New("error decoding blob from db: " + err.Error())
+	}
+
+	// Write the blob to redis for faster reads next time
+	if redisKey != "" && redisExpiration > 0 {
+		err = writeBlobToRedis(redisKey, outBlobPtr, redisExpiration, ctx)
+		if err != nil {
+			logger.LogError("error saving blob to redis" +
+				"|blob name=" + outBlobPtr.GetBlobName() +
+				"|primary key values=" + fmt.Sprintf("%#v", primaryKeyValues) +
+				"|error=" + err.Error())
+			// Fall-through
+		}
+	}
+
+	return raw, metadata, nil
+}
 
 func getDBSpaceFromStorageSpace(storageSpace storage_typedefs.StorageSpace) (mongo_adaptor.DBSpace, error) {
 	switch storageSpace {
@@ -155,13 +391,56 @@ func getRedisKey(blobName string, primaryKeyValues []interface{}, version int) s
 	return redisKey + ":" + strconv.Itoa(version)
 }
 
-func writeBlobToRedis(redisKey string, blobPtr storage_typedefs.IBlob, ctx context.Context) error {
-	bytes, err := json.Marshal(blobPtr)
+/**
+ * Decodes the blob read from the db, migrating it (and writing it back) if needed.
+ * Returns how long to cache the blob in redis for, or 0 if it shouldn't be cached
+ */
+func decodeBlobFromDB(raw bson.Raw,
+	metadata mongo_adaptor.DataItemMetadata,
+	outBlobPtr storage_typedefs.IBlob,
+	primaryKeyValues []interface{},
+	ctx context.Context) (time.Duration, error) {
+
+	migrated, err := decodeBlobDocument(raw, metadata.SchemaVersion, outBlobPtr)
+	if err != nil {
+		return 0, err
+	}
+	outBlobPtr.SetRevision(metadata.Revision)
+
+	// Expiring blobs are not written back, since writing them extends their expiry
+	if migrated && shouldWriteBackMigratedBlob(outBlobPtr.GetBlobName()) && outBlobPtr.GetTTL() == 0 {
+		err = SetBlobIfUnchanged(outBlobPtr, ctx)
+		if err == nil {
+			// Also wrote the blob to redis
+			return 0, nil
+		}
+		// Not a problem if another writer got there first. The blob is still migrated for this read, but isn't
+		// cached, since the db likely has a newer one
+		logger.LogWarning("error writing back migrated blob" +
+			"|blob name=" + outBlobPtr.GetBlobName() +
+			"|primary key values=" + fmt.Sprintf("%#v", primaryKeyValues) +
+			"|error=" + err.Error())
+		outBlobPtr.SetRevision(metadata.Revision)
+		return 0, nil
+	}
+
+	// Expire from redis together with the db
+	if !metadata.ExpiresAt.IsZero() {
+		return time.Until(metadata.ExpiresAt), nil
+	}
+	return redis_adaptor.EXPIRATION_DEFAULT, nil
+}
+
+/**
+ * Overwrites whatever is cached for the blob, including it being cached as missing
+ */
+func writeBlobToRedis(redisKey string, blobPtr storage_typedefs.IBlob, expiration time.Duration, ctx context.Context) error {
+	value, err := serializeBlobForRedis(blobPtr)
 	if err != nil {
-		return errors.New("error serializing blob: " + err.Error())
+		return err
 	}
 
-	err = redis_adaptor.Write(redisKey, string(bytes), redis_adaptor.EXPIRATION_DEFAULT, ctx)
+	err = redis_adaptor.Write(redisKey, value, getJitteredExpiration(expiration, blobPtr.GetCachePolicy().TTLJitter), ctx)
 	if err != nil {
 		return errors.New("error writing blob to redis: " + err.Error())
 	}
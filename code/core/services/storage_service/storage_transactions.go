@@ -0,0 +1,209 @@
+package storage_service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spacetimi/timi_shared_server/code/core/adaptors/mongo_adaptor"
+	"github.com/spacetimi/timi_shared_server/code/core/adaptors/redis_adaptor"
+	"github.com/spacetimi/timi_shared_server/code/core/services/storage_service/storage_typedefs"
+	"github.com/spacetimi/timi_shared_server/utils/logger"
+	"github.com/spacetimi/timi_shared_server/utils/reflection_utils"
+)
+
+/**
+ * Blob writes and deletes that are committed together: either all of them are applied, or none.
+ * Nothing is written until Commit. The blobs must all be in the same storage space, and the db must support
+ * transactions (see AreTransactionsSupported)
+ */
+type BlobTransaction struct {
+	ops []blobTransactionOp
+}
+
+func NewBlobTransaction() *BlobTransaction {
+	return &BlobTransaction{}
+}
+
+/**
+ * Whether blob transactions can be committed in the storage space. They need the db to be a replica set or a
+ * sharded cluster, and not a standalone server (as dev setups often are)
+ */
+func AreTransactionsSupported(storageSpace storage_typedefs.StorageSpace, ctx context.Context) (bool, error) {
+	dbSpace, err := getDBSpaceFromStorageSpace(storageSpace)
+	if err != nil {
+		return false, errors.New("error resolving db space: " + err.Error())
+	}
+
+	supported, err := mongo_adaptor.SupportsTransactions(dbSpace, ctx)
+	if err != nil {
+		return false, errors.New("error checking for transaction support: " + err.Error())
+	}
+	return supported, nil
+}
+
+/**
+ * Same as storage_service.SetBlob, when the transaction is committed
+ */
+func (tx *BlobTransaction) SetBlob(blobPtr storage_typedefs.IBlob) {
+	tx.ops = append(tx.ops, blobTransactionOp{blobPtr: blobPtr, expectedRevision: mongo_adaptor.AnyRevision})
+}
+
+/**
+ * Same as storage_service.SetBlobIfUnchanged, when the transaction is committed.
+ * A blob with revision 0 must not exist yet, so this is also how to create a blob only if it is new
+ */
+func (tx *BlobTransaction) SetBlobIfUnchanged(blobPtr storage_typedefs.IBlob) {
+	tx.ops = append(tx.ops, blobTransactionOp{blobPtr: blobPtr, expectedRevision: blobPtr.GetRevision()})
+}
+
+/**
+ * Same as storage_service.DeleteBlob, when the transaction is committed
+ */
+func (tx *BlobTransaction) DeleteBlob(blobPtr storage_typedefs.IBlob) {
+	tx.ops = append(tx.ops, blobTransactionOp{blobPtr: blobPtr, isDelete: true})
+}
+
+/**
+ * Applies the transaction's writes and deletes in a db transaction, retrying it on transient errors.
+ * Redis is only updated once the transaction is committed.
+ * Returns a *storage_typedefs.BlobConflictError if a SetBlobIfUnchanged blob was modified since it was read
+ * (or, for a new blob, already exists), in which case nothing was written.
+ * Returns storage_typedefs.ErrTransactionsNotSupported if the db doesn't support transactions
+ */
+func (tx *BlobTransaction) Commit(ctx context.Context) error {
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	var dbSpace mongo_adaptor.DBSpace
+	writes := make([]mongo_adaptor.TransactionWrite, len(tx.ops))
+	primaryKeyValuesList := make([][]interface{}, len(tx.ops))
+
+	for i, op := range tx.ops {
+		if op.blobPtr == nil {
+			return errors.New("blob ptr is nil")
+		}
+
+		opDBSpace, err := getDBSpaceFromStorageSpace(op.blobPtr.GetStorageSpace())
+		if err != nil {
+			return errors.New("error resolving db space: " + err.Error())
+		}
+		if i == 0 {
+			dbSpace = opDBSpace
+		} else if opDBSpace != dbSpace {
+			return errors.New("blobs in a transaction must be in the same storage space")
+		}
+
+		primaryKeyValuesList[i], err = reflection_utils.GetFieldValuesFromStructPtr(op.blobPtr, op.blobPtr.GetPrimaryKeys())
+		if err != nil {
+			return errors.New("error getting primary key values from blob: " + err.Error())
+		}
+
+		writes[i] = mongo_adaptor.TransactionWrite{
+			CollectionName:   op.blobPtr.GetBlobName(),
+			PrimaryKeys:      op.blobPtr.GetPrimaryKeys(),
+			PrimaryKeyValues: primaryKeyValuesList[i],
+		}
+		if op.isDelete {
+			continue
+		}
+
+		// Indexes can't be created inside the transaction
+		ensureBlobIndexes(op.blobPtr, dbSpace, ctx)
+
+		writes[i].DataItemPtr = op.blobPtr
+		writes[i].ExpectedRevision = op.expectedRevision
+		writes[i].SchemaVersion = op.blobPtr.GetVersion()
+		if op.blobPtr.GetTTL() > 0 {
+			writes[i].ExpiresAt = time.Now().Add(op.blobPtr.GetTTL())
+		}
+	}
+
+	revisions, failedWriteIndex, err := mongo_adaptor.RunWritesInTransaction(dbSpace, writes, ctx)
+	if err == mongo_adaptor.ErrTransactionsNotSupported {
+		return storage_typedefs.ErrTransactionsNotSupported
+	}
+	if err == mongo_adaptor.ErrRevisionMismatch {
+		op := tx.ops[failedWriteIndex]
+		// The blob in redis is likely the stale one that was read, so evict it for a retry to read the latest from the db
+		tx.evictFromRedis(failedWriteIndex, primaryKeyValuesList[failedWriteIndex], ctx)
+		return &storage_typedefs.BlobConflictError{
+			BlobName:         op.blobPtr.GetBlobName(),
+			PrimaryKeyValues: primaryKeyValuesList[failedWriteIndex],
+			ExpectedRevision: op.expectedRevision,
+		}
+	}
+	if err != nil {
+		// The commit's outcome can be unknown (eg: the connection dropped while committing), so don't leave
+		// possibly stale blobs in redis
+		for i := range tx.ops {
+			tx.evictFromRedis(i, primaryKeyValuesList[i], ctx)
+		}
+		return errors.New("error committing blob transaction: " + err.Error())
+	}
+
+	// Committed. Update redis the same way SetBlob and DeleteBlob do
+	var evictionErr error
+	for i, op := range tx.ops {
+		if op.isDelete {
+			if !tx.evictFromRedis(i, primaryKeyValuesList[i], ctx) {
+				evictionErr = errors.New("transaction committed, but error evicting deleted blob from redis")
+			}
+			continue
+		}
+
+		op.blobPtr.SetRevision(revisions[i])
+		if !op.blobPtr.IsRedisAllowed() {
+			continue
+		}
+
+		redisExpiration := redis_adaptor.EXPIRATION_DEFAULT
+		if op.blobPtr.GetTTL() > 0 {
+			redisExpiration = op.blobPtr.GetTTL()
+		}
+		redisKey := getRedisKey(op.blobPtr.GetBlobName(), primaryKeyValuesList[i], op.blobPtr.GetVersion())
+		err = writeBlobToRedis(redisKey, op.blobPtr, redisExpiration, ctx)
+		if err != nil {
+			logger.LogError("error saving blob to redis" +
+				"|blob name=" + op.blobPtr.GetBlobName() +
+				"|primary key values=" + fmt.Sprintf("%#v", primaryKeyValuesList[i]) +
+				"|error=" + err.Error())
+			// Fall-through
+		}
+		invalidateLocallyCachedBlob(op.blobPtr, redisKey, ctx)
+	}
+
+	return evictionErr
+}
+
+/***** Private ******************************************************************/
+
+type blobTransactionOp struct {
+	blobPtr          storage_typedefs.IBlob
+	expectedRevision int64
+	isDelete         bool
+}
+
+/**
+ * Returns false if the blob could not be evicted
+ */
+func (tx *BlobTransaction) evictFromRedis(opIndex int, primaryKeyValues []interface{}, ctx context.Context) bool {
+	blobPtr := tx.ops[opIndex].blobPtr
+	if !blobPtr.IsRedisAllowed() {
+		return true
+	}
+
+	redisKey := getRedisKey(blobPtr.GetBlobName(), primaryKeyValues, blobPtr.GetVersion())
+	err := redis_adaptor.Delete(redisKey, ctx)
+	invalidateLocallyCachedBlob(blobPtr, redisKey, ctx)
+	if err != nil {
+		logger.LogError("error evicting blob from redis" +
+			"|blob name=" + blobPtr.GetBlobName() +
+			"|primary key values=" + fmt.Sprintf("%#v", primaryKeyValues) +
+			"|error=" + err.Error())
+		return false
+	}
+	return true
+}
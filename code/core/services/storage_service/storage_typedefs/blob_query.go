@@ -0,0 +1,63 @@
+package storage_typedefs
+
+import "strings"
+
+/**
+ * A secondary index on a blob's fields. storage_service creates it in the db the first time the blob is written
+ * or queried, or when the blob's indexes are ensured (see storage_service.EnsureBlobIndexes)
+ */
+type BlobIndex struct {
+	Fields []string // In order, for compound indexes. Prefix a field with "-" to index it in descending order
+	Unique bool
+
+	// For indexes on string fields: leaves out blobs with an empty string in any of the fields.
+	// Eg: for a unique index on email addresses, with users that have no email address
+	IgnoreEmptyStrings bool
+}
+
+/**
+ * The name of the index in the db. The same as mongo's default name for an index on the fields
+ */
+func (bi *BlobIndex) GetName() string {
+	var parts []string
+	for _, field := range bi.Fields {
+		if strings.HasPrefix(field, "-") {
+			parts = append(parts, strings.TrimPrefix(field, "-")+"_-1")
+		} else {
+			parts = append(parts, field+"_1")
+		}
+	}
+	return strings.Join(parts, "_")
+}
+
+type BlobFilterOp string
+
+const (
+	BLOB_FILTER_EQ  BlobFilterOp = "$eq"
+	BLOB_FILTER_NE  BlobFilterOp = "$ne"
+	BLOB_FILTER_LT  BlobFilterOp = "$lt"
+	BLOB_FILTER_LTE BlobFilterOp = "$lte"
+	BLOB_FILTER_GT  BlobFilterOp = "$gt"
+	BLOB_FILTER_GTE BlobFilterOp = "$gte"
+	BLOB_FILTER_IN  BlobFilterOp = "$in" // Value is a slice
+)
+
+type BlobFilter struct {
+	Field string
+	Op    BlobFilterOp
+	Value interface{}
+}
+
+type BlobQuery struct {
+	Filters []BlobFilter // All of them have to match
+
+	// Prefix a field with "-" to sort in descending order. The primary keys are always added at the end,
+	// so that the order (and so the pagination) is stable. Sort fields should be set on every blob
+	SortBy []string
+
+	Limit  int    // Blobs per page. Defaults to DefaultBlobQueryLimit, and is capped at MaxBlobQueryLimit
+	Cursor string // NextCursor of the previous page. Empty for the first page
+}
+
+const DefaultBlobQueryLimit = 100
+const MaxBlobQueryLimit = 1000
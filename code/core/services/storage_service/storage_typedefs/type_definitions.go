@@ -1,5 +1,11 @@
 package storage_typedefs
 
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
 type StorageSpace int
 
 const (
@@ -11,8 +17,96 @@ type IBlob interface {
 	GetStorageSpace() StorageSpace
 	GetBlobName() string
 	GetPrimaryKeys() []string
-	GetVersion() int
+	GetVersion() int // Schema version. Stored blobs at older versions are migrated on read (see storage_service.RegisterBlobMigrations)
 	IsRedisAllowed() bool
+	GetTTL() time.Duration // Zero if the blob does not expire
+	GetIndexes() []BlobIndex
+	GetCachePolicy() BlobCachePolicy
+
+	// The stored revision the blob was read at (or last written as). Managed by storage_service
+	GetRevision() int64
+	SetRevision(revision int64)
+}
+
+/**
+ * Returned by storage_service.GetBlobByPrimaryKeys (and per blob by GetBlobsByPrimaryKeys) for blobs that don't exist
+ */
+var ErrBlobNotFound = errors.New("blob not found")
+
+/**
+ * Returned by storage_service.BlobTransaction.Commit when the db is a standalone server, in which case nothing
+ * was written (see storage_service.AreTransactionsSupported)
+ */
+var ErrTransactionsNotSupported = errors.New("transactions are not supported by the db")
+
+/**
+ * Returned by storage_service.SetBlobIfUnchanged when the stored blob was modified since it was read
+ */
+type BlobConflictError struct {
+	BlobName         string
+	PrimaryKeyValues []interface{}
+	ExpectedRevision int64
+}
+
+func (bce *BlobConflictError) Error() string {
+	return fmt.Sprintf("blob %s %v was modified since it was read at revision %d",
+		bce.BlobName, bce.PrimaryKeyValues, bce.ExpectedRevision)
+}
+
+/**
+ * How storage_service caches a blob in redis
+ */
+type BlobCachePolicy struct {
+	// Concurrent GetBlobByPrimaryKeys calls for the same blob that miss redis share a single db read,
+	// instead of all of them hitting the db at once when a hot blob expires from redis
+	CoalesceReads bool
+
+	// How long redis remembers that a blob doesn't exist, so that repeated reads of a missing blob (eg: username
+	// availability checks) don't all go to the db. Zero to not cache misses.
+	// Setting the blob through storage_service replaces the cached miss
+	NegativeTTL time.Duration
+
+	// Redis expirations are shortened by a random fraction of up to this much (eg: 0.1 for up to 10%), so that
+	// blobs cached at the same time don't all expire at the same time
+	TTLJitter float64
+
+	// Also caches the blob in each server's memory (in front of redis) for up to this long. Zero to not cache it
+	// in memory. Only for blobs allowed in redis, since servers tell each other to drop blobs that were set or
+	// deleted through redis. If that message is lost (eg: redis was unreachable), a server can return the old
+	// blob for up to this long. Expiring blobs can likewise be returned for up to this long past their expiry
+	LocalCacheMaxAge time.Duration
+
+	// How the blob is encoded in redis. Empty for BLOB_CODEC_JSON
+	Codec BlobCodec
+
+	// Encoded blobs larger than this are compressed in redis. Zero to not compress
+	CompressAboveBytes int
+}
+
+var DefaultBlobCachePolicy = BlobCachePolicy{
+	CoalesceReads: true,
+	TTLJitter:     0.1,
+	Codec:         BLOB_CODEC_JSON,
+}
+
+/**
+ * Names a blob encoding for redis. Besides the built-in ones, apps can register their own
+ * with storage_service.RegisterBlobCodec
+ */
+type BlobCodec string
+
+const (
+	BLOB_CODEC_JSON    BlobCodec = "json"
+	BLOB_CODEC_BSON    BlobCodec = "bson"    // Same document as the blob is stored as in the db
+	BLOB_CODEC_MSGPACK BlobCodec = "msgpack" // Compact, keyed by field name (or msgpack tag)
+)
+
+/**
+ * Encodes and decodes blobs for redis. Only the blob's own fields: storage_service stores the revision separately
+ */
+type IBlobCodec interface {
+	Encode(blobPtr IBlob) ([]byte, error)
+	Decode(data []byte, outBlobPtr IBlob) error
 }
 
 /***** Concrete Types ***********************************************************/
@@ -23,6 +117,10 @@ type BlobDescriptor struct { // Implements IBlob
 	primaryKeys    []string
 	version        int
 	isRedisAllowed bool
+	ttl            time.Duration
+	indexes        []BlobIndex
+	cachePolicy    BlobCachePolicy
+	revision       int64
 }
 
 func NewBlobDescriptor(space StorageSpace, blobName string, primaryKeys []string, version int, isRedisAllowed bool) BlobDescriptor {
@@ -30,11 +128,41 @@ func NewBlobDescriptor(space StorageSpace, blobName string, primaryKeys []string
 		space:          space,
 		blobName:       blobName,
 		primaryKeys:    primaryKeys,
+		version:        version,
 		isRedisAllowed: isRedisAllowed,
+		cachePolicy:    DefaultBlobCachePolicy,
 	}
 	return bd
 }
 
+/**
+ * For session-like and temporary blobs (tokens, daily challenges, ...).
+ * The blob is removed from both the db and redis ttl after it was last set
+ */
+func NewExpiringBlobDescriptor(space StorageSpace, blobName string, primaryKeys []string, version int, isRedisAllowed bool, ttl time.Duration) BlobDescriptor {
+	bd := NewBlobDescriptor(space, blobName, primaryKeys, version, isRedisAllowed)
+	bd.ttl = ttl
+	return bd
+}
+
+/**
+ * Declares secondary indexes for the blob, for storage_service.QueryBlobs. Eg:
+ *   NewBlobDescriptor(...).WithIndexes(BlobIndex{Fields: []string{"UserName"}, Unique: true})
+ */
+func (bd BlobDescriptor) WithIndexes(indexes ...BlobIndex) BlobDescriptor {
+	bd.indexes = append(bd.indexes[:len(bd.indexes):len(bd.indexes)], indexes...)
+	return bd
+}
+
+/**
+ * Replaces the default cache policy (DefaultBlobCachePolicy) of the blob. Eg:
+ *   NewBlobDescriptor(...).WithCachePolicy(BlobCachePolicy{CoalesceReads: true, NegativeTTL: 30 * time.Second})
+ */
+func (bd BlobDescriptor) WithCachePolicy(cachePolicy BlobCachePolicy) BlobDescriptor {
+	bd.cachePolicy = cachePolicy
+	return bd
+}
+
 func (bd *BlobDescriptor) GetStorageSpace() StorageSpace {
 	return bd.space
 }
@@ -54,3 +182,23 @@ func (bd *BlobDescriptor) GetVersion() int {
 func (bd *BlobDescriptor) IsRedisAllowed() bool {
 	return bd.isRedisAllowed
 }
+
+func (bd *BlobDescriptor) GetTTL() time.Duration {
+	return bd.ttl
+}
+
+func (bd *BlobDescriptor) GetIndexes() []BlobIndex {
+	return bd.indexes
+}
+
+func (bd *BlobDescriptor) GetCachePolicy() BlobCachePolicy {
+	return bd.cachePolicy
+}
+
+func (bd *BlobDescriptor) GetRevision() int64 {
+	return bd.revision
+}
+
+func (bd *BlobDescriptor) SetRevision(revision int64) {
+	bd.revision = revision
+}
@@ -1,14 +1,18 @@
 package shared_init
 
 import (
+	"context"
 	"strings"
 
 	"github.com/spacetimi/timi_shared_server/code/config"
 	"github.com/spacetimi/timi_shared_server/code/core/adaptors/mongo_adaptor"
 	"github.com/spacetimi/timi_shared_server/code/core/adaptors/redis_adaptor"
 	"github.com/spacetimi/timi_shared_server/code/core/services/identity_service"
+	"github.com/spacetimi/timi_shared_server/code/core/services/localization_service"
 	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service"
+	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_experiments"
 	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_factory"
+	"github.com/spacetimi/timi_shared_server/code/core/services/storage_service"
 	"github.com/spacetimi/timi_shared_server/utils/logger"
 )
 
@@ -35,8 +39,38 @@ func SharedInit(appInitializer IAppInitializer) {
 	if err != nil {
 		logger.LogFatal("error during app init|error=" + err.Error())
 	}
+	// Apps register their blobs during App init
+	ensureRequiredBlobIndexes()
+	if reqdServices.EnsureBlobIndexesOnStartup {
+		go ensureBlobIndexes()
+	}
+}
+
+/**
+ * For command line tools that work with an app's services (eg: metadata scripts):
+ * initializes the app's required services, without the background work of a running server, and without App init
+ */
+func ScriptInit(appName string) {
+	isScript = true
+
+	config.Initialize(appName)
+
+	var reqdServices RequiredServicesConfig
+	reqdServicesFilePath := config.GetAppConfigFilesPath() + "/services/required_services.json"
+	err := config.ReadConfigFile(reqdServicesFilePath, &reqdServices)
+	if err != nil {
+		logger.LogFatal("error reading required-services config" +
+			"|file path=" + reqdServicesFilePath +
+			"|error=" + err.Error())
+		return
+	}
+	for _, serviceName := range reqdServices.Services {
+		initializeService(serviceName)
+	}
 }
 
+var isScript bool
+
 func initializeService(serviceName string) {
 	logger.LogInfo("initializing service|service name=" + serviceName)
 
@@ -53,13 +87,23 @@ func initializeService(serviceName string) {
 		redis_adaptor.Initialize(configObject)
 
 	case "metadata_service":
-		metadata_service.Initialize()
+		if isScript {
+			metadata_service.InitializeForScript()
+		} else {
+			metadata_service.Initialize()
+		}
 		metadata_factory.Initialize()
 		registerMetadataFactories()
 
 	case "identity_service":
 		identity_service.Initialize()
 
+	case "localization_service":
+		// Needs metadata_service to be initialized first
+		configObject := localization_service.Config{}
+		readConfigForService(serviceName, &configObject)
+		localization_service.Initialize(&configObject)
+
 	default:
 		logger.LogError("attempting to initialize unknown service" +
 			"|service name=" + serviceName)
@@ -79,7 +123,64 @@ func readConfigForService(serviceName string, configObject config.IConfig) {
 	}
 }
 
+/**
+ * Blobs can't be created only if they are new without these indexes (see storage_service.EnsureRequiredBlobIndexes),
+ * so servers wait for them before serving
+ */
+func ensureRequiredBlobIndexes() {
+	reports, err := storage_service.EnsureRequiredBlobIndexes(context.Background())
+	if err != nil {
+		logger.LogError("error ensuring required blob indexes|error=" + err.Error())
+	}
+	for _, report := range reports {
+		for _, created := range report.Created {
+			logger.LogInfo("created blob index" +
+				"|blob name=" + report.BlobName +
+				"|index=" + created)
+		}
+		for _, reportError := range report.Errors {
+			logger.LogError("error creating required blob index. creating blobs only if they are new will fail until it is fixed" +
+				"|blob name=" + report.BlobName +
+				"|error=" + reportError)
+		}
+		if len(report.Mismatched) > 0 {
+			logger.LogError("blob indexes differ from the declared indexes" +
+				"|blob name=" + report.BlobName +
+				"|mismatched=" + strings.Join(report.Mismatched, "; "))
+		}
+	}
+}
+
+/**
+ * Runs in the background, since building indexes on large collections can take a while.
+ * Blobs create their secondary indexes lazily when they are used, so serving doesn't need to wait for this
+ */
+func ensureBlobIndexes() {
+	reports, err := storage_service.EnsureAllBlobIndexes(false, context.Background())
+	if err != nil {
+		logger.LogError("error ensuring blob indexes|error=" + err.Error())
+	}
+	for _, report := range reports {
+		for _, created := range report.Created {
+			logger.LogInfo("created blob index" +
+				"|blob name=" + report.BlobName +
+				"|index=" + created)
+		}
+		for _, reportError := range report.Errors {
+			logger.LogError("error creating blob index" +
+				"|blob name=" + report.BlobName +
+				"|error=" + reportError)
+		}
+		if len(report.Mismatched) > 0 || len(report.Undeclared) > 0 {
+			logger.LogWarning("blob indexes differ from the declared indexes" +
+				"|blob name=" + report.BlobName +
+				"|mismatched=" + strings.Join(report.Mismatched, "; ") +
+				"|undeclared=" + strings.Join(report.Undeclared, ", "))
+		}
+	}
+}
+
 // TODO: Avi: Move this somewhere else?
 func registerMetadataFactories() {
-	// Nothing yet
+	metadata_factory.RegisterFactory(metadata_experiments.ExperimentsMetadataKey, metadata_experiments.ExperimentsMetadataFactory{})
 }
@@ -7,6 +7,10 @@ type IAppInitializer interface {
 
 type RequiredServicesConfig struct {
 	Services []string
+
+	// Creates all the missing indexes of registered blobs after App init, and logs index drift (see storage_service.EnsureAllBlobIndexes).
+	// The indexes that storage_service relies on are always created (see storage_service.EnsureRequiredBlobIndexes)
+	EnsureBlobIndexesOnStartup bool
 }
 
 func (rsc *RequiredServicesConfig) OnConfigLoaded() {
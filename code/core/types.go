@@ -2,46 +2,99 @@ package core
 
 import (
 	"errors"
+	"regexp"
 	"strconv"
 	"strings"
 )
 
+/**
+ * Semantic version (https://semver.org) of an app / of metadata.
+ * Minor and patch versions are optional when parsing, so "1", "1.2", "1.2.0" and "1.2.0-beta.1+456" are all valid.
+ * Versions with no patch version, pre-release or build metadata are written as "Major.Minor"
+ * to stay compatible with existing "1.2" style version strings
+ */
 type AppVersion struct {
-	MajorVersion int64
-	MinorVersion int64
+	MajorVersion  int64
+	MinorVersion  int64
+	PatchVersion  int64
+	PreRelease    string // Dot-separated identifiers, eg: "beta.1"
+	BuildMetadata string // Dot-separated identifiers, eg: "456". Ignored when comparing versions
 }
 
+/**
+ * Unanchored pattern matching a version string. Use this when matching versions inside urls / routes
+ */
+const AppVersionRegexPattern = `[0-9]+(?:\.[0-9]+){0,2}(?:-[0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*)?(?:\+[0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*)?`
+
+var kAppVersionRegex = regexp.MustCompile(`^([0-9]+)(?:\.([0-9]+))?(?:\.([0-9]+))?(?:-([0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*))?(?:\+([0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*))?$`)
+
+// Pre-release identifiers made of digits are numeric, and can't have leading zeros. Others (eg: "-1", "rc1") are alphanumeric
+var kNumericPreReleaseIdentifierRegex = regexp.MustCompile(`^(0|[1-9][0-9]*)$`)
+var kDigitsRegex = regexp.MustCompile(`^[0-9]+$`)
+
 func (a *AppVersion)String() string {
-	return strconv.FormatInt(a.MajorVersion, 10) + "." + strconv.FormatInt(a.MinorVersion, 10)
+	s := strconv.FormatInt(a.MajorVersion, 10) + "." + strconv.FormatInt(a.MinorVersion, 10)
+	if a.PatchVersion != 0 || a.PreRelease != "" {
+		s += "." + strconv.FormatInt(a.PatchVersion, 10)
+	}
+	if a.PreRelease != "" {
+		s += "-" + a.PreRelease
+	}
+	if a.BuildMetadata != "" {
+		s += "+" + a.BuildMetadata
+	}
+	return s
 }
 
 func GetAppVersionFromString(s string) (*AppVersion, error) {
-	tokens := strings.Split(s, ".")
-	numTokens := len(tokens)
-
-	if numTokens < 1 || numTokens > 2 {
+	matches := kAppVersionRegex.FindStringSubmatch(strings.TrimSpace(s))
+	if matches == nil {
 		return nil, errors.New("malformed app version string")
 	}
 
-	majorVersion, err := strconv.ParseInt(tokens[0], 10, 64)
+	majorVersion, err := strconv.ParseInt(matches[1], 10, 64)
 	if err != nil {
 		return nil, errors.New("error parsing major version: " + err.Error())
 	}
 
 	minorVersion := int64(0)
-	if numTokens > 1 {
-		minorVersion, err = strconv.ParseInt(tokens[1], 10, 64)
+	if matches[2] != "" {
+		minorVersion, err = strconv.ParseInt(matches[2], 10, 64)
 		if err != nil {
 			return nil, errors.New("error parsing minor version: " + err.Error())
 		}
 	}
 
-	return &AppVersion{MajorVersion: majorVersion, MinorVersion: minorVersion}, nil
+	patchVersion := int64(0)
+	if matches[3] != "" {
+		patchVersion, err = strconv.ParseInt(matches[3], 10, 64)
+		if err != nil {
+			return nil, errors.New("error parsing patch version: " + err.Error())
+		}
+	}
+
+	if matches[4] != "" {
+		for _, identifier := range strings.Split(matches[4], ".") {
+			if kDigitsRegex.MatchString(identifier) && !kNumericPreReleaseIdentifierRegex.MatchString(identifier) {
+				return nil, errors.New("numeric pre-release identifier with leading zeros: " + identifier)
+			}
+		}
+	}
+
+	return &AppVersion{
+		MajorVersion:  majorVersion,
+		MinorVersion:  minorVersion,
+		PatchVersion:  patchVersion,
+		PreRelease:    matches[4],
+		BuildMetadata: matches[5],
+	}, nil
 }
 
+/**
+ * Versions are equal if they have the same precedence (build metadata is ignored)
+ */
 func (a *AppVersion)Equals(b *AppVersion) bool {
-	return a.MajorVersion == b.MajorVersion &&
-		   a.MinorVersion == b.MinorVersion
+	return a.Compare(b) == 0
 }
 
 func (a *AppVersion)Compare(b *AppVersion) int {
@@ -63,5 +116,75 @@ func (a *AppVersion)Compare(b *AppVersion) int {
 
 	// Major and Minor versions are equal
 
+	if a.PatchVersion < b.PatchVersion {
+		return -1
+	}
+	if a.PatchVersion > b.PatchVersion {
+		return 1
+	}
+
+	// Major, Minor and Patch versions are equal
+
+	return comparePreReleases(a.PreRelease, b.PreRelease)
+}
+
+/**
+ * A version without a pre-release has higher precedence than one with a pre-release.
+ * Otherwise pre-release identifiers are compared left to right:
+ * numeric identifiers numerically, alphanumeric identifiers lexically, and numeric ones lower than alphanumeric ones.
+ * If all identifiers are equal, the longer pre-release has higher precedence
+ */
+func comparePreReleases(a string, b string) int {
+	if a == b {
+		return 0
+	}
+	if a == "" {
+		return 1
+	}
+	if b == "" {
+		return -1
+	}
+
+	aIdentifiers := strings.Split(a, ".")
+	bIdentifiers := strings.Split(b, ".")
+	for i := 0; i < len(aIdentifiers) && i < len(bIdentifiers); i++ {
+		aIsNumeric := kNumericPreReleaseIdentifierRegex.MatchString(aIdentifiers[i])
+		bIsNumeric := kNumericPreReleaseIdentifierRegex.MatchString(bIdentifiers[i])
+
+		switch {
+		case aIsNumeric && bIsNumeric:
+			// Without leading zeros, the longer number is the larger one. This also works past int64
+			if len(aIdentifiers[i]) != len(bIdentifiers[i]) {
+				if len(aIdentifiers[i]) < len(bIdentifiers[i]) {
+					return -1
+				}
+				return 1
+			}
+			if aIdentifiers[i] < bIdentifiers[i] {
+				return -1
+			}
+			if aIdentifiers[i] > bIdentifiers[i] {
+				return 1
+			}
+		case aIsNumeric:
+			return -1
+		case bIsNumeric:
+			return 1
+		default:
+			if aIdentifiers[i] < bIdentifiers[i] {
+				return -1
+			}
+			if aIdentifiers[i] > bIdentifiers[i] {
+				return 1
+			}
+		}
+	}
+
+	if len(aIdentifiers) < len(bIdentifiers) {
+		return -1
+	}
+	if len(aIdentifiers) > len(bIdentifiers) {
+		return 1
+	}
 	return 0
 }
@@ -0,0 +1,107 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestGetAppVersionFromString(t *testing.T) {
+	testCases := []struct {
+		versionString string
+		want          AppVersion
+		wantString    string
+	}{
+		{"1", AppVersion{MajorVersion: 1}, "1.0"},
+		{"1.2", AppVersion{MajorVersion: 1, MinorVersion: 2}, "1.2"},
+		{"1.2.0", AppVersion{MajorVersion: 1, MinorVersion: 2}, "1.2"},
+		{"1.2.3", AppVersion{MajorVersion: 1, MinorVersion: 2, PatchVersion: 3}, "1.2.3"},
+		{" 1.2.3 ", AppVersion{MajorVersion: 1, MinorVersion: 2, PatchVersion: 3}, "1.2.3"},
+		{"1.2.0-beta.1", AppVersion{MajorVersion: 1, MinorVersion: 2, PreRelease: "beta.1"}, "1.2.0-beta.1"},
+		{"1.2.3+456", AppVersion{MajorVersion: 1, MinorVersion: 2, PatchVersion: 3, BuildMetadata: "456"}, "1.2.3+456"},
+		{"1.2-rc.1+exp.sha.5114f85", AppVersion{MajorVersion: 1, MinorVersion: 2, PreRelease: "rc.1", BuildMetadata: "exp.sha.5114f85"}, "1.2.0-rc.1+exp.sha.5114f85"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.versionString, func(t *testing.T) {
+			version, err := GetAppVersionFromString(testCase.versionString)
+			if err != nil {
+				t.Fatalf("parsing: %v", err)
+			}
+			if *version != testCase.want {
+				t.Errorf("parsed %+v, want %+v", *version, testCase.want)
+			}
+			if version.String() != testCase.wantString {
+				t.Errorf("String() = %q, want %q", version.String(), testCase.wantString)
+			}
+		})
+	}
+}
+
+func TestGetAppVersionFromStringMalformed(t *testing.T) {
+	for _, versionString := range []string{"", "v1.2", "1.", "1.2.3.4", "1.2-", "1.2+", "1.2-beta..1", "a.b", "1.0.0-01", "1.0.0-beta.007"} {
+		t.Run(versionString, func(t *testing.T) {
+			_, err := GetAppVersionFromString(versionString)
+			if err == nil {
+				t.Errorf("parsed malformed version %q", versionString)
+			}
+		})
+	}
+}
+
+func TestAppVersionCompare(t *testing.T) {
+	testCases := []struct {
+		a    string
+		b    string
+		want int
+	}{
+		{"1.2", "1.2.0", 0},
+		{"1.2.3", "1.2.3+456", 0},
+		{"1.2.3+123", "1.2.3+456", 0},
+		{"1", "2", -1},
+		{"2", "1.9.9", 1},
+		{"1.2", "1.10", -1},
+		{"1.2.3", "1.2.4", -1},
+		{"1.2.10", "1.2.9", 1},
+
+		// Pre-release ordering, from https://semver.org/#spec-item-11
+		{"1.0.0-alpha", "1.0.0", -1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-alpha.1", "1.0.0-alpha.beta", -1},
+		{"1.0.0-alpha.beta", "1.0.0-beta", -1},
+		{"1.0.0-beta", "1.0.0-beta.2", -1},
+		{"1.0.0-beta.2", "1.0.0-beta.11", -1},
+		{"1.0.0-beta.11", "1.0.0-rc.1", -1},
+		{"1.0.0-rc.1", "1.0.0", -1},
+		{"1.0.0-rc.1", "1.0.0-rc.1+456", 0},
+		{"1.0.1-alpha", "1.0.0", 1},
+
+		// Identifiers that aren't plain digits without leading zeros are alphanumeric, and sort after numeric ones
+		{"1.0.0-0", "1.0.0-1", -1},
+		{"1.0.0-1", "1.0.0--1", -1},
+		{"1.0.0-alpha.9", "1.0.0-alpha.-1", -1},
+		{"1.0.0-rc.2", "1.0.0-rc.10", -1},
+		{"1.0.0-99999999999999999999", "1.0.0-100000000000000000000", -1},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.a+" vs "+testCase.b, func(t *testing.T) {
+			a, err := GetAppVersionFromString(testCase.a)
+			if err != nil {
+				t.Fatalf("parsing %q: %v", testCase.a, err)
+			}
+			b, err := GetAppVersionFromString(testCase.b)
+			if err != nil {
+				t.Fatalf("parsing %q: %v", testCase.b, err)
+			}
+
+			if got := a.Compare(b); got != testCase.want {
+				t.Errorf("%s.Compare(%s) = %d, want %d", testCase.a, testCase.b, got, testCase.want)
+			}
+			if got := b.Compare(a); got != -testCase.want {
+				t.Errorf("%s.Compare(%s) = %d, want %d", testCase.b, testCase.a, got, -testCase.want)
+			}
+			if a.Equals(b) != (testCase.want == 0) {
+				t.Errorf("%s.Equals(%s) = %v", testCase.a, testCase.b, a.Equals(b))
+			}
+		})
+	}
+}
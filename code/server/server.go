@@ -10,6 +10,7 @@ import (
 	"github.com/spacetimi/timi_shared_server/code/config"
 	"github.com/spacetimi/timi_shared_server/code/controllers/admin"
 	"github.com/spacetimi/timi_shared_server/code/controllers/login"
+	"github.com/spacetimi/timi_shared_server/code/controllers/metadata_sync"
 	"github.com/spacetimi/timi_shared_server/code/controllers/server_status"
 	"github.com/spacetimi/timi_shared_server/code/core/controller"
 	"github.com/spacetimi/timi_shared_server/utils/logger"
@@ -32,6 +33,7 @@ func StartServer(appController controller.IAppController) {
 	registerController(appController)
 	registerController(&server_status.ServerStatusController{})
 	registerController(&login.LoginController{})
+	registerController(&metadata_sync.MetadataSyncController{})
 
 	// Admin server
 	_router.PathPrefix("/admin").HandlerFunc(admin.AdminController).Methods("GET", "POST")
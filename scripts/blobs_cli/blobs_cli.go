@@ -0,0 +1,201 @@
+package blobs_cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/spacetimi/timi_shared_server/code/core/services/storage_service"
+	"github.com/spacetimi/timi_shared_server/code/core/shared_init"
+	"github.com/spacetimi/timi_shared_server/utils/logger"
+)
+
+/**
+ * Command line batch migration of stored blobs to their current schema versions (see storage_service.MigrateBlobs),
+ * and management of the blobs' db indexes (see storage_service.EnsureBlobIndexes).
+ * Prints a single json object (CommandResult) to stdout. Logs go to stderr.
+ * Exits with 1 if the command failed.
+ *
+ * The tool only knows about registered blobs. Apps should wrap it in their own main, passing a function that
+ * registers the app's blobs and blob migrations
+ */
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "!! Usage: timi_blobs -app=APP_NAME [-env=ENVIRONMENT] [-appdir=<path to your app's code>] [-shareddir=<path to shared code>] COMMAND [ARGS]")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  list")
+	fmt.Fprintln(os.Stderr, "  migrate [-dry-run] BLOB_NAME")
+	fmt.Fprintln(os.Stderr, "  migrate-all [-dry-run]")
+	fmt.Fprintln(os.Stderr, "  indexes [-dry-run] [BLOB_NAME]")
+	flag.PrintDefaults()
+}
+
+/**
+ * Printed to stdout as json once the command is done
+ */
+type CommandResult struct {
+	Command string
+	Ok      bool
+	Error   string `json:",omitempty"`
+
+	BlobNames  []string                               `json:",omitempty"`
+	Migrations []*storage_service.BlobMigrationResult `json:",omitempty"`
+	Indexes    []*storage_service.BlobIndexReport     `json:",omitempty"`
+	HasDrift   bool                                   `json:",omitempty"`
+}
+
+/**
+ * registerAppBlobs can be nil. It is called after the required services are initialized
+ */
+func Main(registerAppBlobs func()) {
+
+	appPtr := flag.String("app", "", "Name of a valid spacetimi app")
+	appDirPtr := flag.String("appdir", "", "Path to your app's code. Defaults to the app's directory in GOPATH")
+	sharedDirPtr := flag.String("shareddir", "", "Path to shared code. Defaults to the shared code's directory in GOPATH")
+	envPtr := flag.String("env", "", "Local, Test, Staging, Production. Defaults to Local")
+
+	flag.Usage = usage
+	flag.Parse()
+
+	if len(*appPtr) == 0 || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Keep stdout for the result
+	logger.SetOutput(os.Stderr)
+
+	setEnvIfNotEmpty("app_dir_path", *appDirPtr)
+	setEnvIfNotEmpty("shared_dir_path", *sharedDirPtr)
+	setEnvIfNotEmpty("app_environment", *envPtr)
+
+	commandName := flag.Arg(0)
+	result := &CommandResult{
+		Command: commandName,
+	}
+
+	func() {
+		// Log fatals panic. Report them like any other failure
+		defer func() {
+			if r := recover(); r != nil {
+				result.Ok = false
+				result.Error = fmt.Sprint(r)
+			}
+		}()
+
+		shared_init.ScriptInit(*appPtr)
+		if registerAppBlobs != nil {
+			registerAppBlobs()
+		}
+
+		err := runCommand(commandName, flag.Args()[1:], result)
+		if err != nil {
+			result.Error = err.Error()
+			return
+		}
+		result.Ok = true
+	}()
+
+	printResult(result)
+	if !result.Ok {
+		os.Exit(1)
+	}
+}
+
+func runCommand(commandName string, args []string, result *CommandResult) error {
+	switch commandName {
+	case "list":
+		if len(args) != 0 {
+			return errors.New("usage: list")
+		}
+		result.BlobNames = storage_service.GetBlobNamesWithMigrations()
+		return nil
+
+	case "migrate":
+		flagSet := flag.NewFlagSet("migrate", flag.ContinueOnError)
+		dryRunPtr := flagSet.Bool("dry-run", false, "Run the migrations without writing the migrated blobs")
+		err := flagSet.Parse(args)
+		if err != nil || flagSet.NArg() != 1 {
+			return errors.New("usage: migrate [-dry-run] BLOB_NAME")
+		}
+		return runMigrate([]string{flagSet.Arg(0)}, *dryRunPtr, result)
+
+	case "migrate-all":
+		flagSet := flag.NewFlagSet("migrate-all", flag.ContinueOnError)
+		dryRunPtr := flagSet.Bool("dry-run", false, "Run the migrations without writing the migrated blobs")
+		err := flagSet.Parse(args)
+		if err != nil || flagSet.NArg() != 0 {
+			return errors.New("usage: migrate-all [-dry-run]")
+		}
+		return runMigrate(storage_service.GetBlobNamesWithMigrations(), *dryRunPtr, result)
+
+	case "indexes":
+		flagSet := flag.NewFlagSet("indexes", flag.ContinueOnError)
+		dryRunPtr := flagSet.Bool("dry-run", false, "Report index drift without creating the missing indexes")
+		err := flagSet.Parse(args)
+		if err != nil || flagSet.NArg() > 1 {
+			return errors.New("usage: indexes [-dry-run] [BLOB_NAME]")
+		}
+		blobNames := storage_service.GetRegisteredBlobNames()
+		if flagSet.NArg() == 1 {
+			blobNames = []string{flagSet.Arg(0)}
+		}
+		return runIndexes(blobNames, *dryRunPtr, result)
+	}
+
+	return errors.New("unknown command: " + commandName)
+}
+
+/**
+ * Stops at the first blob that fails to migrate. Re-running picks up where it stopped
+ */
+func runMigrate(blobNames []string, dryRun bool, result *CommandResult) error {
+	for _, blobName := range blobNames {
+		migrationResult, err := storage_service.MigrateBlobs(blobName, dryRun, context.Background())
+		if migrationResult != nil {
+			result.Migrations = append(result.Migrations, migrationResult)
+		}
+		if err != nil {
+			return errors.New("error migrating " + blobName + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+/**
+ * Stops at the first blob whose indexes can't be read. Errors creating individual indexes are in the reports
+ */
+func runIndexes(blobNames []string, dryRun bool, result *CommandResult) error {
+	for _, blobName := range blobNames {
+		report, err := storage_service.EnsureBlobIndexes(blobName, dryRun, context.Background())
+		if err != nil {
+			return errors.New("error ensuring indexes for " + blobName + ": " + err.Error())
+		}
+		result.Indexes = append(result.Indexes, report)
+		if report.HasDrift() {
+			result.HasDrift = true
+		}
+		if len(report.Errors) > 0 {
+			return errors.New("error creating indexes for " + blobName)
+		}
+	}
+	return nil
+}
+
+func setEnvIfNotEmpty(name string, value string) {
+	if value != "" {
+		_ = os.Setenv(name, value)
+	}
+}
+
+func printResult(result *CommandResult) {
+	resultJson, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		fmt.Println("{\"Command\": \"" + result.Command + "\", \"Ok\": false, \"Error\": \"error serializing result\"}")
+		return
+	}
+	fmt.Println(string(resultJson))
+}
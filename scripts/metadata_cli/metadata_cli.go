@@ -0,0 +1,162 @@
+package metadata_cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
+	"github.com/spacetimi/timi_shared_server/code/core/shared_init"
+	"github.com/spacetimi/timi_shared_server/utils/logger"
+)
+
+/**
+ * Command line access to the same metadata operations as the admin tool, for build pipelines.
+ * Prints a single json object (CommandResult) to stdout. Logs go to stderr.
+ * Exits with 1 if the command failed.
+ *
+ * The tool can only validate metadata items whose factories it knows about. Apps should wrap it
+ * in their own main, passing a function that registers the app's metadata factories
+ */
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "!! Usage: timi_metadata -app=APP_NAME [-env=ENVIRONMENT] [-appdir=<path to your app's code>] [-shareddir=<path to shared code>] [-space=app|shared] [-user=USER] COMMAND [ARGS]")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  list")
+	fmt.Fprintln(os.Stderr, "  create [-current] VERSION")
+	fmt.Fprintln(os.Stderr, "  clone [-current] FROM_VERSION NEW_VERSION")
+	fmt.Fprintln(os.Stderr, "  diff VERSION_A VERSION_B")
+	fmt.Fprintln(os.Stderr, "  download VERSION DIRECTORY")
+	fmt.Fprintln(os.Stderr, "  validate DIRECTORY")
+	fmt.Fprintln(os.Stderr, "  upload VERSION DIRECTORY")
+	fmt.Fprintln(os.Stderr, "  publish [-from=VERSION] VERSION DIRECTORY")
+	fmt.Fprintln(os.Stderr, "  set-current VERSION[,VERSION...]")
+	fmt.Fprintln(os.Stderr, "Directories hold a <key>.json (or <key>.csv, for tabular items) per metadata item, and <key>@<platform>.json per platform override")
+	flag.PrintDefaults()
+}
+
+/**
+ * Printed to stdout as json once the command is done
+ */
+type CommandResult struct {
+	Command string
+	Ok      bool
+	Error   string   `json:",omitempty"`
+	Errors  []string `json:",omitempty"` // Every problem found, for commands that check many items
+
+	Space           string   `json:",omitempty"`
+	Version         string   `json:",omitempty"`
+	Versions        []string `json:",omitempty"`
+	CurrentVersions []string `json:",omitempty"`
+
+	Items    []*ItemResult `json:",omitempty"`
+	Warnings []string      `json:",omitempty"`
+	Diff     *DiffResult   `json:",omitempty"`
+}
+
+type ItemResult struct {
+	MetadataKey       string
+	Hash              string   `json:",omitempty"`
+	PlatformOverrides []string `json:",omitempty"`
+	File              string   `json:",omitempty"`
+}
+
+type DiffResult struct {
+	From    string
+	To      string
+	Added   []string // Keys in To but not in From. Platform overrides are listed as <key>@<platform>
+	Removed []string
+	Changed []string
+}
+
+/**
+ * registerAppMetadataFactories can be nil. It is called after the required services are initialized
+ */
+func Main(registerAppMetadataFactories func()) {
+
+	appPtr := flag.String("app", "", "Name of a valid spacetimi app")
+	appDirPtr := flag.String("appdir", "", "Path to your app's code. Defaults to the app's directory in GOPATH")
+	sharedDirPtr := flag.String("shareddir", "", "Path to shared code. Defaults to the shared code's directory in GOPATH")
+	envPtr := flag.String("env", "", "Local, Test, Staging, Production. Defaults to Local")
+	spacePtr := flag.String("space", "app", "Metadata space: app or shared")
+	userPtr := flag.String("user", "timi_metadata", "Name the changes are attributed to (eg: in git backed metadata)")
+
+	flag.Usage = usage
+	flag.Parse()
+
+	if len(*appPtr) == 0 || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var space metadata_typedefs.MetadataSpace
+	switch *spacePtr {
+	case "app":
+		space = metadata_typedefs.METADATA_SPACE_APP
+	case "shared":
+		space = metadata_typedefs.METADATA_SPACE_SHARED
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	// Keep stdout for the result
+	logger.SetOutput(os.Stderr)
+
+	setEnvIfNotEmpty("app_dir_path", *appDirPtr)
+	setEnvIfNotEmpty("shared_dir_path", *sharedDirPtr)
+	setEnvIfNotEmpty("app_environment", *envPtr)
+
+	commandName := flag.Arg(0)
+	result := &CommandResult{
+		Command: commandName,
+		Space:   space.String(),
+	}
+
+	func() {
+		// Log fatals panic. Report them like any other failure
+		defer func() {
+			if r := recover(); r != nil {
+				result.Ok = false
+				result.Error = fmt.Sprint(r)
+			}
+		}()
+
+		shared_init.ScriptInit(*appPtr)
+		if registerAppMetadataFactories != nil {
+			registerAppMetadataFactories()
+		}
+
+		err := runCommand(commandName, flag.Args()[1:], space, *userPtr, result)
+		if err != nil {
+			result.Error = err.Error()
+			return
+		}
+		result.Ok = len(result.Errors) == 0
+		if !result.Ok {
+			result.Error = strings.Join(result.Errors, "; ")
+		}
+	}()
+
+	printResult(result)
+	if !result.Ok {
+		os.Exit(1)
+	}
+}
+
+func setEnvIfNotEmpty(name string, value string) {
+	if value != "" {
+		_ = os.Setenv(name, value)
+	}
+}
+
+func printResult(result *CommandResult) {
+	resultJson, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		fmt.Println("{\"Command\": \"" + result.Command + "\", \"Ok\": false, \"Error\": \"error serializing result\"}")
+		return
+	}
+	fmt.Println(string(resultJson))
+}
@@ -0,0 +1,464 @@
+package metadata_cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spacetimi/timi_shared_server/code/core"
+	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service"
+	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
+	"github.com/spacetimi/timi_shared_server/utils/logger"
+)
+
+func runCommand(commandName string, args []string, space metadata_typedefs.MetadataSpace, user string, result *CommandResult) error {
+	switch commandName {
+	case "list":
+		return runList(args, space, result)
+	case "create":
+		return runCreate(args, space, user, result)
+	case "clone":
+		return runClone(args, space, user, result)
+	case "diff":
+		return runDiff(args, space, result)
+	case "download":
+		return runDownload(args, space, result)
+	case "validate":
+		return runValidate(args, space, result)
+	case "upload":
+		return runUpload(args, space, user, result)
+	case "publish":
+		return runPublish(args, space, user, result)
+	case "set-current":
+		return runSetCurrent(args, space, user, result)
+	}
+
+	return errors.New("unknown command: " + commandName)
+}
+
+/**
+ * Handles: list
+ */
+func runList(args []string, space metadata_typedefs.MetadataSpace, result *CommandResult) error {
+	if len(args) != 0 {
+		return errors.New("usage: list")
+	}
+
+	result.Versions = metadata_service.Instance().GetAllVersions(space)
+	result.CurrentVersions = metadata_service.Instance().GetCurrentVersions(space)
+	return nil
+}
+
+/**
+ * Handles: create [-current] VERSION
+ */
+func runCreate(args []string, space metadata_typedefs.MetadataSpace, user string, result *CommandResult) error {
+	flagSet := newCommandFlagSet("create")
+	markAsCurrentPtr := flagSet.Bool("current", false, "Also add the new version to the current versions")
+	err := flagSet.Parse(args)
+	if err != nil || flagSet.NArg() != 1 {
+		return errors.New("usage: create [-current] VERSION")
+	}
+
+	version, err := core.GetAppVersionFromString(flagSet.Arg(0))
+	if err != nil {
+		return errors.New("bad version: " + err.Error())
+	}
+	result.Version = version.String()
+
+	defer metadata_service.ReleaseInstanceRW()
+	err = metadata_service.InstanceRWAsUser(user).CreateNewVersion(version, space, *markAsCurrentPtr)
+	if err != nil {
+		return errors.New("error creating new version: " + err.Error())
+	}
+
+	return markMetadataAsUpdated(space)
+}
+
+/**
+ * Handles: clone [-current] FROM_VERSION NEW_VERSION
+ */
+func runClone(args []string, space metadata_typedefs.MetadataSpace, user string, result *CommandResult) error {
+	flagSet := newCommandFlagSet("clone")
+	markAsCurrentPtr := flagSet.Bool("current", false, "Also add the new version to the current versions")
+	err := flagSet.Parse(args)
+	if err != nil || flagSet.NArg() != 2 {
+		return errors.New("usage: clone [-current] FROM_VERSION NEW_VERSION")
+	}
+
+	fromVersion, err := core.GetAppVersionFromString(flagSet.Arg(0))
+	if err != nil {
+		return errors.New("bad version: " + err.Error())
+	}
+	newVersion, err := core.GetAppVersionFromString(flagSet.Arg(1))
+	if err != nil {
+		return errors.New("bad version: " + err.Error())
+	}
+	result.Version = newVersion.String()
+
+	defer metadata_service.ReleaseInstanceRW()
+	err = metadata_service.InstanceRWAsUser(user).CloneMetadataVersion(fromVersion, newVersion, space, *markAsCurrentPtr)
+	if err != nil {
+		return err
+	}
+
+	return markMetadataAsUpdated(space)
+}
+
+/**
+ * Handles: diff VERSION_A VERSION_B
+ * Compares the hashes in the versions' manifests
+ */
+func runDiff(args []string, space metadata_typedefs.MetadataSpace, result *CommandResult) error {
+	if len(args) != 2 {
+		return errors.New("usage: diff VERSION_A VERSION_B")
+	}
+
+	fromHashes, err := getStoredKeyHashes(args[0], space)
+	if err != nil {
+		return err
+	}
+	toHashes, err := getStoredKeyHashes(args[1], space)
+	if err != nil {
+		return err
+	}
+
+	diff := &DiffResult{
+		From:    args[0],
+		To:      args[1],
+		Added:   []string{},
+		Removed: []string{},
+		Changed: []string{},
+	}
+	for storedKey, toHash := range toHashes {
+		fromHash, ok := fromHashes[storedKey]
+		if !ok {
+			diff.Added = append(diff.Added, storedKey)
+		} else if fromHash != toHash {
+			diff.Changed = append(diff.Changed, storedKey)
+		}
+	}
+	for storedKey := range fromHashes {
+		if _, ok := toHashes[storedKey]; !ok {
+			diff.Removed = append(diff.Removed, storedKey)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+
+	result.Diff = diff
+	return nil
+}
+
+/**
+ * Handles: download VERSION DIRECTORY
+ * Writes the items (and their platform overrides) as json, in the format that upload reads
+ */
+func runDownload(args []string, space metadata_typedefs.MetadataSpace, result *CommandResult) error {
+	if len(args) != 2 {
+		return errors.New("usage: download VERSION DIRECTORY")
+	}
+
+	version, err := core.GetAppVersionFromString(args[0])
+	if err != nil {
+		return errors.New("bad version: " + err.Error())
+	}
+	result.Version = version.String()
+	directoryPath := args[1]
+
+	manifestItems, err := metadata_service.Instance().GetMetadataManifestItemsInVersion(version.String(), space)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(directoryPath, os.FileMode(0755))
+	if err != nil {
+		return errors.New("error creating directory: " + err.Error())
+	}
+
+	for _, manifestItem := range manifestItems {
+		storedKeys := []string{manifestItem.MetadataKey}
+		itemResult := &ItemResult{
+			MetadataKey: manifestItem.MetadataKey,
+			Hash:        manifestItem.Hash,
+			File:        manifestItem.MetadataKey + ".json",
+		}
+		for platformString := range manifestItem.PlatformOverrides {
+			storedKeys = append(storedKeys, manifestItem.MetadataKey + "@" + platformString)
+			itemResult.PlatformOverrides = append(itemResult.PlatformOverrides, platformString)
+		}
+		sort.Strings(itemResult.PlatformOverrides)
+
+		for _, storedKey := range storedKeys {
+			content, err := metadata_service.Instance().GetMetadataItemRawContent(storedKey, version, space)
+			if err != nil {
+				result.Errors = append(result.Errors, storedKey + ": " + err.Error())
+				continue
+			}
+			err = writeMetadataFile(directoryPath, storedKey + ".json", content)
+			if err != nil {
+				result.Errors = append(result.Errors, storedKey + ": error writing file: " + err.Error())
+			}
+		}
+
+		result.Items = append(result.Items, itemResult)
+	}
+
+	return nil
+}
+
+/**
+ * Handles: validate DIRECTORY
+ * Checks the files without uploading them
+ */
+func runValidate(args []string, space metadata_typedefs.MetadataSpace, result *CommandResult) error {
+	if len(args) != 1 {
+		return errors.New("usage: validate DIRECTORY")
+	}
+
+	metadataFiles, errorList, warnings := readMetadataDirectory(args[0], nil, space)
+	result.Errors = errorList
+	result.Warnings = warnings
+	result.Items = getItemResults(metadataFiles)
+	return nil
+}
+
+/**
+ * Handles: upload VERSION DIRECTORY
+ * Nothing is uploaded unless every file is valid
+ */
+func runUpload(args []string, space metadata_typedefs.MetadataSpace, user string, result *CommandResult) error {
+	if len(args) != 2 {
+		return errors.New("usage: upload VERSION DIRECTORY")
+	}
+
+	version, err := core.GetAppVersionFromString(args[0])
+	if err != nil {
+		return errors.New("bad version: " + err.Error())
+	}
+	result.Version = version.String()
+
+	validVersion, err := metadata_service.Instance().IsVersionValid(version.String(), space)
+	if !validVersion {
+		return errors.New("invalid version: " + err.Error())
+	}
+
+	return uploadMetadataDirectory(args[1], version, space, user, result)
+}
+
+/**
+ * Handles: publish [-from=VERSION] VERSION DIRECTORY
+ * Creates the version if it does not exist (as a clone of -from, if given), uploads the directory into it,
+ * and adds it to the current versions
+ */
+func runPublish(args []string, space metadata_typedefs.MetadataSpace, user string, result *CommandResult) error {
+	flagSet := newCommandFlagSet("publish")
+	fromVersionPtr := flagSet.String("from", "", "Version to clone, if the published version does not exist yet")
+	err := flagSet.Parse(args)
+	if err != nil || flagSet.NArg() != 2 {
+		return errors.New("usage: publish [-from=VERSION] VERSION DIRECTORY")
+	}
+
+	version, err := core.GetAppVersionFromString(flagSet.Arg(0))
+	if err != nil {
+		return errors.New("bad version: " + err.Error())
+	}
+	result.Version = version.String()
+
+	// Check the files before creating anything. Csv files are checked against an empty item here,
+	// and again against the version's content when uploading
+	_, errorList, _ := readMetadataDirectory(flagSet.Arg(1), nil, space)
+	if len(errorList) != 0 {
+		result.Errors = errorList
+		return nil
+	}
+
+	validVersion, _ := metadata_service.Instance().IsVersionValid(version.String(), space)
+	if !validVersion {
+		err = createVersionForPublish(version, *fromVersionPtr, space, user)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = uploadMetadataDirectory(flagSet.Arg(1), version, space, user, result)
+	if err != nil || len(result.Errors) != 0 {
+		return err
+	}
+
+	currentVersions := metadata_service.Instance().GetCurrentVersions(space)
+	for _, currentVersion := range currentVersions {
+		if currentVersion == version.String() {
+			result.CurrentVersions = currentVersions
+			return nil
+		}
+	}
+	return setCurrentVersions(append(currentVersions, version.String()), space, user, result)
+}
+
+/**
+ * Handles: set-current VERSION[,VERSION...]
+ */
+func runSetCurrent(args []string, space metadata_typedefs.MetadataSpace, user string, result *CommandResult) error {
+	if len(args) != 1 {
+		return errors.New("usage: set-current VERSION[,VERSION...]")
+	}
+
+	var versionStrings []string
+	for _, versionString := range strings.Split(args[0], ",") {
+		versionString = strings.TrimSpace(versionString)
+		if versionString != "" {
+			versionStrings = append(versionStrings, versionString)
+		}
+	}
+	if len(versionStrings) == 0 {
+		return errors.New("no versions given")
+	}
+
+	return setCurrentVersions(versionStrings, space, user, result)
+}
+
+/********** Helpers **********/
+
+func newCommandFlagSet(commandName string) *flag.FlagSet {
+	flagSet := flag.NewFlagSet(commandName, flag.ContinueOnError)
+	flagSet.SetOutput(os.Stderr)
+	return flagSet
+}
+
+func markMetadataAsUpdated(space metadata_typedefs.MetadataSpace) error {
+	err := metadata_service.MarkMetadataAsUpdated(space, context.Background())
+	if err != nil {
+		return errors.New("error marking metadata as updated: " + err.Error())
+	}
+	metadata_service.RefreshLastUpdatedTimestamps()
+	return nil
+}
+
+/**
+ * Hashes by stored key: the item's key, or <key>@<platform> for platform overrides
+ */
+func getStoredKeyHashes(versionString string, space metadata_typedefs.MetadataSpace) (map[string]string, error) {
+	manifestItems, err := metadata_service.Instance().GetMetadataManifestItemsInVersion(versionString, space)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make(map[string]string)
+	for _, manifestItem := range manifestItems {
+		hashes[manifestItem.MetadataKey] = manifestItem.Hash
+		for platformString, hash := range manifestItem.PlatformOverrides {
+			hashes[manifestItem.MetadataKey + "@" + platformString] = hash
+		}
+	}
+	return hashes, nil
+}
+
+func getItemResults(metadataFiles []*metadataFile) []*ItemResult {
+	var itemResults []*ItemResult
+	for _, mdFile := range metadataFiles {
+		itemResult := &ItemResult{
+			MetadataKey: mdFile.MetadataKey,
+			File:        mdFile.FileName,
+		}
+		if mdFile.IsOverride {
+			itemResult.PlatformOverrides = []string{mdFile.Platform.String()}
+		}
+		itemResults = append(itemResults, itemResult)
+	}
+	return itemResults
+}
+
+func uploadMetadataDirectory(directoryPath string, version *core.AppVersion, space metadata_typedefs.MetadataSpace, user string, result *CommandResult) error {
+	// Read before taking the write lock, since reading csv files needs the version's current content
+	metadataFiles, errorList, warnings := readMetadataDirectory(directoryPath, version, space)
+	result.Warnings = warnings
+	if len(errorList) != 0 {
+		result.Errors = errorList
+		return nil
+	}
+	if len(metadataFiles) == 0 {
+		return errors.New("found no metadata to upload in " + directoryPath)
+	}
+
+	metadataJsons := make(map[string]string)
+	for _, mdFile := range metadataFiles {
+		if !mdFile.IsOverride {
+			metadataJsons[mdFile.MetadataKey] = mdFile.MetadataJson
+		}
+	}
+
+	defer metadata_service.ReleaseInstanceRW()
+	metadataServiceInstance := metadata_service.InstanceRWAsUser(user)
+
+	if len(metadataJsons) != 0 {
+		err := metadataServiceInstance.SetMetadataItemsRawContent(metadataJsons, version, space)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, mdFile := range metadataFiles {
+		if !mdFile.IsOverride {
+			continue
+		}
+		err := metadataServiceInstance.SetMetadataItemPlatformOverride(mdFile.MetadataKey, mdFile.MetadataJson, version, space, mdFile.Platform)
+		if err != nil {
+			result.Errors = append(result.Errors, mdFile.FileName + ": " + err.Error())
+		}
+	}
+
+	err := markMetadataAsUpdated(space)
+	if err != nil {
+		return err
+	}
+
+	logger.LogInfo("uploaded metadata from directory" +
+				   "|metadata space=" + space.String() +
+				   "|version=" + version.String() +
+				   "|directory=" + directoryPath +
+				   "|user=" + user)
+
+	result.Items = getItemResults(metadataFiles)
+	return nil
+}
+
+func createVersionForPublish(version *core.AppVersion, fromVersionString string, space metadata_typedefs.MetadataSpace, user string) error {
+	defer metadata_service.ReleaseInstanceRW()
+	metadataServiceInstance := metadata_service.InstanceRWAsUser(user)
+
+	if fromVersionString == "" {
+		err := metadataServiceInstance.CreateNewVersion(version, space, false)
+		if err != nil {
+			return errors.New("error creating new version: " + err.Error())
+		}
+	} else {
+		fromVersion, err := core.GetAppVersionFromString(fromVersionString)
+		if err != nil {
+			return errors.New("bad version: " + err.Error())
+		}
+		err = metadataServiceInstance.CloneMetadataVersion(fromVersion, version, space, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	return markMetadataAsUpdated(space)
+}
+
+func setCurrentVersions(versionStrings []string, space metadata_typedefs.MetadataSpace, user string, result *CommandResult) error {
+	defer metadata_service.ReleaseInstanceRW()
+	metadataServiceInstance := metadata_service.InstanceRWAsUser(user)
+
+	err := metadataServiceInstance.SetCurrentVersions(versionStrings, space)
+	if err != nil {
+		return errors.New("error setting current versions: " + err.Error())
+	}
+	result.CurrentVersions = metadataServiceInstance.GetCurrentVersions(space)
+
+	return markMetadataAsUpdated(space)
+}
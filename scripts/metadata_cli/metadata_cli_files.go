@@ -0,0 +1,177 @@
+package metadata_cli
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spacetimi/timi_shared_server/code/core"
+	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service"
+	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_factory"
+	"github.com/spacetimi/timi_shared_server/code/core/services/metadata_service/metadata_typedefs"
+)
+
+/**
+ * A metadata item (or platform override) read from a file, as json
+ */
+type metadataFile struct {
+	FileName     string
+	MetadataKey  string
+	IsOverride   bool
+	Platform     metadata_typedefs.MetadataPlatform
+	MetadataJson string
+}
+
+/**
+ * Reads and validates every .json and .csv file in the directory (not recursive).
+ * Csv files replace the records of the item's content in the version (or of an empty item if version is nil).
+ * Returns every problem found, and warnings for items that could only be checked for well formed json
+ * since no factory is registered for them
+ */
+func readMetadataDirectory(directoryPath string, version *core.AppVersion, space metadata_typedefs.MetadataSpace) ([]*metadataFile, []string, []string) {
+	var errorList []string
+	var warnings []string
+
+	fileInfos, err := ioutil.ReadDir(directoryPath)
+	if err != nil {
+		return nil, []string{"error reading directory: " + err.Error()}, nil
+	}
+
+	var metadataFiles []*metadataFile
+	seenKeys := make(map[string]string)
+
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() {
+			continue
+		}
+		fileName := fileInfo.Name()
+		extension := strings.ToLower(filepath.Ext(fileName))
+		if extension != ".json" && extension != ".csv" {
+			continue
+		}
+
+		mdFile := &metadataFile{
+			FileName:    fileName,
+			MetadataKey: strings.TrimSuffix(fileName, filepath.Ext(fileName)),
+		}
+
+		storedKey := mdFile.MetadataKey
+		if otherFileName, ok := seenKeys[storedKey]; ok {
+			errorList = append(errorList, fileName + ": same metadata item as " + otherFileName)
+			continue
+		}
+		seenKeys[storedKey] = fileName
+
+		tokens := strings.SplitN(mdFile.MetadataKey, "@", 2)
+		if len(tokens) == 2 {
+			platform, err := metadata_typedefs.GetMetadataPlatformFromString(tokens[1])
+			if err != nil || platform == metadata_typedefs.METADATA_PLATFORM_NONE {
+				errorList = append(errorList, fileName + ": bad platform in file name")
+				continue
+			}
+			mdFile.MetadataKey = tokens[0]
+			mdFile.IsOverride = true
+			mdFile.Platform = platform
+		}
+		if mdFile.MetadataKey == "" {
+			errorList = append(errorList, fileName + ": error getting metadata item key from file name")
+			continue
+		}
+
+		fileContents, err := ioutil.ReadFile(filepath.Join(directoryPath, fileName))
+		if err != nil {
+			errorList = append(errorList, fileName + ": error reading file: " + err.Error())
+			continue
+		}
+
+		if extension == ".csv" {
+			if mdFile.IsOverride {
+				errorList = append(errorList, fileName + ": platform overrides must be json")
+				continue
+			}
+			metadataJson, csvErrors := convertCSVToMetadataJson(mdFile.MetadataKey, fileContents, version, space)
+			if len(csvErrors) != 0 {
+				for _, csvError := range csvErrors {
+					errorList = append(errorList, fileName + ": " + csvError)
+				}
+				continue
+			}
+			mdFile.MetadataJson = metadataJson
+		} else {
+			mdFile.MetadataJson = string(fileContents)
+		}
+
+		// Overrides are partial items, so they can only be checked for well formed json
+		if mdFile.IsOverride {
+			if !json.Valid([]byte(mdFile.MetadataJson)) {
+				errorList = append(errorList, fileName + ": invalid json")
+				continue
+			}
+			metadataFiles = append(metadataFiles, mdFile)
+			continue
+		}
+
+		metadataItem, err := metadata_factory.InstantiateMetadataItem(mdFile.MetadataKey)
+		if err != nil {
+			if !json.Valid([]byte(mdFile.MetadataJson)) {
+				errorList = append(errorList, fileName + ": invalid json")
+				continue
+			}
+			warnings = append(warnings, fileName + ": no metadata item factory registered, only checked for valid json")
+			metadataFiles = append(metadataFiles, mdFile)
+			continue
+		}
+
+		if space != metadataItem.GetMetadataSpace() {
+			errorList = append(errorList, fileName + ": wrong metadata space" +
+										  " (expected=" + metadataItem.GetMetadataSpace().String() +
+										  ", got=" + space.String() + ")")
+			continue
+		}
+
+		err = metadata_typedefs.UnmarshalAndValidateMetadataItem([]byte(mdFile.MetadataJson), metadataItem)
+		if err != nil {
+			errorList = append(errorList, fileName + ": error validating metadata item: " + err.Error())
+			continue
+		}
+
+		metadataFiles = append(metadataFiles, mdFile)
+	}
+
+	// Base items before their overrides
+	sort.SliceStable(metadataFiles, func(i, j int) bool {
+		return !metadataFiles[i].IsOverride && metadataFiles[j].IsOverride
+	})
+
+	return metadataFiles, errorList, warnings
+}
+
+func convertCSVToMetadataJson(metadataItemKey string, csvContents []byte, version *core.AppVersion, space metadata_typedefs.MetadataSpace) (string, []string) {
+	mapping := metadata_factory.GetTabularMapping(metadataItemKey)
+	if mapping == nil {
+		return "", []string{metadataItemKey + " is not a tabular metadata item"}
+	}
+
+	// Items not defined in the version yet start out empty
+	baseJson := ""
+	if version != nil {
+		baseJson, _ = metadata_service.Instance().GetMetadataItemRawContent(metadataItemKey, version, space)
+	}
+
+	metadataJson, rowErrors := metadata_typedefs.ConvertCSVToMetadataJson(strings.NewReader(string(csvContents)), mapping, baseJson)
+	if len(rowErrors) != 0 {
+		var errorList []string
+		for _, rowError := range rowErrors {
+			errorList = append(errorList, rowError.Error())
+		}
+		return "", errorList
+	}
+	return metadataJson, nil
+}
+
+func writeMetadataFile(directoryPath string, fileName string, contents string) error {
+	return ioutil.WriteFile(filepath.Join(directoryPath, fileName), []byte(contents), os.FileMode(0644))
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"github.com/spacetimi/timi_shared_server/scripts/blobs_cli"
+)
+
+/**
+ * The shared blobs have no migrations yet, and identity_service registers its blobs when it is initialized.
+ * Apps should build their own main calling blobs_cli.Main with a function registering their blobs and blob migrations
+ */
+func main() {
+	blobs_cli.Main(nil)
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"github.com/spacetimi/timi_shared_server/scripts/metadata_cli"
+)
+
+/**
+ * Only validates the shared metadata items. Apps that want their items validated too
+ * should build their own main calling metadata_cli.Main with a function registering their factories
+ */
+func main() {
+	metadata_cli.Main(nil)
+}
@@ -0,0 +1,118 @@
+package aws_helper
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type S3ClientOptions struct {
+	Region string
+
+	// Optional. Set to point at S3-compatible stand-ins (eg: "http://localhost:9000")
+	Endpoint string
+
+	// Address buckets as endpoint/bucket instead of bucket.endpoint. Most S3-compatible stand-ins need this
+	ForcePathStyle bool
+
+	// Optional. The default aws credentials chain (env vars, profile, instance role) is used if not set
+	AccessKeyId     string
+	SecretAccessKey string
+}
+
+/**
+ * S3 client for reading and writing objects in private buckets
+ */
+func NewS3Client(options S3ClientOptions) (*s3.S3, error) {
+	awsConfig := aws.NewConfig()
+	if len(options.Region) != 0 {
+		awsConfig = awsConfig.WithRegion(options.Region)
+	}
+	if len(options.Endpoint) != 0 {
+		awsConfig = awsConfig.WithEndpoint(options.Endpoint)
+	}
+	awsConfig = awsConfig.WithS3ForcePathStyle(options.ForcePathStyle)
+	if len(options.AccessKeyId) != 0 {
+		awsConfig = awsConfig.WithCredentials(credentials.NewStaticCredentials(options.AccessKeyId, options.SecretAccessKey, ""))
+	}
+
+	sessionOptions := session.Options{
+		Config:            *awsConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	}
+	if len(options.AccessKeyId) == 0 {
+		sessionOptions.Profile = getOptionalAwsProfile()
+	}
+
+	awsSession, err := session.NewSessionWithOptions(sessionOptions)
+	if err != nil {
+		return nil, errors.New("error creating aws session: " + err.Error())
+	}
+
+	_, err = awsSession.Config.Credentials.Get()
+	if err != nil {
+		return nil, errors.New("error getting credentials for aws session: " + err.Error())
+	}
+
+	return s3.New(awsSession), nil
+}
+
+func ReadFromS3(client *s3.S3, bucketName string, key string) ([]byte, error) {
+	output, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, errors.New("error reading from s3: " + err.Error())
+	}
+	defer func() {
+		_ = output.Body.Close()
+	}()
+
+	contents, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return nil, errors.New("error reading s3 object body: " + err.Error())
+	}
+
+	return contents, nil
+}
+
+/**
+ * Uploads with a private ACL, so that the object is only readable with credentials or through presigned urls
+ */
+func UploadToS3Private(client *s3.S3, contents []byte, bucketName string, key string) error {
+	_, err := client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(contents),
+		ACL:    aws.String(s3.ObjectCannedACLPrivate),
+	})
+	if err != nil {
+		return errors.New("error uploading to s3: " + err.Error())
+	}
+
+	return nil
+}
+
+/**
+ * Url that allows anyone holding it to download the object until it expires
+ */
+func GetPresignedDownloadURL(client *s3.S3, bucketName string, key string, expiry time.Duration) (string, error) {
+	request, _ := client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+
+	url, err := request.Presign(expiry)
+	if err != nil {
+		return "", errors.New("error presigning s3 url: " + err.Error())
+	}
+
+	return url, nil
+}
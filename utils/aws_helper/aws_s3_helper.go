@@ -20,7 +20,8 @@ func UploadToS3(bytes []byte, bucketName string, key string) error {
 
 	reader := strings.NewReader(string(bytes))
 
-	// TODO: Avi: Do not use public-read (not even on test and staging)
+	// public-read is only needed by readers of unauthenticated public urls (eg: MetadataFetcherS3)
+	// Use UploadToS3Private to keep buckets private
 	publicReadACL := "public-read"
 
 	_, err = uploader.Upload(&s3manager.UploadInput{
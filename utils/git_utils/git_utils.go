@@ -0,0 +1,201 @@
+package git_utils
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+/**
+ * Helpers over the git cli's plumbing commands.
+ * They work on both bare repos and checkouts, and never touch the working tree of a checkout.
+ * Refs may come from user input, so they are validated and passed after --end-of-options (needs git 2.24+)
+ */
+
+type GitSignature struct {
+	Name  string
+	Email string
+}
+
+func ReadFileAtRef(repoPath string, ref string, filePath string) ([]byte, error) {
+	err := validateRef(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := runGitCommand(repoPath, nil, nil, "cat-file", "blob", "--end-of-options", ref+":"+filePath)
+	if err != nil {
+		return nil, errors.New("error reading file at ref: " + err.Error())
+	}
+	return output, nil
+}
+
+/**
+ * Names of the files (not directories) directly inside the directory at the ref. Use "" for the root directory
+ */
+func ListFilesAtRef(repoPath string, ref string, directoryPath string) ([]string, error) {
+	err := validateRef(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	treeish := ref
+	if len(directoryPath) != 0 {
+		treeish = ref + ":" + directoryPath
+	}
+
+	output, err := runGitCommand(repoPath, nil, nil, "ls-tree", "--end-of-options", treeish)
+	if err != nil {
+		return nil, errors.New("error listing files at ref: " + err.Error())
+	}
+
+	var fileNames []string
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		// Format: <mode> SP <type> SP <object> TAB <file>
+		tokens := strings.SplitN(line, "\t", 2)
+		if len(tokens) != 2 {
+			continue
+		}
+		if !strings.Contains(tokens[0], " blob ") {
+			continue
+		}
+		fileNames = append(fileNames, tokens[1])
+	}
+
+	return fileNames, nil
+}
+
+/**
+ * Returns the sha of the commit the ref points to (peeling tags), or false if there is no such commit
+ */
+func ResolveCommit(repoPath string, ref string) (string, bool) {
+	if validateRef(ref) != nil {
+		return "", false
+	}
+
+	output, err := runGitCommand(repoPath, nil, nil, "rev-parse", "--verify", "--quiet", "--end-of-options", ref+"^{commit}")
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(output)), true
+}
+
+/**
+ * Commits the files (path => contents) on top of the branch, and moves the branch to the new commit.
+ * Fails if the branch moved while committing. Creates the branch if it does not exist yet
+ */
+func CommitFiles(repoPath string, branch string, files map[string][]byte, message string, author GitSignature, committer GitSignature) (string, error) {
+	err := validateRef(branch)
+	if err != nil {
+		return "", err
+	}
+
+	branchRef := branch
+	if !strings.HasPrefix(branchRef, "refs/") {
+		branchRef = "refs/heads/" + branch
+	}
+
+	// Use a temporary index so that the repo's own index (and working tree) are left alone
+	indexFile, err := ioutil.TempFile("", "git_utils_index")
+	if err != nil {
+		return "", errors.New("error creating temporary index file: " + err.Error())
+	}
+	indexFilePath := indexFile.Name()
+	_ = indexFile.Close()
+	_ = os.Remove(indexFilePath)
+	defer func() {
+		_ = os.Remove(indexFilePath)
+	}()
+	indexEnv := []string{"GIT_INDEX_FILE=" + indexFilePath}
+
+	parentCommit, hasParent := ResolveCommit(repoPath, branchRef)
+	if hasParent {
+		_, err = runGitCommand(repoPath, indexEnv, nil, "read-tree", "--end-of-options", parentCommit)
+		if err != nil {
+			return "", errors.New("error reading parent tree: " + err.Error())
+		}
+	}
+
+	for filePath, contents := range files {
+		output, err := runGitCommand(repoPath, nil, contents, "hash-object", "-w", "--stdin")
+		if err != nil {
+			return "", errors.New("error writing blob for " + filePath + ": " + err.Error())
+		}
+		blobSha := strings.TrimSpace(string(output))
+
+		_, err = runGitCommand(repoPath, indexEnv, nil, "update-index", "--add", "--cacheinfo", "100644,"+blobSha+","+filePath)
+		if err != nil {
+			return "", errors.New("error adding " + filePath + " to index: " + err.Error())
+		}
+	}
+
+	output, err := runGitCommand(repoPath, indexEnv, nil, "write-tree")
+	if err != nil {
+		return "", errors.New("error writing tree: " + err.Error())
+	}
+	treeSha := strings.TrimSpace(string(output))
+
+	signatureEnv := []string{
+		"GIT_AUTHOR_NAME=" + author.Name,
+		"GIT_AUTHOR_EMAIL=" + author.Email,
+		"GIT_COMMITTER_NAME=" + committer.Name,
+		"GIT_COMMITTER_EMAIL=" + committer.Email,
+	}
+	commitArgs := []string{"commit-tree", treeSha, "-m", message}
+	if hasParent {
+		commitArgs = append(commitArgs, "-p", parentCommit)
+	}
+	output, err = runGitCommand(repoPath, signatureEnv, nil, commitArgs...)
+	if err != nil {
+		return "", errors.New("error creating commit: " + err.Error())
+	}
+	commitSha := strings.TrimSpace(string(output))
+
+	// Only move the branch if it still points at the parent we committed on top of
+	oldValue := parentCommit
+	if !hasParent {
+		oldValue = strings.Repeat("0", len(commitSha))
+	}
+	_, err = runGitCommand(repoPath, nil, nil, "update-ref", "-m", message, "--end-of-options", branchRef, commitSha, oldValue)
+	if err != nil {
+		return "", errors.New("error updating branch (was it modified concurrently?): " + err.Error())
+	}
+
+	return commitSha, nil
+}
+
+/**
+ * Rejects refs that git would parse as options
+ */
+func validateRef(ref string) error {
+	if len(ref) == 0 {
+		return errors.New("empty git ref")
+	}
+	if strings.HasPrefix(ref, "-") {
+		return errors.New("invalid git ref: " + ref)
+	}
+	return nil
+}
+
+func runGitCommand(repoPath string, env []string, stdin []byte, args ...string) ([]byte, error) {
+	command := exec.Command("git", append([]string{"-C", repoPath}, args...)...)
+	command.Env = append(os.Environ(), env...)
+	if stdin != nil {
+		command.Stdin = bytes.NewReader(stdin)
+	}
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+
+	err := command.Run()
+	if err != nil {
+		return nil, errors.New("git " + args[0] + " failed: " + err.Error() + ": " + strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
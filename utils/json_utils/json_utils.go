@@ -0,0 +1,59 @@
+package json_utils
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+/**
+ * Applies a JSON merge patch (RFC 7386) on top of a base JSON document:
+ * objects in the patch are merged recursively into the base, null values in the patch remove keys from the base,
+ * and every other value (including arrays) in the patch replaces the value in the base
+ */
+func ApplyMergePatch(baseJson []byte, patchJson []byte) ([]byte, error) {
+	var base interface{}
+	err := json.Unmarshal(baseJson, &base)
+	if err != nil {
+		return nil, errors.New("error deserializing base json: " + err.Error())
+	}
+
+	var patch interface{}
+	err = json.Unmarshal(patchJson, &patch)
+	if err != nil {
+		return nil, errors.New("error deserializing patch json: " + err.Error())
+	}
+
+	merged, err := json.Marshal(mergePatch(base, patch))
+	if err != nil {
+		return nil, errors.New("error serializing merged json: " + err.Error())
+	}
+
+	return merged, nil
+}
+
+func mergePatch(base interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	baseObject, ok := base.(map[string]interface{})
+	if !ok {
+		baseObject = make(map[string]interface{})
+	}
+
+	for key, patchValue := range patchObject {
+		if patchValue == nil {
+			delete(baseObject, key)
+			continue
+		}
+		baseObject[key] = mergePatch(baseObject[key], patchValue)
+	}
+
+	return baseObject
+}
+
+func IsJsonObject(data []byte) bool {
+	var object map[string]interface{}
+	return json.Unmarshal(data, &object) == nil
+}
@@ -0,0 +1,76 @@
+package json_utils
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// The examples from RFC 7386, Appendix A, as base, patch and result
+var kRFC7386Examples = [][3]string{
+	{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+	{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+	{`{"a":"b"}`, `{"a":null}`, `{}`},
+	{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+	{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+	{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+	{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+	{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+	{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+	{`{"a":"b"}`, `["c"]`, `["c"]`},
+	{`{"a":"foo"}`, `null`, `null`},
+	{`{"a":"foo"}`, `"bar"`, `"bar"`},
+	{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+	{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+	{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+}
+
+func assertMergesTo(t *testing.T, base string, patch string, want string) {
+	t.Helper()
+
+	merged, err := ApplyMergePatch([]byte(base), []byte(patch))
+	if err != nil {
+		t.Errorf("applying %s on top of %s: %v", patch, base, err)
+		return
+	}
+
+	var got, wantValue interface{}
+	if err := json.Unmarshal(merged, &got); err != nil {
+		t.Fatalf("deserializing merged json %s: %v", merged, err)
+	}
+	if err := json.Unmarshal([]byte(want), &wantValue); err != nil {
+		t.Fatalf("deserializing expected json %s: %v", want, err)
+	}
+	if !reflect.DeepEqual(got, wantValue) {
+		t.Errorf("applying %s on top of %s gave %s, want %s", patch, base, merged, want)
+	}
+}
+
+func TestApplyMergePatchRFC7386Examples(t *testing.T) {
+	for _, example := range kRFC7386Examples {
+		assertMergesTo(t, example[0], example[1], example[2])
+	}
+}
+
+func TestApplyMergePatch(t *testing.T) {
+	base := `{"a":1,"b":{"c":2,"d":[1,2]}}`
+
+	// An empty patch changes nothing, and arrays are replaced rather than merged
+	assertMergesTo(t, base, `{}`, base)
+	assertMergesTo(t, base, `{"b":{"d":[3]}}`, `{"a":1,"b":{"c":2,"d":[3]}}`)
+
+	// An object replaces a value that isn't one
+	assertMergesTo(t, `{"a":{"b":1}}`, `{"a":{"b":{"c":2}}}`, `{"a":{"b":{"c":2}}}`)
+}
+
+func TestApplyMergePatchBadJson(t *testing.T) {
+	if _, err := ApplyMergePatch([]byte(`{"a":`), []byte(`{}`)); err == nil {
+		t.Errorf("applied a patch on top of bad json")
+	}
+	if _, err := ApplyMergePatch([]byte(`{}`), []byte(`{"a":`)); err == nil {
+		t.Errorf("applied a bad patch")
+	}
+	if _, err := ApplyMergePatch(nil, []byte(`{}`)); err == nil {
+		t.Errorf("applied a patch on top of nothing")
+	}
+}
@@ -2,6 +2,7 @@ package logger
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"runtime/debug"
@@ -24,6 +25,13 @@ func LogFatal(formatString string, a... interface{}) {
 	processLogMessage(fatal, formatString, a...)
 }
 
+/**
+ * Logs go to stdout by default. Command line tools that print their results to stdout can send the logs elsewhere
+ */
+func SetOutput(w io.Writer) {
+	logger.SetOutput(w)
+}
+
 func VarDumpInfo(message string, object interface{}) {
 	processLogMessage(info, message + ": %#v", object)
 }
@@ -52,6 +52,10 @@ func GetFieldValuesFromStructPtr(structPtr interface{}, fieldNames []string) ([]
     return fieldValues, nil
 }
 
+/**
+ * Keys fields by the name in their bson tag if they have one, and by their Go field name otherwise.
+ * Fields tagged bson:"-" are skipped (as is the older bson:"ignore")
+ */
 func MarshalStructPtrToBson(s interface{}) (bson.M, error) {
 	bsonMRepresentation := make(map[string]interface{})
 
@@ -70,10 +74,18 @@ func MarshalStructPtrToBson(s interface{}) (bson.M, error) {
 		value := v.Field(i)
 		if value.CanInterface() {
 			field := v.Type().Field(i)
+			key := field.Name
 			bsonTag, ok := field.Tag.Lookup("bson")
-			if !ok || !strings.Contains(bsonTag, "ignore") {
-				bsonMRepresentation[field.Name] = value.Interface()
+			if ok {
+				tagName := strings.Split(bsonTag, ",")[0]
+				if tagName == "-" || tagName == "ignore" {
+					continue
+				}
+				if tagName != "" {
+					key = tagName
+				}
 			}
+			bsonMRepresentation[key] = value.Interface()
 		}
 	}
 